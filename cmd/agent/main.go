@@ -27,6 +27,7 @@ func main() {
 	if err != nil {
 		log.Fatal("Error while getting config.", err.Error())
 	}
+	cfg.Version = buildVersion
 
 	agent, err := agent.NewAgent(cfg)
 	if err != nil {
@@ -5,33 +5,62 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math/rand"
 	_ "net/http/pprof"
 	"os"
-	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Jay-T/go-devops.git/internal/utils/helpers"
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/mem"
+	"github.com/rs/xid"
 )
 
 const (
-	gauge   = "gauge"
-	counter = "counter"
+	gauge     = "gauge"
+	counter   = "counter"
+	histogram = "histogram"
+	summary   = "summary"
 )
 
-var (
-	PollCount int64
-)
+// finalSendTimeout limits the last report on shutdown. StopAgent waits for it 3 seconds at most.
+const finalSendTimeout = 2 * time.Second
 
 // Data struct describes message format between goroutines
 type Data struct {
 	name         string
+	mType        string
 	gaugeValue   float64
 	counterValue int64
+	histogram    *metric.Histogram
+	summary      *metric.Summary
+	labels       metric.Labels
+}
+
+// NewGaugeData returns Data with a gauge value.
+func NewGaugeData(name string, value float64) Data {
+	return Data{name: name, mType: gauge, gaugeValue: value}
+}
+
+// NewCounterData returns Data with a counter increment.
+func NewCounterData(name string, delta int64) Data {
+	return Data{name: name, mType: counter, counterValue: delta}
+}
+
+// NewHistogramData returns Data with observations of a histogram since the previous poll.
+func NewHistogramData(name string, h *metric.Histogram) Data {
+	return Data{name: name, mType: histogram, histogram: h}
+}
+
+// NewSummaryData returns Data with observations of a summary since the previous poll.
+func NewSummaryData(name string, s *metric.Summary) Data {
+	return Data{name: name, mType: summary, summary: s}
+}
+
+// WithLabels returns Data of a series with labels, e.g. a mount point or a network interface.
+func (d Data) WithLabels(labels metric.Labels) Data {
+	d.labels = labels
+	return d
 }
 
 // Agent interface for both HTTP and gRPC implementation.
@@ -65,10 +94,20 @@ func NewAgent(cfg *Config) (Agent, error) {
 // GenericAgent struct accepts Config and handles all metrics manipulations.
 type GenericAgent struct {
 	sync.RWMutex
-	Cfg          *Config
-	Metrics      map[string]metric.Metric
-	Encryptor    *Encryptor
-	localAddress string
+	Cfg           *Config
+	Metrics       map[string]metric.Metric
+	Encryptor     *Encryptor
+	localAddress  string
+	collectors    []*collectorRunner
+	statsd        *StatsDListener
+	counterTotals map[string]int64
+	statsMu       sync.Mutex
+	stats         sendStats
+	spool         *Spool
+	retrier       *retrier
+	startTime     time.Time
+	labels        metric.Labels
+	agentID       string
 }
 
 // NewAgent configures GenericAgent and returns pointer on it.
@@ -77,7 +116,28 @@ func NewGenericAgent(cfg *Config) (*GenericAgent, error) {
 	var err error
 
 	a.Metrics = map[string]metric.Metric{}
+	a.counterTotals = map[string]int64{}
+	a.startTime = time.Now()
 	a.Cfg = cfg
+	switch a.Cfg.SendMode {
+	case "", SendModeSingle, SendModeBatch, SendModeBoth:
+	default:
+		return nil, fmt.Errorf("unknown send mode '%s'", a.Cfg.SendMode)
+	}
+
+	a.labels, err = agentLabels(a.Cfg.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	a.retrier = newRetrier(RetryPolicy{
+		MaxAttempts:      a.Cfg.RetryMaxAttempts,
+		InitialBackoff:   a.Cfg.RetryInitialBackoff,
+		MaxBackoff:       a.Cfg.RetryMaxBackoff,
+		RequestTimeout:   a.Cfg.RequestTimeout,
+		BreakerThreshold: a.Cfg.BreakerThreshold,
+		BreakerTimeout:   a.Cfg.BreakerTimeout,
+	})
 
 	if a.Cfg.CryptoKey != "" {
 		a.Encryptor, err = NewEncryptor(a.Cfg.CryptoKey)
@@ -90,122 +150,130 @@ func NewGenericAgent(cfg *Config) (*GenericAgent, error) {
 	if err != nil {
 		return nil, err
 	}
+	a.agentID = agentID(a.Cfg.AgentID, a.localAddress)
 
-	return &a, nil
-}
+	a.collectors, err = newCollectorRunners(a.Cfg)
+	if err != nil {
+		return nil, err
+	}
 
-func (a *GenericAgent) runCommonAgentGoroutines(ctx context.Context) chan Data {
-	dataChan := make(chan Data)
-	syncChan := make(chan time.Time)
+	if a.Cfg.SpoolDir != "" {
+		a.spool, err = NewSpool(a.Cfg.SpoolDir, a.Cfg.SpoolMaxSize, a.Cfg.SpoolMaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	go a.RunTicker(ctx, syncChan)
-	go a.NewMetric(ctx, dataChan)
-	go a.GetDataByInterval(ctx, dataChan, syncChan)
-	go a.GetMemDataByInterval(ctx, dataChan, syncChan)
-	go a.GetCPUDataByInterval(ctx, dataChan)
+	if a.Cfg.StatsDAddress != "" {
+		a.statsd, err = NewStatsDListener(a.Cfg.StatsDAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return dataChan
+	return &a, nil
 }
 
-// GetDataByInterval gouroutine polls memory metrics each time it receives signal from syncChan.
-func (a *GenericAgent) GetDataByInterval(ctx context.Context, dataChan chan<- Data, syncChan <-chan time.Time) {
-	var rtm runtime.MemStats
-
-	log.Printf("Polling data with interval: %s", a.Cfg.PollInterval)
-	for {
-		select {
-		case <-syncChan:
-			PollCount += 1
-			runtime.ReadMemStats(&rtm)
-
-			dataChan <- Data{name: "Alloc", gaugeValue: float64(rtm.Alloc)}
-			dataChan <- Data{name: "TotalAlloc", gaugeValue: float64(rtm.TotalAlloc)}
-			dataChan <- Data{name: "BuckHashSys", gaugeValue: float64(rtm.BuckHashSys)}
-			dataChan <- Data{name: "Frees", gaugeValue: float64(rtm.Frees)}
-			dataChan <- Data{name: "GCCPUFraction", gaugeValue: float64(rtm.GCCPUFraction)}
-			dataChan <- Data{name: "GCSys", gaugeValue: float64(rtm.GCSys)}
-			dataChan <- Data{name: "HeapAlloc", gaugeValue: float64(rtm.HeapAlloc)}
-			dataChan <- Data{name: "HeapIdle", gaugeValue: float64(rtm.HeapIdle)}
-			dataChan <- Data{name: "HeapInuse", gaugeValue: float64(rtm.HeapInuse)}
-			dataChan <- Data{name: "HeapObjects", gaugeValue: float64(rtm.HeapObjects)}
-			dataChan <- Data{name: "HeapReleased", gaugeValue: float64(rtm.HeapReleased)}
-			dataChan <- Data{name: "HeapSys", gaugeValue: float64(rtm.HeapSys)}
-			dataChan <- Data{name: "LastGC", gaugeValue: float64(rtm.LastGC)}
-			dataChan <- Data{name: "Lookups", gaugeValue: float64(rtm.Lookups)}
-			dataChan <- Data{name: "MCacheInuse", gaugeValue: float64(rtm.MCacheInuse)}
-			dataChan <- Data{name: "MCacheSys", gaugeValue: float64(rtm.MCacheSys)}
-			dataChan <- Data{name: "MSpanInuse", gaugeValue: float64(rtm.MSpanInuse)}
-			dataChan <- Data{name: "MSpanSys", gaugeValue: float64(rtm.MSpanSys)}
-			dataChan <- Data{name: "Mallocs", gaugeValue: float64(rtm.Mallocs)}
-			dataChan <- Data{name: "NextGC", gaugeValue: float64(rtm.NextGC)}
-			dataChan <- Data{name: "NumForcedGC", gaugeValue: float64(rtm.NumForcedGC)}
-			dataChan <- Data{name: "NumGC", gaugeValue: float64(rtm.NumGC)}
-			dataChan <- Data{name: "OtherSys", gaugeValue: float64(rtm.OtherSys)}
-			dataChan <- Data{name: "PauseTotalNs", gaugeValue: float64(rtm.PauseTotalNs)}
-			dataChan <- Data{name: "StackInuse", gaugeValue: float64(rtm.StackInuse)}
-			dataChan <- Data{name: "StackSys", gaugeValue: float64(rtm.StackSys)}
-			dataChan <- Data{name: "Sys", gaugeValue: float64(rtm.Sys)}
-			dataChan <- Data{name: "RandomValue", gaugeValue: rand.Float64() * 100}
-			dataChan <- Data{name: "PollCount", counterValue: int64(PollCount)}
+// agentID returns identity of the agent reported to server: configured ID, host name or local address.
+func agentID(configured, localAddress string) string {
+	if configured != "" {
+		return configured
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return localAddress
+	}
+	return hostname
+}
 
-		case <-ctx.Done():
-			log.Println("GetDataByInterval has been canceled successfully.")
-			return
+// identity returns metadata describing the agent to server as key-value pairs: ID, version and report interval.
+// With a key set the ID is signed, see helpers.AgentSignature.
+func (a *GenericAgent) identity() []string {
+	var kv []string
+	if a.agentID != "" {
+		kv = append(kv, "Agent-ID", a.agentID)
+		if a.Cfg.Key != "" {
+			kv = append(kv, "Agent-Signature", helpers.AgentSignature(a.Cfg.Key, a.agentID))
 		}
 	}
+	if a.Cfg.Version != "" {
+		kv = append(kv, "Agent-Version", a.Cfg.Version)
+	}
+	if a.Cfg.ReportInterval > 0 {
+		kv = append(kv, "Report-Interval", a.Cfg.ReportInterval.String())
+	}
+	return kv
 }
 
-// GetMemDataByInterval gouroutine polls CPU data from system.
-// Polls CPU metrics each time it receives signal from syncChan.
-func (a *GenericAgent) GetMemDataByInterval(ctx context.Context, gaugeChan chan<- Data, syncChan <-chan time.Time) {
-	for {
-		select {
-		case <-syncChan:
-			v, _ := mem.VirtualMemory()
-			gaugeChan <- Data{name: "TotalMemory", gaugeValue: float64(v.Free)}
-			gaugeChan <- Data{name: "FreeMemory", gaugeValue: float64(v.Free)}
-
-		case <-ctx.Done():
-			log.Println("GetMemDataByInterval has been canceled successfully.")
-			return
-		}
+// sendHeartbeat tells server that the agent is alive when there are no metrics to report.
+func (a *GenericAgent) sendHeartbeat(ctx context.Context, heartbeat func(ctx context.Context) error) {
+	err := a.retrier.do(ctx, heartbeat)
+	if err != nil {
+		log.Printf("heartbeat error: %s", err)
 	}
 }
 
-// GetCPUDataByInterval gouroutine polls MEM data from system.
-// Polls MEM metrics each time it receives signal from syncChan.
-func (a *GenericAgent) GetCPUDataByInterval(ctx context.Context, gaugeChan chan<- Data) {
-	const CPUPollTime time.Duration = 10 * time.Second
+// agentLabels returns labels attached to every metric of the agent: host name and configured labels.
+// Configured labels are comma separated name=value pairs. A label with empty value is removed.
+func agentLabels(configured string) (metric.Labels, error) {
+	labels := metric.Labels{}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("Could not get host name: %s", err)
+	} else {
+		labels["host"] = hostname
+	}
 
-	for {
-		select {
-		default:
-			cSlice, _ := cpu.Percent(CPUPollTime, true)
+	for _, pair := range strings.Split(configured, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label '%s', expected name=value", pair)
+		}
+		if !metric.ValidLabelName(name) {
+			return nil, fmt.Errorf("invalid label name '%s'", name)
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			delete(labels, name)
+			continue
+		}
+		labels[name] = value
+	}
 
-			for i, c := range cSlice {
-				gaugeChan <- Data{name: fmt.Sprintf("CPUutilization%d", i), gaugeValue: float64(c)}
-			}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
 
-		case <-ctx.Done():
-			log.Println("GetCPUDataByInterval has been canceled successfully.")
-			return
-		}
+// runCommonAgentGoroutines starts all enabled collectors and the goroutine which saves their data.
+func (a *GenericAgent) runCommonAgentGoroutines(ctx context.Context) {
+	dataChan := make(chan Data)
+
+	go a.NewMetric(ctx, dataChan)
+	for _, r := range a.collectors {
+		go r.run(ctx, dataChan)
+	}
+	if a.statsd != nil {
+		go a.statsd.Listen(ctx)
+	}
+	if a.Cfg.PromAddress != "" {
+		go a.ServePrometheus(ctx)
 	}
 }
 
-// RunTicker function syncronizes goroutines that poll system metrics by sending signal to syncChan.
-// Goroutines that receive signal, poll system metrics with same interval.
-func (a *GenericAgent) RunTicker(ctx context.Context, syncChan chan<- time.Time) {
-	ticker := time.NewTicker(a.Cfg.PollInterval)
-	for {
-		select {
-		case t := <-ticker.C:
-			syncChan <- t
-		case <-ctx.Done():
-			log.Println("RunTicker has been canceled successfully.")
-			return
-		}
+// CollectorsStatus returns state of all running collectors.
+func (a *GenericAgent) CollectorsStatus() []CollectorStatus {
+	statuses := make([]CollectorStatus, 0, len(a.collectors))
+	for _, r := range a.collectors {
+		statuses = append(statuses, r.status())
 	}
+	return statuses
 }
 
 // StopAgent stops the application.
@@ -227,27 +295,213 @@ func (a *GenericAgent) StopAgent(sigChan <-chan os.Signal, doneChan <-chan struc
 	}
 }
 
-// NewMetric saves new incoming Data from channel to metric map in Metric format.
-func (a *GenericAgent) NewMetric(ctx context.Context, dataChan <-chan Data) {
-	assignValue := func(data Data) {
-		a.Lock()
-		defer a.Unlock()
-		if data.name == "PollCount" {
-			a.Metrics[data.name] = metric.Metric{ID: data.name, MType: counter, Delta: &data.counterValue}
-		} else {
-			a.Metrics[data.name] = metric.Metric{ID: data.name, MType: gauge, Value: &data.gaugeValue}
+// saveData saves Data to metric map in Metric format.
+// Gauges are replaced with the latest value, counter increments are summed up until the next report.
+// Totals of counters since the agent start are kept as well, negative increments are dropped.
+// Histograms and summaries are merged until the next report, numbers of their observations since
+// the agent start are kept as counter totals. Metrics are kept per series: name and labels.
+func (a *GenericAgent) saveData(data ...Data) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.counterTotals == nil {
+		a.counterTotals = map[string]int64{}
+	}
+	for _, d := range data {
+		key := metric.SeriesKey(d.name, d.labels)
+		switch d.mType {
+		case counter:
+			if d.counterValue < 0 {
+				// totals reported to server never decrease, a decrement would be taken for a stale value
+				log.Printf("Dropping negative increment %d of counter %s", d.counterValue, key)
+				continue
+			}
+			a.counterTotals[key] += d.counterValue
+			delta := d.counterValue
+			if m, ok := a.Metrics[key]; ok && m.Delta != nil {
+				delta += *m.Delta
+			}
+			a.Metrics[key] = metric.Metric{ID: d.name, MType: counter, Delta: &delta, Labels: d.labels}
+		case histogram:
+			h := d.histogram.Copy()
+			if m, ok := a.Metrics[key]; ok && m.Histogram != nil {
+				merged := m.Histogram.Copy()
+				if err := merged.Merge(h); err != nil {
+					log.Printf("Histogram %s has changed its buckets, its pending observations are dropped", key)
+				} else {
+					h = merged
+				}
+			}
+			a.counterTotals[key] += int64(d.histogram.Count)
+			a.Metrics[key] = metric.Metric{ID: d.name, MType: histogram, Histogram: h, Labels: d.labels}
+		case summary:
+			sum := d.summary.Copy()
+			if m, ok := a.Metrics[key]; ok && m.Summary != nil {
+				merged := m.Summary.Copy()
+				merged.Merge(sum)
+				sum = merged
+			}
+			a.counterTotals[key] += int64(d.summary.Count)
+			a.Metrics[key] = metric.Metric{ID: d.name, MType: summary, Summary: sum, Labels: d.labels}
+		default:
+			value := d.gaugeValue
+			a.Metrics[key] = metric.Metric{ID: d.name, MType: gauge, Value: &value, Labels: d.labels}
 		}
 	}
+}
 
+// NewMetric saves new incoming Data from channel to metric map.
+func (a *GenericAgent) NewMetric(ctx context.Context, dataChan <-chan Data) {
 	for {
 		select {
 		case data := <-dataChan:
-			assignValue(data)
+			a.saveData(data)
 		case <-ctx.Done():
-			data := <-dataChan
-			assignValue(data)
 			log.Println("NewMetric has been canceled successfully.")
 			return
 		}
 	}
 }
+
+// takeMetrics returns current metrics and resets counter increments and distributions that are about to be reported.
+// Counters carry their totals since the agent start as well, so server can compute increments itself.
+// Histograms and summaries carry numbers of their observations since the agent start,
+// so server merges every report once, even if it is sent several times.
+// Agent labels are added to labels of every series. Values aggregated by StatsD listener are flushed first.
+func (a *GenericAgent) takeMetrics() []metric.Metric {
+	if a.statsd != nil {
+		a.saveData(a.statsd.Flush()...)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	mList := make([]metric.Metric, 0, len(a.Metrics))
+	for id, m := range a.Metrics {
+		labels := m.Labels
+		m.Labels = a.seriesLabels(labels)
+		switch m.MType {
+		case counter:
+			a.setCumulative(&m, id)
+			var zero int64
+			a.Metrics[id] = metric.Metric{ID: m.ID, MType: counter, Delta: &zero, Labels: labels}
+		case histogram, summary:
+			a.setCumulative(&m, id)
+			delete(a.Metrics, id)
+		}
+		mList = append(mList, m)
+	}
+	return mList
+}
+
+// setCumulative sets total of series id since the agent start to metric m.
+func (a *GenericAgent) setCumulative(m *metric.Metric, id string) {
+	cumulative := a.counterTotals[id]
+	m.Cumulative = &cumulative
+	if !a.startTime.IsZero() {
+		m.StartTime = a.startTime.UnixNano()
+	}
+}
+
+// seriesLabels merges agent labels with labels of a series. Labels of the series take precedence.
+func (a *GenericAgent) seriesLabels(labels metric.Labels) metric.Labels {
+	if len(labels) == 0 {
+		return a.labels
+	}
+	res := make(metric.Labels, len(a.labels)+len(labels))
+	for k, v := range a.labels {
+		res[k] = v
+	}
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+// sendMetrics reports metrics to server according to the configured send mode.
+// Every request is retried with the agent retry policy.
+func (a *GenericAgent) sendMetrics(
+	ctx context.Context,
+	mList []metric.Metric,
+	sendOne func(ctx context.Context, m *metric.Metric) error,
+	sendBatch func(ctx context.Context, mList *[]metric.Metric, batchID string) error,
+) {
+	mode := a.Cfg.SendMode
+	if mode == "" {
+		mode = SendModeBatch
+	}
+
+	if mode == SendModeSingle || mode == SendModeBoth {
+		for _, m := range mList {
+			err := a.retrier.do(ctx, func(ctx context.Context) error {
+				return sendOne(ctx, &m)
+			})
+			a.recordSend(err)
+			if err != nil {
+				log.Printf("metric: %s, error: %s", m.ID, err)
+			}
+		}
+	}
+
+	if mode == SendModeBatch || mode == SendModeBoth {
+		err := a.deliverBatch(mList, func(batchID string, mList []metric.Metric) error {
+			return a.retrier.do(ctx, func(ctx context.Context) error {
+				return sendBatch(ctx, &mList, batchID)
+			})
+		})
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// splitBatch splits metrics into batches of at most size metrics. Non-positive size means no limit.
+func splitBatch(mList []metric.Metric, size int) [][]metric.Metric {
+	if len(mList) == 0 {
+		return nil
+	}
+	if size <= 0 || len(mList) <= size {
+		return [][]metric.Metric{mList}
+	}
+
+	batches := make([][]metric.Metric, 0, (len(mList)+size-1)/size)
+	for size < len(mList) {
+		batches = append(batches, mList[:size])
+		mList = mList[size:]
+	}
+	return append(batches, mList)
+}
+
+// deliverBatch sends metrics in batches of at most MaxBatchSize metrics with the send function.
+// With spool enabled batches are persisted first, then all spooled batches are sent in order.
+func (a *GenericAgent) deliverBatch(mList []metric.Metric, send func(batchID string, mList []metric.Metric) error) error {
+	sendAndRecord := func(batchID string, mList []metric.Metric) error {
+		err := send(batchID, mList)
+		a.recordSend(err)
+		return err
+	}
+
+	batches := splitBatch(mList, a.Cfg.MaxBatchSize)
+	if a.spool == nil {
+		var lastErr error
+		for _, batch := range batches {
+			err := sendAndRecord(xid.New().String(), batch)
+			if err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	}
+
+	for _, batch := range batches {
+		err := a.spool.Append(batch)
+		if err != nil {
+			log.Printf("could not spool metrics: %s", err)
+			err = sendAndRecord(xid.New().String(), batch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return a.spool.Replay(sendAndRecord)
+}
@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// Collector describes a source of metrics polled by the agent.
+type Collector interface {
+	// Name returns collector's name used in logs and config.
+	Name() string
+	// Collect polls the source once. Data returned along with an error is still processed.
+	Collect(ctx context.Context) ([]Data, error)
+}
+
+// CollectorFactory builds a Collector from its raw JSON options.
+type CollectorFactory func(options json.RawMessage) (Collector, error)
+
+var (
+	collectorFactoriesMu sync.RWMutex
+	collectorFactories   = map[string]CollectorFactory{
+		"runtime": newRuntimeCollector,
+		"memory":  newMemoryCollector,
+		"cpu":     newCPUCollector,
+		"disk":    newDiskCollector,
+		"net":     newNetCollector,
+		"process": newProcessCollector,
+		"exec":    newExecCollector,
+	}
+)
+
+// defaultCollectors are enabled when config file does not say otherwise.
+var defaultCollectors = []string{"runtime", "memory", "cpu"}
+
+// RegisterCollector makes a collector available for config under the name.
+// Registering the same name twice replaces the previous factory.
+func RegisterCollector(name string, factory CollectorFactory) {
+	collectorFactoriesMu.Lock()
+	defer collectorFactoriesMu.Unlock()
+	collectorFactories[name] = factory
+}
+
+func getCollectorFactory(name string) (CollectorFactory, bool) {
+	collectorFactoriesMu.RLock()
+	defer collectorFactoriesMu.RUnlock()
+	factory, ok := collectorFactories[name]
+	return factory, ok
+}
+
+// CollectorConfig describes settings of a single collector.
+type CollectorConfig struct {
+	Enabled      bool            `json:"enabled"`
+	PollInterval time.Duration   `json:"poll_interval"`
+	Options      json.RawMessage `json:"options"`
+}
+
+// UnmarshalJSON parses collector config. Collector is enabled unless "enabled" is set to false.
+func (config *CollectorConfig) UnmarshalJSON(b []byte) error {
+	type MyTypeAlias CollectorConfig
+
+	config.Enabled = true
+	unmarshalledJSON := &struct {
+		*MyTypeAlias
+		PollInterval string `json:"poll_interval"`
+	}{
+		MyTypeAlias: (*MyTypeAlias)(config),
+	}
+	err := json.Unmarshal(b, &unmarshalledJSON)
+	if err != nil {
+		return err
+	}
+
+	if unmarshalledJSON.PollInterval != "" {
+		config.PollInterval, err = time.ParseDuration(unmarshalledJSON.PollInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CollectorStatus describes state of a running collector.
+type CollectorStatus struct {
+	Name      string
+	Interval  time.Duration
+	Errors    int64
+	LastError string
+}
+
+// collectorRunner polls a Collector with its own interval and keeps error statistics.
+type collectorRunner struct {
+	mu        sync.Mutex
+	collector Collector
+	interval  time.Duration
+	errors    int64
+	lastError string
+}
+
+func (r *collectorRunner) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors++
+	r.lastError = err.Error()
+}
+
+func (r *collectorRunner) status() CollectorStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return CollectorStatus{
+		Name:      r.collector.Name(),
+		Interval:  r.interval,
+		Errors:    r.errors,
+		LastError: r.lastError,
+	}
+}
+
+// run polls collector each interval and sends collected data to dataChan.
+func (r *collectorRunner) run(ctx context.Context, dataChan chan<- Data) {
+	log.Printf("Polling '%s' collector with interval: %s", r.collector.Name(), r.interval)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			data, err := r.collector.Collect(ctx)
+			if err != nil {
+				log.Printf("collector '%s' failed: %s", r.collector.Name(), err)
+				r.setError(err)
+			}
+			for _, d := range data {
+				select {
+				case dataChan <- d:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			log.Printf("Collector '%s' has been canceled successfully.", r.collector.Name())
+			return
+		}
+	}
+}
+
+// newCollectorRunners builds runners for all enabled collectors.
+// Default collectors are enabled unless disabled in config, others must be enabled explicitly.
+func newCollectorRunners(cfg *Config) ([]*collectorRunner, error) {
+	configs := map[string]CollectorConfig{}
+	for _, name := range defaultCollectors {
+		configs[name] = CollectorConfig{Enabled: true}
+	}
+	for name, c := range cfg.Collectors {
+		configs[name] = c
+	}
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var runners []*collectorRunner
+	for _, name := range names {
+		c := configs[name]
+		if !c.Enabled {
+			log.Printf("Collector '%s' is disabled.", name)
+			continue
+		}
+
+		factory, ok := getCollectorFactory(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown collector: %s", name)
+		}
+		collector, err := factory(c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("collector '%s': %w", name, err)
+		}
+
+		interval := c.PollInterval
+		if interval <= 0 {
+			interval = cfg.PollInterval
+		}
+		runners = append(runners, &collectorRunner{
+			collector: collector,
+			interval:  interval,
+		})
+	}
+	return runners, nil
+}
+
+// unmarshalOptions decodes collector options into v. Empty options leave v untouched.
+func unmarshalOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	return json.Unmarshal(options, v)
+}
+
+// Filter selects names by include and exclude glob patterns.
+// Empty include list selects everything, exclude patterns take precedence.
+type Filter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// Validate checks that all patterns are well-formed.
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether name is selected by the filter.
+func (f Filter) Match(name string) bool {
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// counterTracker turns monotonically increasing totals into increments between polls.
+type counterTracker struct {
+	last map[string]uint64
+}
+
+func newCounterTracker() *counterTracker {
+	return &counterTracker{last: map[string]uint64{}}
+}
+
+// delta returns increment of the total since previous call for the same key.
+// First call for a key returns false. A total lower than the previous one is treated as a reset.
+func (t *counterTracker) delta(key string, total uint64) (int64, bool) {
+	last, ok := t.last[key]
+	t.last[key] = total
+	if !ok {
+		return 0, false
+	}
+	if total < last {
+		return int64(total), true
+	}
+	return int64(total - last), true
+}
+
+// appendCounter appends a counter Data of the series to data if the increment is known.
+func (t *counterTracker) appendCounter(data []Data, name string, labels metric.Labels, total uint64) []Data {
+	if delta, ok := t.delta(metric.SeriesKey(name, labels), total); ok {
+		data = append(data, NewCounterData(name, delta).WithLabels(labels))
+	}
+	return data
+}
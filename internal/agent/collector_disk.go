@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// diskOptions describes options of the disk collector.
+type diskOptions struct {
+	// AllPartitions includes pseudo file systems like proc or tmpfs.
+	AllPartitions bool   `json:"all_partitions"`
+	MountPoints   Filter `json:"mount_points"`
+	Devices       Filter `json:"devices"`
+}
+
+// diskCollector polls disk usage per mount point and I/O counters per block device.
+// Series are labeled with the mount point or the device.
+type diskCollector struct {
+	opts     diskOptions
+	counters *counterTracker
+}
+
+func newDiskCollector(options json.RawMessage) (Collector, error) {
+	c := &diskCollector{counters: newCounterTracker()}
+	if err := unmarshalOptions(options, &c.opts); err != nil {
+		return nil, err
+	}
+	if err := c.opts.MountPoints.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.opts.Devices.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Name returns collector's name.
+func (c *diskCollector) Name() string {
+	return "disk"
+}
+
+// Collect reads usage of selected mount points and I/O counters of selected devices.
+// Usage is reported as gauges, I/O counters as increments since the previous poll.
+func (c *diskCollector) Collect(ctx context.Context) ([]Data, error) {
+	var errs []string
+
+	data, err := c.collectUsage(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	ioData, err := c.collectIO(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	data = append(data, ioData...)
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+func (c *diskCollector) collectUsage(ctx context.Context) ([]Data, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, c.opts.AllPartitions)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []Data
+	var errs []string
+	seen := map[string]bool{}
+	for _, p := range partitions {
+		if seen[p.Mountpoint] || !c.opts.MountPoints.Match(p.Mountpoint) {
+			continue
+		}
+		seen[p.Mountpoint] = true
+
+		u, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("mount point %s: %s", p.Mountpoint, err))
+			continue
+		}
+
+		labels := metric.Labels{"mount": p.Mountpoint}
+		data = append(data,
+			NewGaugeData("DiskTotalBytes", float64(u.Total)).WithLabels(labels),
+			NewGaugeData("DiskFreeBytes", float64(u.Free)).WithLabels(labels),
+			NewGaugeData("DiskUsedBytes", float64(u.Used)).WithLabels(labels),
+			NewGaugeData("DiskInodesTotal", float64(u.InodesTotal)).WithLabels(labels),
+			NewGaugeData("DiskInodesUsed", float64(u.InodesUsed)).WithLabels(labels),
+			NewGaugeData("DiskInodesFree", float64(u.InodesFree)).WithLabels(labels),
+		)
+	}
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+func (c *diskCollector) collectIO(ctx context.Context) ([]Data, error) {
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []Data
+	for name, io := range counters {
+		if !c.opts.Devices.Match(name) {
+			continue
+		}
+
+		labels := metric.Labels{"device": name}
+		data = c.counters.appendCounter(data, "DiskReadBytes", labels, io.ReadBytes)
+		data = c.counters.appendCounter(data, "DiskWriteBytes", labels, io.WriteBytes)
+		data = c.counters.appendCounter(data, "DiskReadOps", labels, io.ReadCount)
+		data = c.counters.appendCounter(data, "DiskWriteOps", labels, io.WriteCount)
+		data = c.counters.appendCounter(data, "DiskIOTimeMs", labels, io.IoTime)
+	}
+	return data, nil
+}
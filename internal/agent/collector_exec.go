@@ -0,0 +1,288 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+const (
+	execFormatJSON = "json"
+	execFormatLine = "line"
+
+	defaultExecTimeout = 10 * time.Second
+)
+
+// execCommandConfig describes an external command whose stdout is parsed as metrics.
+type execCommandConfig struct {
+	Name    string        `json:"name"`
+	Command string        `json:"command"`
+	Args    []string      `json:"args"`
+	Timeout time.Duration `json:"timeout"`
+	Format  string        `json:"format"`
+}
+
+// UnmarshalJSON parses command config with human readable timeout.
+func (config *execCommandConfig) UnmarshalJSON(b []byte) error {
+	type MyTypeAlias execCommandConfig
+
+	unmarshalledJSON := &struct {
+		*MyTypeAlias
+		Timeout string `json:"timeout"`
+	}{
+		MyTypeAlias: (*MyTypeAlias)(config),
+	}
+	err := json.Unmarshal(b, &unmarshalledJSON)
+	if err != nil {
+		return err
+	}
+
+	if unmarshalledJSON.Timeout != "" {
+		config.Timeout, err = time.ParseDuration(unmarshalledJSON.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execOptions describes options of the exec collector.
+type execOptions struct {
+	Commands []execCommandConfig `json:"commands"`
+}
+
+// execCollector runs external commands and parses their output as metrics.
+type execCollector struct {
+	commands []execCommandConfig
+}
+
+func newExecCollector(options json.RawMessage) (Collector, error) {
+	var opts execOptions
+	if err := unmarshalOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Commands) == 0 {
+		return nil, errors.New("no commands configured")
+	}
+
+	for i := range opts.Commands {
+		cmd := &opts.Commands[i]
+		if cmd.Command == "" {
+			return nil, fmt.Errorf("command #%d is empty", i)
+		}
+		if cmd.Name == "" {
+			cmd.Name = cmd.Command
+		}
+		if cmd.Timeout <= 0 {
+			cmd.Timeout = defaultExecTimeout
+		}
+		switch cmd.Format {
+		case "":
+			cmd.Format = execFormatLine
+		case execFormatLine, execFormatJSON:
+		default:
+			return nil, fmt.Errorf("command '%s': unknown format '%s'", cmd.Name, cmd.Format)
+		}
+	}
+	return &execCollector{commands: opts.Commands}, nil
+}
+
+// Name returns collector's name.
+func (c *execCollector) Name() string {
+	return "exec"
+}
+
+// Collect runs all commands concurrently and returns metrics parsed from their output.
+func (c *execCollector) Collect(ctx context.Context) ([]Data, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var data []Data
+	var errs []string
+
+	for _, cmd := range c.commands {
+		wg.Add(1)
+		go func(cmd execCommandConfig) {
+			defer wg.Done()
+
+			cmdData, err := runExecCommand(ctx, cmd)
+			mu.Lock()
+			defer mu.Unlock()
+			data = append(data, cmdData...)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("command '%s': %s", cmd.Name, err))
+			}
+		}(cmd)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+func runExecCommand(ctx context.Context, cfg execCommandConfig) ([]Data, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.Command, cfg.Args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out after %s", cfg.Timeout)
+		}
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if cfg.Format == execFormatJSON {
+		return parseJSONMetrics(stdout.Bytes())
+	}
+	return parseLineMetrics(stdout.Bytes())
+}
+
+// validateParsed checks ID and labels of a metric parsed from command output,
+// so that a metric the server would drop is reported as a collector error instead.
+func validateParsed(id string, labels metric.Labels) error {
+	if err := metric.ValidateID(id); err != nil {
+		return err
+	}
+	return labels.Validate()
+}
+
+// parseJSONMetrics parses a metric or a list of metrics in metric.Metric JSON format.
+// Labels of a metric, e.g. {"id": "QueueSize", "type": "gauge", "value": 3, "labels": {"queue": "mail"}}, are kept.
+// Histograms and summaries hold observations since the previous run of the command.
+func parseJSONMetrics(b []byte) ([]Data, error) {
+	var mList []metric.Metric
+
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if b[0] == '[' {
+		if err := json.Unmarshal(b, &mList); err != nil {
+			return nil, err
+		}
+	} else {
+		var m metric.Metric
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		mList = append(mList, m)
+	}
+
+	data := make([]Data, 0, len(mList))
+	var errs []string
+	for i, m := range mList {
+		if err := validateParsed(m.ID, m.Labels); err != nil {
+			errs = append(errs, fmt.Sprintf("metric %d: %s", i+1, err))
+			continue
+		}
+		switch {
+		case m.MType == gauge && m.Value != nil:
+			data = append(data, NewGaugeData(m.ID, *m.Value).WithLabels(m.Labels))
+		case m.MType == counter && m.Delta != nil && *m.Delta < 0:
+			errs = append(errs, fmt.Sprintf("metric '%s': negative counter increment", m.ID))
+		case m.MType == counter && m.Delta != nil:
+			data = append(data, NewCounterData(m.ID, *m.Delta).WithLabels(m.Labels))
+		case m.MType == histogram && m.Histogram != nil:
+			if err := m.Histogram.Validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("metric %d: %s", i+1, err))
+				continue
+			}
+			data = append(data, NewHistogramData(m.ID, m.Histogram).WithLabels(m.Labels))
+		case m.MType == summary && m.Summary != nil:
+			if err := m.Summary.Validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("metric %d: %s", i+1, err))
+				continue
+			}
+			data = append(data, NewSummaryData(m.ID, m.Summary).WithLabels(m.Labels))
+		default:
+			errs = append(errs, fmt.Sprintf("metric '%s': bad type '%s' or missing value", m.ID, m.MType))
+		}
+	}
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+// parseLineMetrics parses "name type value" lines. Empty lines and lines starting with # are skipped.
+func parseLineMetrics(b []byte) ([]Data, error) {
+	var data []Data
+	var errs []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		d, err := parseLineMetric(line)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %s", n, err))
+			continue
+		}
+		data = append(data, d)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+func parseLineMetric(line string) (Data, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Data{}, fmt.Errorf("expected 'name type value', got '%s'", line)
+	}
+
+	name, mType, value := fields[0], fields[1], fields[2]
+	if err := validateParsed(name, nil); err != nil {
+		return Data{}, err
+	}
+	switch mType {
+	case gauge:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return Data{}, err
+		}
+		// such values can not be encoded to JSON and would block sending of all metrics
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Data{}, fmt.Errorf("value '%s' is not finite", value)
+		}
+		return NewGaugeData(name, v), nil
+	case counter:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return Data{}, err
+		}
+		if v < 0 {
+			return Data{}, errors.New("negative counter increment")
+		}
+		return NewCounterData(name, v), nil
+	default:
+		return Data{}, fmt.Errorf("unknown metric type '%s'", mType)
+	}
+}
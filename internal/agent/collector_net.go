@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/shirou/gopsutil/net"
+)
+
+// tcpStates lists TCP socket states which are always reported, even with zero sockets.
+var tcpStates = []string{
+	"ESTABLISHED",
+	"SYN_SENT",
+	"SYN_RECV",
+	"FIN_WAIT1",
+	"FIN_WAIT2",
+	"TIME_WAIT",
+	"CLOSE",
+	"CLOSE_WAIT",
+	"LAST_ACK",
+	"LISTEN",
+	"CLOSING",
+}
+
+// netOptions describes options of the network collector.
+type netOptions struct {
+	Interfaces Filter `json:"interfaces"`
+	// DisableTCPStates turns off counting of TCP sockets by state.
+	DisableTCPStates bool `json:"disable_tcp_states"`
+}
+
+// netCollector polls network interface counters and TCP connection states.
+// Interface counters are labeled with the interface name, socket counts with the TCP state.
+type netCollector struct {
+	opts     netOptions
+	counters *counterTracker
+}
+
+func newNetCollector(options json.RawMessage) (Collector, error) {
+	c := &netCollector{counters: newCounterTracker()}
+	if err := unmarshalOptions(options, &c.opts); err != nil {
+		return nil, err
+	}
+	if err := c.opts.Interfaces.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Name returns collector's name.
+func (c *netCollector) Name() string {
+	return "net"
+}
+
+// Collect reads counters of selected interfaces and counts TCP sockets by state.
+// Interface counters are reported as increments since the previous poll, socket counts as gauges.
+func (c *netCollector) Collect(ctx context.Context) ([]Data, error) {
+	var errs []string
+
+	data, err := c.collectInterfaces(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if !c.opts.DisableTCPStates {
+		tcpData, err := c.collectTCPStates(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		data = append(data, tcpData...)
+	}
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+func (c *netCollector) collectInterfaces(ctx context.Context) ([]Data, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []Data
+	for _, io := range counters {
+		if !c.opts.Interfaces.Match(io.Name) {
+			continue
+		}
+
+		labels := metric.Labels{"iface": io.Name}
+		data = c.counters.appendCounter(data, "NetBytesSent", labels, io.BytesSent)
+		data = c.counters.appendCounter(data, "NetBytesRecv", labels, io.BytesRecv)
+		data = c.counters.appendCounter(data, "NetPacketsSent", labels, io.PacketsSent)
+		data = c.counters.appendCounter(data, "NetPacketsRecv", labels, io.PacketsRecv)
+		data = c.counters.appendCounter(data, "NetErrIn", labels, io.Errin)
+		data = c.counters.appendCounter(data, "NetErrOut", labels, io.Errout)
+		data = c.counters.appendCounter(data, "NetDropIn", labels, io.Dropin)
+		data = c.counters.appendCounter(data, "NetDropOut", labels, io.Dropout)
+	}
+	return data, nil
+}
+
+func (c *netCollector) collectTCPStates(ctx context.Context) ([]Data, error) {
+	conns, err := net.ConnectionsWithoutUidsWithContext(ctx, "tcp")
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]int, len(tcpStates))
+	for _, state := range tcpStates {
+		states[state] = 0
+	}
+	for _, conn := range conns {
+		if conn.Status != "" && conn.Status != "NONE" {
+			states[conn.Status]++
+		}
+	}
+
+	data := make([]Data, 0, len(states))
+	for state, count := range states {
+		data = append(data, NewGaugeData("TCPConnections", float64(count)).WithLabels(metric.Labels{"state": state}))
+	}
+	return data, nil
+}
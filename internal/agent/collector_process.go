@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/shirou/gopsutil/process"
+)
+
+// processGroupConfig describes rules which select processes of a group.
+// With a pidfile only the process from the file is selected,
+// otherwise a process must match both the name regex and the cmdline substring if they are set.
+type processGroupConfig struct {
+	Name      string `json:"name"`
+	NameRegex string `json:"name_regex"`
+	Cmdline   string `json:"cmdline"`
+	Pidfile   string `json:"pidfile"`
+}
+
+// processOptions describes options of the process collector.
+type processOptions struct {
+	Groups []processGroupConfig `json:"groups"`
+}
+
+type processGroup struct {
+	processGroupConfig
+	nameRegex *regexp.Regexp
+	labels    metric.Labels
+}
+
+// processStats accumulates resource usage of all processes in a group.
+type processStats struct {
+	count      int
+	cpuPercent float64
+	rss        uint64
+	fds        int32
+	threads    int32
+	uptime     time.Duration
+}
+
+// cachedProcess is a running process with its start time, which tells it apart from a later process with the same PID.
+type cachedProcess struct {
+	*process.Process
+	created int64
+}
+
+// processCollector polls resource usage of process groups selected by matching rules.
+type processCollector struct {
+	groups    []processGroup
+	processes map[int32]cachedProcess
+}
+
+func newProcessCollector(options json.RawMessage) (Collector, error) {
+	var opts processOptions
+	if err := unmarshalOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Groups) == 0 {
+		return nil, errors.New("no process groups configured")
+	}
+
+	c := &processCollector{processes: map[int32]cachedProcess{}}
+	seen := map[string]bool{}
+	for _, g := range opts.Groups {
+		if g.Name == "" {
+			return nil, errors.New("process group name is empty")
+		}
+		if g.NameRegex == "" && g.Cmdline == "" && g.Pidfile == "" {
+			return nil, fmt.Errorf("process group '%s' has no matching rules", g.Name)
+		}
+
+		if seen[g.Name] {
+			return nil, fmt.Errorf("duplicate process group '%s'", g.Name)
+		}
+		seen[g.Name] = true
+
+		group := processGroup{
+			processGroupConfig: g,
+			labels:             metric.Labels{"group": g.Name},
+		}
+
+		if g.NameRegex != "" {
+			re, err := regexp.Compile(g.NameRegex)
+			if err != nil {
+				return nil, fmt.Errorf("process group '%s': %w", g.Name, err)
+			}
+			group.nameRegex = re
+		}
+		c.groups = append(c.groups, group)
+	}
+	return c, nil
+}
+
+// Name returns collector's name.
+func (c *processCollector) Name() string {
+	return "process"
+}
+
+// Collect reports number of processes, CPU%, RSS, open file descriptors, threads and uptime for each group.
+// Values of all processes of a group are summed up, uptime is reported for the oldest process.
+// Series are labeled with the group name.
+func (c *processCollector) Collect(ctx context.Context) ([]Data, error) {
+	if err := c.refreshProcesses(ctx); err != nil {
+		return nil, err
+	}
+
+	var data []Data
+	var errs []string
+	for _, g := range c.groups {
+		procs, err := c.matchGroup(ctx, g)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		stats := c.groupStats(ctx, procs)
+		data = append(data,
+			NewGaugeData("ProcessCount", float64(stats.count)).WithLabels(g.labels),
+			NewGaugeData("ProcessCPUPercent", stats.cpuPercent).WithLabels(g.labels),
+			NewGaugeData("ProcessRSSBytes", float64(stats.rss)).WithLabels(g.labels),
+			NewGaugeData("ProcessOpenFDs", float64(stats.fds)).WithLabels(g.labels),
+			NewGaugeData("ProcessThreads", float64(stats.threads)).WithLabels(g.labels),
+			NewGaugeData("ProcessUptimeSeconds", stats.uptime.Seconds()).WithLabels(g.labels),
+		)
+	}
+
+	if len(errs) > 0 {
+		return data, errors.New(strings.Join(errs, "; "))
+	}
+	return data, nil
+}
+
+// refreshProcesses keeps cache of running processes. Cached processes remember previous CPU times for CPU%.
+// A cached process is replaced when its PID has been reused by a process started later,
+// it is kept if its start time can't be read. Only new PIDs are opened as processes.
+func (c *processCollector) refreshProcesses(ctx context.Context) error {
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	alive := make(map[int32]bool, len(pids))
+	for _, pid := range pids {
+		if cached, ok := c.processes[pid]; ok {
+			alive[pid] = true
+			// cached process remembers its start time, a fresh one reads it again
+			created, err := (&process.Process{Pid: pid}).CreateTimeWithContext(ctx)
+			if err != nil || created == cached.created {
+				continue
+			}
+		}
+
+		p, err := process.NewProcessWithContext(ctx, pid)
+		if err != nil {
+			continue
+		}
+		alive[pid] = true
+		created, _ := p.CreateTimeWithContext(ctx)
+		c.processes[pid] = cachedProcess{Process: p, created: created}
+	}
+
+	for pid := range c.processes {
+		if !alive[pid] {
+			delete(c.processes, pid)
+		}
+	}
+	return nil
+}
+
+func (c *processCollector) matchGroup(ctx context.Context, g processGroup) ([]*process.Process, error) {
+	if g.Pidfile != "" {
+		pid, err := readPidfile(g.Pidfile)
+		if err != nil {
+			return nil, fmt.Errorf("process group '%s': %w", g.Name, err)
+		}
+		if p, ok := c.processes[pid]; ok {
+			return []*process.Process{p.Process}, nil
+		}
+		return nil, nil
+	}
+
+	var procs []*process.Process
+	for _, p := range c.processes {
+		if g.nameRegex != nil {
+			name, err := p.NameWithContext(ctx)
+			if err != nil || !g.nameRegex.MatchString(name) {
+				continue
+			}
+		}
+		if g.Cmdline != "" {
+			cmdline, err := p.CmdlineWithContext(ctx)
+			if err != nil || !strings.Contains(cmdline, g.Cmdline) {
+				continue
+			}
+		}
+		procs = append(procs, p.Process)
+	}
+	return procs, nil
+}
+
+// groupStats sums up resource usage of processes. Values which can't be read are skipped.
+func (c *processCollector) groupStats(ctx context.Context, procs []*process.Process) processStats {
+	var stats processStats
+	now := time.Now()
+
+	for _, p := range procs {
+		stats.count++
+		if cpu, err := p.PercentWithContext(ctx, 0); err == nil {
+			stats.cpuPercent += cpu
+		}
+		if mem, err := p.MemoryInfoWithContext(ctx); err == nil {
+			stats.rss += mem.RSS
+		}
+		if fds, err := p.NumFDsWithContext(ctx); err == nil {
+			stats.fds += fds
+		}
+		if threads, err := p.NumThreadsWithContext(ctx); err == nil {
+			stats.threads += threads
+		}
+		if created, err := p.CreateTimeWithContext(ctx); err == nil {
+			uptime := now.Sub(time.UnixMilli(created))
+			if uptime > stats.uptime {
+				stats.uptime = uptime
+			}
+		}
+	}
+	return stats
+}
+
+func readPidfile(filename string) (int32, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad pidfile %s: %w", filename, err)
+	}
+	return int32(pid), nil
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"runtime"
+	"strconv"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// runtimeCollector polls Go runtime memory statistics of the agent itself.
+type runtimeCollector struct{}
+
+func newRuntimeCollector(options json.RawMessage) (Collector, error) {
+	return &runtimeCollector{}, nil
+}
+
+// Name returns collector's name.
+func (c *runtimeCollector) Name() string {
+	return "runtime"
+}
+
+// Collect reads runtime.MemStats. Also reports RandomValue and PollCount.
+func (c *runtimeCollector) Collect(ctx context.Context) ([]Data, error) {
+	var rtm runtime.MemStats
+	runtime.ReadMemStats(&rtm)
+
+	return []Data{
+		NewGaugeData("Alloc", float64(rtm.Alloc)),
+		NewGaugeData("TotalAlloc", float64(rtm.TotalAlloc)),
+		NewGaugeData("BuckHashSys", float64(rtm.BuckHashSys)),
+		NewGaugeData("Frees", float64(rtm.Frees)),
+		NewGaugeData("GCCPUFraction", float64(rtm.GCCPUFraction)),
+		NewGaugeData("GCSys", float64(rtm.GCSys)),
+		NewGaugeData("HeapAlloc", float64(rtm.HeapAlloc)),
+		NewGaugeData("HeapIdle", float64(rtm.HeapIdle)),
+		NewGaugeData("HeapInuse", float64(rtm.HeapInuse)),
+		NewGaugeData("HeapObjects", float64(rtm.HeapObjects)),
+		NewGaugeData("HeapReleased", float64(rtm.HeapReleased)),
+		NewGaugeData("HeapSys", float64(rtm.HeapSys)),
+		NewGaugeData("LastGC", float64(rtm.LastGC)),
+		NewGaugeData("Lookups", float64(rtm.Lookups)),
+		NewGaugeData("MCacheInuse", float64(rtm.MCacheInuse)),
+		NewGaugeData("MCacheSys", float64(rtm.MCacheSys)),
+		NewGaugeData("MSpanInuse", float64(rtm.MSpanInuse)),
+		NewGaugeData("MSpanSys", float64(rtm.MSpanSys)),
+		NewGaugeData("Mallocs", float64(rtm.Mallocs)),
+		NewGaugeData("NextGC", float64(rtm.NextGC)),
+		NewGaugeData("NumForcedGC", float64(rtm.NumForcedGC)),
+		NewGaugeData("NumGC", float64(rtm.NumGC)),
+		NewGaugeData("OtherSys", float64(rtm.OtherSys)),
+		NewGaugeData("PauseTotalNs", float64(rtm.PauseTotalNs)),
+		NewGaugeData("StackInuse", float64(rtm.StackInuse)),
+		NewGaugeData("StackSys", float64(rtm.StackSys)),
+		NewGaugeData("Sys", float64(rtm.Sys)),
+		NewGaugeData("RandomValue", rand.Float64()*100),
+		NewCounterData("PollCount", 1),
+	}, nil
+}
+
+// memoryCollector polls system virtual memory.
+type memoryCollector struct{}
+
+func newMemoryCollector(options json.RawMessage) (Collector, error) {
+	return &memoryCollector{}, nil
+}
+
+// Name returns collector's name.
+func (c *memoryCollector) Name() string {
+	return "memory"
+}
+
+// Collect reads total and free system memory.
+func (c *memoryCollector) Collect(ctx context.Context) ([]Data, error) {
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Data{
+		NewGaugeData("TotalMemory", float64(v.Total)),
+		NewGaugeData("FreeMemory", float64(v.Free)),
+	}, nil
+}
+
+// cpuCollector polls utilization of each CPU core. Series are labeled with the core number.
+type cpuCollector struct{}
+
+func newCPUCollector(options json.RawMessage) (Collector, error) {
+	return &cpuCollector{}, nil
+}
+
+// Name returns collector's name.
+func (c *cpuCollector) Name() string {
+	return "cpu"
+}
+
+// Collect reads per-core CPU utilization since the previous call.
+func (c *cpuCollector) Collect(ctx context.Context) ([]Data, error) {
+	cSlice, err := cpu.PercentWithContext(ctx, 0, true)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]Data, 0, len(cSlice))
+	for i, c := range cSlice {
+		data = append(data, NewGaugeData("CPUutilization", c).WithLabels(metric.Labels{"core": strconv.Itoa(i)}))
+	}
+	return data, nil
+}
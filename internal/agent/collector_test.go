@@ -0,0 +1,317 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectorConfigUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		unparsed string
+		parsed   CollectorConfig
+		wantErr  bool
+	}{
+		{
+			name:     "enabled by default",
+			unparsed: `{"poll_interval": "5s"}`,
+			parsed:   CollectorConfig{Enabled: true, PollInterval: 5 * time.Second},
+		},
+		{
+			name:     "disabled",
+			unparsed: `{"enabled": false}`,
+			parsed:   CollectorConfig{Enabled: false},
+		},
+		{
+			name:     "bad interval",
+			unparsed: `{"poll_interval": "sss"}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c CollectorConfig
+			err := json.Unmarshal([]byte(tt.unparsed), &c)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.parsed, c)
+		})
+	}
+}
+
+func TestNewCollectorRunners(t *testing.T) {
+	tests := []struct {
+		name       string
+		collectors map[string]CollectorConfig
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name: "defaults",
+			want: []string{"cpu", "memory", "runtime"},
+		},
+		{
+			name: "disable default",
+			collectors: map[string]CollectorConfig{
+				"cpu": {Enabled: false},
+			},
+			want: []string{"memory", "runtime"},
+		},
+		{
+			name: "unknown collector",
+			collectors: map[string]CollectorConfig{
+				"unknown": {Enabled: true},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{PollInterval: 2 * time.Second, Collectors: tt.collectors}
+			runners, err := newCollectorRunners(cfg)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var names []string
+			for _, r := range runners {
+				names = append(names, r.collector.Name())
+				assert.Equal(t, cfg.PollInterval, r.interval)
+			}
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestNewMetricSumsCounters(t *testing.T) {
+	a := &GenericAgent{Metrics: map[string]metric.Metric{}}
+	dataChan := make(chan Data)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.NewMetric(ctx, dataChan)
+
+	dataChan <- NewCounterData("PollCount", 1)
+	dataChan <- NewCounterData("PollCount", 2)
+	dataChan <- NewGaugeData("Alloc", 1.5)
+	dataChan <- NewGaugeData("Alloc", 2.5)
+	// unbuffered channel: the last value is saved once the next one is received
+	dataChan <- NewGaugeData("Sys", 1)
+
+	mList := a.takeMetrics()
+	got := map[string]metric.Metric{}
+	for _, m := range mList {
+		got[m.ID] = m
+	}
+	assert.Equal(t, int64(3), *got["PollCount"].Delta)
+	assert.Equal(t, 2.5, *got["Alloc"].Value)
+
+	for _, m := range a.takeMetrics() {
+		if m.ID == "PollCount" {
+			assert.Equal(t, int64(0), *m.Delta)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	f := Filter{Include: []string{"/", "/data*"}, Exclude: []string{"/data-tmp"}}
+	require.NoError(t, f.Validate())
+
+	assert.True(t, f.Match("/"))
+	assert.True(t, f.Match("/data1"))
+	assert.False(t, f.Match("/data-tmp"))
+	assert.False(t, f.Match("/boot"))
+	assert.True(t, Filter{}.Match("/boot"))
+	assert.Error(t, Filter{Include: []string{"["}}.Validate())
+}
+
+func TestCounterTracker(t *testing.T) {
+	tr := newCounterTracker()
+
+	_, ok := tr.delta("bytes", 100)
+	assert.False(t, ok)
+
+	d, ok := tr.delta("bytes", 150)
+	assert.True(t, ok)
+	assert.Equal(t, int64(50), d)
+
+	d, ok = tr.delta("bytes", 20)
+	assert.True(t, ok)
+	assert.Equal(t, int64(20), d)
+}
+
+func TestMemoryCollector(t *testing.T) {
+	c, err := newMemoryCollector(nil)
+	require.NoError(t, err)
+
+	data, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	got := map[string]float64{}
+	for _, d := range data {
+		got[d.name] = d.gaugeValue
+	}
+
+	v, err := mem.VirtualMemory()
+	require.NoError(t, err)
+	assert.Equal(t, float64(v.Total), got["TotalMemory"])
+	assert.GreaterOrEqual(t, got["TotalMemory"], got["FreeMemory"])
+}
+
+func TestDiskCollector(t *testing.T) {
+	c, err := newDiskCollector(json.RawMessage(`{"mount_points": {"include": ["/"]}}`))
+	require.NoError(t, err)
+
+	data, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	for _, d := range data {
+		assert.Equal(t, gauge, d.mType)
+		assert.Equal(t, metric.Labels{"mount": "/"}, d.labels)
+	}
+
+	_, err = newDiskCollector(json.RawMessage(`{"devices": {"exclude": ["["]}}`))
+	assert.Error(t, err)
+}
+
+func TestNetCollector(t *testing.T) {
+	c, err := newNetCollector(json.RawMessage(`{"interfaces": {"include": ["lo"]}}`))
+	require.NoError(t, err)
+
+	got := map[string]Data{}
+	for i := 0; i < 2; i++ {
+		data, err := c.Collect(context.Background())
+		require.NoError(t, err)
+		for _, d := range data {
+			got[metric.SeriesKey(d.name, d.labels)] = d
+		}
+	}
+
+	assert.Equal(t, gauge, got[`TCPConnections{state="ESTABLISHED"}`].mType)
+	if d, ok := got[`NetBytesSent{iface="lo"}`]; ok {
+		assert.Equal(t, counter, d.mType)
+		assert.GreaterOrEqual(t, d.counterValue, int64(0))
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "agent.pid")
+	require.NoError(t, os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644))
+
+	options := fmt.Sprintf(`{"groups": [{"name": "self", "pidfile": %q}, {"name": "none", "name_regex": "^no-such-process$"}]}`, pidfile)
+	c, err := newProcessCollector(json.RawMessage(options))
+	require.NoError(t, err)
+
+	data, err := c.Collect(context.Background())
+	require.NoError(t, err)
+
+	got := map[string]float64{}
+	for _, d := range data {
+		got[metric.SeriesKey(d.name, d.labels)] = d.gaugeValue
+	}
+	assert.Equal(t, float64(1), got[`ProcessCount{group="self"}`])
+	assert.Greater(t, got[`ProcessRSSBytes{group="self"}`], float64(0))
+	assert.Greater(t, got[`ProcessThreads{group="self"}`], float64(0))
+	assert.Equal(t, float64(0), got[`ProcessCount{group="none"}`])
+
+	_, err = newProcessCollector(json.RawMessage(`{"groups": [{"name": "bad"}]}`))
+	assert.Error(t, err)
+	_, err = newProcessCollector(json.RawMessage(`{"groups": [{"name": "bad", "name_regex": "("}]}`))
+	assert.Error(t, err)
+}
+
+func TestProcessCollectorReusedPID(t *testing.T) {
+	c := &processCollector{processes: map[int32]cachedProcess{}}
+	require.NoError(t, c.refreshProcesses(context.Background()))
+	pid := int32(os.Getpid())
+	self, ok := c.processes[pid]
+	require.True(t, ok)
+
+	// the same process is kept with its CPU times
+	require.NoError(t, c.refreshProcesses(context.Background()))
+	assert.Same(t, self.Process, c.processes[pid].Process)
+
+	// a process which had the PID before is replaced
+	previous := &process.Process{Pid: pid}
+	c.processes[pid] = cachedProcess{Process: previous, created: self.created - 1000}
+	require.NoError(t, c.refreshProcesses(context.Background()))
+	assert.Equal(t, self.created, c.processes[pid].created)
+	assert.NotSame(t, previous, c.processes[pid].Process)
+}
+
+func TestParseLineMetrics(t *testing.T) {
+	data, err := parseLineMetrics([]byte("# comment\nQueueSize gauge 12.5\n\nJobsDone counter 3\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []Data{NewGaugeData("QueueSize", 12.5), NewCounterData("JobsDone", 3)}, data)
+
+	data, err = parseLineMetrics([]byte("QueueSize gauge 1\nBad histogram 1\nBad counter 1.5\nBad counter -1\n"))
+	assert.Error(t, err)
+	assert.Equal(t, []Data{NewGaugeData("QueueSize", 1)}, data)
+
+	data, err = parseLineMetrics([]byte("QueueSize gauge 1\nQueue{a} gauge 2\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: metric ID 'Queue{a}'")
+	assert.Equal(t, []Data{NewGaugeData("QueueSize", 1)}, data)
+
+	data, err = parseLineMetrics([]byte("QueueSize gauge 1\nLoad gauge NaN\nLoad gauge +Inf\nLoad gauge -Inf\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: value 'NaN' is not finite")
+	assert.Contains(t, err.Error(), "line 3: value '+Inf' is not finite")
+	assert.Contains(t, err.Error(), "line 4: value '-Inf' is not finite")
+	assert.Equal(t, []Data{NewGaugeData("QueueSize", 1)}, data)
+}
+
+func TestParseJSONMetrics(t *testing.T) {
+	data, err := parseJSONMetrics([]byte(`{"id": "QueueSize", "type": "gauge", "value": 12.5}`))
+	require.NoError(t, err)
+	assert.Equal(t, []Data{NewGaugeData("QueueSize", 12.5)}, data)
+
+	data, err = parseJSONMetrics([]byte(`[{"id": "JobsDone", "type": "counter", "delta": 3, "labels": {"queue": "mail"}}, {"id": "Bad", "type": "gauge"}]`))
+	assert.Error(t, err)
+	assert.Equal(t, []Data{NewCounterData("JobsDone", 3).WithLabels(metric.Labels{"queue": "mail"})}, data)
+
+	data, err = parseJSONMetrics([]byte(`[{"id": "Latency", "type": "histogram", "histogram": {"bounds": [0.1], "counts": [2, 1], "sum": 0.5, "count": 3}},
+		{"id": "Size", "type": "summary", "summary": {"quantiles": [{"quantile": 0.5, "value": 10}], "sum": 30, "count": 2}},
+		{"id": "Bad", "type": "histogram", "histogram": {"bounds": [0.1], "counts": [2], "count": 2}}]`))
+	assert.Error(t, err)
+	assert.Equal(t, []Data{
+		NewHistogramData("Latency", &metric.Histogram{Bounds: []float64{0.1}, Counts: []uint64{2, 1}, Sum: 0.5, Count: 3}),
+		NewSummaryData("Size", &metric.Summary{Quantiles: []metric.Quantile{{Quantile: 0.5, Value: 10}}, Sum: 30, Count: 2}),
+	}, data)
+
+	data, err = parseJSONMetrics([]byte(`[{"id": "Queue{a}", "type": "gauge", "value": 1}, {"id": "Queue", "type": "gauge", "value": 1, "labels": {"bad-name": "x"}}]`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "metric 1: metric ID 'Queue{a}'")
+	assert.Contains(t, err.Error(), "metric 2: invalid label name 'bad-name'")
+	assert.Empty(t, data)
+}
+
+func TestExecCollector(t *testing.T) {
+	c, err := newExecCollector(json.RawMessage(`{"commands": [
+		{"name": "echo", "command": "echo", "args": ["QueueSize gauge 7"]},
+		{"name": "slow", "command": "sleep", "args": ["5"], "timeout": "100ms"}
+	]}`))
+	require.NoError(t, err)
+
+	data, err := c.Collect(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "command 'slow': timed out")
+	assert.Equal(t, []Data{NewGaugeData("QueueSize", 7)}, data)
+
+	_, err = newExecCollector(json.RawMessage(`{"commands": [{"command": "echo", "format": "xml"}]}`))
+	assert.Error(t, err)
+}
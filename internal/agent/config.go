@@ -20,8 +20,35 @@ const usage = `Usage of using_flag:
   -p duration Metric poll interval (default 2s)
   -r duration Metric report to server interval (default 10s)
   -intf string Local network interface
+  -statsd string Address of StatsD UDP listener
+  -prom string Address of Prometheus metrics endpoint
+  -spool-dir string Directory for unsent batches
+  -spool-max-size int Maximum size of unsent batches in bytes (default 67108864)
+  -spool-max-age duration Maximum age of unsent batches (default 24h0m0s)
+  -send-mode string Send metrics one by one, in batches or both: single|batch|both (default "batch")
+  -max-batch-size int Maximum number of metrics in a batch, 0 means no limit (default 1000)
+  -retry-max-attempts int Attempts per request to server (default 3)
+  -retry-initial-backoff duration Delay before the first retry (default 100ms)
+  -retry-max-backoff duration Maximum delay between retries (default 5s)
+  -request-timeout duration Timeout of a request to server (default 5s)
+  -breaker-threshold int Consecutive failed requests which stop sending, 0 disables (default 5)
+  -breaker-timeout duration Pause in sending after failed requests (default 30s)
+  -agent-id string Agent identity reported to server (default host name)
+  -labels string Labels attached to every metric: name=value,... (host label is added by default, "host=" removes it)
 `
 
+// Send modes of metrics to server.
+const (
+	// SendModeSingle sends every metric in a separate request.
+	SendModeSingle = "single"
+	// SendModeBatch sends metrics in batches.
+	SendModeBatch = "batch"
+	// SendModeBoth sends metrics one by one and then in batches, as legacy agents did.
+	// Counters are applied once: server takes increments from their cumulative totals, which are sent both times.
+	// Histograms and summaries are merged once as well, they carry numbers of observations since the agent start.
+	SendModeBoth = "both"
+)
+
 const (
 	defaultAddress        string        = "localhost:8080"
 	defaultReportInterval time.Duration = time.Duration(10 * time.Second)
@@ -29,6 +56,22 @@ const (
 	defaultCryptoKey      string        = ""
 	defaultKey            string        = ""
 	defaultLocalInterface string        = ""
+	defaultStatsDAddress  string        = ""
+	defaultPromAddress    string        = ""
+	defaultSpoolDir       string        = ""
+	defaultSpoolMaxSize   int64         = 64 << 20
+	defaultSpoolMaxAge    time.Duration = time.Duration(24 * time.Hour)
+	defaultSendMode       string        = SendModeBatch
+	defaultMaxBatchSize   int           = 1000
+	defaultLabels         string        = ""
+	defaultAgentID        string        = ""
+
+	defaultRetryMaxAttempts    int           = 3
+	defaultRetryInitialBackoff time.Duration = time.Duration(100 * time.Millisecond)
+	defaultRetryMaxBackoff     time.Duration = time.Duration(5 * time.Second)
+	defaultRequestTimeout      time.Duration = time.Duration(5 * time.Second)
+	defaultBreakerThreshold    int           = 5
+	defaultBreakerTimeout      time.Duration = time.Duration(30 * time.Second)
 )
 
 // Config structure. Used for application configuration.
@@ -39,14 +82,49 @@ type Config struct {
 	Key            string        `env:"KEY"`
 	CryptoKey      string        `env:"CRYPTO_KEY"`
 	ConfigFile     string        `env:"CONFIG"`
+	StatsDAddress  string        `env:"STATSD_ADDRESS"`
+	PromAddress    string        `env:"PROMETHEUS_ADDRESS"`
+	SpoolDir       string        `env:"SPOOL_DIR"`
+	SpoolMaxSize   int64         `env:"SPOOL_MAX_SIZE"`
+	SpoolMaxAge    time.Duration `env:"SPOOL_MAX_AGE"`
+	SendMode       string        `env:"SEND_MODE"`
+	MaxBatchSize   int           `env:"MAX_BATCH_SIZE"`
+	Labels         string        `env:"LABELS"`
+	AgentID        string        `env:"AGENT_ID"`
 	GRPC           bool
+	Version        string
+	Collectors     map[string]CollectorConfig
+
+	RetryMaxAttempts    int           `env:"RETRY_MAX_ATTEMPTS"`
+	RetryInitialBackoff time.Duration `env:"RETRY_INITIAL_BACKOFF"`
+	RetryMaxBackoff     time.Duration `env:"RETRY_MAX_BACKOFF"`
+	RequestTimeout      time.Duration `env:"REQUEST_TIMEOUT"`
+	BreakerThreshold    int           `env:"BREAKER_THRESHOLD"`
+	BreakerTimeout      time.Duration `env:"BREAKER_TIMEOUT"`
 }
 
 type ConfigFile struct {
-	Address        string        `json:"address"`
-	ReportInterval time.Duration `json:"report_interval"`
-	PollInterval   time.Duration `json:"poll_interval"`
-	CryptoKey      string        `json:"crypto_key"`
+	Address        string                     `json:"address"`
+	ReportInterval time.Duration              `json:"report_interval"`
+	PollInterval   time.Duration              `json:"poll_interval"`
+	CryptoKey      string                     `json:"crypto_key"`
+	StatsDAddress  string                     `json:"statsd_address"`
+	PromAddress    string                     `json:"prometheus_address"`
+	SpoolDir       string                     `json:"spool_dir"`
+	SpoolMaxSize   int64                      `json:"spool_max_size"`
+	SpoolMaxAge    time.Duration              `json:"spool_max_age"`
+	SendMode       string                     `json:"send_mode"`
+	MaxBatchSize   int                        `json:"max_batch_size"`
+	Labels         string                     `json:"labels"`
+	AgentID        string                     `json:"agent_id"`
+	Collectors     map[string]CollectorConfig `json:"collectors"`
+
+	RetryMaxAttempts    int           `json:"retry_max_attempts"`
+	RetryInitialBackoff time.Duration `json:"retry_initial_backoff"`
+	RetryMaxBackoff     time.Duration `json:"retry_max_backoff"`
+	RequestTimeout      time.Duration `json:"request_timeout"`
+	BreakerThreshold    int           `json:"breaker_threshold"`
+	BreakerTimeout      time.Duration `json:"breaker_timeout"`
 }
 
 func (config *ConfigFile) UnmarshalJSON(b []byte) error {
@@ -56,6 +134,12 @@ func (config *ConfigFile) UnmarshalJSON(b []byte) error {
 		*MyTypeAlias
 		ReportInterval string `json:"report_interval"`
 		PollInterval   string `json:"poll_interval"`
+		SpoolMaxAge    string `json:"spool_max_age"`
+
+		RetryInitialBackoff string `json:"retry_initial_backoff"`
+		RetryMaxBackoff     string `json:"retry_max_backoff"`
+		RequestTimeout      string `json:"request_timeout"`
+		BreakerTimeout      string `json:"breaker_timeout"`
 	}{
 		MyTypeAlias: (*MyTypeAlias)(config),
 	}
@@ -72,6 +156,25 @@ func (config *ConfigFile) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	optionalDurations := []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{unmarshalledJSON.SpoolMaxAge, &config.SpoolMaxAge},
+		{unmarshalledJSON.RetryInitialBackoff, &config.RetryInitialBackoff},
+		{unmarshalledJSON.RetryMaxBackoff, &config.RetryMaxBackoff},
+		{unmarshalledJSON.RequestTimeout, &config.RequestTimeout},
+		{unmarshalledJSON.BreakerTimeout, &config.BreakerTimeout},
+	}
+	for _, d := range optionalDurations {
+		if d.value == "" {
+			continue
+		}
+		*d.dst, err = time.ParseDuration(d.value)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -109,6 +212,68 @@ func loadConfigFromFile(c *Config) error {
 		c.CryptoKey = cfgFromFile.CryptoKey
 	}
 
+	if c.StatsDAddress == defaultStatsDAddress && cfgFromFile.StatsDAddress != "" {
+		c.StatsDAddress = cfgFromFile.StatsDAddress
+	}
+
+	if c.PromAddress == defaultPromAddress && cfgFromFile.PromAddress != "" {
+		c.PromAddress = cfgFromFile.PromAddress
+	}
+
+	if c.SpoolDir == defaultSpoolDir && cfgFromFile.SpoolDir != "" {
+		c.SpoolDir = cfgFromFile.SpoolDir
+	}
+
+	if c.SpoolMaxSize == defaultSpoolMaxSize && cfgFromFile.SpoolMaxSize != 0 {
+		c.SpoolMaxSize = cfgFromFile.SpoolMaxSize
+	}
+
+	if c.SpoolMaxAge == defaultSpoolMaxAge && cfgFromFile.SpoolMaxAge != 0 {
+		c.SpoolMaxAge = cfgFromFile.SpoolMaxAge
+	}
+
+	if c.SendMode == defaultSendMode && cfgFromFile.SendMode != "" {
+		c.SendMode = cfgFromFile.SendMode
+	}
+
+	if c.MaxBatchSize == defaultMaxBatchSize && cfgFromFile.MaxBatchSize != 0 {
+		c.MaxBatchSize = cfgFromFile.MaxBatchSize
+	}
+
+	if c.Labels == defaultLabels && cfgFromFile.Labels != "" {
+		c.Labels = cfgFromFile.Labels
+	}
+
+	if c.AgentID == defaultAgentID && cfgFromFile.AgentID != "" {
+		c.AgentID = cfgFromFile.AgentID
+	}
+
+	if c.RetryMaxAttempts == defaultRetryMaxAttempts && cfgFromFile.RetryMaxAttempts != 0 {
+		c.RetryMaxAttempts = cfgFromFile.RetryMaxAttempts
+	}
+
+	if c.RetryInitialBackoff == defaultRetryInitialBackoff && cfgFromFile.RetryInitialBackoff != 0 {
+		c.RetryInitialBackoff = cfgFromFile.RetryInitialBackoff
+	}
+
+	if c.RetryMaxBackoff == defaultRetryMaxBackoff && cfgFromFile.RetryMaxBackoff != 0 {
+		c.RetryMaxBackoff = cfgFromFile.RetryMaxBackoff
+	}
+
+	if c.RequestTimeout == defaultRequestTimeout && cfgFromFile.RequestTimeout != 0 {
+		c.RequestTimeout = cfgFromFile.RequestTimeout
+	}
+
+	if c.BreakerThreshold == defaultBreakerThreshold && cfgFromFile.BreakerThreshold != 0 {
+		c.BreakerThreshold = cfgFromFile.BreakerThreshold
+	}
+
+	if c.BreakerTimeout == defaultBreakerTimeout && cfgFromFile.BreakerTimeout != 0 {
+		c.BreakerTimeout = cfgFromFile.BreakerTimeout
+	}
+
+	c.Collectors = cfgFromFile.Collectors
+
 	return nil
 }
 
@@ -121,6 +286,21 @@ func GetConfig() (*Config, error) {
 	flag.DurationVar(&c.PollInterval, "p", defaultPollInterval, "Metric poll interval")
 	flag.StringVar(&c.CryptoKey, "crypto-key", defaultCryptoKey, "Path to public key")
 	flag.StringVar(&c.Key, "k", defaultKey, "Encryption key")
+	flag.StringVar(&c.StatsDAddress, "statsd", defaultStatsDAddress, "Address of StatsD UDP listener")
+	flag.StringVar(&c.PromAddress, "prom", defaultPromAddress, "Address of Prometheus metrics endpoint")
+	flag.StringVar(&c.SpoolDir, "spool-dir", defaultSpoolDir, "Directory for unsent batches")
+	flag.Int64Var(&c.SpoolMaxSize, "spool-max-size", defaultSpoolMaxSize, "Maximum size of unsent batches in bytes")
+	flag.DurationVar(&c.SpoolMaxAge, "spool-max-age", defaultSpoolMaxAge, "Maximum age of unsent batches")
+	flag.StringVar(&c.SendMode, "send-mode", defaultSendMode, "Send metrics one by one, in batches or both: single|batch|both")
+	flag.IntVar(&c.MaxBatchSize, "max-batch-size", defaultMaxBatchSize, "Maximum number of metrics in a batch, 0 means no limit")
+	flag.StringVar(&c.Labels, "labels", defaultLabels, "Labels attached to every metric: name=value,...")
+	flag.StringVar(&c.AgentID, "agent-id", defaultAgentID, "Agent identity reported to server")
+	flag.IntVar(&c.RetryMaxAttempts, "retry-max-attempts", defaultRetryMaxAttempts, "Attempts per request to server")
+	flag.DurationVar(&c.RetryInitialBackoff, "retry-initial-backoff", defaultRetryInitialBackoff, "Delay before the first retry")
+	flag.DurationVar(&c.RetryMaxBackoff, "retry-max-backoff", defaultRetryMaxBackoff, "Maximum delay between retries")
+	flag.DurationVar(&c.RequestTimeout, "request-timeout", defaultRequestTimeout, "Timeout of a request to server")
+	flag.IntVar(&c.BreakerThreshold, "breaker-threshold", defaultBreakerThreshold, "Consecutive failed requests which stop sending, 0 disables")
+	flag.DurationVar(&c.BreakerTimeout, "breaker-timeout", defaultBreakerTimeout, "Pause in sending after failed requests")
 	flag.StringVar(&c.ConfigFile, "config", "", "Config file name")
 	flag.StringVar(&c.ConfigFile, "c", "", "Config file name")
 	flag.BoolVar(&c.GRPC, "grpc", false, "Run as gRPC service")
@@ -1,5 +1,7 @@
 package agent
 
+import "fmt"
+
 type DecryptError struct {
 	msg string
 }
@@ -11,3 +13,16 @@ func (de *DecryptError) Error() string {
 func NewDecryptError(text string) error {
 	return &DecryptError{msg: text}
 }
+
+// StatusError is returned when server responds with non-OK HTTP status.
+type StatusError struct {
+	Code int
+}
+
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("Non-OK HTTP status: %d", se.Code)
+}
+
+func NewStatusError(code int) error {
+	return &StatusError{Code: code}
+}
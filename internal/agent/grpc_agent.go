@@ -2,13 +2,19 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jay-T/go-devops.git/internal/pb"
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type GRPCRequestError struct {
@@ -23,11 +29,22 @@ func NewGRPCRequestError(text string) error {
 	return &GRPCRequestError{msg: text}
 }
 
+// errStreamUnsupported is returned by sendStream if server does not implement StreamMetrics.
+var errStreamUnsupported = errors.New("server does not support metric streams")
+
+// streamRetryIntervals is how many report intervals the agent uses unary requests before it tries streaming again,
+// so it starts streaming once the server is upgraded.
+const streamRetryIntervals = 30
+
 // GRPCAgent struct describes format of GRPC agent based on GenericAgent.
+// Metrics are sent over one long-lived StreamMetrics stream. Unary requests are used with servers which do not support it.
 type GRPCAgent struct {
 	*GenericAgent
 	conn   *grpc.ClientConn
 	client pb.MetricsAgentClient
+	stream *metricStream
+	// unaryUntil is the time in unix nanoseconds until which unary requests are used instead of the stream
+	unaryUntil atomic.Int64
 }
 
 // NewGRPCAgent returns GRPCAgent for work.
@@ -36,8 +53,13 @@ func NewGRPCAgent(cfg *Config) (*GRPCAgent, error) {
 	if err != nil {
 		return nil, err
 	}
-	interceptor := getClientInterceptor(genericAgent.localAddress)
-	conn, err := grpc.Dial(cfg.Address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithUnaryInterceptor(interceptor))
+	interceptor := getClientInterceptor(genericAgent.localAddress, genericAgent.identity()...)
+	streamInterceptor := getClientStreamInterceptor(genericAgent.localAddress, genericAgent.identity()...)
+	conn, err := grpc.Dial(cfg.Address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(interceptor),
+		grpc.WithStreamInterceptor(streamInterceptor),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -45,13 +67,64 @@ func NewGRPCAgent(cfg *Config) (*GRPCAgent, error) {
 	client := pb.NewMetricsAgentClient(conn)
 
 	return &GRPCAgent{
-		genericAgent,
-		conn,
-		client,
+		GenericAgent: genericAgent,
+		conn:         conn,
+		client:       client,
+		stream:       newMetricStream(client),
 	}, nil
 }
 
+// sendStream sends metrics over StreamMetrics stream and returns acknowledgement of the batch.
+// Rejected metrics are logged, they are not sent again. errStreamUnsupported is returned if server
+// does not implement streaming, unary requests are used for streamRetryIntervals report intervals since then.
+func (a *GRPCAgent) sendStream(ctx context.Context, mList []metric.Metric, batchID string) (*pb.StreamMetricsResponse, error) {
+	if time.Now().UnixNano() < a.unaryUntil.Load() {
+		return nil, errStreamUnsupported
+	}
+
+	req := &pb.StreamMetricsRequest{
+		BatchId: batchID,
+		Metrics: make([]*pb.Metric, 0, len(mList)),
+	}
+	for _, m := range mList {
+		req.Metrics = append(req.Metrics, m.ConvertMetricToPB(a.Cfg.Key))
+	}
+
+	res, err := a.stream.send(ctx, req)
+	if status.Code(err) == codes.Unimplemented {
+		interval := a.Cfg.ReportInterval
+		if interval <= 0 {
+			interval = defaultReportInterval
+		}
+		retryAt := time.Now().Add(streamRetryIntervals * interval)
+		log.Printf("Server does not support metric streams, sending metrics with unary requests until %s", retryAt.Format(time.RFC3339))
+		a.unaryUntil.Store(retryAt.UnixNano())
+		return nil, errStreamUnsupported
+	}
+	if err != nil {
+		log.Printf("Error during sendData, %s", err)
+		return nil, err
+	}
+
+	if res.Error != "" {
+		log.Printf("server rejected batch: %s", res.Error)
+		return nil, NewGRPCRequestError(res.Error)
+	}
+	for _, r := range res.Rejected {
+		log.Printf("server rejected metric %s: %s", r.Id, r.Reason)
+	}
+	return res, nil
+}
+
 func (a *GRPCAgent) sendData(ctx context.Context, m *metric.Metric) error {
+	ack, err := a.sendStream(ctx, []metric.Metric{*m}, "")
+	if !errors.Is(err, errStreamUnsupported) {
+		if err == nil && len(ack.Rejected) > 0 {
+			err = NewGRPCRequestError(ack.Rejected[0].Reason)
+		}
+		return err
+	}
+
 	pbMetric := m.ConvertMetricToPB(a.Cfg.Key)
 
 	req := &pb.UpdateMetricRequest{
@@ -71,7 +144,12 @@ func (a *GRPCAgent) sendData(ctx context.Context, m *metric.Metric) error {
 	return nil
 }
 
-func (a *GRPCAgent) sendBulkData(ctx context.Context, mList *[]metric.Metric) error {
+func (a *GRPCAgent) sendBulkData(ctx context.Context, mList *[]metric.Metric, batchID string) error {
+	_, err := a.sendStream(ctx, *mList, batchID)
+	if !errors.Is(err, errStreamUnsupported) {
+		return err
+	}
+
 	var pbMetrics []*pb.Metric
 
 	for _, m := range *mList {
@@ -82,6 +160,7 @@ func (a *GRPCAgent) sendBulkData(ctx context.Context, mList *[]metric.Metric) er
 		Metrics: pbMetrics,
 	}
 
+	ctx = metadata.AppendToOutgoingContext(ctx, "Batch-ID", batchID)
 	res, err := a.client.UpdateMetrics(ctx, req)
 	if err != nil {
 		log.Printf("Error during sendData, %s", err)
@@ -95,41 +174,27 @@ func (a *GRPCAgent) sendBulkData(ctx context.Context, mList *[]metric.Metric) er
 	return nil
 }
 
-func (a *GRPCAgent) combineAndSend(ctx context.Context, dataChan chan<- Data, doneChan chan<- struct{}, finFlag bool) {
-	var mList []metric.Metric
-
-	func() {
-		a.Lock()
-		defer a.Unlock()
-
-		for _, m := range a.Metrics {
-			err := a.sendData(ctx, &m)
-			if err != nil {
-				log.Printf("metric: %s, error: %s", m.ID, err)
-			}
-			mList = append(mList, m)
-			if m.ID == "PollCount" {
-				PollCount = 0
-			}
-		}
-	}()
+// sendHeartbeatRequest notifies server that the agent is alive.
+func (a *GRPCAgent) sendHeartbeatRequest(ctx context.Context) error {
+	_, err := a.client.Heartbeat(ctx, &emptypb.Empty{})
+	return err
+}
+
+func (a *GRPCAgent) combineAndSend(ctx context.Context, doneChan chan<- struct{}, finFlag bool) {
+	mList := a.takeMetrics()
+	if len(mList) == 0 {
+		a.sendHeartbeat(ctx, a.sendHeartbeatRequest)
+	} else {
+		a.sendMetrics(ctx, mList, a.sendData, a.sendBulkData)
+	}
 
 	if finFlag {
 		doneChan <- struct{}{}
 	}
-	if PollCount == 0 {
-		dataChan <- Data{name: "PollCount", counterValue: 0}
-	}
-	if len(mList) > 0 {
-		err := a.sendBulkData(ctx, &mList)
-		if err != nil {
-			log.Print(err)
-		}
-	}
 }
 
 // SendDataByInterval gorouting sends data to server every specified interval.
-func (a *GRPCAgent) SendGRPCDataByInterval(ctx context.Context, dataChan chan<- Data, doneChan chan<- struct{}) {
+func (a *GRPCAgent) SendGRPCDataByInterval(ctx context.Context, doneChan chan<- struct{}) {
 	log.Printf("Sending data with interval: %s", a.Cfg.ReportInterval)
 	log.Printf("Sending data to: %s", a.Cfg.Address)
 
@@ -137,10 +202,13 @@ func (a *GRPCAgent) SendGRPCDataByInterval(ctx context.Context, dataChan chan<-
 	for {
 		select {
 		case <-ticker.C:
-			a.combineAndSend(ctx, dataChan, doneChan, false)
+			a.combineAndSend(ctx, doneChan, false)
 		case <-ctx.Done():
 			log.Println("Received cancel command. Sending processed data.")
-			a.combineAndSend(ctx, dataChan, doneChan, true)
+			finCtx, cancel := context.WithTimeout(context.Background(), finalSendTimeout)
+			a.combineAndSend(finCtx, doneChan, true)
+			cancel()
+			a.stream.close()
 
 			log.Println("Context has been canceled successfully.")
 			return
@@ -150,6 +218,6 @@ func (a *GRPCAgent) SendGRPCDataByInterval(ctx context.Context, dataChan chan<-
 
 // Run begins the agent work.
 func (a *GRPCAgent) Run(ctx context.Context, doneChan chan<- struct{}) {
-	dataChan := a.runCommonAgentGoroutines(ctx)
-	go a.SendGRPCDataByInterval(ctx, dataChan, doneChan)
+	a.runCommonAgentGoroutines(ctx)
+	go a.SendGRPCDataByInterval(ctx, doneChan)
 }
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// streamServer acknowledges streamed batches rejecting metrics with ID "Bad".
+type streamServer struct {
+	pb.UnimplementedMetricsAgentServer
+
+	mu      sync.Mutex
+	streams int
+	agentID string
+	batches []*pb.StreamMetricsRequest
+}
+
+func (s *streamServer) StreamMetrics(stream pb.MetricsAgent_StreamMetricsServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.mu.Lock()
+	s.streams++
+	if ids := md.Get("Agent-ID"); len(ids) > 0 {
+		s.agentID = ids[0]
+	}
+	s.mu.Unlock()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		res := &pb.StreamMetricsResponse{BatchId: req.BatchId}
+		for i, m := range req.Metrics {
+			if m.Id == "Bad" {
+				res.Rejected = append(res.Rejected, &pb.RejectedMetric{Index: uint32(i), Id: m.Id, Reason: "bad metric"})
+			} else {
+				res.Accepted++
+			}
+		}
+		s.mu.Lock()
+		s.batches = append(s.batches, req)
+		s.mu.Unlock()
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// unaryServer is a server which does not support metric streams.
+type unaryServer struct {
+	pb.UnimplementedMetricsAgentServer
+
+	mu      sync.Mutex
+	metrics int
+}
+
+func (s *unaryServer) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics += len(in.Metrics)
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+func serveGRPC(t *testing.T, lis net.Listener, srv pb.MetricsAgentServer) *grpc.Server {
+	server := grpc.NewServer()
+	pb.RegisterMetricsAgentServer(server, srv)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func newTestGRPCAgent(t *testing.T, address string) *GRPCAgent {
+	a := &GenericAgent{
+		Cfg:     &Config{Address: address},
+		agentID: "web1",
+		retrier: newRetrier(RetryPolicy{MaxAttempts: 8, InitialBackoff: 200 * time.Millisecond, MaxBackoff: time.Second}),
+	}
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(getClientInterceptor("127.0.0.1", a.identity()...)),
+		grpc.WithStreamInterceptor(getClientStreamInterceptor("127.0.0.1", a.identity()...)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client := pb.NewMetricsAgentClient(conn)
+	return &GRPCAgent{GenericAgent: a, conn: conn, client: client, stream: newMetricStream(client)}
+}
+
+func TestGRPCAgentStream(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := lis.Addr().String()
+	srv := &streamServer{}
+	server := serveGRPC(t, lis, srv)
+
+	a := newTestGRPCAgent(t, address)
+	ctx := context.Background()
+	value := 1.0
+	mList := []metric.Metric{
+		{ID: "Alloc", MType: gauge, Value: &value},
+		{ID: "Bad", MType: gauge, Value: &value},
+	}
+
+	// batches share one stream, rejected metrics are not an error
+	require.NoError(t, a.sendBulkData(ctx, &mList, "batch1"))
+	require.NoError(t, a.sendBulkData(ctx, &mList, "batch2"))
+	require.NoError(t, a.sendData(ctx, &mList[0]))
+	require.Error(t, a.sendData(ctx, &mList[1]))
+	srv.mu.Lock()
+	require.Equal(t, 1, srv.streams)
+	require.Equal(t, "web1", srv.agentID)
+	require.Len(t, srv.batches, 4)
+	require.Equal(t, "batch2", srv.batches[1].BatchId)
+	srv.mu.Unlock()
+
+	// server restart is transparent to the agent
+	server.Stop()
+	lis, err = net.Listen("tcp", address)
+	require.NoError(t, err)
+	restarted := &streamServer{}
+	serveGRPC(t, lis, restarted)
+
+	a.sendMetrics(ctx, mList[:1], a.sendData, a.sendBulkData)
+	restarted.mu.Lock()
+	require.Equal(t, 1, restarted.streams)
+	require.Len(t, restarted.batches, 1)
+	require.NotEmpty(t, restarted.batches[0].BatchId)
+	restarted.mu.Unlock()
+	a.stream.close()
+}
+
+func TestGRPCAgentUnaryFallback(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := lis.Addr().String()
+	srv := &unaryServer{}
+	server := serveGRPC(t, lis, srv)
+
+	a := newTestGRPCAgent(t, address)
+	value := 1.0
+	mList := []metric.Metric{{ID: "Alloc", MType: gauge, Value: &value}}
+	require.NoError(t, a.sendBulkData(context.Background(), &mList, "batch1"))
+	require.NoError(t, a.sendBulkData(context.Background(), &mList, "batch2"))
+	require.Greater(t, a.unaryUntil.Load(), time.Now().UnixNano())
+	srv.mu.Lock()
+	require.Equal(t, 2, srv.metrics)
+	srv.mu.Unlock()
+
+	// streaming is tried again later, e.g. once the server is upgraded
+	server.Stop()
+	lis, err = net.Listen("tcp", address)
+	require.NoError(t, err)
+	upgraded := &streamServer{}
+	serveGRPC(t, lis, upgraded)
+	a.unaryUntil.Store(time.Now().UnixNano())
+
+	a.sendMetrics(context.Background(), mList, a.sendData, a.sendBulkData)
+	upgraded.mu.Lock()
+	require.Len(t, upgraded.batches, 1)
+	upgraded.mu.Unlock()
+	a.stream.close()
+}
@@ -8,19 +8,36 @@ import (
 	"google.golang.org/grpc/metadata"
 )
 
-// getClientInterceptor returns an interceptor which adds Request-ID and X-Real-Ip (if needed) to request metadata
-func getClientInterceptor(address string) func(ctx context.Context, method string, req interface{},
+// getClientInterceptor returns an interceptor which adds Request-ID, X-Real-Ip and identity of the agent to request metadata.
+// Identity is given as key-value pairs.
+func getClientInterceptor(address string, identity ...string) func(ctx context.Context, method string, req interface{},
 	reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
 	opts ...grpc.CallOption) error {
 
 	return func(ctx context.Context, method string, req interface{},
 		reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
 		opts ...grpc.CallOption) error {
-		reqID := xid.New()
-		ctx = metadata.AppendToOutgoingContext(ctx, "Request-ID", reqID.String(), "X-Real-Ip", address)
-
+		ctx = withRequestMetadata(ctx, address, identity...)
 		err := invoker(ctx, method, req, reply, cc, opts...)
 
 		return err
 	}
 }
+
+// getClientStreamInterceptor returns getClientInterceptor counterpart for streams.
+func getClientStreamInterceptor(address string, identity ...string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withRequestMetadata(ctx, address, identity...), desc, cc, method, opts...)
+	}
+}
+
+// withRequestMetadata adds Request-ID, X-Real-Ip and identity of the agent to outgoing metadata.
+func withRequestMetadata(ctx context.Context, address string, identity ...string) context.Context {
+	reqID := xid.New()
+	ctx = metadata.AppendToOutgoingContext(ctx, "Request-ID", reqID.String(), "X-Real-Ip", address)
+	if len(identity) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, identity...)
+	}
+	return ctx
+}
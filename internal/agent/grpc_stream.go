@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Jay-T/go-devops.git/internal/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metricStream keeps one StreamMetrics stream to server open and sends batches over it one at a time.
+// A broken stream is dropped and a new one is opened for the next batch, so reconnects are transparent to callers.
+type metricStream struct {
+	client pb.MetricsAgentClient
+
+	mu     sync.Mutex
+	stream pb.MetricsAgent_StreamMetricsClient
+	cancel context.CancelFunc
+}
+
+func newMetricStream(client pb.MetricsAgentClient) *metricStream {
+	return &metricStream{client: client}
+}
+
+// send sends a batch and waits for its acknowledgement.
+// A batch which fails on a stream opened earlier is sent once again over a new stream:
+// the old one may have been broken while idle, e.g. by server restart. Server skips a batch received twice.
+func (ms *metricStream) send(ctx context.Context, req *pb.StreamMetricsRequest) (*pb.StreamMetricsResponse, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	reused := ms.stream != nil
+	res, err := ms.roundTrip(ctx, req)
+	if err != nil && reused && ctx.Err() == nil && status.Code(err) != codes.Unimplemented {
+		res, err = ms.roundTrip(ctx, req)
+	}
+	return res, err
+}
+
+type streamResult struct {
+	res *pb.StreamMetricsResponse
+	err error
+}
+
+// roundTrip sends a batch over the current stream opening it if needed.
+func (ms *metricStream) roundTrip(ctx context.Context, req *pb.StreamMetricsRequest) (*pb.StreamMetricsResponse, error) {
+	if ms.stream == nil {
+		// the stream outlives requests, so it does not use their context
+		streamCtx, cancel := context.WithCancel(context.Background())
+		stream, err := ms.client.StreamMetrics(streamCtx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		ms.stream, ms.cancel = stream, cancel
+	}
+
+	stream := ms.stream
+	done := make(chan streamResult, 1)
+	go func() {
+		err := stream.Send(req)
+		if err == nil || errors.Is(err, io.EOF) {
+			// on io.EOF the actual error is returned by Recv
+			var res *pb.StreamMetricsResponse
+			res, err = stream.Recv()
+			done <- streamResult{res: res, err: err}
+			return
+		}
+		done <- streamResult{err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if errors.Is(r.err, io.EOF) {
+			r.err = status.Error(codes.Unavailable, "metric stream is closed by server")
+		}
+		if r.err == nil && r.res.BatchId != req.BatchId {
+			r.err = fmt.Errorf("received acknowledgement of batch '%s' instead of '%s'", r.res.BatchId, req.BatchId)
+		}
+		if r.err != nil {
+			ms.reset()
+		}
+		return r.res, r.err
+	case <-ctx.Done():
+		// the acknowledgement may still come, so the stream can not be used for other batches
+		ms.reset()
+		return nil, ctx.Err()
+	}
+}
+
+// reset drops the current stream.
+func (ms *metricStream) reset() {
+	if ms.stream != nil {
+		ms.cancel()
+		ms.stream, ms.cancel = nil, nil
+	}
+}
+
+// close closes the stream gracefully.
+func (ms *metricStream) close() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.stream != nil {
+		_ = ms.stream.CloseSend()
+	}
+	ms.reset()
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -32,7 +33,7 @@ func NewHTTPAgent(cfg *Config) (*HTTPAgent, error) {
 
 }
 
-func (a *HTTPAgent) sendData(m *metric.Metric) error {
+func (a *HTTPAgent) sendData(ctx context.Context, m *metric.Metric) error {
 	var url string
 	mSer, err := m.PrepareMetricAsJSON(a.Cfg.Key)
 	if err != nil {
@@ -48,35 +49,51 @@ func (a *HTTPAgent) sendData(m *metric.Metric) error {
 		}
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(mSer))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(mSer))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
-	if a.localAddress != "" {
-		req.Header.Add("X-Real-Ip", a.localAddress)
-	}
+	a.addSourceHeaders(req)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
 		return err
 	}
 
-	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !statusOK {
-		return NewDecryptError(fmt.Sprintf("Non-OK HTTP status: %d", resp.StatusCode))
-	}
-
 	err = resp.Body.Close()
 	if err != nil {
 		return err
 	}
+
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		return NewStatusError(resp.StatusCode)
+	}
 	return nil
 }
 
-func (a *HTTPAgent) sendBulkData(mList *[]metric.Metric) error {
+// addSourceHeaders adds identity of the agent to request headers.
+func (a *HTTPAgent) addSourceHeaders(req *http.Request) {
+	kv := a.identity()
+	for i := 0; i+1 < len(kv); i += 2 {
+		req.Header.Add("X-"+kv[i], kv[i+1])
+	}
+	if a.localAddress != "" {
+		req.Header.Add("X-Real-Ip", a.localAddress)
+	}
+}
+
+// sendBulkData sends a batch of metrics. With a key set every metric is signed, as single metrics are.
+func (a *HTTPAgent) sendBulkData(ctx context.Context, mList *[]metric.Metric, batchID string) error {
 	url := fmt.Sprintf("http://%s/updates/", a.Cfg.Address)
+	if a.Cfg.Key != "" {
+		for i := range *mList {
+			m := &(*mList)[i]
+			m.Hash = hex.EncodeToString(m.GenerateHash(a.Cfg.Key))
+		}
+	}
 	mSer, err := json.Marshal(*mList)
 	if err != nil {
 		return err
@@ -88,14 +105,13 @@ func (a *HTTPAgent) sendBulkData(mList *[]metric.Metric) error {
 		}
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(mSer))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(mSer))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	if a.localAddress != "" {
-		req.Header.Add("X-Real-Ip", a.localAddress)
-	}
+	req.Header.Add("X-Batch-ID", batchID)
+	a.addSourceHeaders(req)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -103,53 +119,59 @@ func (a *HTTPAgent) sendBulkData(mList *[]metric.Metric) error {
 		return err
 	}
 
+	err = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
 	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
 	if !statusOK {
-		return NewDecryptError(fmt.Sprintf("Non-OK HTTP status: %d", resp.StatusCode))
+		return NewStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// sendHeartbeatRequest notifies server that the agent is alive.
+func (a *HTTPAgent) sendHeartbeatRequest(ctx context.Context) error {
+	url := fmt.Sprintf("http://%s/heartbeat/", a.Cfg.Address)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return err
+	}
+	a.addSourceHeaders(req)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
 	}
 
 	err = resp.Body.Close()
 	if err != nil {
 		return err
 	}
+
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		return NewStatusError(resp.StatusCode)
+	}
 	return nil
 }
 
-func (a *HTTPAgent) combineAndSend(dataChan chan<- Data, doneChan chan<- struct{}, finFlag bool) {
-	var mList []metric.Metric
-
-	func() {
-		a.Lock()
-		defer a.Unlock()
-
-		for _, m := range a.Metrics {
-			err := a.sendData(&m)
-			if err != nil {
-				log.Printf("metric: %s, error: %s", m.ID, err)
-			}
-			mList = append(mList, m)
-			if m.ID == "PollCount" {
-				PollCount = 0
-			}
-		}
-	}()
+func (a *HTTPAgent) combineAndSend(ctx context.Context, doneChan chan<- struct{}, finFlag bool) {
+	mList := a.takeMetrics()
+	if len(mList) == 0 {
+		a.sendHeartbeat(ctx, a.sendHeartbeatRequest)
+	} else {
+		a.sendMetrics(ctx, mList, a.sendData, a.sendBulkData)
+	}
 
 	if finFlag {
 		doneChan <- struct{}{}
 	}
-	if PollCount == 0 {
-		dataChan <- Data{name: "PollCount", counterValue: 0}
-	}
-	if len(mList) > 0 {
-		err := a.sendBulkData(&mList)
-		if err != nil {
-			log.Print(err)
-		}
-	}
 }
 
 // SendDataByInterval gorouting sends data to server every specified interval.
-func (a *HTTPAgent) SendHTTPDataByInterval(ctx context.Context, dataChan chan<- Data, doneChan chan<- struct{}) {
+func (a *HTTPAgent) SendHTTPDataByInterval(ctx context.Context, doneChan chan<- struct{}) {
 	log.Printf("Sending data with interval: %s", a.Cfg.ReportInterval)
 	log.Printf("Sending data to: %s", a.Cfg.Address)
 
@@ -157,10 +179,12 @@ func (a *HTTPAgent) SendHTTPDataByInterval(ctx context.Context, dataChan chan<-
 	for {
 		select {
 		case <-ticker.C:
-			a.combineAndSend(dataChan, doneChan, false)
+			a.combineAndSend(ctx, doneChan, false)
 		case <-ctx.Done():
 			log.Println("Received cancel command. Sending processed data.")
-			a.combineAndSend(dataChan, doneChan, true)
+			finCtx, cancel := context.WithTimeout(context.Background(), finalSendTimeout)
+			a.combineAndSend(finCtx, doneChan, true)
+			cancel()
 
 			log.Println("Context has been canceled successfully.")
 			return
@@ -170,6 +194,6 @@ func (a *HTTPAgent) SendHTTPDataByInterval(ctx context.Context, dataChan chan<-
 
 // Run begins the agent work.
 func (a *HTTPAgent) Run(ctx context.Context, doneChan chan<- struct{}) {
-	dataChan := a.runCommonAgentGoroutines(ctx)
-	go a.SendHTTPDataByInterval(ctx, dataChan, doneChan)
+	a.runCommonAgentGoroutines(ctx)
+	go a.SendHTTPDataByInterval(ctx, doneChan)
 }
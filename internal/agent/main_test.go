@@ -1,10 +1,15 @@
 package agent
 
 import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 	"time"
 
@@ -78,7 +83,7 @@ func Test_SendData(t *testing.T) {
 
 			defer srv.Close()
 
-			err = a.sendData(&m)
+			err = a.sendData(context.Background(), &m)
 			if !tt.wantErr {
 				require.NoError(t, err)
 			} else {
@@ -158,3 +163,268 @@ func Test_SendDataOld(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitBatch(t *testing.T) {
+	mList := make([]metric.Metric, 5)
+
+	require.Nil(t, splitBatch(nil, 2))
+	require.Len(t, splitBatch(mList, 0), 1)
+
+	batches := splitBatch(mList, 2)
+	require.Len(t, batches, 3)
+	require.Len(t, batches[0], 2)
+	require.Len(t, batches[2], 1)
+}
+
+func TestSendMetricsModes(t *testing.T) {
+	tests := []struct {
+		mode        string
+		wantSingle  int
+		wantBatches []int
+	}{
+		{mode: "", wantBatches: []int{2, 1}},
+		{mode: SendModeBatch, wantBatches: []int{2, 1}},
+		{mode: SendModeSingle, wantSingle: 3},
+		{mode: SendModeBoth, wantSingle: 3, wantBatches: []int{2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			a := &GenericAgent{Cfg: &Config{SendMode: tt.mode, MaxBatchSize: 2}}
+			mList := []metric.Metric{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+
+			var single int
+			var batches []int
+			a.sendMetrics(context.Background(), mList,
+				func(ctx context.Context, m *metric.Metric) error {
+					single++
+					return nil
+				},
+				func(ctx context.Context, mList *[]metric.Metric, batchID string) error {
+					require.NotEmpty(t, batchID)
+					batches = append(batches, len(*mList))
+					return nil
+				},
+			)
+
+			require.Equal(t, tt.wantSingle, single)
+			require.Equal(t, tt.wantBatches, batches)
+		})
+	}
+}
+
+func TestTakeMetricsCumulativeCounters(t *testing.T) {
+	a := &GenericAgent{
+		Cfg:       &Config{},
+		Metrics:   map[string]metric.Metric{},
+		startTime: time.Unix(0, 100),
+	}
+
+	a.saveData(NewCounterData("PollCount", 2))
+	mList := a.takeMetrics()
+	require.Len(t, mList, 1)
+	require.Equal(t, int64(2), *mList[0].Delta)
+	require.Equal(t, int64(2), *mList[0].Cumulative)
+	require.Equal(t, int64(100), mList[0].StartTime)
+
+	a.saveData(NewCounterData("PollCount", 3))
+	mList = a.takeMetrics()
+	require.Equal(t, int64(3), *mList[0].Delta)
+	require.Equal(t, int64(5), *mList[0].Cumulative)
+
+	a.saveData(NewCounterData("PollCount", -4), NewCounterData("PollCount", 1))
+	mList = a.takeMetrics()
+	require.Equal(t, int64(1), *mList[0].Delta)
+	require.Equal(t, int64(6), *mList[0].Cumulative)
+}
+
+func TestTakeMetricsDistributions(t *testing.T) {
+	a := &GenericAgent{
+		Cfg:       &Config{},
+		Metrics:   map[string]metric.Metric{},
+		startTime: time.Unix(0, 100),
+	}
+
+	h := func(below, above uint64) *metric.Histogram {
+		return &metric.Histogram{Bounds: []float64{1}, Counts: []uint64{below, above}, Count: below + above, Sum: float64(below + 2*above)}
+	}
+	a.saveData(NewHistogramData("Latency", h(1, 0)), NewHistogramData("Latency", h(1, 2)))
+	a.saveData(NewSummaryData("Size", &metric.Summary{Sum: 3, Count: 1}))
+	mList := a.takeMetrics()
+	require.Len(t, mList, 2)
+	got := map[string]metric.Metric{}
+	for _, m := range mList {
+		got[m.ID] = m
+	}
+	require.Equal(t, h(2, 2), got["Latency"].Histogram)
+	require.Equal(t, int64(4), *got["Latency"].Cumulative)
+	require.Equal(t, int64(100), got["Latency"].StartTime)
+	require.Equal(t, int64(1), *got["Size"].Cumulative)
+
+	// reported observations are not sent again
+	require.Empty(t, a.takeMetrics())
+
+	a.saveData(NewHistogramData("Latency", h(0, 1)))
+	mList = a.takeMetrics()
+	require.Len(t, mList, 1)
+	require.Equal(t, h(0, 1), mList[0].Histogram)
+	require.Equal(t, int64(5), *mList[0].Cumulative)
+}
+
+func TestAgentLabels(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	labels, err := agentLabels("service=api, dc = eu ")
+	require.NoError(t, err)
+	require.Equal(t, metric.Labels{"host": hostname, "service": "api", "dc": "eu"}, labels)
+
+	labels, err = agentLabels("host=web1")
+	require.NoError(t, err)
+	require.Equal(t, metric.Labels{"host": "web1"}, labels)
+
+	labels, err = agentLabels("host=")
+	require.NoError(t, err)
+	require.Nil(t, labels)
+
+	_, err = agentLabels("service")
+	require.Error(t, err)
+
+	_, err = agentLabels("service-name=api")
+	require.Error(t, err)
+
+	a := &GenericAgent{
+		Cfg:     &Config{},
+		Metrics: map[string]metric.Metric{},
+		labels:  metric.Labels{"host": "web1"},
+	}
+	a.saveData(NewGaugeData("Alloc", 1), NewCounterData("PollCount", 1))
+	for _, m := range a.takeMetrics() {
+		require.Equal(t, metric.Labels{"host": "web1"}, m.Labels)
+	}
+}
+
+func TestTakeMetricsSeriesLabels(t *testing.T) {
+	a := &GenericAgent{
+		Cfg:     &Config{},
+		Metrics: map[string]metric.Metric{},
+		labels:  metric.Labels{"host": "web1"},
+	}
+	eth0 := metric.Labels{"iface": "eth0"}
+	a.saveData(
+		NewCounterData("NetBytesSent", 10).WithLabels(eth0),
+		NewCounterData("NetBytesSent", 20).WithLabels(metric.Labels{"iface": "lo"}),
+		NewCounterData("NetBytesSent", 5).WithLabels(eth0),
+	)
+
+	got := map[string]int64{}
+	for _, m := range a.takeMetrics() {
+		require.Equal(t, "NetBytesSent", m.ID)
+		require.Equal(t, "web1", m.Labels["host"])
+		got[m.Labels["iface"]] = *m.Delta
+	}
+	require.Equal(t, map[string]int64{"eth0": 15, "lo": 20}, got)
+
+	a.saveData(NewCounterData("NetBytesSent", 1).WithLabels(eth0))
+	for _, m := range a.takeMetrics() {
+		if m.Labels["iface"] == "eth0" {
+			require.Equal(t, int64(1), *m.Delta)
+			require.Equal(t, int64(16), *m.Cumulative)
+		}
+	}
+}
+
+func TestAgentSourceHeaders(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	require.Equal(t, "web1", agentID("web1", "10.0.0.1"))
+	require.Equal(t, hostname, agentID("", "10.0.0.1"))
+
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	a := &HTTPAgent{
+		GenericAgent: &GenericAgent{
+			Cfg:          &Config{Address: srv.Listener.Addr().String(), Version: "v1.2.0", ReportInterval: 10 * time.Second},
+			Metrics:      map[string]metric.Metric{},
+			agentID:      "web1",
+			localAddress: "10.0.0.1",
+		},
+		client: &http.Client{},
+	}
+	mList := []metric.Metric{{ID: "Alloc", MType: gauge, Value: new(float64)}}
+	require.NoError(t, a.sendBulkData(context.Background(), &mList, "batch"))
+
+	h := <-headers
+	require.Equal(t, "web1", h.Get("X-Agent-ID"))
+	require.Equal(t, "10.0.0.1", h.Get("X-Real-Ip"))
+	require.Equal(t, "v1.2.0", h.Get("X-Agent-Version"))
+	require.Equal(t, "10s", h.Get("X-Report-Interval"))
+}
+
+func TestHTTPAgentHeartbeat(t *testing.T) {
+	paths := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	a := &HTTPAgent{
+		GenericAgent: &GenericAgent{
+			Cfg:     &Config{Address: srv.Listener.Addr().String()},
+			Metrics: map[string]metric.Metric{},
+			agentID: "web1",
+		},
+		client: &http.Client{},
+	}
+	doneChan := make(chan struct{}, 1)
+
+	// nothing to report
+	a.combineAndSend(context.Background(), doneChan, true)
+	<-doneChan
+	require.Equal(t, "/heartbeat/", <-paths)
+
+	a.saveData(NewGaugeData("Alloc", 1))
+	a.combineAndSend(context.Background(), doneChan, true)
+	<-doneChan
+	require.Equal(t, "/updates/", <-paths)
+}
+
+func TestSendBulkDataHashes(t *testing.T) {
+	const key = "secret"
+	bodies := make(chan []metric.Metric, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var mList []metric.Metric
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&mList))
+		bodies <- mList
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	a := &HTTPAgent{
+		GenericAgent: &GenericAgent{
+			Cfg:     &Config{Address: srv.Listener.Addr().String(), Key: key, SendMode: SendModeBatch, MaxBatchSize: 2},
+			Metrics: map[string]metric.Metric{},
+		},
+		client: &http.Client{},
+	}
+	delta := int64(3)
+	value := 1.5
+	a.sendMetrics(context.Background(), []metric.Metric{
+		{ID: "Alloc", MType: gauge, Value: &value},
+		{ID: "PollCount", MType: counter, Delta: &delta},
+		{ID: "Disk", MType: gauge, Value: &value, Labels: metric.Labels{"mount": "/"}},
+	}, a.sendData, a.sendBulkData)
+
+	for i := 0; i < 2; i++ {
+		for _, m := range <-bodies {
+			hash, err := hex.DecodeString(m.Hash)
+			require.NoError(t, err)
+			require.True(t, hmac.Equal(m.GenerateHash(key), hash), "metric %s is not signed", m.SeriesKey())
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// Names of agent self-metrics exposed to Prometheus.
+const (
+	promSendFailures    = "agent_send_failures_total"
+	promLastSuccessful  = "agent_last_successful_report_timestamp_seconds"
+	promCollectorErrors = "agent_collector_errors_total"
+)
+
+// sendStats keeps agent self-metrics about reports to server.
+type sendStats struct {
+	failures       int64
+	lastSuccessful time.Time
+}
+
+// recordSend updates self-metrics with result of a request to server.
+func (a *GenericAgent) recordSend(err error) {
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	if err != nil {
+		a.stats.failures++
+		return
+	}
+	a.stats.lastSuccessful = time.Now()
+}
+
+func (a *GenericAgent) sendStats() sendStats {
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	return a.stats
+}
+
+// promName turns metric ID into a valid Prometheus metric name.
+func promName(id string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, id)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// promFamily identifies metrics exposed under one Prometheus name: series of a metric ID with the same type.
+type promFamily struct {
+	id    string
+	mType string
+}
+
+// promNames assigns unique Prometheus names to metric families. Families which turn into the same name,
+// like "a.b" and "a_b" or a gauge and a counter with one ID, are told apart by a numeric suffix.
+// A family whose ID is a valid name already keeps it. Names in reserved are not assigned.
+func promNames(families []promFamily, reserved ...string) map[promFamily]string {
+	sort.Slice(families, func(i, j int) bool {
+		fi, fj := families[i], families[j]
+		vi, vj := promName(fi.id) == fi.id, promName(fj.id) == fj.id
+		if vi != vj {
+			return vi
+		}
+		if fi.id != fj.id {
+			return fi.id < fj.id
+		}
+		return fi.mType < fj.mType
+	})
+
+	taken := make(map[string]bool, len(families)+len(reserved))
+	for _, name := range reserved {
+		taken[name] = true
+	}
+	res := make(map[promFamily]string, len(families))
+	for _, f := range families {
+		name := promName(f.id)
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s_%d", promName(f.id), i)
+		}
+		taken[name] = true
+		res[f] = name
+	}
+	return res
+}
+
+// promLabels renders labels of a series in Prometheus format. Empty set gives an empty string.
+func promLabels(labels metric.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", promName(name), labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writePromMetric(buf *bytes.Buffer, name, mType string, samples ...string) {
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, mType)
+	for _, s := range samples {
+		fmt.Fprintf(buf, "%s%s\n", name, s)
+	}
+}
+
+// PrometheusMetrics renders current metrics and agent self-metrics in Prometheus text exposition format.
+// Counters are exposed as totals since the agent start. Series of a metric are exposed under one name with their labels.
+// Self-metric names are reserved, see promNames for names of metrics which clash after sanitising.
+func (a *GenericAgent) PrometheusMetrics() []byte {
+	var buf bytes.Buffer
+
+	a.RLock()
+	ids := make([]string, 0, len(a.Metrics))
+	for id := range a.Metrics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var families []promFamily
+	samples := map[promFamily][]string{}
+	for _, id := range ids {
+		m := a.Metrics[id]
+		var sample string
+		switch m.MType {
+		case gauge:
+			sample = promLabels(m.Labels) + " " + promValue(*m.Value)
+		case counter:
+			sample = promLabels(m.Labels) + " " + strconv.FormatInt(a.counterTotals[id], 10)
+		default:
+			continue
+		}
+		f := promFamily{id: m.ID, mType: m.MType}
+		if _, ok := samples[f]; !ok {
+			families = append(families, f)
+		}
+		samples[f] = append(samples[f], sample)
+	}
+	a.RUnlock()
+
+	names := promNames(families, promSendFailures, promLastSuccessful, promCollectorErrors)
+	sort.Slice(families, func(i, j int) bool {
+		return names[families[i]] < names[families[j]]
+	})
+	for _, f := range families {
+		writePromMetric(&buf, names[f], f.mType, samples[f]...)
+	}
+
+	stats := a.sendStats()
+	writePromMetric(&buf, promSendFailures, "counter", " "+strconv.FormatInt(stats.failures, 10))
+	var lastSuccessful float64
+	if !stats.lastSuccessful.IsZero() {
+		lastSuccessful = float64(stats.lastSuccessful.UnixNano()) / float64(time.Second)
+	}
+	writePromMetric(&buf, promLastSuccessful, "gauge", " "+promValue(lastSuccessful))
+
+	statuses := a.CollectorsStatus()
+	if len(statuses) > 0 {
+		samples := make([]string, 0, len(statuses))
+		for _, s := range statuses {
+			samples = append(samples, fmt.Sprintf("{collector=%q} %d", s.Name, s.Errors))
+		}
+		writePromMetric(&buf, promCollectorErrors, "counter", samples...)
+	}
+
+	return buf.Bytes()
+}
+
+// PrometheusHandler serves metrics for Prometheus scrapes.
+// URI: "/metrics".
+func (a *GenericAgent) PrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := w.Write(a.PrometheusMetrics())
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// ServePrometheus exposes /metrics endpoint until ctx is canceled.
+func (a *GenericAgent) ServePrometheus(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.PrometheusHandler)
+
+	srv := &http.Server{
+		Addr:              a.Cfg.PromAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		err := srv.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Printf("Serving Prometheus metrics on: %s", a.Cfg.PromAddress)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("Prometheus endpoint failed: %s", err)
+	}
+}
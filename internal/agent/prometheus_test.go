@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	a := &GenericAgent{
+		Cfg:     &Config{},
+		Metrics: map[string]metric.Metric{},
+	}
+	a.saveData(NewGaugeData("Alloc", 1.5), NewCounterData("PollCount", 2), NewGaugeData("Disk.Used", 3))
+	a.saveData(
+		NewGaugeData("CPUutilization", 10).WithLabels(metric.Labels{"core": "0"}),
+		NewGaugeData("CPUutilization", 20).WithLabels(metric.Labels{"core": "1"}),
+	)
+	a.takeMetrics()
+	a.saveData(NewCounterData("PollCount", 3))
+	a.recordSend(errors.New("server is down"))
+
+	w := httptest.NewRecorder()
+	a.PrometheusHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	res := w.Result()
+	defer func() {
+		assert.NoError(t, res.Body.Close())
+	}()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE Alloc gauge\nAlloc 1.5\n")
+	assert.Contains(t, body, "# TYPE PollCount counter\nPollCount 5\n")
+	assert.Contains(t, body, "# TYPE Disk_Used gauge\nDisk_Used 3\n")
+	assert.Contains(t, body, "# TYPE CPUutilization gauge\nCPUutilization{core=\"0\"} 10\nCPUutilization{core=\"1\"} 20\n")
+	assert.Contains(t, body, "agent_send_failures_total 1\n")
+	assert.Contains(t, body, "agent_last_successful_report_timestamp_seconds 0\n")
+}
+
+func TestPrometheusNameCollisions(t *testing.T) {
+	a := &GenericAgent{
+		Cfg:     &Config{},
+		Metrics: map[string]metric.Metric{},
+	}
+	a.saveData(
+		NewGaugeData("a.b", 1),
+		NewGaugeData("a_b", 2),
+		NewGaugeData("Jobs", 3).WithLabels(metric.Labels{"queue": "mail"}),
+		NewCounterData("Jobs", 4).WithLabels(metric.Labels{"queue": "sms"}),
+		NewGaugeData("agent.send.failures.total", 5),
+	)
+
+	body := string(a.PrometheusMetrics())
+	assert.Contains(t, body, "# TYPE a_b gauge\na_b 2\n")
+	assert.Contains(t, body, "# TYPE a_b_2 gauge\na_b_2 1\n")
+	assert.Contains(t, body, "# TYPE Jobs counter\nJobs{queue=\"sms\"} 4\n")
+	assert.Contains(t, body, "# TYPE Jobs_2 gauge\nJobs_2{queue=\"mail\"} 3\n")
+	assert.Contains(t, body, "# TYPE agent_send_failures_total_2 gauge\nagent_send_failures_total_2 5\n")
+	assert.Equal(t, 1, strings.Count(body, "# TYPE agent_send_failures_total counter\n"))
+}
@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	backoffMultiplier = 2
+	backoffJitter     = 0.2
+)
+
+// ErrCircuitOpen is returned without calling server while circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open: server is unavailable")
+
+// RetryPolicy describes how agent retries requests to server.
+type RetryPolicy struct {
+	// MaxAttempts is a number of attempts per request including the first one.
+	MaxAttempts int
+	// InitialBackoff is a delay before the first retry. Next delays grow exponentially up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RequestTimeout limits each attempt. Zero means no limit.
+	RequestTimeout time.Duration
+	// BreakerThreshold is a number of consecutive failed requests which opens circuit breaker. Zero disables breaker.
+	BreakerThreshold int
+	// BreakerTimeout is a time circuit breaker stays open before a probe request is let through.
+	BreakerTimeout time.Duration
+}
+
+// backoff returns delay before the retry following the attempt. Delay is randomized by jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(backoffMultiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d *= 1 + backoffJitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops requests to server after several consecutive failures.
+// After timeout one probe request is allowed: its success closes the breaker, its failure opens it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	timeout   time.Duration
+	failures  int
+	state     breakerState
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, timeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, timeout: timeout}
+}
+
+// allow reports whether a request may be sent now.
+func (b *circuitBreaker) allow() bool {
+	if b == nil || b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) success() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+func (b *circuitBreaker) failure() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// retrier sends requests according to RetryPolicy and shares circuit breaker between them.
+type retrier struct {
+	policy  RetryPolicy
+	breaker *circuitBreaker
+}
+
+func newRetrier(policy RetryPolicy) *retrier {
+	return &retrier{
+		policy:  policy,
+		breaker: newCircuitBreaker(policy.BreakerThreshold, policy.BreakerTimeout),
+	}
+}
+
+// do calls fn until it succeeds, fails with non-retryable error, attempts are exhausted or ctx is done.
+// Nil retrier calls fn once.
+func (r *retrier) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if r == nil {
+		return fn(ctx)
+	}
+	if !r.breaker.allow() {
+		return ErrCircuitOpen
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := r.attempt(ctx, fn)
+		if err == nil {
+			r.breaker.success()
+			return nil
+		}
+		if !isRetryable(err) {
+			// server is alive, it just rejected the request
+			r.breaker.success()
+			return err
+		}
+		if attempt >= r.policy.MaxAttempts || ctx.Err() != nil {
+			r.breaker.failure()
+			return err
+		}
+
+		timer := time.NewTimer(r.policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			r.breaker.failure()
+			return err
+		}
+	}
+}
+
+func (r *retrier) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if r.policy.RequestTimeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.policy.RequestTimeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// isRetryable reports whether a failed request may succeed if repeated:
+// network errors, timeouts, HTTP 5xx and unavailable gRPC server are retryable,
+// HTTP 4xx and rejections by server (e.g. hash validation) are not.
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+
+	var rejectErr *GRPCRequestError
+	if errors.As(err, &rejectErr) {
+		return false
+	}
+
+	if s, ok := status.FromError(err); ok && s.Code() != codes.OK && s.Code() != codes.Unknown {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// isRejected reports whether server has refused a request, so sending it again is pointless:
+// HTTP 4xx, errors reported by gRPC server in response and InvalidArgument, FailedPrecondition
+// or PermissionDenied gRPC statuses. Local errors (marshaling, encryption, hashing), open circuit
+// breaker and cancellation are not rejections.
+func isRejected(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 400 && statusErr.Code < 500
+	}
+
+	var rejectErr *GRPCRequestError
+	if errors.As(err, &rejectErr) {
+		return true
+	}
+
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.InvalidArgument, codes.FailedPrecondition, codes.PermissionDenied:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:      3,
+		InitialBackoff:   time.Millisecond,
+		MaxBackoff:       5 * time.Millisecond,
+		RequestTimeout:   time.Second,
+		BreakerThreshold: 2,
+		BreakerTimeout:   50 * time.Millisecond,
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "HTTP 503", err: NewStatusError(http.StatusServiceUnavailable), want: true},
+		{name: "HTTP 400", err: NewStatusError(http.StatusBadRequest), want: false},
+		{name: "hash rejected", err: NewGRPCRequestError("hash mismatch"), want: false},
+		{name: "gRPC unavailable", err: status.Error(codes.Unavailable, "down"), want: true},
+		{name: "gRPC invalid argument", err: status.Error(codes.InvalidArgument, "bad"), want: false},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "other", err: errors.New("marshal failed"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryable(tt.err))
+		})
+	}
+}
+
+func TestIsRejected(t *testing.T) {
+	assert.True(t, isRejected(NewStatusError(http.StatusBadRequest)))
+	assert.True(t, isRejected(NewGRPCRequestError("hash mismatch")))
+	assert.False(t, isRejected(nil))
+	assert.False(t, isRejected(NewStatusError(http.StatusServiceUnavailable)))
+	assert.False(t, isRejected(ErrCircuitOpen))
+	assert.False(t, isRejected(context.Canceled))
+	assert.True(t, isRejected(status.Error(codes.InvalidArgument, "bad metric")))
+	assert.False(t, isRejected(status.Error(codes.Internal, "internal error")))
+	assert.False(t, isRejected(errors.New("crypto/rsa: message too long for RSA key size")))
+	assert.False(t, isRejected(fmt.Errorf("marshal metrics: %w", errors.New("unsupported value"))))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+
+	assert.InDelta(t, 100*time.Millisecond, p.backoff(1), float64(20*time.Millisecond))
+	assert.InDelta(t, 200*time.Millisecond, p.backoff(2), float64(40*time.Millisecond))
+	assert.InDelta(t, 300*time.Millisecond, p.backoff(5), float64(60*time.Millisecond))
+}
+
+func TestRetrierRetriesUntilSuccess(t *testing.T) {
+	r := newRetrier(testRetryPolicy())
+	var calls int
+	err := r.do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return NewStatusError(http.StatusBadGateway)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetrierStopsOnPermanentError(t *testing.T) {
+	r := newRetrier(testRetryPolicy())
+	var calls int
+	err := r.do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return NewStatusError(http.StatusBadRequest)
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetrierCircuitBreaker(t *testing.T) {
+	r := newRetrier(testRetryPolicy())
+	var calls int
+	failing := func(ctx context.Context) error {
+		calls++
+		return NewStatusError(http.StatusInternalServerError)
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Error(t, r.do(context.Background(), failing))
+	}
+	assert.Equal(t, 6, calls)
+
+	err := r.do(context.Background(), failing)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 6, calls)
+
+	time.Sleep(60 * time.Millisecond)
+	err = r.do(context.Background(), func(ctx context.Context) error { return nil })
+	require.NoError(t, err)
+	require.NoError(t, r.do(context.Background(), func(ctx context.Context) error { return nil }))
+}
+
+func TestHTTPAgentRetriesServerErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	a := &HTTPAgent{
+		GenericAgent: &GenericAgent{
+			Cfg:     &Config{Address: srv.Listener.Addr().String()},
+			Metrics: map[string]metric.Metric{},
+			retrier: newRetrier(testRetryPolicy()),
+		},
+		client: &http.Client{},
+	}
+	a.saveData(NewGaugeData("Alloc", 1))
+
+	doneChan := make(chan struct{}, 1)
+	a.combineAndSend(context.Background(), doneChan, true)
+	<-doneChan
+
+	// failed batch and its retry
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(0), a.sendStats().failures)
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/rs/xid"
+)
+
+const (
+	spoolFileExt = ".batch"
+	// tmpFileExt is an extension of a file which is being written by writeFileSync.
+	tmpFileExt = ".tmp"
+)
+
+// spoolBatch is a batch of metrics persisted in spool.
+type spoolBatch struct {
+	ID      string          `json:"id"`
+	Created time.Time       `json:"created"`
+	Metrics []metric.Metric `json:"metrics"`
+}
+
+// spoolEntry describes a spool file.
+type spoolEntry struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// Spool is a bounded on-disk queue of metric batches which are not delivered to server yet.
+// Batches are written before the first send attempt and removed only after server accepts them,
+// so they survive server outages and agent restarts. Each batch keeps its ID, so server can skip
+// a batch which is replayed after it has been already applied.
+type Spool struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	entries []spoolEntry
+	size    int64
+	nextSeq uint64
+}
+
+// NewSpool opens spool in dir. Batches left by previous runs are queued for replay.
+// Zero maxSize or maxAge means no limit.
+func NewSpool(dir string, maxSize int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), spoolFileExt+tmpFileExt) {
+			// the batch was being written when the agent stopped, it has never been queued
+			if err = os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.entries = append(s.entries, spoolEntry{seq: seq, path: filepath.Join(dir, f.Name()), size: info.Size()})
+		s.size += info.Size()
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+	if len(s.entries) > 0 {
+		s.nextSeq = s.entries[len(s.entries)-1].seq + 1
+		log.Printf("Found %d unsent batches in spool %s", len(s.entries), dir)
+	}
+
+	return s, nil
+}
+
+// Len returns number of batches in spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Append persists a batch. The oldest batches are dropped if spool exceeds its maximum size.
+func (s *Spool) Append(mList []metric.Metric) error {
+	b, err := json.Marshal(spoolBatch{
+		ID:      xid.New().String(),
+		Created: time.Now(),
+		Metrics: mList,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.nextSeq
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolFileExt))
+	if err = writeFileSync(path, b); err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.entries = append(s.entries, spoolEntry{seq: seq, path: path, size: int64(len(b))})
+	s.size += int64(len(b))
+
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.entries) > 1 {
+		log.Printf("Spool exceeds %d bytes, dropping the oldest batch", s.maxSize)
+		if err = s.removeFirst(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay sends spooled batches in order and removes the accepted ones.
+// Batches older than maximum age and batches rejected by server are dropped, see isRejected.
+// Replay stops at the first batch which has failed for other reasons, e.g. server is unavailable.
+func (s *Spool) Replay(send func(batchID string, mList []metric.Metric) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.entries) > 0 {
+		b, err := os.ReadFile(s.entries[0].path)
+		if err != nil {
+			return err
+		}
+
+		var batch spoolBatch
+		if err = json.Unmarshal(b, &batch); err != nil {
+			log.Printf("Dropping corrupted spool batch %s: %s", s.entries[0].path, err)
+			if err = s.removeFirst(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if s.maxAge > 0 && time.Since(batch.Created) > s.maxAge {
+			log.Printf("Dropping spool batch %s created at %s: older than %s", batch.ID, batch.Created, s.maxAge)
+			if err = s.removeFirst(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = send(batch.ID, batch.Metrics); err != nil && !isRejected(err) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Dropping spool batch %s rejected by server: %s", batch.ID, err)
+		}
+		if err = s.removeFirst(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Spool) removeFirst() error {
+	e := s.entries[0]
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.entries = s.entries[1:]
+	s.size -= e.size
+	return nil
+}
+
+// writeFileSync writes file atomically: data is synced to a temporary file which is renamed then.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + tmpFileExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		closeErr := f.Close()
+		if closeErr != nil {
+			log.Print(closeErr)
+		}
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		closeErr := f.Close()
+		if closeErr != nil {
+			log.Print(closeErr)
+		}
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func counterMetric(id string, delta int64) metric.Metric {
+	return metric.Metric{ID: id, MType: counter, Delta: &delta}
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 1)}))
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 2)}))
+
+	// server is down: nothing is removed
+	err = s.Replay(func(batchID string, mList []metric.Metric) error {
+		return status.Error(codes.Unavailable, "connection refused")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, s.Len())
+
+	// agent restarts
+	s, err = NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 3)}))
+
+	var got []int64
+	ids := map[string]bool{}
+	err = s.Replay(func(batchID string, mList []metric.Metric) error {
+		ids[batchID] = true
+		got = append(got, *mList[0].Delta)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, got)
+	assert.Len(t, ids, 3)
+	assert.Equal(t, 0, s.Len())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpoolLimits(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 1, time.Hour)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 1)}))
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 2)}))
+	assert.Equal(t, 1, s.Len())
+
+	var got []int64
+	err = s.Replay(func(batchID string, mList []metric.Metric) error {
+		got = append(got, *mList[0].Delta)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{2}, got)
+
+	s.maxAge = time.Nanosecond
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 3)}))
+	time.Sleep(time.Millisecond)
+	err = s.Replay(func(batchID string, mList []metric.Metric) error {
+		t.Fatal("expired batch must not be sent")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSpoolSkipsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("hi"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000007.batch"), []byte("{broken"), 0600))
+
+	s, err := NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, s.Len())
+
+	require.NoError(t, s.Replay(func(batchID string, mList []metric.Metric) error { return nil }))
+	assert.Equal(t, 0, s.Len())
+	assert.Equal(t, uint64(8), s.nextSeq)
+}
+
+func TestSpoolDropsRejectedBatches(t *testing.T) {
+	s, err := NewSpool(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("Poison", 1)}))
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 2)}))
+	require.NoError(t, s.Append([]metric.Metric{counterMetric("PollCount", 3)}))
+
+	var got []int64
+	send := func(batchID string, mList []metric.Metric) error {
+		if mList[0].ID == "Poison" {
+			return NewGRPCRequestError("hash validation error")
+		}
+		got = append(got, *mList[0].Delta)
+		return nil
+	}
+
+	// batches are kept while circuit breaker is open
+	require.ErrorIs(t, s.Replay(func(batchID string, mList []metric.Metric) error { return ErrCircuitOpen }), ErrCircuitOpen)
+	assert.Equal(t, 3, s.Len())
+
+	// batches are kept on local errors
+	localErr := errors.New("crypto/rsa: message too long for RSA key size")
+	require.ErrorIs(t, s.Replay(func(batchID string, mList []metric.Metric) error { return localErr }), localErr)
+	assert.Equal(t, 3, s.Len())
+
+	require.NoError(t, s.Replay(send))
+	assert.Equal(t, []int64{2, 3}, got)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSpoolRemovesUnfinishedWrites(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "00000000000000000003.batch.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte(`{"id": "half`), 0600))
+
+	s, err := NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, s.Len())
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,340 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+const statsdMaxPacketSize = 65535
+
+// statsdQuantiles are reported for timers along with their count and sum. The first and the last ones are min and max.
+var statsdQuantiles = []float64{0, 0.5, 0.9, 0.99, 1}
+
+// StatsDListener receives StatsD metrics over UDP and aggregates them between report ticks.
+// Supported types are counters (c), gauges (g), timers (ms), histograms (h) and sets (s).
+// Timers and histograms are both reported as summaries.
+// Tags in DogStatsD format, e.g. "|#queue:mail", are reported as labels of the series.
+type StatsDListener struct {
+	mu       sync.Mutex
+	conn     net.PacketConn
+	counters map[string]*statsdCounter
+	gauges   map[string]*statsdGauge
+	timers   map[string]*statsdTimer
+	sets     map[string]*statsdSet
+	rejected int64
+}
+
+// statsdSeries identifies a series: metric name and labels from tags.
+type statsdSeries struct {
+	name   string
+	labels metric.Labels
+}
+
+// statsdCounter is a counter increment not reported yet.
+type statsdCounter struct {
+	statsdSeries
+	value   float64
+	updated bool
+}
+
+// statsdGauge is the last value of a gauge. Gauges are kept between flushes as a base for relative updates.
+type statsdGauge struct {
+	statsdSeries
+	value   float64
+	updated bool
+}
+
+// statsdTimer keeps timings received since the previous flush. Count and sum are scaled by sample rate,
+// a fractional part of the count is kept until the next flush.
+type statsdTimer struct {
+	statsdSeries
+	values []float64
+	count  float64
+	sum    float64
+}
+
+// statsdSet keeps unique values received since the previous flush.
+type statsdSet struct {
+	statsdSeries
+	values map[string]struct{}
+}
+
+// NewStatsDListener binds UDP socket on address.
+func NewStatsDListener(address string) (*StatsDListener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsDListener{
+		conn:     conn,
+		counters: map[string]*statsdCounter{},
+		gauges:   map[string]*statsdGauge{},
+		timers:   map[string]*statsdTimer{},
+		sets:     map[string]*statsdSet{},
+	}, nil
+}
+
+// Addr returns address the listener is bound to.
+func (l *StatsDListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Listen reads packets until ctx is canceled.
+func (l *StatsDListener) Listen(ctx context.Context) {
+	log.Printf("Listening StatsD on: %s", l.conn.LocalAddr())
+
+	go func() {
+		<-ctx.Done()
+		err := l.conn.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	buf := make([]byte, statsdMaxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				log.Println("StatsD listener has been canceled successfully.")
+				return
+			}
+			log.Printf("statsd: %s", err)
+			continue
+		}
+		l.handlePacket(buf[:n])
+	}
+}
+
+func (l *StatsDListener) handlePacket(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := l.handleLine(line); err != nil {
+			log.Printf("statsd: bad line '%s': %s", line, err)
+			l.mu.Lock()
+			l.rejected++
+			l.mu.Unlock()
+		}
+	}
+}
+
+// parseStatsDTags parses "k1:v1,k2:v2" tags into labels.
+func parseStatsDTags(tags string) (metric.Labels, error) {
+	labels := metric.Labels{}
+	for _, tag := range strings.Split(tags, ",") {
+		k, v, ok := strings.Cut(tag, ":")
+		if !ok {
+			return nil, fmt.Errorf("tag '%s' has no value", tag)
+		}
+		labels[k] = v
+	}
+	return labels, labels.Validate()
+}
+
+// parseStatsDValue parses a finite value of a line.
+func parseStatsDValue(value string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("value '%s' is not finite", value)
+	}
+	return v, nil
+}
+
+// handleLine parses "name:value|type[|@rate][|#tags]" line and aggregates the value.
+func (l *StatsDListener) handleLine(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("no metric name")
+	}
+	if err := metric.ValidateID(name); err != nil {
+		return err
+	}
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return errors.New("no metric type")
+	}
+	value, mType := parts[0], parts[1]
+
+	rate := 1.0
+	var labels metric.Labels
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			r, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("bad sample rate '%s'", p)
+			}
+			rate = r
+		case strings.HasPrefix(p, "#"):
+			var err error
+			if labels, err = parseStatsDTags(p[1:]); err != nil {
+				return err
+			}
+		}
+	}
+	series := statsdSeries{name: name, labels: labels}
+	key := metric.SeriesKey(name, labels)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch mType {
+	case "c":
+		v, err := parseStatsDValue(value)
+		if err != nil {
+			return err
+		}
+		// server keeps counter totals which never decrease
+		if v < 0 {
+			return errors.New("negative counter increment")
+		}
+		return l.addCount(key, series, v/rate)
+	case "g":
+		v, err := parseStatsDValue(value)
+		if err != nil {
+			return err
+		}
+		g, ok := l.gauges[key]
+		if !ok {
+			g = &statsdGauge{statsdSeries: series}
+			l.gauges[key] = g
+		}
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			v += g.value
+		}
+		g.value = v
+		g.updated = true
+	case "ms", "h":
+		v, err := parseStatsDValue(value)
+		if err != nil {
+			return err
+		}
+		t, ok := l.timers[key]
+		if !ok {
+			t = &statsdTimer{statsdSeries: series}
+			l.timers[key] = t
+		}
+		t.values = append(t.values, v)
+		// a sampled timing stands for 1/rate timings, the same way as a sampled counter increment
+		t.count += 1 / rate
+		t.sum += v / rate
+	case "s":
+		set, ok := l.sets[key]
+		if !ok {
+			set = &statsdSet{statsdSeries: series, values: map[string]struct{}{}}
+			l.sets[key] = set
+		}
+		set.values[value] = struct{}{}
+	default:
+		return fmt.Errorf("unknown metric type '%s'", mType)
+	}
+	return nil
+}
+
+// addCount adds increment v to counter series key. An increment which would make
+// the counter overflow int64 before the next flush is rejected.
+func (l *StatsDListener) addCount(key string, series statsdSeries, v float64) error {
+	c, ok := l.counters[key]
+	if !ok {
+		c = &statsdCounter{statsdSeries: series}
+	}
+	if c.value+v >= math.MaxInt64 {
+		return fmt.Errorf("counter %s overflows", key)
+	}
+	l.counters[key] = c
+	c.value += v
+	c.updated = true
+	return nil
+}
+
+// Flush returns values aggregated since the previous flush.
+// Counters are reported as increments, fractional parts are carried over to the next flush
+// of counters which keep receiving values, others are forgotten. Timers are reported as summaries
+// of received timings, fractional parts of their counts are carried over the same way. Sets are reported as number of unique values. Number of rejected lines is reported as StatsDRejectedLines counter.
+func (l *StatsDListener) Flush() []Data {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var data []Data
+	for key, c := range l.counters {
+		delta := math.Trunc(c.value)
+		if delta != 0 {
+			data = append(data, NewCounterData(c.name, int64(delta)).WithLabels(c.labels))
+		}
+		c.value -= delta
+		if c.value == 0 || !c.updated {
+			delete(l.counters, key)
+		}
+		c.updated = false
+	}
+
+	for _, g := range l.gauges {
+		if g.updated {
+			data = append(data, NewGaugeData(g.name, g.value).WithLabels(g.labels))
+			g.updated = false
+		}
+	}
+
+	for key, t := range l.timers {
+		if len(t.values) == 0 {
+			delete(l.timers, key)
+			continue
+		}
+		count := math.Trunc(t.count)
+		data = append(data, NewSummaryData(t.name, timerSummary(t.values, t.sum, uint64(count))).WithLabels(t.labels))
+		t.count -= count
+		if t.count == 0 {
+			delete(l.timers, key)
+		}
+		t.values, t.sum = nil, 0
+	}
+
+	for _, set := range l.sets {
+		data = append(data, NewGaugeData(set.name, float64(len(set.values))).WithLabels(set.labels))
+	}
+	l.sets = map[string]*statsdSet{}
+
+	if l.rejected > 0 {
+		data = append(data, NewCounterData("StatsDRejectedLines", l.rejected))
+		l.rejected = 0
+	}
+
+	return data
+}
+
+// timerSummary returns a summary of timings with quantiles of received values.
+func timerSummary(values []float64, sum float64, count uint64) *metric.Summary {
+	sort.Float64s(values)
+
+	quantiles := make([]metric.Quantile, 0, len(statsdQuantiles))
+	for _, q := range statsdQuantiles {
+		idx := int(math.Ceil(q*float64(len(values)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		quantiles = append(quantiles, metric.Quantile{Quantile: q, Value: values[idx]})
+	}
+	return &metric.Summary{
+		Quantiles: quantiles,
+		Sum:       sum,
+		Count:     count,
+	}
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func flushToMap(l *StatsDListener) map[string]Data {
+	got := map[string]Data{}
+	for _, d := range l.Flush() {
+		got[metric.SeriesKey(d.name, d.labels)] = d
+	}
+	return got
+}
+
+func TestStatsDListenerAggregation(t *testing.T) {
+	l, err := NewStatsDListener("127.0.0.1:0")
+	require.NoError(t, err)
+
+	l.handlePacket([]byte("requests:1|c\nrequests:2|c\nsampled:1|c|@0.5\n" +
+		"queue:10|g\nqueue:-3|g\n" +
+		"latency:10|ms\nlatency:30|h\nlatency:20|ms\n" +
+		"users:alice|s\nusers:bob|s\nusers:alice|s\n" +
+		"broken\nbad:1|x\n"))
+
+	got := flushToMap(l)
+	assert.Equal(t, NewCounterData("requests", 3), got["requests"])
+	assert.Equal(t, NewCounterData("sampled", 2), got["sampled"])
+	assert.Equal(t, NewGaugeData("queue", 7), got["queue"])
+	assert.Equal(t, NewSummaryData("latency", &metric.Summary{
+		Quantiles: []metric.Quantile{{Quantile: 0, Value: 10}, {Quantile: 0.5, Value: 20}, {Quantile: 0.9, Value: 30}, {Quantile: 0.99, Value: 30}, {Quantile: 1, Value: 30}},
+		Sum:       60,
+		Count:     3,
+	}), got["latency"])
+	assert.Equal(t, NewGaugeData("users", 2), got["users"])
+	assert.Equal(t, NewCounterData("StatsDRejectedLines", 2), got["StatsDRejectedLines"])
+
+	// nothing new since the previous flush
+	assert.Empty(t, flushToMap(l))
+
+	l.handlePacket([]byte("queue:+1|g"))
+	assert.Equal(t, NewGaugeData("queue", 8), flushToMap(l)["queue"])
+}
+
+func TestStatsDListenerNegativeCounter(t *testing.T) {
+	l, err := NewStatsDListener("127.0.0.1:0")
+	require.NoError(t, err)
+
+	// a decrement would make the cumulative total sent to server go back and lose later increments
+	l.handlePacket([]byte("jobs:-3|c\n"))
+	assert.NotContains(t, flushToMap(l), "jobs")
+
+	l.handlePacket([]byte("jobs:5|c\n"))
+	assert.Equal(t, NewCounterData("jobs", 5), flushToMap(l)["jobs"])
+}
+
+func TestStatsDListenerTags(t *testing.T) {
+	l, err := NewStatsDListener("127.0.0.1:0")
+	require.NoError(t, err)
+
+	l.handlePacket([]byte("jobs:1|c|#queue:mail\njobs:2|c|#queue:sms\nlatency:10|ms|@0.5|#queue:mail\n" +
+		"bad{x:1|c\njobs:1|c|#bad-tag:x\njobs:1|c|#novalue\n"))
+	got := flushToMap(l)
+	assert.Equal(t, NewCounterData("jobs", 1).WithLabels(metric.Labels{"queue": "mail"}), got[`jobs{queue="mail"}`])
+	assert.Equal(t, NewCounterData("jobs", 2).WithLabels(metric.Labels{"queue": "sms"}), got[`jobs{queue="sms"}`])
+	assert.Equal(t, uint64(2), got[`latency{queue="mail"}`].summary.Count)
+	assert.Equal(t, metric.Labels{"queue": "mail"}, got[`latency{queue="mail"}`].labels)
+	assert.Equal(t, NewCounterData("StatsDRejectedLines", 3), got["StatsDRejectedLines"])
+	assert.Len(t, got, 4)
+}
+
+func TestStatsDListenerCounterLimits(t *testing.T) {
+	l, err := NewStatsDListener("127.0.0.1:0")
+	require.NoError(t, err)
+
+	l.handlePacket([]byte("huge:1e300|c\nhuge:5e18|c\nhuge:5e18|c\nnan:NaN|c\n"))
+	got := flushToMap(l)
+	assert.Equal(t, NewCounterData("huge", 5e18), got["huge"])
+	assert.Equal(t, NewCounterData("StatsDRejectedLines", 3), got["StatsDRejectedLines"])
+
+	// a fraction is carried over while the counter is active, then the counter is forgotten
+	l.handlePacket([]byte("sampled:1|c|@0.4\n"))
+	assert.Equal(t, NewCounterData("sampled", 2), flushToMap(l)["sampled"])
+	assert.Contains(t, l.counters, "sampled")
+	assert.Empty(t, flushToMap(l))
+	assert.Empty(t, l.counters)
+}
+
+func TestStatsDListenerSampledTimers(t *testing.T) {
+	l, err := NewStatsDListener("127.0.0.1:0")
+	require.NoError(t, err)
+
+	l.handlePacket([]byte("latency:10|ms|@0.5\nlatency:30|ms|@0.5\nlatency:20|ms|@0.1\n"))
+	s := flushToMap(l)["latency"].summary
+	require.NotNil(t, s)
+	assert.Equal(t, uint64(14), s.Count)
+	assert.InDelta(t, 280, s.Sum, 1e-9)
+
+	// fractional counts are carried over like those of counters
+	l.handlePacket([]byte("latency:10|ms|@0.4\n"))
+	assert.Equal(t, uint64(2), flushToMap(l)["latency"].summary.Count)
+	l.handlePacket([]byte("latency:10|ms|@0.4\n"))
+	assert.Equal(t, uint64(3), flushToMap(l)["latency"].summary.Count)
+	assert.Empty(t, flushToMap(l))
+	assert.Empty(t, l.timers)
+}
+
+func TestStatsDListenerListen(t *testing.T) {
+	l, err := NewStatsDListener("127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Listen(ctx)
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+
+	_, err = conn.Write([]byte("hits:5|c"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		c, ok := l.counters["hits"]
+		return ok && c.value == 5
+	}, time.Second, 10*time.Millisecond)
+}
@@ -27,7 +27,13 @@ type MetricsAgentClient interface {
 	UpdateMetrics(ctx context.Context, in *UpdateMetricsRequest, opts ...grpc.CallOption) (*UpdateMetricsResponse, error)
 	CheckStorageStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	GetMetric(ctx context.Context, in *GetMetricRequest, opts ...grpc.CallOption) (*GetMetricResponse, error)
-	GetAllMetrics(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetAllMetricsResponse, error)
+	GetAllMetrics(ctx context.Context, in *GetAllMetricsRequest, opts ...grpc.CallOption) (*GetAllMetricsResponse, error)
+	QueryRange(ctx context.Context, in *QueryRangeRequest, opts ...grpc.CallOption) (*QueryRangeResponse, error)
+	Heartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ListAgents(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListAgentsResponse, error)
+	ListAlerts(ctx context.Context, in *ListAlertsRequest, opts ...grpc.CallOption) (*ListAlertsResponse, error)
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (MetricsAgent_SubscribeClient, error)
+	StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (MetricsAgent_StreamMetricsClient, error)
 }
 
 type metricsAgentClient struct {
@@ -74,7 +80,7 @@ func (c *metricsAgentClient) GetMetric(ctx context.Context, in *GetMetricRequest
 	return out, nil
 }
 
-func (c *metricsAgentClient) GetAllMetrics(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetAllMetricsResponse, error) {
+func (c *metricsAgentClient) GetAllMetrics(ctx context.Context, in *GetAllMetricsRequest, opts ...grpc.CallOption) (*GetAllMetricsResponse, error) {
 	out := new(GetAllMetricsResponse)
 	err := c.cc.Invoke(ctx, "/go_devops_advanced.MetricsAgent/GetAllMetrics", in, out, opts...)
 	if err != nil {
@@ -83,6 +89,105 @@ func (c *metricsAgentClient) GetAllMetrics(ctx context.Context, in *emptypb.Empt
 	return out, nil
 }
 
+func (c *metricsAgentClient) QueryRange(ctx context.Context, in *QueryRangeRequest, opts ...grpc.CallOption) (*QueryRangeResponse, error) {
+	out := new(QueryRangeResponse)
+	err := c.cc.Invoke(ctx, "/go_devops_advanced.MetricsAgent/QueryRange", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsAgentClient) Heartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/go_devops_advanced.MetricsAgent/Heartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsAgentClient) ListAgents(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListAgentsResponse, error) {
+	out := new(ListAgentsResponse)
+	err := c.cc.Invoke(ctx, "/go_devops_advanced.MetricsAgent/ListAgents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsAgentClient) ListAlerts(ctx context.Context, in *ListAlertsRequest, opts ...grpc.CallOption) (*ListAlertsResponse, error) {
+	out := new(ListAlertsResponse)
+	err := c.cc.Invoke(ctx, "/go_devops_advanced.MetricsAgent/ListAlerts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsAgentClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (MetricsAgent_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetricsAgent_ServiceDesc.Streams[0], "/go_devops_advanced.MetricsAgent/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsAgentSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetricsAgent_SubscribeClient interface {
+	Recv() (*SubscribeResponse, error)
+	grpc.ClientStream
+}
+
+type metricsAgentSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsAgentSubscribeClient) Recv() (*SubscribeResponse, error) {
+	m := new(SubscribeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metricsAgentClient) StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (MetricsAgent_StreamMetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetricsAgent_ServiceDesc.Streams[1], "/go_devops_advanced.MetricsAgent/StreamMetrics", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsAgentStreamMetricsClient{stream}
+	return x, nil
+}
+
+type MetricsAgent_StreamMetricsClient interface {
+	Send(*StreamMetricsRequest) error
+	Recv() (*StreamMetricsResponse, error)
+	grpc.ClientStream
+}
+
+type metricsAgentStreamMetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsAgentStreamMetricsClient) Send(m *StreamMetricsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *metricsAgentStreamMetricsClient) Recv() (*StreamMetricsResponse, error) {
+	m := new(StreamMetricsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MetricsAgentServer is the server API for MetricsAgent service.
 // All implementations must embed UnimplementedMetricsAgentServer
 // for forward compatibility
@@ -91,7 +196,13 @@ type MetricsAgentServer interface {
 	UpdateMetrics(context.Context, *UpdateMetricsRequest) (*UpdateMetricsResponse, error)
 	CheckStorageStatus(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
 	GetMetric(context.Context, *GetMetricRequest) (*GetMetricResponse, error)
-	GetAllMetrics(context.Context, *emptypb.Empty) (*GetAllMetricsResponse, error)
+	GetAllMetrics(context.Context, *GetAllMetricsRequest) (*GetAllMetricsResponse, error)
+	QueryRange(context.Context, *QueryRangeRequest) (*QueryRangeResponse, error)
+	Heartbeat(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	ListAgents(context.Context, *emptypb.Empty) (*ListAgentsResponse, error)
+	ListAlerts(context.Context, *ListAlertsRequest) (*ListAlertsResponse, error)
+	Subscribe(*SubscribeRequest, MetricsAgent_SubscribeServer) error
+	StreamMetrics(MetricsAgent_StreamMetricsServer) error
 	mustEmbedUnimplementedMetricsAgentServer()
 }
 
@@ -111,9 +222,27 @@ func (UnimplementedMetricsAgentServer) CheckStorageStatus(context.Context, *empt
 func (UnimplementedMetricsAgentServer) GetMetric(context.Context, *GetMetricRequest) (*GetMetricResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetMetric not implemented")
 }
-func (UnimplementedMetricsAgentServer) GetAllMetrics(context.Context, *emptypb.Empty) (*GetAllMetricsResponse, error) {
+func (UnimplementedMetricsAgentServer) GetAllMetrics(context.Context, *GetAllMetricsRequest) (*GetAllMetricsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetAllMetrics not implemented")
 }
+func (UnimplementedMetricsAgentServer) QueryRange(context.Context, *QueryRangeRequest) (*QueryRangeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryRange not implemented")
+}
+func (UnimplementedMetricsAgentServer) Heartbeat(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedMetricsAgentServer) ListAgents(context.Context, *emptypb.Empty) (*ListAgentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAgents not implemented")
+}
+func (UnimplementedMetricsAgentServer) ListAlerts(context.Context, *ListAlertsRequest) (*ListAlertsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAlerts not implemented")
+}
+func (UnimplementedMetricsAgentServer) Subscribe(*SubscribeRequest, MetricsAgent_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedMetricsAgentServer) StreamMetrics(MetricsAgent_StreamMetricsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamMetrics not implemented")
+}
 func (UnimplementedMetricsAgentServer) mustEmbedUnimplementedMetricsAgentServer() {}
 
 // UnsafeMetricsAgentServer may be embedded to opt out of forward compatibility for this service.
@@ -200,7 +329,7 @@ func _MetricsAgent_GetMetric_Handler(srv interface{}, ctx context.Context, dec f
 }
 
 func _MetricsAgent_GetAllMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(emptypb.Empty)
+	in := new(GetAllMetricsRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -212,11 +341,130 @@ func _MetricsAgent_GetAllMetrics_Handler(srv interface{}, ctx context.Context, d
 		FullMethod: "/go_devops_advanced.MetricsAgent/GetAllMetrics",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetricsAgentServer).GetAllMetrics(ctx, req.(*emptypb.Empty))
+		return srv.(MetricsAgentServer).GetAllMetrics(ctx, req.(*GetAllMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsAgent_QueryRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsAgentServer).QueryRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/go_devops_advanced.MetricsAgent/QueryRange",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsAgentServer).QueryRange(ctx, req.(*QueryRangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsAgent_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsAgentServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/go_devops_advanced.MetricsAgent/Heartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsAgentServer).Heartbeat(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsAgent_ListAgents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsAgentServer).ListAgents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/go_devops_advanced.MetricsAgent/ListAgents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsAgentServer).ListAgents(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsAgent_ListAlerts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAlertsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsAgentServer).ListAlerts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/go_devops_advanced.MetricsAgent/ListAlerts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsAgentServer).ListAlerts(ctx, req.(*ListAlertsRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetricsAgent_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricsAgentServer).Subscribe(m, &metricsAgentSubscribeServer{stream})
+}
+
+type MetricsAgent_SubscribeServer interface {
+	Send(*SubscribeResponse) error
+	grpc.ServerStream
+}
+
+type metricsAgentSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsAgentSubscribeServer) Send(m *SubscribeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MetricsAgent_StreamMetrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MetricsAgentServer).StreamMetrics(&metricsAgentStreamMetricsServer{stream})
+}
+
+type MetricsAgent_StreamMetricsServer interface {
+	Send(*StreamMetricsResponse) error
+	Recv() (*StreamMetricsRequest, error)
+	grpc.ServerStream
+}
+
+type metricsAgentStreamMetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsAgentStreamMetricsServer) Send(m *StreamMetricsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *metricsAgentStreamMetricsServer) Recv() (*StreamMetricsRequest, error) {
+	m := new(StreamMetricsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MetricsAgent_ServiceDesc is the grpc.ServiceDesc for MetricsAgent service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -244,7 +492,35 @@ var MetricsAgent_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetAllMetrics",
 			Handler:    _MetricsAgent_GetAllMetrics_Handler,
 		},
+		{
+			MethodName: "QueryRange",
+			Handler:    _MetricsAgent_QueryRange_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _MetricsAgent_Heartbeat_Handler,
+		},
+		{
+			MethodName: "ListAgents",
+			Handler:    _MetricsAgent_ListAgents_Handler,
+		},
+		{
+			MethodName: "ListAlerts",
+			Handler:    _MetricsAgent_ListAlerts_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _MetricsAgent_Subscribe_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamMetrics",
+			Handler:       _MetricsAgent_StreamMetrics_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/metric.proto",
 }
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	neturl "net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// Alert states. A pending alert has its condition met for less than the rule duration.
+// A resolved alert was firing and its condition is not met anymore.
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// resolvedAlertRetention is how long resolved alerts are kept visible.
+const resolvedAlertRetention = 15 * time.Minute
+
+// alertChangedTick is how often rules depending on received metrics are evaluated.
+const alertChangedTick = time.Second
+
+// AlertRule describes a condition over stored metrics, e.g. "FreeMemory < 500MB for 5m".
+// The condition is a comparison of expressions with an optional duration it must hold for to fire.
+// Rule labels are added to labels of its alerts.
+type AlertRule struct {
+	Name   string        `json:"name"`
+	Expr   string        `json:"expr"`
+	Labels metric.Labels `json:"labels,omitempty"`
+
+	cond exprNode
+	dur  time.Duration
+}
+
+// compile parses rule expression.
+func (r *AlertRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule '%s' has no name", r.Expr)
+	}
+
+	p, err := newParser(r.Expr)
+	if err != nil {
+		return err
+	}
+	cond, err := p.parseCondition()
+	if err != nil {
+		return err
+	}
+	if b, ok := cond.(*binaryNode); !ok || !isComparison(b.op) {
+		return fmt.Errorf("alert rule '%s' must be a comparison", r.Name)
+	}
+	if p.tok.kind == tokIdent && p.tok.text == "for" {
+		raw, err := p.rawUntil("")
+		if err != nil {
+			return err
+		}
+		r.dur, err = time.ParseDuration(raw)
+		if err != nil || r.dur < 0 {
+			return fmt.Errorf("alert rule '%s' has invalid duration '%s'", r.Name, raw)
+		}
+	}
+	if p.tok.kind != tokEOF {
+		return p.errorf("unexpected '%s'", p.tok.text)
+	}
+	r.cond = cond
+	return nil
+}
+
+// AlertConfig is a content of alert rules file. Notifications are optional.
+//
+//	{"rules": [{"name": ..., "expr": ..., "labels": {...}}], "notifications": {"webhooks": [...], ...}}
+type AlertConfig struct {
+	Rules         []AlertRule         `json:"rules"`
+	Notifications *NotificationConfig `json:"notifications,omitempty"`
+}
+
+// LoadAlertConfig reads alert rules and notification settings from JSON file.
+func LoadAlertConfig(path string) (*AlertConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AlertConfig
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			return nil, err
+		}
+		if names[cfg.Rules[i].Name] {
+			return nil, fmt.Errorf("alert rule '%s' is duplicated", cfg.Rules[i].Name)
+		}
+		names[cfg.Rules[i].Name] = true
+	}
+	if cfg.Notifications != nil {
+		for _, url := range cfg.Notifications.Webhooks {
+			if _, err := neturl.ParseRequestURI(url); err != nil {
+				return nil, fmt.Errorf("invalid webhook url '%s': %w", url, err)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// Alert is a state of alert rule for a series.
+type Alert struct {
+	Rule       string        `json:"rule"`
+	Expr       string        `json:"expr"`
+	Labels     metric.Labels `json:"labels,omitempty"`
+	State      string        `json:"state"`
+	Value      float64       `json:"value"`
+	ActiveAt   time.Time     `json:"active_at"`
+	FiredAt    time.Time     `json:"fired_at"`
+	ResolvedAt time.Time     `json:"resolved_at"`
+}
+
+// alertEngine evaluates alert rules over stored metrics and keeps alerts. It is safe for concurrent use.
+// Alerts which start firing or get resolved are passed to notifier if it is set.
+// Rules depending on received metrics are only marked by markChanged, so ingestion does not wait for evaluation.
+type alertEngine struct {
+	mu       sync.Mutex
+	rules    []AlertRule
+	alerts   map[string]*Alert
+	metrics  *MetricStore
+	history  *History
+	notifier *notifier
+
+	changedMu sync.Mutex
+	changed   map[int]bool
+}
+
+func newAlertEngine(rules []AlertRule, metrics *MetricStore, history *History, n *notifier) *alertEngine {
+	return &alertEngine{
+		rules:    rules,
+		alerts:   map[string]*Alert{},
+		changed:  map[int]bool{},
+		metrics:  metrics,
+		history:  history,
+		notifier: n,
+	}
+}
+
+// evaluate evaluates rules depending on metrics with the names or all rules if no names are given.
+// It returns alerts which have started firing or have been resolved.
+func (e *alertEngine) evaluate(now time.Time, names ...string) []Alert {
+	if e == nil {
+		return nil
+	}
+
+	var rules []int
+	for i := range e.rules {
+		if len(names) == 0 || dependsOn(e.rules[i].cond, names) {
+			rules = append(rules, i)
+		}
+	}
+	return e.evaluateRules(now, rules)
+}
+
+// markChanged marks rules depending on metrics with the names to be evaluated by evaluateChanged.
+func (e *alertEngine) markChanged(names ...string) {
+	if e == nil {
+		return
+	}
+
+	e.changedMu.Lock()
+	defer e.changedMu.Unlock()
+	for i := range e.rules {
+		if !e.changed[i] && dependsOn(e.rules[i].cond, names) {
+			e.changed[i] = true
+		}
+	}
+}
+
+// evaluateChanged evaluates rules marked by markChanged since the previous call.
+func (e *alertEngine) evaluateChanged(now time.Time) []Alert {
+	if e == nil {
+		return nil
+	}
+
+	e.changedMu.Lock()
+	rules := make([]int, 0, len(e.changed))
+	for i := range e.changed {
+		rules = append(rules, i)
+	}
+	e.changed = map[int]bool{}
+	e.changedMu.Unlock()
+
+	sort.Ints(rules)
+	return e.evaluateRules(now, rules)
+}
+
+// evaluateRules evaluates rules with the indexes, then logs and notifies alerts which have changed state.
+func (e *alertEngine) evaluateRules(now time.Time, rules []int) []Alert {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	ec := &evalContext{metrics: e.metrics.List(), history: e.history, now: now}
+	var changed []Alert
+	e.mu.Lock()
+	for _, i := range rules {
+		changed = append(changed, e.evaluateRule(&e.rules[i], ec)...)
+	}
+	e.mu.Unlock()
+
+	for _, a := range changed {
+		log.Printf("Alert %s%s is %s, value: %g", a.Rule, a.Labels.String(), a.State, a.Value)
+	}
+	e.notifier.notify(changed)
+	return changed
+}
+
+// evaluateRule updates alerts of rule with series for which the rule condition holds.
+func (e *alertEngine) evaluateRule(rule *AlertRule, ec *evalContext) []Alert {
+	var changed []Alert
+	active := map[string]bool{}
+	for _, s := range rule.cond.eval(ec).samples {
+		labels := s.Labels.Copy()
+		for k, v := range rule.Labels {
+			if labels == nil {
+				labels = metric.Labels{}
+			}
+			labels[k] = v
+		}
+		key := rule.Name + labels.String()
+		active[key] = true
+
+		a, ok := e.alerts[key]
+		if !ok || a.State == AlertResolved {
+			a = &Alert{Rule: rule.Name, Expr: rule.Expr, Labels: labels, State: AlertPending, ActiveAt: ec.now}
+			e.alerts[key] = a
+		}
+		a.Value = s.Value
+		if a.State == AlertPending && ec.now.Sub(a.ActiveAt) >= rule.dur {
+			a.State = AlertFiring
+			a.FiredAt = ec.now
+			changed = append(changed, *a)
+		}
+	}
+
+	for key, a := range e.alerts {
+		if a.Rule != rule.Name || active[key] {
+			continue
+		}
+		switch {
+		case a.State == AlertPending:
+			delete(e.alerts, key)
+		case a.State == AlertFiring:
+			a.State = AlertResolved
+			a.ResolvedAt = ec.now
+			changed = append(changed, *a)
+		case ec.now.Sub(a.ResolvedAt) > resolvedAlertRetention:
+			delete(e.alerts, key)
+		}
+	}
+	return changed
+}
+
+// dependsOn reports whether the expression uses any of metrics with the names.
+func dependsOn(n exprNode, names []string) bool {
+	for _, dep := range n.names() {
+		for _, name := range names {
+			if matchName(dep, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// list returns alerts in the state or all alerts if state is empty, sorted by rule and labels.
+func (e *alertEngine) list(state string) []Alert {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	res := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		if state == "" || a.State == state {
+			res = append(res, *a)
+		}
+	}
+	e.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Rule != res[j].Rule {
+			return res[i].Rule < res[j].Rule
+		}
+		return res[i].Labels.String() < res[j].Labels.String()
+	})
+	return res
+}
+
+// validAlertState reports whether state can be used to filter alerts. Empty state means all alerts.
+func validAlertState(state string) bool {
+	switch state {
+	case "", AlertPending, AlertFiring, AlertResolved:
+		return true
+	}
+	return false
+}
+
+// evaluateAlerts marks alert rules depending on received metrics for evaluation.
+func (s GenericService) evaluateAlerts(mList []metric.Metric) {
+	if s.alerts == nil || len(mList) == 0 {
+		return
+	}
+	names := make([]string, 0, len(mList))
+	for _, m := range mList {
+		names = append(names, m.ID)
+	}
+	s.alerts.markChanged(names...)
+}
+
+// StartAlertEvaluation evaluates alert rules depending on received metrics every alertChangedTick.
+// All rules are evaluated with alert evaluation interval if it is set, so alerts change state without new metrics.
+func (s GenericService) StartAlertEvaluation(ctx context.Context) {
+	changed := time.NewTicker(alertChangedTick)
+	defer changed.Stop()
+	var all <-chan time.Time
+	if s.Cfg.AlertEvalInterval > time.Duration(0) {
+		ticker := time.NewTicker(s.Cfg.AlertEvalInterval)
+		defer ticker.Stop()
+		all = ticker.C
+	}
+
+	for {
+		select {
+		case <-changed.C:
+			s.alerts.evaluateChanged(time.Now())
+		case <-all:
+			s.alerts.evaluate(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func writeAlertRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+	return path
+}
+
+func TestLoadAlertConfig(t *testing.T) {
+	path := writeAlertRules(t, `{"rules": [
+		{"name": "LowMemory", "expr": "FreeMemory < 500MB for 5m", "labels": {"severity": "page"}},
+		{"name": "AgentDown", "expr": "rate(PollCount) == 0"}
+	]}`)
+	cfg, err := LoadAlertConfig(path)
+	require.NoError(t, err)
+	assert.Nil(t, cfg.Notifications)
+	rules := cfg.Rules
+	require.Len(t, rules, 2)
+	assert.Equal(t, 5*time.Minute, rules[0].dur)
+	assert.Equal(t, metric.Labels{"severity": "page"}, rules[0].Labels)
+	assert.Equal(t, time.Duration(0), rules[1].dur)
+
+	for _, rules := range []string{
+		`{"rules": [{"name": "NoComparison", "expr": "FreeMemory"}]}`,
+		`{"rules": [{"name": "BadDuration", "expr": "FreeMemory < 1 for soon"}]}`,
+		`{"rules": [{"name": "Trailing", "expr": "FreeMemory < 1 FreeMemory"}]}`,
+		`{"rules": [{"expr": "FreeMemory < 1"}]}`,
+		`{"rules": [{"name": "A", "expr": "FreeMemory < 1"}, {"name": "A", "expr": "FreeMemory < 2"}]}`,
+		`{"notifications": {"webhooks": ["not a url"]}}`,
+		`{"notifications": {"group_interval": "often"}}`,
+	} {
+		_, err := LoadAlertConfig(writeAlertRules(t, rules))
+		assert.Error(t, err, rules)
+	}
+
+	_, err = LoadAlertConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestAlertStates(t *testing.T) {
+	cfg, err := LoadAlertConfig(writeAlertRules(t, `{"rules": [
+		{"name": "LowMemory", "expr": "FreeMemory < 500MB for 5m", "labels": {"severity": "page"}}
+	]}`))
+	require.NoError(t, err)
+
+	store := NewMetricStore()
+	e := newAlertEngine(cfg.Rules, store, nil, nil)
+	setFree := func(v float64) {
+		store.Upsert(metric.Metric{ID: "FreeMemory", MType: gauge, Labels: metric.Labels{"host": "web1"}, Value: &v})
+	}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	setFree(1 << 30)
+	assert.Empty(t, e.evaluate(start, "FreeMemory"))
+	assert.Empty(t, e.list(""))
+
+	// pending until the condition holds for 5 minutes
+	setFree(100 << 20)
+	assert.Empty(t, e.evaluate(start.Add(time.Minute), "FreeMemory"))
+	alerts := e.list(AlertPending)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, metric.Labels{"host": "web1", "severity": "page"}, alerts[0].Labels)
+	assert.Equal(t, float64(100<<20), alerts[0].Value)
+
+	// unrelated metrics do not trigger the rule
+	assert.Empty(t, e.evaluate(start.Add(10*time.Minute), "Alloc"))
+
+	changed := e.evaluate(start.Add(6 * time.Minute))
+	require.Len(t, changed, 1)
+	assert.Equal(t, AlertFiring, changed[0].State)
+	assert.Equal(t, start.Add(time.Minute), changed[0].ActiveAt)
+	assert.Equal(t, start.Add(6*time.Minute), changed[0].FiredAt)
+	assert.Empty(t, e.evaluate(start.Add(7*time.Minute)))
+
+	setFree(1 << 30)
+	changed = e.evaluate(start.Add(8 * time.Minute))
+	require.Len(t, changed, 1)
+	assert.Equal(t, AlertResolved, changed[0].State)
+	assert.Len(t, e.list(AlertResolved), 1)
+
+	// resolved alerts are dropped after retention
+	e.evaluate(start.Add(8*time.Minute + resolvedAlertRetention + time.Second))
+	assert.Empty(t, e.list(""))
+
+	// pending alert whose condition stops holding is dropped without notice
+	setFree(100 << 20)
+	e.evaluate(start.Add(time.Hour))
+	setFree(1 << 30)
+	assert.Empty(t, e.evaluate(start.Add(time.Hour+time.Minute)))
+	assert.Empty(t, e.list(""))
+}
+
+func TestAlertsHandlers(t *testing.T) {
+	cfg, err := LoadAlertConfig(writeAlertRules(t, `{"rules": [{"name": "HighAlloc", "expr": "Alloc > 10"}]}`))
+	require.NoError(t, err)
+	service := newSourceService(t)
+	service.alerts = newAlertEngine(cfg.Rules, service.Metrics, service.history, nil)
+
+	// metrics received by server mark rules depending on them for evaluation
+	service.saveMetric(context.Background(), &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(20)})
+	service.saveMetric(context.Background(), &metric.Metric{ID: "Frees", MType: gauge, Value: getFloatPointer(20)})
+	assert.Empty(t, service.alerts.list(""))
+	require.Len(t, service.alerts.evaluateChanged(time.Now()), 1)
+	assert.Empty(t, service.alerts.evaluateChanged(time.Now()))
+
+	s := HTTPServer{service}
+	w := httptest.NewRecorder()
+	s.GetAlertsHandler(w, httptest.NewRequest(http.MethodGet, "/alerts/?state=firing", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var alerts []Alert
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alerts))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "HighAlloc", alerts[0].Rule)
+	assert.Equal(t, 20.0, alerts[0].Value)
+
+	w = httptest.NewRecorder()
+	s.GetAlertsHandler(w, httptest.NewRequest(http.MethodGet, "/alerts/?state=broken", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	g := &GRPCServer{GenericService: service}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test"))
+	res, err := g.ListAlerts(ctx, &pb.ListAlertsRequest{State: AlertFiring})
+	require.NoError(t, err)
+	require.Len(t, res.Alerts, 1)
+	assert.Equal(t, "Alloc > 10", res.Alerts[0].Expr)
+	assert.NotNil(t, res.Alerts[0].FiredAt)
+	assert.Nil(t, res.Alerts[0].ResolvedAt)
+
+	res, err = g.ListAlerts(ctx, &pb.ListAlertsRequest{State: AlertPending})
+	require.NoError(t, err)
+	assert.Empty(t, res.Alerts)
+
+	_, err = g.ListAlerts(ctx, &pb.ListAlertsRequest{State: "broken"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -1,18 +1,31 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
 )
 
 // StorageBackuper interfaces describes a storage for metrics.
 type StorageBackuper interface {
-	SaveMetric(ctx context.Context, mMap map[string]metric.Metric) error
-	RestoreMetrics(ctx context.Context, mMap map[string]metric.Metric) error
+	SaveMetric(ctx context.Context, store *MetricStore) error
+	RestoreMetrics(ctx context.Context, store *MetricStore) error
+	SaveCounterStates(ctx context.Context, states []CounterState, expiredBefore time.Time) error
+	RestoreCounterStates(ctx context.Context) ([]CounterState, error)
+	SaveSamples(ctx context.Context, samples []MetricSample) error
+	RestoreHistory(ctx context.Context, perMetric int) ([]MetricSample, error)
+	LoadHistory(ctx context.Context, id string, from, to time.Time) ([]Sample, error)
+	LoadRollups(ctx context.Context, id string, from, to time.Time) ([]Rollup, error)
+	Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error
 	CheckStorageStatus(ctx context.Context) error
 }
 
@@ -22,13 +35,17 @@ type DBStorageBackuper struct {
 }
 
 // SaveMetric saves metrics to storage (DB).
-func (dbBackuper *DBStorageBackuper) SaveMetric(ctx context.Context, mMap map[string]metric.Metric) error {
+// Metrics are keyed by series key, name and labels are saved separately.
+// Histograms and summaries are saved as JSON.
+func (dbBackuper *DBStorageBackuper) SaveMetric(ctx context.Context, store *MetricStore) error {
 	addRecordQuery := `
-		INSERT INTO metrics (id, mtype, delta, value) 
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO metrics (id, mtype, delta, value, name, labels, distribution) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		ON CONFLICT (id) DO UPDATE 
-		SET delta = $3,
-			value = $4
+		SET mtype = $2,
+			delta = $3,
+			value = $4,
+			distribution = $7
 	`
 	tx, err := dbBackuper.db.Begin()
 	if err != nil {
@@ -38,8 +55,15 @@ func (dbBackuper *DBStorageBackuper) SaveMetric(ctx context.Context, mMap map[st
 	if err != nil {
 		return err
 	}
-	for _, metric := range mMap {
-		_, err = stmt.ExecContext(ctx, metric.ID, metric.MType, metric.Delta, metric.Value)
+	for _, metric := range store.List() {
+		var labels, distribution sql.NullString
+		labels, err = labelsToJSON(metric.Labels)
+		if err == nil {
+			distribution, err = distributionToJSON(metric)
+		}
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, metric.SeriesKey(), metric.MType, metric.Delta, metric.Value, metric.ID, labels, distribution)
+		}
 		if err != nil {
 			log.Println(err)
 			errRollback := tx.Rollback()
@@ -57,11 +81,42 @@ func (dbBackuper *DBStorageBackuper) SaveMetric(ctx context.Context, mMap map[st
 	return nil
 }
 
+// labelsToJSON returns labels as JSON for a jsonb column. Empty labels are NULL.
+func labelsToJSON(labels metric.Labels) (sql.NullString, error) {
+	if len(labels) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// distributionToJSON returns histogram or summary of a metric as JSON for a jsonb column.
+// Other metrics have NULL distribution.
+func distributionToJSON(m metric.Metric) (sql.NullString, error) {
+	var v interface{}
+	switch {
+	case m.MType == histogram && m.Histogram != nil:
+		v = m.Histogram
+	case m.MType == summary && m.Summary != nil:
+		v = m.Summary
+	default:
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
 // RestoreMetrics restores metrics from storage (DB).
-func (dbBackuper *DBStorageBackuper) RestoreMetrics(ctx context.Context, mMap map[string]metric.Metric) error {
+func (dbBackuper *DBStorageBackuper) RestoreMetrics(ctx context.Context, store *MetricStore) error {
 	recs := make([]metric.Metric, 0)
 	query := `
-		SELECT * FROM metrics
+		SELECT id, mtype, delta, value, name, labels, distribution FROM metrics
 	`
 	rows, err := dbBackuper.db.QueryContext(ctx, query)
 	if err != nil {
@@ -76,10 +131,33 @@ func (dbBackuper *DBStorageBackuper) RestoreMetrics(ctx context.Context, mMap ma
 
 	for rows.Next() {
 		var rec metric.Metric
-		err = rows.Scan(&rec.ID, &rec.MType, &rec.Delta, &rec.Value)
+		var name sql.NullString
+		var labels, distribution []byte
+		err = rows.Scan(&rec.ID, &rec.MType, &rec.Delta, &rec.Value, &name, &labels, &distribution)
 		if err != nil {
 			return err
 		}
+		// rows saved before labels were introduced have no name, their key is the name
+		if name.Valid {
+			rec.ID = name.String
+		}
+		if len(labels) > 0 {
+			err = json.Unmarshal(labels, &rec.Labels)
+			if err != nil {
+				return err
+			}
+		}
+		if len(distribution) > 0 {
+			switch rec.MType {
+			case histogram:
+				err = json.Unmarshal(distribution, &rec.Histogram)
+			case summary:
+				err = json.Unmarshal(distribution, &rec.Summary)
+			}
+			if err != nil {
+				return err
+			}
+		}
 
 		recs = append(recs, rec)
 
@@ -89,12 +167,292 @@ func (dbBackuper *DBStorageBackuper) RestoreMetrics(ctx context.Context, mMap ma
 		}
 	}
 	for _, i := range recs {
-		mMap[i.ID] = i
+		store.Upsert(i)
 	}
 	return nil
 }
 
-// DBInit creates table with specific structure if it is not created yet.
+// SaveCounterStates upserts counter states and removes states updated before expiredBefore in storage (DB).
+func (dbBackuper *DBStorageBackuper) SaveCounterStates(ctx context.Context, states []CounterState, expiredBefore time.Time) error {
+	upsertStateQuery := `
+		INSERT INTO counter_states (id, start_time, cumulative, updated)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id, start_time) DO UPDATE SET cumulative = EXCLUDED.cumulative, updated = EXCLUDED.updated
+	`
+	tx, err := dbBackuper.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rollback := func(err error) error {
+		log.Println(err)
+		errRollback := tx.Rollback()
+		if errRollback != nil {
+			log.Println(errRollback)
+			return errRollback
+		}
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, upsertStateQuery)
+	if err != nil {
+		return rollback(err)
+	}
+	for _, st := range states {
+		_, err = stmt.ExecContext(ctx, st.ID, st.StartTime, st.Cumulative, st.Updated)
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM counter_states WHERE updated < $1`, expiredBefore); err != nil {
+		return rollback(err)
+	}
+	return tx.Commit()
+}
+
+// RestoreCounterStates restores counter states from storage (DB).
+func (dbBackuper *DBStorageBackuper) RestoreCounterStates(ctx context.Context) ([]CounterState, error) {
+	query := `
+		SELECT id, start_time, cumulative, updated FROM counter_states
+	`
+	rows, err := dbBackuper.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	var states []CounterState
+	for rows.Next() {
+		var st CounterState
+		err = rows.Scan(&st.ID, &st.StartTime, &st.Cumulative, &st.Updated)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// SaveSamples appends history samples to storage (DB).
+func (dbBackuper *DBStorageBackuper) SaveSamples(ctx context.Context, samples []MetricSample) error {
+	addSampleQuery := `
+		INSERT INTO metric_history (id, ts, value)
+		VALUES ($1, $2, $3)
+	`
+	tx, err := dbBackuper.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, addSampleQuery)
+	if err != nil {
+		errRollback := tx.Rollback()
+		if errRollback != nil {
+			log.Println(errRollback)
+		}
+		return err
+	}
+	for _, sample := range samples {
+		_, err = stmt.ExecContext(ctx, sample.ID, sample.Timestamp, sample.Value)
+		if err != nil {
+			log.Println(err)
+			errRollback := tx.Rollback()
+			if errRollback != nil {
+				log.Println(errRollback)
+				return errRollback
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RestoreHistory restores up to perMetric latest samples of every metric from storage (DB).
+func (dbBackuper *DBStorageBackuper) RestoreHistory(ctx context.Context, perMetric int) ([]MetricSample, error) {
+	query := `
+		SELECT id, ts, value FROM (
+			SELECT id, ts, value, row_number() OVER (PARTITION BY id ORDER BY ts DESC) AS rn
+			FROM metric_history
+		) h
+		WHERE rn <= $1
+		ORDER BY ts
+	`
+	rows, err := dbBackuper.db.QueryContext(ctx, query, perMetric)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	var samples []MetricSample
+	for rows.Next() {
+		var sample MetricSample
+		err = rows.Scan(&sample.ID, &sample.Timestamp, &sample.Value)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// LoadHistory returns samples of metric id with timestamps in [from, to] from storage (DB).
+func (dbBackuper *DBStorageBackuper) LoadHistory(ctx context.Context, id string, from, to time.Time) ([]Sample, error) {
+	query := `
+		SELECT ts, value FROM metric_history
+		WHERE id = $1 AND ts >= $2 AND ts <= $3
+		ORDER BY ts
+	`
+	rows, err := dbBackuper.db.QueryContext(ctx, query, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	var samples []Sample
+	for rows.Next() {
+		var sample Sample
+		err = rows.Scan(&sample.Timestamp, &sample.Value)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// LoadRollups returns rollups of metric id which start in [from, to] from storage (DB).
+func (dbBackuper *DBStorageBackuper) LoadRollups(ctx context.Context, id string, from, to time.Time) ([]Rollup, error) {
+	query := `
+		SELECT resolution, start, min, max, sum, count, last FROM metric_rollups
+		WHERE id = $1 AND start >= $2 AND start <= $3
+		ORDER BY start
+	`
+	rows, err := dbBackuper.db.QueryContext(ctx, query, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	var rollups []Rollup
+	for rows.Next() {
+		rollup := Rollup{ID: id}
+		var resolution int64
+		err = rows.Scan(&resolution, &rollup.Start, &rollup.Min, &rollup.Max, &rollup.Sum, &rollup.Count, &rollup.Last)
+		if err != nil {
+			return nil, err
+		}
+		rollup.Resolution = time.Duration(resolution) * time.Second
+		rollups = append(rollups, rollup)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
+
+// Compact rolls up and deletes old history in storage (DB) according to retention policy.
+func (dbBackuper *DBStorageBackuper) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error {
+	const rollupRawQuery = `
+		INSERT INTO metric_rollups (id, resolution, start, min, max, sum, count, last)
+		SELECT id, 60, date_trunc('minute', ts), min(value), max(value), sum(value), count(*),
+			(array_agg(value ORDER BY ts DESC))[1]
+		FROM metric_history
+		WHERE ts < $1
+		GROUP BY id, date_trunc('minute', ts)
+		ON CONFLICT (id, resolution, start) DO UPDATE
+		SET min = LEAST(metric_rollups.min, EXCLUDED.min),
+			max = GREATEST(metric_rollups.max, EXCLUDED.max),
+			sum = metric_rollups.sum + EXCLUDED.sum,
+			count = metric_rollups.count + EXCLUDED.count,
+			last = EXCLUDED.last
+	`
+	const rollupMinuteQuery = `
+		INSERT INTO metric_rollups (id, resolution, start, min, max, sum, count, last)
+		SELECT id, 3600, date_trunc('hour', start), min(min), max(max), sum(sum), sum(count),
+			(array_agg(last ORDER BY start DESC))[1]
+		FROM metric_rollups
+		WHERE resolution = 60 AND start < $1
+		GROUP BY id, date_trunc('hour', start)
+		ON CONFLICT (id, resolution, start) DO UPDATE
+		SET min = LEAST(metric_rollups.min, EXCLUDED.min),
+			max = GREATEST(metric_rollups.max, EXCLUDED.max),
+			sum = metric_rollups.sum + EXCLUDED.sum,
+			count = metric_rollups.count + EXCLUDED.count,
+			last = EXCLUDED.last
+	`
+
+	type compactionStep struct {
+		query  string
+		cutoff time.Time
+	}
+	rawCutoff, minuteCutoff, hourCutoff := policy.cutoffs(now)
+	var steps []compactionStep
+	if !rawCutoff.IsZero() {
+		steps = append(steps,
+			compactionStep{rollupRawQuery, rawCutoff},
+			compactionStep{`DELETE FROM metric_history WHERE ts < $1`, rawCutoff},
+		)
+	}
+	if !minuteCutoff.IsZero() {
+		steps = append(steps,
+			compactionStep{rollupMinuteQuery, minuteCutoff},
+			compactionStep{`DELETE FROM metric_rollups WHERE resolution = 60 AND start < $1`, minuteCutoff},
+		)
+	}
+	if !hourCutoff.IsZero() {
+		steps = append(steps, compactionStep{`DELETE FROM metric_rollups WHERE resolution = 3600 AND start < $1`, hourCutoff})
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+
+	tx, err := dbBackuper.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		_, err = tx.ExecContext(ctx, step.query, step.cutoff)
+		if err != nil {
+			log.Println(err)
+			errRollback := tx.Rollback()
+			if errRollback != nil {
+				log.Println(errRollback)
+				return errRollback
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DBInit creates tables with specific structure if they are not created yet.
 func (dbBackuper *DBStorageBackuper) DBInit(ctx context.Context) error {
 	const queryInitialTable = `
 		CREATE TABLE IF NOT EXISTS metrics (
@@ -102,6 +460,33 @@ func (dbBackuper *DBStorageBackuper) DBInit(ctx context.Context) error {
 			mtype text NOT NULL,
 			delta bigint,
 			value double precision
+		);
+		ALTER TABLE metrics ADD COLUMN IF NOT EXISTS name text;
+		ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels jsonb;
+		ALTER TABLE metrics ADD COLUMN IF NOT EXISTS distribution jsonb;
+		CREATE TABLE IF NOT EXISTS counter_states (
+			id text NOT NULL,
+			start_time bigint NOT NULL,
+			cumulative bigint NOT NULL,
+			updated timestamptz NOT NULL,
+			PRIMARY KEY (id, start_time)
+		);
+		CREATE TABLE IF NOT EXISTS metric_history (
+			id text NOT NULL,
+			ts timestamptz NOT NULL,
+			value double precision NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS metric_history_id_ts ON metric_history (id, ts);
+		CREATE TABLE IF NOT EXISTS metric_rollups (
+			id text NOT NULL,
+			resolution integer NOT NULL,
+			start timestamptz NOT NULL,
+			min double precision NOT NULL,
+			max double precision NOT NULL,
+			sum double precision NOT NULL,
+			count bigint NOT NULL,
+			last double precision NOT NULL,
+			PRIMARY KEY (id, resolution, start)
 		)`
 	if _, err := dbBackuper.db.ExecContext(ctx, queryInitialTable); err != nil {
 		log.Println(err)
@@ -121,23 +506,31 @@ func (dbBackuper *DBStorageBackuper) CheckStorageStatus(ctx context.Context) err
 
 // FileStorageBackuper backs up metrics to a file.
 type FileStorageBackuper struct {
+	mu       sync.Mutex
 	filename string
 }
 
 // SaveMetric saves metrics to storage (file).
-func (fileBackuper *FileStorageBackuper) SaveMetric(ctx context.Context, mMap map[string]metric.Metric) error {
-	var MetricList []metric.Metric
+// Metrics are encoded before the file is truncated, so the previous backup is kept if they can not be encoded.
+func (fileBackuper *FileStorageBackuper) SaveMetric(ctx context.Context, store *MetricStore) error {
+	MetricList := store.List()
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&MetricList); err != nil {
+		return err
+	}
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+
 	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	producer, err := NewProducer(fileBackuper.filename, flags)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	for _, metric := range mMap {
-		MetricList = append(MetricList, metric)
-	}
-	if err = producer.WriteMetric(&MetricList); err != nil {
-		log.Fatal(err)
+	if err = producer.Write(buf.Bytes()); err != nil {
+		_ = producer.Close()
+		return err
 	}
 	err = producer.Close()
 	if err != nil {
@@ -147,19 +540,347 @@ func (fileBackuper *FileStorageBackuper) SaveMetric(ctx context.Context, mMap ma
 }
 
 // RestoreMetrics restores metrics from storage (file).
-func (fileBackuper *FileStorageBackuper) RestoreMetrics(ctx context.Context, mMap map[string]metric.Metric) error {
+func (fileBackuper *FileStorageBackuper) RestoreMetrics(ctx context.Context, store *MetricStore) error {
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+
 	flags := os.O_RDONLY | os.O_CREATE
 	consumer, err := NewConsumer(fileBackuper.filename, flags)
 	if err != nil {
 		return err
 	}
-	err = consumer.ReadEvents(mMap)
+	err = consumer.ReadEvents(store)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// counterStatesFile returns name of the file with counter states, which is kept next to metrics file.
+func (fileBackuper *FileStorageBackuper) counterStatesFile() string {
+	return fileBackuper.filename + ".counters"
+}
+
+// SaveCounterStates merges counter states into storage (file). States updated before expiredBefore are removed.
+func (fileBackuper *FileStorageBackuper) SaveCounterStates(ctx context.Context, states []CounterState, expiredBefore time.Time) error {
+	if fileBackuper.filename == "" {
+		return nil
+	}
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+	saved, err := fileBackuper.readCounterStates()
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[counterKey]CounterState, len(saved)+len(states))
+	for _, st := range append(saved, states...) {
+		merged[counterKey{id: st.ID, start: st.StartTime}] = st
+	}
+	res := make([]CounterState, 0, len(merged))
+	for _, st := range merged {
+		if !st.Updated.Before(expiredBefore) {
+			res = append(res, st)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ID != res[j].ID {
+			return res[i].ID < res[j].ID
+		}
+		return res[i].StartTime < res[j].StartTime
+	})
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	tmp := fileBackuper.counterStatesFile() + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileBackuper.counterStatesFile())
+}
+
+// RestoreCounterStates restores counter states from storage (file).
+func (fileBackuper *FileStorageBackuper) RestoreCounterStates(ctx context.Context) ([]CounterState, error) {
+	if fileBackuper.filename == "" {
+		return nil, nil
+	}
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+	return fileBackuper.readCounterStates()
+}
+
+// readCounterStates reads counter states file. Missing file means there are no states.
+func (fileBackuper *FileStorageBackuper) readCounterStates() ([]CounterState, error) {
+	b, err := os.ReadFile(fileBackuper.counterStatesFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var states []CounterState
+	if err = json.Unmarshal(b, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// historyFile returns name of the file with history samples, which is kept next to metrics file.
+func (fileBackuper *FileStorageBackuper) historyFile() string {
+	return fileBackuper.filename + ".history"
+}
+
+// SaveSamples appends history samples to storage (file). Every sample is a JSON line.
+func (fileBackuper *FileStorageBackuper) SaveSamples(ctx context.Context, samples []MetricSample) error {
+	if fileBackuper.filename == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, sample := range samples {
+		if err := encoder.Encode(sample); err != nil {
+			return err
+		}
+	}
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+	f, err := os.OpenFile(fileBackuper.historyFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		closeErr := f.Close()
+		if closeErr != nil {
+			log.Print(closeErr)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// forEachSample calls fn for every sample in history file. Caller must hold the lock.
+func (fileBackuper *FileStorageBackuper) forEachSample(fn func(sample MetricSample)) error {
+	f, err := os.Open(fileBackuper.historyFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		err = f.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	decoder := json.NewDecoder(f)
+	for {
+		var sample MetricSample
+		err = decoder.Decode(&sample)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// the tail may be lost if server stopped during a write
+			log.Printf("Could not read history file %s: %s", fileBackuper.historyFile(), err)
+			return nil
+		}
+		fn(sample)
+	}
+}
+
+// RestoreHistory restores up to perMetric latest samples of every metric from storage (file).
+func (fileBackuper *FileStorageBackuper) RestoreHistory(ctx context.Context, perMetric int) ([]MetricSample, error) {
+	if fileBackuper.filename == "" || perMetric <= 0 {
+		return nil, nil
+	}
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+
+	series := map[string]*ringBuffer{}
+	err := fileBackuper.forEachSample(func(sample MetricSample) {
+		rb, ok := series[sample.ID]
+		if !ok {
+			rb = &ringBuffer{}
+			series[sample.ID] = rb
+		}
+		rb.add(sample.Sample, perMetric)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []MetricSample
+	for id, rb := range series {
+		for _, sample := range rb.ordered() {
+			samples = append(samples, MetricSample{ID: id, Sample: sample})
+		}
+	}
+	return samples, nil
+}
+
+// LoadHistory returns samples of metric id with timestamps in [from, to] from storage (file).
+func (fileBackuper *FileStorageBackuper) LoadHistory(ctx context.Context, id string, from, to time.Time) ([]Sample, error) {
+	if fileBackuper.filename == "" {
+		return nil, nil
+	}
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+
+	var samples []Sample
+	err := fileBackuper.forEachSample(func(sample MetricSample) {
+		if sample.ID != id || sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			return
+		}
+		samples = append(samples, sample.Sample)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+	return samples, nil
+}
+
+// rollupsFile returns name of the file with rolled up history, which is kept next to metrics file.
+func (fileBackuper *FileStorageBackuper) rollupsFile() string {
+	return fileBackuper.filename + ".rollups"
+}
+
+// readRollups reads rollups file. Caller must hold the lock.
+func (fileBackuper *FileStorageBackuper) readRollups() ([]Rollup, error) {
+	b, err := os.ReadFile(fileBackuper.rollupsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rollups []Rollup
+	if err = json.Unmarshal(b, &rollups); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
+
+// replaceFile writes file atomically through a temporary file.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadRollups returns rollups of metric id which start in [from, to] from storage (file).
+func (fileBackuper *FileStorageBackuper) LoadRollups(ctx context.Context, id string, from, to time.Time) ([]Rollup, error) {
+	if fileBackuper.filename == "" {
+		return nil, nil
+	}
+
+	fileBackuper.mu.Lock()
+	rollups, err := fileBackuper.readRollups()
+	fileBackuper.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Rollup
+	for _, r := range rollups {
+		if r.ID != id || r.Start.Before(from) || r.Start.After(to) {
+			continue
+		}
+		res = append(res, r)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return res, nil
+}
+
+// Compact rolls up and deletes old history in storage (file) according to retention policy.
+func (fileBackuper *FileStorageBackuper) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error {
+	if fileBackuper.filename == "" {
+		return nil
+	}
+	rawCutoff, minuteCutoff, hourCutoff := policy.cutoffs(now)
+
+	fileBackuper.mu.Lock()
+	defer fileBackuper.mu.Unlock()
+
+	rollups, err := fileBackuper.readRollups()
+	if err != nil {
+		return err
+	}
+	rollupsChanged := false
+
+	if !rawCutoff.IsZero() {
+		var keep bytes.Buffer
+		var old []MetricSample
+		encoder := json.NewEncoder(&keep)
+		err = fileBackuper.forEachSample(func(sample MetricSample) {
+			if sample.Timestamp.Before(rawCutoff) {
+				old = append(old, sample)
+				return
+			}
+			if err := encoder.Encode(sample); err != nil {
+				log.Print(err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if len(old) > 0 {
+			rollups = mergeRollups(rollups, rollupSamples(old, minuteResolution))
+			rollupsChanged = true
+			// rollups are saved first: a failure in between may only duplicate data, not lose it
+			b, err := json.Marshal(rollups)
+			if err != nil {
+				return err
+			}
+			if err = replaceFile(fileBackuper.rollupsFile(), b); err != nil {
+				return err
+			}
+			if err = replaceFile(fileBackuper.historyFile(), keep.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	var minutes, kept []Rollup
+	for _, r := range rollups {
+		switch {
+		case r.Resolution == minuteResolution && !minuteCutoff.IsZero() && r.Start.Before(minuteCutoff):
+			minutes = append(minutes, r)
+		case r.Resolution == hourResolution && !hourCutoff.IsZero() && r.Start.Before(hourCutoff):
+			rollupsChanged = true
+		default:
+			kept = append(kept, r)
+		}
+	}
+	if len(minutes) > 0 {
+		kept = mergeRollups(kept, downsampleRollups(minutes, hourResolution))
+		rollupsChanged = true
+	}
+	if !rollupsChanged {
+		return nil
+	}
+
+	b, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return replaceFile(fileBackuper.rollupsFile(), b)
+}
+
 // CheckStorageStatus checks nothing here. Interface requirement.
 func (fileBackuper *FileStorageBackuper) CheckStorageStatus(ctx context.Context) error {
 	return nil
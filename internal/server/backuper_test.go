@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"math"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDBInit(t *testing.T) {
@@ -58,12 +61,15 @@ func TestRestoreMetrics(t *testing.T) {
 	}
 
 	s := GenericService{
-		Metrics: map[string]metric.Metric{},
+		Metrics: NewMetricStore(),
 	}
 
-	rs := sqlmock.NewRows([]string{"id", "mtype", "delta", "value"}).AddRow("Alloc", "gauge", "0", "23456")
+	rs := sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "name", "labels", "distribution"}).
+		AddRow("Alloc", "gauge", "0", "23456", nil, nil, nil).
+		AddRow(`Alloc{host="web1"}`, "gauge", nil, "1", "Alloc", []byte(`{"host":"web1"}`), nil).
+		AddRow("Latency", "histogram", nil, nil, "Latency", nil, []byte(`{"bounds":[0.1],"counts":[2,1],"sum":0.5,"count":3}`))
 
-	mock.ExpectQuery(`SELECT \* FROM metrics`).
+	mock.ExpectQuery(`SELECT (.+) FROM metrics`).
 		WillDelayFor(1 * time.Second).
 		WillReturnRows(rs)
 
@@ -71,12 +77,22 @@ func TestRestoreMetrics(t *testing.T) {
 	if err != nil {
 		log.Print(err)
 	}
-	assert.Equal(t, s.Metrics["Alloc"], metric.Metric{
+	alloc, _ := s.Metrics.Get("Alloc")
+	assert.Equal(t, alloc, metric.Metric{
 		ID:    "Alloc",
 		MType: gauge,
 		Delta: getIntPointer(0),
 		Value: getFloatPointer(23456),
 	})
+	labeled, _ := s.Metrics.Get(`Alloc{host="web1"}`)
+	assert.Equal(t, labeled, metric.Metric{
+		ID:     "Alloc",
+		MType:  gauge,
+		Value:  getFloatPointer(1),
+		Labels: metric.Labels{"host": "web1"},
+	})
+	latency, _ := s.Metrics.Get("Latency")
+	assert.Equal(t, &metric.Histogram{Bounds: []float64{0.1}, Counts: []uint64{2, 1}, Sum: 0.5, Count: 3}, latency.Histogram)
 }
 
 func TestSaveMetricToDB(t *testing.T) {
@@ -97,22 +113,20 @@ func TestSaveMetricToDB(t *testing.T) {
 	}
 
 	s := GenericService{
-		Metrics: map[string]metric.Metric{},
+		Metrics: NewMetricStore(),
 	}
 
-	s.Metrics = map[string]metric.Metric{
-		"Alloc": {
-			ID:    "Alloc",
-			MType: gauge,
-			Delta: getIntPointer(0),
-			Value: getFloatPointer(23456),
-		},
-	}
+	s.Metrics.Upsert(metric.Metric{
+		ID:    "Alloc",
+		MType: gauge,
+		Delta: getIntPointer(0),
+		Value: getFloatPointer(23456),
+	})
 
-	metric := s.Metrics["Alloc"]
+	metric, _ := s.Metrics.Get("Alloc")
 	mock.ExpectBegin()
 	mock.ExpectPrepare(`INSERT INTO metrics`).ExpectExec().
-		WithArgs(metric.ID, metric.MType, metric.Delta, metric.Value).
+		WithArgs(metric.ID, metric.MType, metric.Delta, metric.Value, metric.ID, nil, nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	err = dbs.SaveMetric(ctx, s.Metrics)
@@ -120,7 +134,7 @@ func TestSaveMetricToDB(t *testing.T) {
 
 	mock.ExpectBegin()
 	mock.ExpectPrepare(`INSERT INTO metrics`).ExpectExec().
-		WithArgs(metric.ID, metric.MType, metric.Delta, metric.Value).
+		WithArgs(metric.ID, metric.MType, metric.Delta, metric.Value, metric.ID, nil, nil).
 		WillReturnError(New("TestError"))
 	mock.ExpectRollback()
 	err = dbs.SaveMetric(ctx, s.Metrics)
@@ -156,3 +170,21 @@ func TestNewBackuper(t *testing.T) {
 	_, err = NewBackuper(ctx, cfg)
 	assert.NoError(t, err)
 }
+
+func TestFileSaveMetricKeepsBackupOnEncodingError(t *testing.T) {
+	fs := &FileStorageBackuper{filename: filepath.Join(t.TempDir(), "metrics.json")}
+	ctx := context.TODO()
+
+	store := NewMetricStore()
+	store.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1)})
+	require.NoError(t, fs.SaveMetric(ctx, store))
+
+	store.Upsert(metric.Metric{ID: "Frees", MType: gauge, Value: getFloatPointer(math.NaN())})
+	assert.Error(t, fs.SaveMetric(ctx, store))
+
+	restored := NewMetricStore()
+	require.NoError(t, fs.RestoreMetrics(ctx, restored))
+	alloc, ok := restored.Get("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 1.0, *alloc.Value)
+}
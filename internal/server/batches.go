@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sync"
+)
+
+const defaultBatchRegistrySize = 4096
+
+// batchRegistry remembers IDs of recently received metric batches.
+// Agents replay spooled batches until they get a confirmation, so the same batch may arrive twice.
+type batchRegistry struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	size  int
+}
+
+func newBatchRegistry(size int) *batchRegistry {
+	return &batchRegistry{
+		ids:  make(map[string]struct{}, size),
+		size: size,
+	}
+}
+
+// add registers batch ID. It returns false if the batch has been already registered.
+// Empty ID is never registered, such batches are always applied.
+func (b *batchRegistry) add(id string) bool {
+	if b == nil || id == "" {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.ids[id]; ok {
+		return false
+	}
+
+	b.ids[id] = struct{}{}
+	b.order = append(b.order, id)
+	for len(b.order) > b.size {
+		delete(b.ids, b.order[0])
+		b.order = b.order[1:]
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchRegistry(t *testing.T) {
+	b := newBatchRegistry(2)
+
+	assert.True(t, b.add("one"))
+	assert.False(t, b.add("one"))
+	assert.True(t, b.add(""))
+	assert.True(t, b.add(""))
+
+	assert.True(t, b.add("two"))
+	assert.True(t, b.add("three"))
+	// the oldest ID is forgotten
+	assert.True(t, b.add("one"))
+}
+
+func TestSaveBatchSkipsReplayedBatch(t *testing.T) {
+	s := GenericService{
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: "/tmp/test",
+		},
+		batches: newBatchRegistry(defaultBatchRegistrySize),
+	}
+	ctx := context.TODO()
+
+	mList := []metric.Metric{{ID: "PollCount", MType: counter, Delta: getIntPointer(5)}}
+	assert.NoError(t, s.saveBatch(ctx, "batch-1", &mList))
+	mList = []metric.Metric{{ID: "PollCount", MType: counter, Delta: getIntPointer(5)}}
+	assert.NoError(t, s.saveBatch(ctx, "batch-1", &mList))
+
+	m, _ := s.Metrics.Get("PollCount")
+	assert.Equal(t, int64(5), *m.Delta)
+}
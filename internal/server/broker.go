@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// subscriptionBuffer is the number of updates buffered for a subscriber.
+const subscriptionBuffer = 256
+
+// subscription receives updates of stored metrics which pass its filter.
+type subscription struct {
+	ch      chan metric.Metric
+	filter  func(metric.Metric) bool
+	dropped int32
+}
+
+// lagged reports whether updates were dropped for the subscriber since the previous call.
+// Updates buffered so far are discarded then: the subscriber is expected to take current values
+// of its metrics from the store instead, as they supersede both the buffered and the dropped updates.
+func (sub *subscription) lagged() bool {
+	if atomic.SwapInt32(&sub.dropped, 0) == 0 {
+		return false
+	}
+	for {
+		select {
+		case _, ok := <-sub.ch:
+			if !ok {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// snapshot returns stored metrics passing subscription filter.
+func (sub *subscription) snapshot(store *MetricStore) []metric.Metric {
+	var res []metric.Metric
+	for _, m := range store.List() {
+		if sub.filter == nil || sub.filter(m) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// broker delivers updates of stored metrics to subscribers. It is safe for concurrent use.
+// Publishing never blocks: an update is dropped for a subscriber whose buffer is full,
+// so slow consumers can not stall metric ingestion. Such subscriber is told about it by subscription.lagged.
+type broker struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+}
+
+// newBroker returns broker without subscribers.
+func newBroker() *broker {
+	return &broker{
+		subs: map[*subscription]struct{}{},
+	}
+}
+
+// subscribe returns subscription to updates passing filter. All updates are received if filter is nil.
+// The subscription must be cancelled with unsubscribe.
+func (b *broker) subscribe(filter func(metric.Metric) bool) *subscription {
+	sub := &subscription{
+		ch:     make(chan metric.Metric, subscriptionBuffer),
+		filter: filter,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe removes subscription and closes its channel.
+func (b *broker) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// publish sends metric update to subscribers.
+func (b *broker) publish(m metric.Metric) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.filter != nil && !sub.filter(m) {
+			continue
+		}
+		select {
+		case sub.ch <- m:
+		default:
+			atomic.StoreInt32(&sub.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	b := newBroker()
+	all := b.subscribe(nil)
+	cpu := b.subscribe(func(m metric.Metric) bool { return matchName("CPUutilization*", m.ID) })
+
+	b.publish(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1)})
+	b.publish(metric.Metric{ID: "CPUutilization1", MType: gauge, Value: getFloatPointer(2)})
+	assert.Len(t, all.ch, 2)
+	require.Len(t, cpu.ch, 1)
+	assert.Equal(t, "CPUutilization1", (<-cpu.ch).ID)
+
+	// publishing to a full subscriber does not block and drops the update
+	for i := 0; i < subscriptionBuffer; i++ {
+		b.publish(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(float64(i))})
+	}
+	assert.Len(t, all.ch, subscriptionBuffer)
+	assert.Empty(t, cpu.ch)
+	assert.False(t, cpu.lagged())
+	b.publish(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(-1)})
+	assert.True(t, all.lagged())
+	assert.Empty(t, all.ch, "buffered updates are superseded by current values")
+	assert.False(t, all.lagged())
+
+	b.unsubscribe(all)
+	b.unsubscribe(all)
+	for range all.ch {
+	}
+	b.publish(metric.Metric{ID: "CPUutilization2", MType: gauge, Value: getFloatPointer(3)})
+	assert.Len(t, cpu.ch, 1)
+
+	var nilBroker *broker
+	nilBroker.publish(metric.Metric{ID: "Alloc"})
+}
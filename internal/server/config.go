@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/caarlos0/env"
@@ -22,42 +23,86 @@ const usage = `Usage of using_flag:
   -k string Encryption key
   -r bool Restore data from file (default true)
   -t string Trusted subnet
+  -history-size int Samples kept in memory per metric (default 1000)
+  -raw-retention duration Raw history retention (default 24h0m0s)
+  -minute-retention duration 1-minute rollups retention (default 168h0m0s)
+  -hour-retention duration 1-hour rollups retention (default 2160h0m0s)
+  -compaction-interval duration History compaction interval (default 10m0s)
+  -agent-stale-intervals int Missed report intervals after which agent is stale (default 3)
+  -agent-evict-after duration Time without reports after which agent is forgotten, 0 keeps agents (default 24h0m0s)
+  -alert-rules string Alert rules file, relative to config file if set there
+  -alert-eval-interval duration Alert rules evaluation interval (default 15s)
+  -recording-rules string Recording rules file, relative to config file if set there
+  -recording-interval duration Recording rules evaluation interval (default 15s)
 `
 
 const (
-	defaultAddress       string        = "localhost:8080"
-	defaultStoreInterval time.Duration = time.Duration(300 * time.Second)
-	defaultStoreFile     string        = "/tmp/devops-metrics-db.json"
-	defaultRestore       bool          = false
-	defaultDBAddress     string        = ""
-	defaultCryptoKey     string        = ""
-	defaultKey           string        = ""
-	defaultConfig        string        = ""
-	defaultTrustedSubnet string        = ""
+	defaultAddress             string        = "localhost:8080"
+	defaultStoreInterval       time.Duration = time.Duration(300 * time.Second)
+	defaultStoreFile           string        = "/tmp/devops-metrics-db.json"
+	defaultRestore             bool          = false
+	defaultDBAddress           string        = ""
+	defaultCryptoKey           string        = ""
+	defaultKey                 string        = ""
+	defaultConfig              string        = ""
+	defaultTrustedSubnet       string        = ""
+	defaultHistorySize         int           = 1000
+	defaultRawRetention        time.Duration = 24 * time.Hour
+	defaultMinuteRetention     time.Duration = 7 * 24 * time.Hour
+	defaultHourRetention       time.Duration = 90 * 24 * time.Hour
+	defaultCompactionInterval  time.Duration = 10 * time.Minute
+	defaultAgentStaleIntervals int           = 3
+	defaultAgentEvictAfter     time.Duration = 24 * time.Hour
+	defaultAlertRulesFile      string        = ""
+	defaultAlertEvalInterval   time.Duration = 15 * time.Second
+	defaultRecordingRulesFile  string        = ""
+	defaultRecordingInterval   time.Duration = 15 * time.Second
 )
 
 // Config structure. Used for application configuration.
 type Config struct {
-	Address       string        `env:"ADDRESS"`
-	StoreInterval time.Duration `env:"STORE_INTERVAL"`
-	StoreFile     string        `env:"STORE_FILE"`
-	Restore       bool          `env:"RESTORE"`
-	Key           string        `env:"KEY"`
-	DBAddress     string        `env:"DATABASE_DSN"`
-	CryptoKey     string        `env:"CRYPTO_KEY"`
-	ConfigFile    string        `env:"CONFIG"`
-	TrustedSubnet string        `env:"TRUSTED_SUBNET"`
-	GRPC          bool
+	Address             string        `env:"ADDRESS"`
+	StoreInterval       time.Duration `env:"STORE_INTERVAL"`
+	StoreFile           string        `env:"STORE_FILE"`
+	Restore             bool          `env:"RESTORE"`
+	Key                 string        `env:"KEY"`
+	DBAddress           string        `env:"DATABASE_DSN"`
+	CryptoKey           string        `env:"CRYPTO_KEY"`
+	ConfigFile          string        `env:"CONFIG"`
+	TrustedSubnet       string        `env:"TRUSTED_SUBNET"`
+	HistorySize         int           `env:"HISTORY_SIZE"`
+	RawRetention        time.Duration `env:"RAW_RETENTION"`
+	MinuteRetention     time.Duration `env:"MINUTE_RETENTION"`
+	HourRetention       time.Duration `env:"HOUR_RETENTION"`
+	CompactionInterval  time.Duration `env:"COMPACTION_INTERVAL"`
+	AgentStaleIntervals int           `env:"AGENT_STALE_INTERVALS"`
+	AgentEvictAfter     time.Duration `env:"AGENT_EVICT_AFTER"`
+	AlertRulesFile      string        `env:"ALERT_RULES_FILE"`
+	AlertEvalInterval   time.Duration `env:"ALERT_EVAL_INTERVAL"`
+	RecordingRulesFile  string        `env:"RECORDING_RULES_FILE"`
+	RecordingInterval   time.Duration `env:"RECORDING_INTERVAL"`
+	GRPC                bool
 }
 
 type ConfigFile struct {
-	Address       string        `json:"address"`
-	StoreInterval time.Duration `json:"store_interval"`
-	StoreFile     string        `json:"store_file"`
-	Restore       bool          `json:"restore"`
-	DBAddress     string        `json:"database_dsn"`
-	CryptoKey     string        `json:"crypto_key"`
-	TrustedSubnet string        `json:"trusted_subnet"`
+	Address             string        `json:"address"`
+	StoreInterval       time.Duration `json:"store_interval"`
+	StoreFile           string        `json:"store_file"`
+	Restore             bool          `json:"restore"`
+	DBAddress           string        `json:"database_dsn"`
+	CryptoKey           string        `json:"crypto_key"`
+	TrustedSubnet       string        `json:"trusted_subnet"`
+	HistorySize         int           `json:"history_size"`
+	RawRetention        time.Duration `json:"raw_retention"`
+	MinuteRetention     time.Duration `json:"minute_retention"`
+	HourRetention       time.Duration `json:"hour_retention"`
+	CompactionInterval  time.Duration `json:"compaction_interval"`
+	AgentStaleIntervals int           `json:"agent_stale_intervals"`
+	AgentEvictAfter     time.Duration `json:"agent_evict_after"`
+	AlertRulesFile      string        `json:"alert_rules_file"`
+	AlertEvalInterval   time.Duration `json:"alert_eval_interval"`
+	RecordingRulesFile  string        `json:"recording_rules_file"`
+	RecordingInterval   time.Duration `json:"recording_interval"`
 }
 
 func (config *ConfigFile) UnmarshalJSON(b []byte) error {
@@ -65,7 +110,14 @@ func (config *ConfigFile) UnmarshalJSON(b []byte) error {
 
 	unmarshalledJSON := &struct {
 		*MyTypeAlias
-		StoreInterval string `json:"store_interval"`
+		StoreInterval      string `json:"store_interval"`
+		RawRetention       string `json:"raw_retention"`
+		MinuteRetention    string `json:"minute_retention"`
+		HourRetention      string `json:"hour_retention"`
+		CompactionInterval string `json:"compaction_interval"`
+		AgentEvictAfter    string `json:"agent_evict_after"`
+		AlertEvalInterval  string `json:"alert_eval_interval"`
+		RecordingInterval  string `json:"recording_interval"`
 	}{
 		MyTypeAlias: (*MyTypeAlias)(config),
 	}
@@ -79,6 +131,28 @@ func (config *ConfigFile) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	optionalDurations := []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{unmarshalledJSON.RawRetention, &config.RawRetention},
+		{unmarshalledJSON.MinuteRetention, &config.MinuteRetention},
+		{unmarshalledJSON.HourRetention, &config.HourRetention},
+		{unmarshalledJSON.CompactionInterval, &config.CompactionInterval},
+		{unmarshalledJSON.AgentEvictAfter, &config.AgentEvictAfter},
+		{unmarshalledJSON.AlertEvalInterval, &config.AlertEvalInterval},
+		{unmarshalledJSON.RecordingInterval, &config.RecordingInterval},
+	}
+	for _, d := range optionalDurations {
+		if d.value == "" {
+			continue
+		}
+		*d.dst, err = time.ParseDuration(d.value)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -129,9 +203,62 @@ func loadConfigFromFile(c *Config) error {
 		c.CryptoKey = cfgFromFile.CryptoKey
 	}
 
+	if c.HistorySize == defaultHistorySize && cfgFromFile.HistorySize != 0 {
+		c.HistorySize = cfgFromFile.HistorySize
+	}
+
+	if c.RawRetention == defaultRawRetention && cfgFromFile.RawRetention != 0 {
+		c.RawRetention = cfgFromFile.RawRetention
+	}
+
+	if c.MinuteRetention == defaultMinuteRetention && cfgFromFile.MinuteRetention != 0 {
+		c.MinuteRetention = cfgFromFile.MinuteRetention
+	}
+
+	if c.HourRetention == defaultHourRetention && cfgFromFile.HourRetention != 0 {
+		c.HourRetention = cfgFromFile.HourRetention
+	}
+
+	if c.CompactionInterval == defaultCompactionInterval && cfgFromFile.CompactionInterval != 0 {
+		c.CompactionInterval = cfgFromFile.CompactionInterval
+	}
+
+	if c.AgentStaleIntervals == defaultAgentStaleIntervals && cfgFromFile.AgentStaleIntervals != 0 {
+		c.AgentStaleIntervals = cfgFromFile.AgentStaleIntervals
+	}
+
+	if c.AgentEvictAfter == defaultAgentEvictAfter && cfgFromFile.AgentEvictAfter != 0 {
+		c.AgentEvictAfter = cfgFromFile.AgentEvictAfter
+	}
+
+	// rules files set in config are looked for next to it
+	if c.AlertRulesFile == defaultAlertRulesFile && cfgFromFile.AlertRulesFile != "" {
+		c.AlertRulesFile = nextToConfig(c.ConfigFile, cfgFromFile.AlertRulesFile)
+	}
+
+	if c.AlertEvalInterval == defaultAlertEvalInterval && cfgFromFile.AlertEvalInterval != 0 {
+		c.AlertEvalInterval = cfgFromFile.AlertEvalInterval
+	}
+
+	if c.RecordingRulesFile == defaultRecordingRulesFile && cfgFromFile.RecordingRulesFile != "" {
+		c.RecordingRulesFile = nextToConfig(c.ConfigFile, cfgFromFile.RecordingRulesFile)
+	}
+
+	if c.RecordingInterval == defaultRecordingInterval && cfgFromFile.RecordingInterval != 0 {
+		c.RecordingInterval = cfgFromFile.RecordingInterval
+	}
+
 	return nil
 }
 
+// nextToConfig resolves path relative to directory of config file.
+func nextToConfig(configFile, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFile), path)
+}
+
 // RewriteConfigWithEnvs rewrites ENV values if the similiar flag is specified during application launch.
 func GetConfig() (*Config, error) {
 	c := &Config{}
@@ -144,6 +271,17 @@ func GetConfig() (*Config, error) {
 	flag.StringVar(&c.CryptoKey, "crypto-key", defaultCryptoKey, "Path to private key")
 	flag.StringVar(&c.Key, "k", defaultKey, "Encryption key")
 	flag.StringVar(&c.TrustedSubnet, "t", defaultTrustedSubnet, "Trusted subnet")
+	flag.IntVar(&c.HistorySize, "history-size", defaultHistorySize, "Samples kept in memory per metric")
+	flag.DurationVar(&c.RawRetention, "raw-retention", defaultRawRetention, "Raw history retention")
+	flag.DurationVar(&c.MinuteRetention, "minute-retention", defaultMinuteRetention, "1-minute rollups retention")
+	flag.DurationVar(&c.HourRetention, "hour-retention", defaultHourRetention, "1-hour rollups retention")
+	flag.DurationVar(&c.CompactionInterval, "compaction-interval", defaultCompactionInterval, "History compaction interval")
+	flag.IntVar(&c.AgentStaleIntervals, "agent-stale-intervals", defaultAgentStaleIntervals, "Missed report intervals after which agent is stale")
+	flag.DurationVar(&c.AgentEvictAfter, "agent-evict-after", defaultAgentEvictAfter, "Time without reports after which agent is forgotten")
+	flag.StringVar(&c.AlertRulesFile, "alert-rules", defaultAlertRulesFile, "Alert rules file")
+	flag.DurationVar(&c.AlertEvalInterval, "alert-eval-interval", defaultAlertEvalInterval, "Alert rules evaluation interval")
+	flag.StringVar(&c.RecordingRulesFile, "recording-rules", defaultRecordingRulesFile, "Recording rules file")
+	flag.DurationVar(&c.RecordingInterval, "recording-interval", defaultRecordingInterval, "Recording rules evaluation interval")
 	flag.StringVar(&c.ConfigFile, "config", defaultConfig, "Config file name")
 	flag.StringVar(&c.ConfigFile, "c", defaultConfig, "Config file name")
 	flag.BoolVar(&c.GRPC, "grpc", false, "Run as gRPC service")
@@ -3,6 +3,7 @@ package server
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -121,14 +122,43 @@ func TestLoadConfigFromFile(t *testing.T) {
 	}
 }
 
+func TestLoadRulesFilesFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "server.json")
+	err := os.WriteFile(cfgFile, []byte(`{"store_interval": "10s", "alert_rules_file": "alerts.json", "alert_eval_interval": "1m",
+		"recording_rules_file": "/etc/recording.json", "recording_interval": "30s"}`), 0o600)
+	assert.NoError(t, err)
+
+	c := &Config{ConfigFile: cfgFile, AlertEvalInterval: defaultAlertEvalInterval, RecordingInterval: defaultRecordingInterval}
+	assert.NoError(t, loadConfigFromFile(c))
+	assert.Equal(t, filepath.Join(dir, "alerts.json"), c.AlertRulesFile)
+	assert.Equal(t, time.Minute, c.AlertEvalInterval)
+	assert.Equal(t, "/etc/recording.json", c.RecordingRulesFile)
+	assert.Equal(t, 30*time.Second, c.RecordingInterval)
+
+	// rules file set by flag or ENV is not moved
+	c = &Config{ConfigFile: cfgFile, AlertRulesFile: "rules.json"}
+	assert.NoError(t, loadConfigFromFile(c))
+	assert.Equal(t, "rules.json", c.AlertRulesFile)
+}
+
 func TestGetConfig(t *testing.T) {
 	c := &Config{
-		Address:       "localhost:9999",
-		StoreInterval: time.Duration(300 * time.Second),
-		StoreFile:     "/tmp/devops-metrics-db.json",
-		Restore:       false,
-		DBAddress:     "",
-		CryptoKey:     "",
+		Address:             "localhost:9999",
+		StoreInterval:       time.Duration(300 * time.Second),
+		StoreFile:           "/tmp/devops-metrics-db.json",
+		Restore:             false,
+		DBAddress:           "",
+		CryptoKey:           "",
+		HistorySize:         defaultHistorySize,
+		RawRetention:        defaultRawRetention,
+		MinuteRetention:     defaultMinuteRetention,
+		HourRetention:       defaultHourRetention,
+		CompactionInterval:  defaultCompactionInterval,
+		AgentStaleIntervals: defaultAgentStaleIntervals,
+		AgentEvictAfter:     defaultAgentEvictAfter,
+		AlertEvalInterval:   defaultAlertEvalInterval,
+		RecordingInterval:   defaultRecordingInterval,
 	}
 
 	err := os.Setenv("ADDRESS", "localhost:9999")
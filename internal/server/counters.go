@@ -0,0 +1,177 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// counterStateTTL is how long server remembers a counter instance which does not report anymore.
+const counterStateTTL = 24 * time.Hour
+
+// CounterState is the last cumulative value reported by a counter instance.
+// An instance is identified by metric series key and the time the reporting agent started counting,
+// so a restarted agent reports a new instance.
+type CounterState struct {
+	ID         string    `json:"id"`
+	StartTime  int64     `json:"start_time"`
+	Cumulative int64     `json:"cumulative"`
+	Updated    time.Time `json:"updated"`
+}
+
+type counterKey struct {
+	id    string
+	start int64
+}
+
+// counterStateRefresh is how often the state of a flat counter is saved again, so it does not expire in storage.
+const counterStateRefresh = counterStateTTL / 4
+
+// counterRegistry turns cumulative counter values into increments of server-side totals.
+// It tracks states changed since they were saved. A change gets a new version,
+// so a state changed again while it is being saved is saved once more.
+type counterRegistry struct {
+	mu      sync.Mutex
+	states  map[counterKey]CounterState
+	changed map[counterKey]uint64
+	// stored holds update time of states saved to storage
+	stored  map[counterKey]time.Time
+	version uint64
+}
+
+// counterSnapshot is a set of changed counter states with versions of their changes.
+type counterSnapshot struct {
+	states   []CounterState
+	versions []uint64
+}
+
+func newCounterRegistry() *counterRegistry {
+	return &counterRegistry{
+		states:  map[counterKey]CounterState{},
+		changed: map[counterKey]uint64{},
+		stored:  map[counterKey]time.Time{},
+	}
+}
+
+// increment returns how much counter m has grown since its previous report.
+// Counters without cumulative value are legacy deltas which are applied as is.
+// Repeated and stale cumulative values give zero increment, so retried batches do not inflate totals.
+// A new instance counts from zero since its start, so its first cumulative value is the increment.
+// A repeated value keeps the state alive, but the state is saved again only every counterStateRefresh.
+func (r *counterRegistry) increment(m *metric.Metric) int64 {
+	if m.Cumulative == nil || r == nil {
+		if m.Delta != nil {
+			return *m.Delta
+		}
+		if m.Cumulative != nil {
+			return *m.Cumulative
+		}
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := m.SeriesKey()
+	key := counterKey{id: id, start: m.StartTime}
+	cur := *m.Cumulative
+	prev, ok := r.states[key]
+	now := time.Now()
+
+	var inc int64
+	flat := false
+	switch {
+	case !ok:
+		inc = cur
+	case cur > prev.Cumulative:
+		inc = cur - prev.Cumulative
+	case cur == prev.Cumulative:
+		// a flat counter is alive, its state must not expire
+		flat = true
+	case m.StartTime == 0:
+		// without start time the only sign of a reset is a decreased value
+		inc = cur
+	default:
+		// stale value delivered after a newer one
+		return 0
+	}
+
+	r.states[key] = CounterState{ID: id, StartTime: m.StartTime, Cumulative: cur, Updated: now}
+	if !flat || now.Sub(r.stored[key]) >= counterStateRefresh {
+		r.version++
+		r.changed[key] = r.version
+	}
+	return inc
+}
+
+// snapshot returns states changed since they were saved, see markSaved.
+// States which have not been updated for counterStateTTL are forgotten.
+func (r *counterRegistry) snapshot() (counterSnapshot, bool) {
+	if r == nil {
+		return counterSnapshot{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, st := range r.states {
+		if time.Since(st.Updated) > counterStateTTL {
+			delete(r.states, key)
+			delete(r.changed, key)
+			delete(r.stored, key)
+		}
+	}
+	if len(r.changed) == 0 {
+		return counterSnapshot{}, false
+	}
+
+	keys := make([]counterKey, 0, len(r.changed))
+	for key := range r.changed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].start < keys[j].start
+	})
+
+	snap := counterSnapshot{
+		states:   make([]CounterState, 0, len(keys)),
+		versions: make([]uint64, 0, len(keys)),
+	}
+	for _, key := range keys {
+		snap.states = append(snap.states, r.states[key])
+		snap.versions = append(snap.versions, r.changed[key])
+	}
+	return snap, true
+}
+
+// markSaved records that states of the snapshot have been saved to storage.
+// States changed after the snapshot was taken stay changed.
+func (r *counterRegistry) markSaved(snap counterSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, st := range snap.states {
+		key := counterKey{id: st.ID, start: st.StartTime}
+		if _, ok := r.states[key]; !ok {
+			continue
+		}
+		r.stored[key] = st.Updated
+		if r.changed[key] == snap.versions[i] {
+			delete(r.changed, key)
+		}
+	}
+}
+
+// restore loads states saved by a previous run.
+func (r *counterRegistry) restore(states []CounterState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, st := range states {
+		key := counterKey{id: st.ID, start: st.StartTime}
+		r.states[key] = st
+		r.stored[key] = st.Updated
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cumulativeCounter(id string, cumulative int64, start int64) metric.Metric {
+	return metric.Metric{ID: id, MType: counter, Delta: getIntPointer(0), Cumulative: getIntPointer(cumulative), StartTime: start}
+}
+
+func TestCounterRegistryIncrement(t *testing.T) {
+	r := newCounterRegistry()
+
+	tests := []struct {
+		name string
+		m    metric.Metric
+		want int64
+	}{
+		{name: "new instance", m: cumulativeCounter("PollCount", 5, 100), want: 5},
+		{name: "growth", m: cumulativeCounter("PollCount", 8, 100), want: 3},
+		{name: "duplicate", m: cumulativeCounter("PollCount", 8, 100), want: 0},
+		{name: "stale", m: cumulativeCounter("PollCount", 6, 100), want: 0},
+		{name: "restarted agent", m: cumulativeCounter("PollCount", 2, 200), want: 2},
+		{name: "no start time", m: cumulativeCounter("Requests", 10, 0), want: 10},
+		{name: "reset without start time", m: cumulativeCounter("Requests", 4, 0), want: 4},
+		{name: "legacy delta", m: metric.Metric{ID: "Legacy", MType: counter, Delta: getIntPointer(7)}, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, r.increment(&tt.m))
+		})
+	}
+
+	snap, changed := r.snapshot()
+	require.True(t, changed)
+	require.Len(t, snap.states, 3)
+	assert.Equal(t, "PollCount", snap.states[0].ID)
+	assert.Equal(t, int64(8), snap.states[0].Cumulative)
+
+	// states are returned until they are saved
+	_, changed = r.snapshot()
+	assert.True(t, changed)
+	m := cumulativeCounter("PollCount", 9, 100)
+	r.increment(&m)
+	r.markSaved(snap)
+	snap, changed = r.snapshot()
+	require.True(t, changed)
+	require.Len(t, snap.states, 1)
+	assert.Equal(t, int64(9), snap.states[0].Cumulative)
+
+	r.markSaved(snap)
+	_, changed = r.snapshot()
+	assert.False(t, changed)
+}
+
+func TestCounterRegistryFlatCounter(t *testing.T) {
+	r := newCounterRegistry()
+	old := time.Now().Add(-counterStateTTL - time.Hour)
+	r.restore([]CounterState{{ID: "NetErrIn", StartTime: 100, Cumulative: 8, Updated: old}})
+
+	// a counter which has not changed for longer than TTL is still alive
+	m := cumulativeCounter("NetErrIn", 8, 100)
+	assert.Equal(t, int64(0), r.increment(&m))
+	snap, changed := r.snapshot()
+	require.True(t, changed)
+	require.Len(t, snap.states, 1)
+	assert.True(t, snap.states[0].Updated.After(old))
+	r.markSaved(snap)
+
+	// a flat counter saved recently is not saved again
+	m = cumulativeCounter("NetErrIn", 8, 100)
+	assert.Equal(t, int64(0), r.increment(&m))
+	_, changed = r.snapshot()
+	assert.False(t, changed)
+	r.mu.Lock()
+	assert.True(t, r.states[counterKey{id: "NetErrIn", start: 100}].Updated.After(snap.states[0].Updated))
+	r.mu.Unlock()
+}
+
+func TestSaveCounterStatesRetry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	s := GenericService{counters: newCounterRegistry()}
+	backuper := &FileStorageBackuper{filename: filepath.Join(dir, "metrics.json")}
+	m := cumulativeCounter("PollCount", 5, 100)
+	s.counters.increment(&m)
+
+	require.Error(t, s.saveCounterStates(context.TODO(), backuper))
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	require.NoError(t, s.saveCounterStates(context.TODO(), backuper))
+
+	states, err := backuper.RestoreCounterStates(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.Equal(t, int64(5), states[0].Cumulative)
+}
+
+func TestSaveBatchCumulativeCounters(t *testing.T) {
+	s := GenericService{
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		counters: newCounterRegistry(),
+	}
+	ctx := context.TODO()
+
+	for _, cumulative := range []int64{5, 5, 9} {
+		mList := []metric.Metric{cumulativeCounter("PollCount", cumulative, 100)}
+		require.NoError(t, s.saveBatch(ctx, "", &mList))
+	}
+	m, _ := s.Metrics.Get("PollCount")
+	assert.Equal(t, int64(9), *m.Delta)
+	assert.Nil(t, m.Cumulative)
+
+	states, err := s.backuper.RestoreCounterStates(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []CounterState{{ID: "PollCount", StartTime: 100, Cumulative: 9, Updated: states[0].Updated}}, states)
+}
+
+// Agents in "both" send mode report every counter one by one and then in a batch.
+func TestCumulativeCounterSentTwice(t *testing.T) {
+	s := GenericService{
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		counters: newCounterRegistry(),
+	}
+	ctx := context.TODO()
+
+	m := cumulativeCounter("PollCount", 5, 100)
+	m.Delta = getIntPointer(5)
+	s.saveMetric(ctx, &m)
+	mList := []metric.Metric{m}
+	require.NoError(t, s.saveBatch(ctx, "", &mList))
+
+	stored, _ := s.Metrics.Get("PollCount")
+	assert.Equal(t, int64(5), *stored.Delta)
+}
+
+// Histograms and summaries of agents in "both" send mode are merged once as well.
+func TestDistributionSentTwice(t *testing.T) {
+	s := GenericService{
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		counters: newCounterRegistry(),
+	}
+	ctx := context.TODO()
+
+	report := func(cumulative int64) metric.Metric {
+		return metric.Metric{
+			ID:         "Latency",
+			MType:      histogram,
+			Histogram:  &metric.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Sum: 2.5, Count: 2},
+			Cumulative: &cumulative,
+			StartTime:  100,
+		}
+	}
+	m := report(2)
+	require.NoError(t, s.saveMetric(ctx, &m))
+	mList := []metric.Metric{report(2)}
+	require.NoError(t, s.saveBatch(ctx, "", &mList))
+
+	stored, _ := s.Metrics.Get("Latency")
+	assert.Equal(t, uint64(2), stored.Histogram.Count)
+
+	// the next report is merged
+	mList = []metric.Metric{report(4)}
+	require.NoError(t, s.saveBatch(ctx, "", &mList))
+	stored, _ = s.Metrics.Get("Latency")
+	assert.Equal(t, uint64(4), stored.Histogram.Count)
+	assert.Equal(t, []uint64{2, 2}, stored.Histogram.Counts)
+}
+
+func TestSaveBatchLabeledCounters(t *testing.T) {
+	s := GenericService{
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		counters: newCounterRegistry(),
+		history:  NewHistory(10),
+	}
+
+	// two hosts started at the same moment report the same counter
+	web1 := cumulativeCounter("PollCount", 5, 100)
+	web1.Labels = metric.Labels{"host": "web1"}
+	web2 := cumulativeCounter("PollCount", 3, 100)
+	web2.Labels = metric.Labels{"host": "web2"}
+	mList := []metric.Metric{web1, web2}
+	require.NoError(t, s.saveBatch(context.TODO(), "", &mList))
+
+	m, _ := s.Metrics.Get(`PollCount{host="web1"}`)
+	assert.Equal(t, int64(5), *m.Delta)
+	m, _ = s.Metrics.Get(`PollCount{host="web2"}`)
+	assert.Equal(t, int64(3), *m.Delta)
+	assert.Len(t, s.history.Range(`PollCount{host="web2"}`, time.Time{}, time.Time{}), 1)
+}
+
+func TestFileCounterStatesMerge(t *testing.T) {
+	fs := &FileStorageBackuper{filename: filepath.Join(t.TempDir(), "metrics.json")}
+	ctx := context.TODO()
+	now := time.Now().Round(0)
+	expiredBefore := now.Add(-counterStateTTL)
+
+	old := CounterState{ID: "Old", StartTime: 1, Cumulative: 1, Updated: expiredBefore.Add(time.Hour)}
+	poll := CounterState{ID: "PollCount", StartTime: 100, Cumulative: 5, Updated: now}
+	require.NoError(t, fs.SaveCounterStates(ctx, []CounterState{old, poll}, expiredBefore))
+
+	poll.Cumulative = 9
+	require.NoError(t, fs.SaveCounterStates(ctx, []CounterState{poll}, expiredBefore.Add(2*time.Hour)))
+
+	states, err := fs.RestoreCounterStates(ctx)
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.Equal(t, int64(9), states[0].Cumulative)
+}
+
+func TestFileCounterStatesMissingFile(t *testing.T) {
+	fs := &FileStorageBackuper{filename: filepath.Join(t.TempDir(), "metrics.json")}
+
+	states, err := fs.RestoreCounterStates(context.TODO())
+	require.NoError(t, err)
+	assert.Empty(t, states)
+
+	require.NoError(t, os.WriteFile(fs.counterStatesFile(), []byte("{"), 0600))
+	_, err = fs.RestoreCounterStates(context.TODO())
+	assert.Error(t, err)
+}
+
+func TestDBCounterStates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		err = db.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	ctx := context.TODO()
+	dbs := &DBStorageBackuper{db: db}
+	updated := time.Now()
+	st := CounterState{ID: "PollCount", StartTime: 100, Cumulative: 9, Updated: updated}
+
+	expiredBefore := updated.Add(-counterStateTTL)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`INSERT INTO counter_states .* ON CONFLICT \(id, start_time\) DO UPDATE`).ExpectExec().
+		WithArgs(st.ID, st.StartTime, st.Cumulative, st.Updated).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM counter_states WHERE updated < \$1`).WithArgs(expiredBefore).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, dbs.SaveCounterStates(ctx, []CounterState{st}, expiredBefore))
+
+	rows := sqlmock.NewRows([]string{"id", "start_time", "cumulative", "updated"}).AddRow(st.ID, st.StartTime, st.Cumulative, updated)
+	mock.ExpectQuery(`SELECT id, start_time, cumulative, updated FROM counter_states`).WillReturnRows(rows)
+	states, err := dbs.RestoreCounterStates(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []CounterState{st}, states)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
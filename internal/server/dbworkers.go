@@ -3,27 +3,31 @@ package server
 import (
 	"context"
 	"database/sql"
+	"log"
 
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
 )
 
+// saveListToDB applies a list of metrics and saves storage once for the whole list.
 func (s *GenericService) saveListToDB(ctx context.Context, mList *[]metric.Metric) error {
 	for _, m := range *mList {
-		switch m.MType {
-		case counter:
-			if s.Metrics[m.ID].Delta == nil {
-				s.Metrics[m.ID] = m
-			} else {
-				*s.Metrics[m.ID].Delta += *m.Delta
-			}
-		case gauge:
-			s.Metrics[m.ID] = m
+		if err := s.applyMetric(m); err != nil {
+			log.Printf("Metric %s is invalid: %s. Skipping.", m.SeriesKey(), err)
 		}
 	}
-	if err := s.backuper.SaveMetric(ctx, s.Metrics); err != nil {
-		return err
+	s.evaluateAlerts(*mList)
+	return s.backup(ctx, s.backuper)
+}
+
+// saveBatch saves a list of metrics unless a batch with the same ID has been already received.
+// A batch received again is not applied, but storage is saved once more: the batch may be sent again
+// because its previous save failed, so it is confirmed only when storage holds all received data.
+func (s *GenericService) saveBatch(ctx context.Context, batchID string, mList *[]metric.Metric) error {
+	if !s.batches.add(batchID) {
+		log.Printf("Batch %s has been already received. Skipping.", batchID)
+		return s.backup(ctx, s.backuper)
 	}
-	return nil
+	return s.saveListToDB(ctx, mList)
 }
 
 // NewServiceDB returns a DB connection for service.
@@ -56,7 +56,7 @@ func TestSaveListToDB(t *testing.T) {
 	}
 
 	s := GenericService{
-		Metrics:  map[string]metric.Metric{},
+		Metrics:  NewMetricStore(),
 		backuper: dbs,
 	}
 
@@ -0,0 +1,757 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// Expressions over stored metrics. Grammar:
+//
+//	condition = expr [("<" | "<=" | ">" | ">=" | "==" | "!=") expr]
+//	expr      = term {("+" | "-") term}
+//	term      = unary {("*" | "/") unary}
+//	unary     = ["-"] primary
+//	primary   = number | selector | rate | aggregate | "(" expr ")"
+//	rate      = "rate" "(" selector ["[" duration "]"] ")"
+//	aggregate = ("avg" | "sum" | "min" | "max" | "count") "(" expr ")" ["by" "(" name {"," name} ")"]
+//	selector  = name ["{" name "=" string {"," name "=" string} "}"]
+//	number    = digits ["." digits] ["B" | "KB" | "MB" | "GB" | "TB"]
+//
+// Byte units are binary multiples. A selector gives a value of every stored series with the name
+// and the labels, rate gives a per-second increase of the series over the window. A name may be a glob
+// with "*" and "?", e.g. avg(CPUutilization*). A "*" right after a name followed by a digit, a space or "("
+// is a multiplication, so metrics are multiplied with spaces around "*": "A * B". A "*" between two names
+// like "A*B" is an error, as it is not clear whether it is a glob or a multiplication.
+// An aggregate reduces samples to a sample per group of "by" labels, all samples form one group without "by".
+
+// defaultRateWindow is a window of rate without an explicit one.
+const defaultRateWindow = time.Minute
+
+// aggregations are functions which reduce samples.
+var aggregations = map[string]bool{
+	"avg":   true,
+	"sum":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+var byteUnits = map[string]float64{
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ExprError describes an invalid expression.
+type ExprError struct {
+	expr string
+	pos  int
+	msg  string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("expression '%s': %s at position %d", e.expr, e.msg, e.pos)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lexer splits an expression into tokens.
+type lexer struct {
+	input string
+	pos   int
+}
+
+func isIdentRune(r byte, first bool) bool {
+	return r == '_' || unicode.IsLetter(rune(r)) || (!first && (unicode.IsDigit(rune(r)) || r == '.'))
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case unicode.IsDigit(rune(c)):
+		for l.pos < len(l.input) && (unicode.IsDigit(rune(l.input[l.pos])) || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		for l.pos < len(l.input) && unicode.IsLetter(rune(l.input[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.input[start:l.pos], pos: start}, nil
+	case isIdentRune(c, true):
+		for l.pos < len(l.input) && (isIdentRune(l.input[l.pos], false) || l.isGlobRune()) {
+			if l.input[l.pos] == '*' && l.pos+1 < len(l.input) && isIdentRune(l.input[l.pos+1], true) {
+				return token{}, &ExprError{expr: l.input, pos: l.pos, msg: "ambiguous '*' between names, use spaces around multiplication"}
+			}
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}, nil
+	case c == '"':
+		end := strings.IndexByte(l.input[l.pos+1:], '"')
+		if end < 0 {
+			return token{}, &ExprError{expr: l.input, pos: start, msg: "unterminated string"}
+		}
+		l.pos += end + 2
+		return token{kind: tokString, text: l.input[start+1 : l.pos-1], pos: start}, nil
+	}
+
+	for _, op := range []string{"<=", ">=", "==", "!=", "<", ">", "=", "+", "-", "*", "/", "(", ")", "{", "}", "[", "]", ","} {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, &ExprError{expr: l.input, pos: start, msg: fmt.Sprintf("unexpected character '%c'", c)}
+}
+
+// isGlobRune reports whether the current character continues a name as a glob wildcard.
+func (l *lexer) isGlobRune() bool {
+	switch l.input[l.pos] {
+	case '?':
+		return true
+	case '*':
+		if l.pos+1 == len(l.input) {
+			return true
+		}
+		next := l.input[l.pos+1]
+		return !unicode.IsDigit(rune(next)) && !unicode.IsSpace(rune(next)) && next != '('
+	}
+	return false
+}
+
+// parser builds an expression tree with one token lookahead.
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func newParser(input string) (*parser, error) {
+	p := &parser{lex: lexer{input: input}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return &ExprError{expr: p.lex.input, pos: p.tok.pos, msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	if p.tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected '%s'", op)
+	}
+	return p.advance()
+}
+
+// rawUntil returns input after the current token up to sep or the end if sep is empty and continues after sep.
+// It is used for durations which are not split into tokens.
+func (p *parser) rawUntil(sep string) (string, error) {
+	start := p.lex.pos
+	end := len(p.lex.input)
+	if sep != "" {
+		idx := strings.Index(p.lex.input[start:], sep)
+		if idx < 0 {
+			return "", p.errorf("expected '%s'", sep)
+		}
+		end = start + idx
+	}
+	p.lex.pos = end + len(sep)
+	raw := strings.TrimSpace(p.lex.input[start:end])
+	return raw, p.advance()
+}
+
+func (p *parser) parseCondition() (exprNode, error) {
+	lhs, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp("<", "<=", ">", ">=", "==", "!=") {
+		return lhs, nil
+	}
+	op := p.tok.text
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	rhs, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: op, lhs: lhs, rhs: rhs}, nil
+}
+
+func (p *parser) parseExpr() (exprNode, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: op, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseTerm() (exprNode, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*", "/") {
+		op := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: op, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (exprNode, error) {
+	if !p.isOp("-") {
+		return p.parsePrimary()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: "*", lhs: numberNode(-1), rhs: x}, nil
+}
+
+func (p *parser) parsePrimary() (exprNode, error) {
+	switch {
+	case p.tok.kind == tokNumber:
+		v, err := parseQuantity(p.tok.text)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		return numberNode(v), p.advance()
+	case p.tok.kind == tokIdent && p.tok.text == "rate" && p.isCall():
+		return p.parseRate()
+	case p.tok.kind == tokIdent && aggregations[p.tok.text] && p.isCall():
+		return p.parseAggregate()
+	case p.tok.kind == tokIdent:
+		return p.parseSelector()
+	case p.isOp("("):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.tok.kind == tokEOF:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected '%s'", p.tok.text)
+}
+
+// isCall reports whether the current name is followed by "(", so it is a function.
+func (p *parser) isCall() bool {
+	return strings.HasPrefix(strings.TrimLeftFunc(p.lex.input[p.lex.pos:], unicode.IsSpace), "(")
+}
+
+func (p *parser) parseAggregate() (exprNode, error) {
+	node := &aggregateNode{fn: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	x, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	node.x = x
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokIdent || p.tok.text != "by" {
+		return node, nil
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for {
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected label name")
+		}
+		node.by = append(node.by, p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if !p.isOp(",") {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return node, p.expect(")")
+}
+
+func (p *parser) parseRate() (exprNode, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("rate expects a metric")
+	}
+	sel, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+	node := &rateNode{sel: sel, window: defaultRateWindow}
+	if p.isOp("[") {
+		raw, err := p.rawUntil("]")
+		if err != nil {
+			return nil, err
+		}
+		node.window, err = time.ParseDuration(raw)
+		if err != nil || node.window <= 0 {
+			return nil, p.errorf("invalid rate window '%s'", raw)
+		}
+	}
+	return node, p.expect(")")
+}
+
+func (p *parser) parseSelector() (*selectorNode, error) {
+	sel := &selectorNode{name: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if !p.isOp("{") {
+		return sel, nil
+	}
+
+	sel.matchers = metric.Labels{}
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected label name")
+		}
+		name := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokString {
+			return nil, p.errorf("expected quoted label value")
+		}
+		sel.matchers[name] = p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if !p.isOp(",") {
+			break
+		}
+	}
+	return sel, p.expect("}")
+}
+
+// parseQuantity parses a number with an optional byte unit.
+func parseQuantity(text string) (float64, error) {
+	i := strings.IndexFunc(text, unicode.IsLetter)
+	if i < 0 {
+		i = len(text)
+	}
+	multiplier := 1.0
+	if unit := text[i:]; unit != "" {
+		var ok bool
+		multiplier, ok = byteUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit '%s'", unit)
+		}
+	}
+	v, err := strconv.ParseFloat(text[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number '%s'", text)
+	}
+	return v * multiplier, nil
+}
+
+// exprSample is a value of a series labeled as the series.
+type exprSample struct {
+	Labels metric.Labels
+	Value  float64
+}
+
+// exprValue is a result of an expression: a scalar or samples of series.
+type exprValue struct {
+	scalar  bool
+	value   float64
+	samples []exprSample
+}
+
+// evalContext holds data expressions are evaluated over.
+type evalContext struct {
+	metrics []metric.Metric
+	history *History
+	now     time.Time
+}
+
+type exprNode interface {
+	eval(ec *evalContext) exprValue
+	// names returns names of metrics the expression depends on.
+	names() []string
+}
+
+type numberNode float64
+
+func (n numberNode) eval(ec *evalContext) exprValue {
+	return exprValue{scalar: true, value: float64(n)}
+}
+
+func (n numberNode) names() []string {
+	return nil
+}
+
+type selectorNode struct {
+	name     string
+	matchers metric.Labels
+}
+
+// match returns stored metrics selected by the selector.
+func (n *selectorNode) match(ec *evalContext) []metric.Metric {
+	var res []metric.Metric
+	for _, m := range ec.metrics {
+		if !matchName(n.name, m.ID) {
+			continue
+		}
+		matched := true
+		for k, v := range n.matchers {
+			if m.Labels[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (n *selectorNode) eval(ec *evalContext) exprValue {
+	var res exprValue
+	for _, m := range n.match(ec) {
+		v, ok := metricValue(m)
+		if ok {
+			res.samples = append(res.samples, exprSample{Labels: m.Labels, Value: v})
+		}
+	}
+	return res
+}
+
+func (n *selectorNode) names() []string {
+	return []string{n.name}
+}
+
+// matchName reports whether metric name matches the name of selector, which may be a glob.
+func matchName(pattern, name string) bool {
+	if !strings.ContainsAny(pattern, "*?") {
+		return pattern == name
+	}
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// metricValue returns a value of gauge, total of counter or number of observations of histogram or summary.
+func metricValue(m metric.Metric) (float64, bool) {
+	switch {
+	case m.MType == gauge && m.Value != nil:
+		return *m.Value, true
+	case m.MType == counter && m.Delta != nil:
+		return float64(*m.Delta), true
+	case m.MType == histogram || m.MType == summary:
+		return float64(observations(m)), true
+	}
+	return 0, false
+}
+
+type rateNode struct {
+	sel    *selectorNode
+	window time.Duration
+}
+
+// eval computes a per-second increase of series over the window from history.
+// The last sample before the window is a base of the increase, so a series without new samples has zero rate.
+func (n *rateNode) eval(ec *evalContext) exprValue {
+	var res exprValue
+	from := ec.now.Add(-n.window)
+	for _, m := range n.sel.match(ec) {
+		samples := ec.history.RangeWithBase(m.SeriesKey(), from, ec.now)
+		if len(samples) == 0 {
+			continue
+		}
+
+		var increase float64
+		var prev *float64
+		for i := range samples {
+			s := samples[i]
+			if s.Timestamp.After(from) && prev != nil {
+				increase += counterIncrease(*prev, s.Value)
+			}
+			prev = &s.Value
+		}
+		res.samples = append(res.samples, exprSample{Labels: m.Labels, Value: increase / n.window.Seconds()})
+	}
+	return res
+}
+
+func (n *rateNode) names() []string {
+	return n.sel.names()
+}
+
+// aggregateNode reduces samples of expression to a sample per group of labels.
+type aggregateNode struct {
+	fn string
+	x  exprNode
+	by []string
+}
+
+func (n *aggregateNode) eval(ec *evalContext) exprValue {
+	x := n.x.eval(ec)
+	if x.scalar {
+		x.samples = []exprSample{{Value: x.value}}
+	}
+
+	type group struct {
+		labels metric.Labels
+		values []float64
+	}
+	var order []string
+	groups := map[string]*group{}
+	for _, s := range x.samples {
+		var labels metric.Labels
+		for _, name := range n.by {
+			if v, ok := s.Labels[name]; ok {
+				if labels == nil {
+					labels = metric.Labels{}
+				}
+				labels[name] = v
+			}
+		}
+		key := labels.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, s.Value)
+	}
+
+	var res exprValue
+	for _, key := range order {
+		g := groups[key]
+		res.samples = append(res.samples, exprSample{Labels: g.labels, Value: reduce(n.fn, g.values)})
+	}
+	return res
+}
+
+func (n *aggregateNode) names() []string {
+	return n.x.names()
+}
+
+// reduce applies aggregation function to non-empty values.
+func reduce(fn string, values []float64) float64 {
+	res := values[0]
+	switch fn {
+	case "count":
+		return float64(len(values))
+	case "min":
+		for _, v := range values[1:] {
+			res = math.Min(res, v)
+		}
+	case "max":
+		for _, v := range values[1:] {
+			res = math.Max(res, v)
+		}
+	default:
+		for _, v := range values[1:] {
+			res += v
+		}
+		if fn == "avg" {
+			res /= float64(len(values))
+		}
+	}
+	return res
+}
+
+// binaryNode applies an arithmetic operator or a comparison. Operators on samples of two selectors
+// match series with the same labels. A comparison keeps left samples for which it holds.
+type binaryNode struct {
+	op       string
+	lhs, rhs exprNode
+}
+
+func (n *binaryNode) eval(ec *evalContext) exprValue {
+	lhs, rhs := n.lhs.eval(ec), n.rhs.eval(ec)
+
+	switch {
+	case lhs.scalar && rhs.scalar:
+		if !isComparison(n.op) {
+			return exprValue{scalar: true, value: applyOp(n.op, lhs.value, rhs.value)}
+		}
+		var res exprValue
+		if compare(n.op, lhs.value, rhs.value) {
+			res.samples = []exprSample{{Value: lhs.value}}
+		}
+		return res
+	case rhs.scalar:
+		return combine(n.op, lhs.samples, func(labels metric.Labels) (float64, bool) { return rhs.value, true }, false)
+	case lhs.scalar:
+		return combine(n.op, rhs.samples, func(labels metric.Labels) (float64, bool) { return lhs.value, true }, true)
+	}
+
+	byLabels := make(map[string]float64, len(rhs.samples))
+	for _, s := range rhs.samples {
+		byLabels[s.Labels.String()] = s.Value
+	}
+	return combine(n.op, lhs.samples, func(labels metric.Labels) (float64, bool) {
+		v, ok := byLabels[labels.String()]
+		return v, ok
+	}, false)
+}
+
+func (n *binaryNode) names() []string {
+	return append(n.lhs.names(), n.rhs.names()...)
+}
+
+// combine applies op to samples and other operands found by labels. Samples without other operand are dropped.
+// If swapped, samples are the right operands.
+func combine(op string, samples []exprSample, other func(metric.Labels) (float64, bool), swapped bool) exprValue {
+	var res exprValue
+	for _, s := range samples {
+		o, ok := other(s.Labels)
+		if !ok {
+			continue
+		}
+		x, y := s.Value, o
+		if swapped {
+			x, y = o, s.Value
+		}
+		if !isComparison(op) {
+			res.samples = append(res.samples, exprSample{Labels: s.Labels, Value: applyOp(op, x, y)})
+		} else if compare(op, x, y) {
+			res.samples = append(res.samples, s)
+		}
+	}
+	return res
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func applyOp(op string, x, y float64) float64 {
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	default:
+		return x / y
+	}
+}
+
+func compare(op string, x, y float64) bool {
+	switch op {
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	case "==":
+		return x == y
+	default:
+		return x != y
+	}
+}
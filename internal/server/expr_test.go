@@ -0,0 +1,149 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTestExpr(t *testing.T, expr string) exprNode {
+	p, err := newParser(expr)
+	require.NoError(t, err)
+	n, err := p.parseCondition()
+	require.NoError(t, err)
+	require.Equal(t, tokEOF, p.tok.kind, "expression '%s' is not parsed completely", expr)
+	return n
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"FreeMemory <",
+		"FreeMemory < 5XB",
+		"(FreeMemory",
+		`FreeMemory{host=web1}`,
+		`FreeMemory{host="web1"`,
+		"rate(1)",
+		"rate(PollCount[5x])",
+		"FreeMemory # 1",
+		"Alloc*Frees > 1",
+		"A*B > 0",
+	} {
+		p, err := newParser(expr)
+		if err == nil {
+			_, err = p.parseCondition()
+		}
+		var exprErr *ExprError
+		assert.ErrorAs(t, err, &exprErr, expr)
+	}
+}
+
+func TestEvalExpr(t *testing.T) {
+	web1 := metric.Labels{"host": "web1"}
+	web2 := metric.Labels{"host": "web2"}
+	ec := &evalContext{
+		metrics: []metric.Metric{
+			{ID: "FreeMemory", MType: gauge, Labels: web1, Value: getFloatPointer(256 << 20)},
+			{ID: "FreeMemory", MType: gauge, Labels: web2, Value: getFloatPointer(1 << 30)},
+			{ID: "TotalMemory", MType: gauge, Labels: web1, Value: getFloatPointer(1 << 30)},
+			{ID: "PollCount", MType: counter, Labels: web1, Delta: getIntPointer(5)},
+		},
+		now: time.Now(),
+	}
+
+	tests := []struct {
+		expr string
+		want []exprSample
+	}{
+		{expr: "2 + 3 * 4 - -1", want: nil},
+		{expr: "1 + 1 == 2", want: []exprSample{{Value: 2}}},
+		{expr: "FreeMemory < 500MB", want: []exprSample{{Labels: web1, Value: 256 << 20}}},
+		{expr: `FreeMemory{host="web2"} >= 1GB`, want: []exprSample{{Labels: web2, Value: 1 << 30}}},
+		{expr: "(TotalMemory - FreeMemory) / TotalMemory * 100", want: []exprSample{{Labels: web1, Value: 75}}},
+		{expr: "100 - FreeMemory / 1MB > 0", want: nil},
+		{expr: "PollCount > 1", want: []exprSample{{Labels: web1, Value: 5}}},
+		{expr: "Unknown > 1", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			res := parseTestExpr(t, tt.expr).eval(ec)
+			assert.Equal(t, tt.want, res.samples)
+		})
+	}
+
+	res := parseTestExpr(t, "2 + 3 * 4 - -1").eval(ec)
+	assert.True(t, res.scalar)
+	assert.Equal(t, 15.0, res.value)
+}
+
+func TestEvalRate(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 10, 0, 0, time.UTC)
+	h := NewHistory(100)
+	for i, total := range []float64{10, 20, 40, 5} {
+		h.Append("PollCount", Sample{Timestamp: now.Add(time.Duration(i-3) * 20 * time.Second), Value: total})
+	}
+	h.Append("Stopped", Sample{Timestamp: now.Add(-5 * time.Minute), Value: 100})
+
+	ec := &evalContext{
+		metrics: []metric.Metric{
+			{ID: "PollCount", MType: counter, Delta: getIntPointer(5)},
+			{ID: "Stopped", MType: counter, Delta: getIntPointer(100)},
+		},
+		history: h,
+		now:     now,
+	}
+
+	// increases 10, 20 and 5 after reset within the last minute
+	res := parseTestExpr(t, "rate(PollCount)").eval(ec)
+	require.Len(t, res.samples, 1)
+	assert.Equal(t, 35.0/60, res.samples[0].Value)
+
+	res = parseTestExpr(t, "rate(PollCount[30s])").eval(ec)
+	assert.Equal(t, 25.0/30, res.samples[0].Value)
+
+	res = parseTestExpr(t, "rate(Stopped) == 0").eval(ec)
+	assert.Equal(t, []exprSample{{Value: 0}}, res.samples)
+	assert.Equal(t, []string{"Stopped"}, parseTestExpr(t, "rate(Stopped) == 0").names())
+}
+
+func TestEvalAggregations(t *testing.T) {
+	web1 := metric.Labels{"host": "web1"}
+	web2 := metric.Labels{"host": "web2"}
+	ec := &evalContext{
+		metrics: []metric.Metric{
+			{ID: "CPUutilization1", MType: gauge, Labels: web1, Value: getFloatPointer(10)},
+			{ID: "CPUutilization2", MType: gauge, Labels: web1, Value: getFloatPointer(30)},
+			{ID: "CPUutilization1", MType: gauge, Labels: web2, Value: getFloatPointer(50)},
+			{ID: "TotalMemory", MType: gauge, Labels: web1, Value: getFloatPointer(4)},
+		},
+		now: time.Now(),
+	}
+
+	tests := []struct {
+		expr string
+		want []exprSample
+	}{
+		{expr: "avg(CPUutilization*)", want: []exprSample{{Value: 30}}},
+		{expr: "avg(CPUutilization?) by (host)", want: []exprSample{{Labels: web1, Value: 20}, {Labels: web2, Value: 50}}},
+		{expr: "sum(CPUutilization*{host=\"web1\"})", want: []exprSample{{Value: 40}}},
+		{expr: "max(CPUutilization*) - min(CPUutilization*)", want: []exprSample{{Value: 40}}},
+		{expr: "count(CPUutilization*) by (host)", want: []exprSample{{Labels: web1, Value: 2}, {Labels: web2, Value: 1}}},
+		{expr: "avg(CPUutilization*) > 20", want: []exprSample{{Value: 30}}},
+		{expr: "sum(Unknown*)", want: nil},
+		// multiplication is not a glob
+		{expr: "TotalMemory*2", want: []exprSample{{Labels: web1, Value: 8}}},
+		{expr: "CPUutilization1 * TotalMemory", want: []exprSample{{Labels: web1, Value: 40}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			res := parseTestExpr(t, tt.expr).eval(ec)
+			assert.Equal(t, tt.want, res.samples)
+		})
+	}
+
+	assert.True(t, dependsOn(parseTestExpr(t, "avg(CPUutilization*)"), []string{"CPUutilization3"}))
+	assert.False(t, dependsOn(parseTestExpr(t, "avg(CPUutilization*)"), []string{"TotalMemory"}))
+}
@@ -10,8 +10,7 @@ import (
 
 // producer struct fo saving metrics to file.
 type producer struct {
-	file    *os.File
-	encoder *json.Encoder
+	file *os.File
 }
 
 // NewProducer returns new producer.
@@ -22,8 +21,7 @@ func NewProducer(filename string, flags int) (*producer, error) {
 	}
 
 	return &producer{
-		file:    file,
-		encoder: json.NewEncoder(file),
+		file: file,
 	}, nil
 }
 
@@ -32,9 +30,10 @@ func (p producer) Close() error {
 	return p.file.Close()
 }
 
-// WriteMetric encodes MetricList before saving to file.
-func (p producer) WriteMetric(MetricList *[]metric.Metric) error {
-	return p.encoder.Encode(&MetricList)
+// Write saves encoded metrics to file.
+func (p producer) Write(data []byte) error {
+	_, err := p.file.Write(data)
+	return err
 }
 
 // consumer struct for reading metrics from file.
@@ -57,7 +56,7 @@ func NewConsumer(filename string, flags int) (*consumer, error) {
 }
 
 // ReadEvents reads metrics from file, decodes them as MetricList.
-func (c *consumer) ReadEvents(metrics map[string]metric.Metric) error {
+func (c *consumer) ReadEvents(store *MetricStore) error {
 	var err error
 
 	defer func() {
@@ -71,7 +70,7 @@ func (c *consumer) ReadEvents(metrics map[string]metric.Metric) error {
 		return err
 	}
 	for _, i := range MetricList {
-		metrics[i.ID] = i
+		store.Upsert(i)
 	}
 	return nil
 }
@@ -6,7 +6,6 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/Jay-T/go-devops.git/internal/utils/metric"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,8 +23,9 @@ func TestReadEvents(t *testing.T) {
 		decoder: json.NewDecoder(data),
 	}
 
-	metrics := make(map[string]metric.Metric)
+	metrics := NewMetricStore()
 	err := c.ReadEvents(metrics)
+	assert.Equal(t, 3, metrics.Len())
 
 	assert.NoError(t, err, "Function returned error unexpectedly.")
 }
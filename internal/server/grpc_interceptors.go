@@ -12,35 +12,66 @@ import (
 )
 
 func (s *GRPCServer) checkIPInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.checkIP(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) checkReqIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkReqID(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// checkIPStreamInterceptor is checkIPInterceptor for streaming RPCs.
+func (s *GRPCServer) checkIPStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.checkIP(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// checkReqIDStreamInterceptor is checkReqIDInterceptor for streaming RPCs.
+func (s *GRPCServer) checkReqIDStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkReqID(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// checkIP checks that X-Real-Ip from metadata belongs to the trusted subnet. Request-ID must be checked before.
+func (s *GRPCServer) checkIP(ctx context.Context) error {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return nil, status.Error(codes.NotFound, "Not MD found when expected")
+		return status.Error(codes.NotFound, "Not MD found when expected")
 	}
 	reqID := md.Get("Request-ID")[0]
 	reqXRealIPList := md.Get("X-Real-Ip")
 	if len(reqXRealIPList) == 0 {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("X-Real-Ip is not found in MD. Req-ID: %s", reqID))
+		return status.Error(codes.NotFound, fmt.Sprintf("X-Real-Ip is not found in MD. Req-ID: %s", reqID))
 	}
 
 	reqXRealIP := reqXRealIPList[0]
 	ip := net.ParseIP(reqXRealIP)
 
 	if !s.trustedSubnet.Contains(ip) {
-		return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("X-Real-Ip is not trusted. Aborting request. Req-ID: %s", reqID))
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("X-Real-Ip is not trusted. Aborting request. Req-ID: %s", reqID))
 	}
-
-	return handler(ctx, req)
+	return nil
 }
 
-func (s *GRPCServer) checkReqIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+// checkReqID checks that metadata has Request-ID.
+func checkReqID(ctx context.Context) error {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return nil, status.Error(codes.NotFound, "Not MD found when expected")
+		return status.Error(codes.NotFound, "Not MD found when expected")
 	}
 
 	reqIDList := md.Get("Request-ID")
 	if len(reqIDList) == 0 {
-		return nil, status.Error(codes.NotFound, "Request-ID is not found in MD")
+		return status.Error(codes.NotFound, "Request-ID is not found in MD")
 	}
-	return handler(ctx, req)
+	return nil
 }
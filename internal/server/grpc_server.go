@@ -2,11 +2,13 @@ package server
 
 import (
 	"context"
-	"crypto/hmac"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	pb "github.com/Jay-T/go-devops.git/internal/pb"
 	"github.com/Jay-T/go-devops.git/internal/utils/converter"
@@ -16,7 +18,9 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // GRPCServer struct describes GRPC server based on GenericService.
@@ -47,13 +51,22 @@ func (s *GRPCServer) StartServer(ctx context.Context, backuper StorageBackuper)
 
 	interceptors := []grpc.UnaryServerInterceptor{
 		s.checkReqIDInterceptor,
+		s.agentRegistryInterceptor,
+	}
+
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		s.checkReqIDStreamInterceptor,
 	}
 
 	if s.Cfg.TrustedSubnet != "" {
 		interceptors = append(interceptors, s.checkIPInterceptor)
+		streamInterceptors = append(streamInterceptors, s.checkIPStreamInterceptor)
 	}
 
-	server := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(interceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
 	pb.RegisterMetricsAgentServer(server, s)
 	reflection.Register(server)
 
@@ -78,23 +91,17 @@ func (s *GRPCServer) UpdateMetric(ctx context.Context, in *pb.UpdateMetricReques
 			Error: fmt.Sprintf("Could not convert received data. Req-id: %s", reqID),
 		}, nil
 	}
-	var remoteHash []byte
-
-	if s.Cfg.Key != "" {
-		localHash := m.GenerateHash(s.Cfg.Key)
-		remoteHash, err = hex.DecodeString(m.Hash)
-		if err != nil {
-			return &pb.UpdateMetricResponse{
-				Error: fmt.Sprintf("Hash validation error. Req-id: %s", reqID),
-			}, nil
-		}
-		if !hmac.Equal(localHash, remoteHash) {
-			return &pb.UpdateMetricResponse{
-				Error: fmt.Sprintf("Hash validation error. Req-id: %s", reqID),
-			}, nil
-		}
+	if !s.validHash(m) {
+		return &pb.UpdateMetricResponse{
+			Error: fmt.Sprintf("Hash validation error. Req-id: %s", reqID),
+		}, nil
+	}
+	setSource(m, helpers.GetSource(ctx))
+	if err = s.saveMetric(ctx, m); err != nil {
+		return &pb.UpdateMetricResponse{
+			Error: fmt.Sprintf("Invalid metric: %s. Req-id: %s", err, reqID),
+		}, nil
 	}
-	s.saveMetric(ctx, m)
 
 	return &pb.UpdateMetricResponse{}, nil
 }
@@ -103,21 +110,36 @@ func (s *GRPCServer) UpdateMetric(ctx context.Context, in *pb.UpdateMetricReques
 func (s *GRPCServer) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
 	reqID := helpers.GetReqID(ctx)
 
+	source := helpers.GetSource(ctx)
 	mList := make([]metric.Metric, 0, 43)
-	for _, i := range in.Metrics {
+	var rejected []string
+	for idx, i := range in.Metrics {
 		m, err := converter.ConvertData(i)
 		if err != nil {
 			return &pb.UpdateMetricsResponse{
 				Error: fmt.Sprintf("Could not convert received data. Req-id: %s", reqID),
 			}, nil
 		}
+		if err = validateMetric(m); err == nil && !s.validHash(m) {
+			err = errors.New("hash validation error")
+		}
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("metric %d: %s", idx, err))
+			continue
+		}
+		setSource(m, source)
 		mList = append(mList, *m)
 	}
 
-	err := s.saveListToDB(ctx, &mList)
+	// a batch which is not saved is not refused, the agent keeps it and sends it again
+	err := s.saveBatch(ctx, helpers.GetBatchID(ctx), &mList)
 	if err != nil {
+		log.Print(err)
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("Could not save received data to storage. Req-id: %s", reqID))
+	}
+	if len(rejected) > 0 {
 		return &pb.UpdateMetricsResponse{
-			Error: fmt.Sprintf("Could not save received data to storage. Req-id: %s", reqID),
+			Error: fmt.Sprintf("Invalid metrics: %s. Req-id: %s", strings.Join(rejected, "; "), reqID),
 		}, nil
 	}
 
@@ -127,9 +149,13 @@ func (s *GRPCServer) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequ
 func (s *GRPCServer) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
 	reqID := helpers.GetReqID(ctx)
 
-	m, found := s.Metrics[in.Id]
-	if !found {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("Unknown metric id: %s. Req-id: %s", in.Id, reqID))
+	key := metric.SeriesKey(in.Id, in.Labels)
+	m, err := s.Metrics.Find(in.Id, in.Labels)
+	if errors.Is(err, ErrAmbiguousMetric) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Metric id %s has several series, labels are required. Req-id: %s", key, reqID))
+	}
+	if err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Unknown metric id: %s. Req-id: %s", key, reqID))
 	}
 
 	mpb := m.ConvertMetricToPB(s.Cfg.Key)
@@ -139,10 +165,11 @@ func (s *GRPCServer) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*p
 	}, nil
 }
 
-func (s *GRPCServer) GetAllMetrics(ctx context.Context, in *emptypb.Empty) (*pb.GetAllMetricsResponse, error) {
+// GetAllMetrics returns all metrics or metrics of a particular agent if source is set.
+func (s *GRPCServer) GetAllMetrics(ctx context.Context, in *pb.GetAllMetricsRequest) (*pb.GetAllMetricsResponse, error) {
 	var mList []*pb.Metric
 
-	for _, m := range s.Metrics {
+	for _, m := range filterBySource(s.Metrics.List(), in.Source) {
 		mpb := m.ConvertMetricToPB(s.Cfg.Key)
 		mList = append(mList, mpb)
 	}
@@ -152,6 +179,55 @@ func (s *GRPCServer) GetAllMetrics(ctx context.Context, in *emptypb.Empty) (*pb.
 	}, nil
 }
 
+// QueryRange returns history of a metric aggregated by steps.
+func (s *GRPCServer) QueryRange(ctx context.Context, in *pb.QueryRangeRequest) (*pb.QueryRangeResponse, error) {
+	reqID := helpers.GetReqID(ctx)
+
+	q := RangeQuery{
+		ID:          in.Id,
+		Labels:      in.Labels,
+		Step:        in.Step.AsDuration(),
+		Aggregation: in.Aggregation,
+	}
+	if in.From != nil {
+		q.From = in.From.AsTime()
+	}
+	if in.To != nil {
+		q.To = in.To.AsTime()
+	}
+
+	res, err := s.queryRange(ctx, q)
+	var queryErr *QueryError
+	switch {
+	case errors.Is(err, ErrMetricNotFound):
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Unknown metric id: %s. Req-id: %s", metric.SeriesKey(in.Id, in.Labels), reqID))
+	case errors.Is(err, ErrAmbiguousMetric):
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Metric id %s has several series, labels are required. Req-id: %s", metric.SeriesKey(in.Id, in.Labels), reqID))
+	case errors.As(err, &queryErr):
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s. Req-id: %s", queryErr, reqID))
+	case err != nil:
+		log.Print(err)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("could not load metric history. Req-id: %s", reqID))
+	}
+
+	points := make([]*pb.Sample, 0, len(res.Points))
+	for _, p := range res.Points {
+		points = append(points, &pb.Sample{
+			Timestamp: timestamppb.New(p.Timestamp),
+			Value:     p.Value,
+		})
+	}
+
+	return &pb.QueryRangeResponse{
+		Id:          res.ID,
+		Labels:      res.Labels,
+		Mtype:       res.MType,
+		Aggregation: res.Aggregation,
+		Step:        durationpb.New(res.Step),
+		Points:      points,
+	}, nil
+}
+
 func (s *GRPCServer) CheckStorageStatus(ctx context.Context, in *emptypb.Empty) (*emptypb.Empty, error) {
 	if err := s.backuper.CheckStorageStatus(ctx); err != nil {
 		return nil, status.Error(codes.Internal, "storage is inaccesible.")
@@ -159,3 +235,182 @@ func (s *GRPCServer) CheckStorageStatus(ctx context.Context, in *emptypb.Empty)
 
 	return &emptypb.Empty{}, nil
 }
+
+// Heartbeat accepts a heartbeat of an agent which has no metrics to report.
+// The agent is registered by agentRegistryInterceptor.
+func (s *GRPCServer) Heartbeat(ctx context.Context, in *emptypb.Empty) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+// ListAgents returns agents known to server.
+func (s *GRPCServer) ListAgents(ctx context.Context, in *emptypb.Empty) (*pb.ListAgentsResponse, error) {
+	agents := s.agents.list(time.Now())
+	res := make([]*pb.AgentInfo, 0, len(agents))
+	for _, a := range agents {
+		res = append(res, &pb.AgentInfo{
+			Id:             a.ID,
+			Version:        a.Version,
+			Transport:      a.Transport,
+			Address:        a.Address,
+			ReportInterval: durationpb.New(a.ReportInterval),
+			FirstSeen:      timestamppb.New(a.FirstSeen),
+			LastSeen:       timestamppb.New(a.LastSeen),
+			Stale:          a.Stale,
+		})
+	}
+
+	return &pb.ListAgentsResponse{
+		Agents: res,
+	}, nil
+}
+
+// ListAlerts returns alerts in the requested state or all alerts if state is not set.
+func (s *GRPCServer) ListAlerts(ctx context.Context, in *pb.ListAlertsRequest) (*pb.ListAlertsResponse, error) {
+	reqID := helpers.GetReqID(ctx)
+
+	if !validAlertState(in.State) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unknown alert state '%s'. Req-id: %s", in.State, reqID))
+	}
+
+	alerts := s.alerts.list(in.State)
+	res := make([]*pb.Alert, 0, len(alerts))
+	for _, a := range alerts {
+		apb := &pb.Alert{
+			Rule:     a.Rule,
+			Expr:     a.Expr,
+			Labels:   a.Labels,
+			State:    a.State,
+			Value:    a.Value,
+			ActiveAt: timestamppb.New(a.ActiveAt),
+		}
+		if !a.FiredAt.IsZero() {
+			apb.FiredAt = timestamppb.New(a.FiredAt)
+		}
+		if !a.ResolvedAt.IsZero() {
+			apb.ResolvedAt = timestamppb.New(a.ResolvedAt)
+		}
+		res = append(res, apb)
+	}
+
+	return &pb.ListAlertsResponse{
+		Alerts: res,
+	}, nil
+}
+
+// Subscribe streams updates of metrics passing the request filter on ID prefix, type and source.
+// The first response is a snapshot of current values, updates follow.
+// A client which does not keep up with updates gets a new snapshot instead of the missed ones.
+func (s *GRPCServer) Subscribe(in *pb.SubscribeRequest, stream pb.MetricsAgent_SubscribeServer) error {
+	ctx := stream.Context()
+	reqID := helpers.GetReqID(ctx)
+
+	switch in.Mtype {
+	case "", gauge, counter, histogram, summary:
+	default:
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Unknown metric type '%s'. Req-id: %s", in.Mtype, reqID))
+	}
+
+	sub := s.updates.subscribe(func(m metric.Metric) bool {
+		return strings.HasPrefix(m.ID, in.IdPrefix) &&
+			(in.Mtype == "" || m.MType == in.Mtype) &&
+			(in.Source == "" || m.Labels[sourceLabel] == in.Source)
+	})
+	defer s.updates.unsubscribe(sub)
+
+	err := s.sendUpdates(stream, sub.snapshot(s.Metrics), true)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case m := <-sub.ch:
+			if sub.lagged() {
+				err = s.sendUpdates(stream, sub.snapshot(s.Metrics), true)
+				break
+			}
+			// updates buffered by now are sent together
+			mList := []metric.Metric{m}
+			for n := len(sub.ch); n > 0; n-- {
+				mList = append(mList, <-sub.ch)
+			}
+			err = s.sendUpdates(stream, mList, false)
+		case <-ctx.Done():
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendUpdates sends metrics to Subscribe stream.
+func (s *GRPCServer) sendUpdates(stream pb.MetricsAgent_SubscribeServer, mList []metric.Metric, snapshot bool) error {
+	res := &pb.SubscribeResponse{
+		Metrics:  make([]*pb.Metric, 0, len(mList)),
+		Snapshot: snapshot,
+	}
+	for _, m := range mList {
+		res.Metrics = append(res.Metrics, m.ConvertMetricToPB(s.Cfg.Key))
+	}
+	return stream.Send(res)
+}
+
+// StreamMetrics receives batches of metrics over a long-lived stream and acknowledges each of them.
+// Invalid metrics are skipped and reported in the acknowledgement, the rest of the batch is saved.
+// A batch which has been already received is acknowledged without saving it again.
+// The stream is closed with Unavailable if a batch could not be saved to storage, so the agent sends it again.
+func (s *GRPCServer) StreamMetrics(stream pb.MetricsAgent_StreamMetricsServer) error {
+	ctx := stream.Context()
+	if err := s.checkAgentID(ctx); err != nil {
+		return err
+	}
+	reqID := helpers.GetReqID(ctx)
+	source := helpers.GetSource(ctx)
+
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.agents.seen(grpcAgentInfo(ctx), time.Now())
+
+		res := &pb.StreamMetricsResponse{
+			BatchId: in.BatchId,
+		}
+		mList := make([]metric.Metric, 0, len(in.Metrics))
+		for i, mpb := range in.Metrics {
+			m, err := converter.ConvertData(mpb)
+			if err == nil {
+				err = validateMetric(m)
+			}
+			if err == nil && !s.validHash(m) {
+				err = errors.New("hash validation error")
+			}
+			if err != nil {
+				res.Rejected = append(res.Rejected, &pb.RejectedMetric{
+					Index:  uint32(i),
+					Id:     mpb.Id,
+					Reason: err.Error(),
+				})
+				continue
+			}
+			setSource(m, source)
+			mList = append(mList, *m)
+		}
+		res.Accepted = uint32(len(mList))
+
+		if len(mList) > 0 {
+			err = s.saveBatch(ctx, in.BatchId, &mList)
+			if err != nil {
+				log.Print(err)
+				return status.Error(codes.Unavailable, fmt.Sprintf("Could not save received data to storage. Req-id: %s", reqID))
+			}
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/helpers"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// subscribeStream is a server side of Subscribe stream which hands responses over to the test one by one.
+type subscribeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan *pb.SubscribeResponse
+}
+
+func (ss *subscribeStream) Context() context.Context {
+	return ss.ctx
+}
+
+func (ss *subscribeStream) Send(res *pb.SubscribeResponse) error {
+	select {
+	case ss.sent <- res:
+		return nil
+	case <-ss.ctx.Done():
+		return ss.ctx.Err()
+	}
+}
+
+func (ss *subscribeStream) recv(t *testing.T) *pb.SubscribeResponse {
+	select {
+	case res := <-ss.sent:
+		return res
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no response from Subscribe")
+		return nil
+	}
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	service := newSourceService(t)
+	service.updates = newBroker()
+	s := &GRPCServer{GenericService: service}
+	web1 := metric.Labels{sourceLabel: "web1"}
+	web2 := metric.Labels{sourceLabel: "web2"}
+	s.applyMetric(metric.Metric{ID: "Alloc", MType: gauge, Labels: web1, Value: getFloatPointer(1)})
+	s.applyMetric(metric.Metric{ID: "Alloc", MType: gauge, Labels: web2, Value: getFloatPointer(2)})
+	s.applyMetric(metric.Metric{ID: "AllocCount", MType: counter, Labels: web1, Delta: getIntPointer(3)})
+	s.applyMetric(metric.Metric{ID: "FreeMemory", MType: gauge, Labels: web1, Value: getFloatPointer(4)})
+
+	ctx, cancel := context.WithCancel(metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test")))
+	defer cancel()
+	stream := &subscribeStream{ctx: ctx, sent: make(chan *pb.SubscribeResponse)}
+
+	err := s.Subscribe(&pb.SubscribeRequest{Mtype: "timer"}, stream)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	done := make(chan error)
+	go func() {
+		done <- s.Subscribe(&pb.SubscribeRequest{IdPrefix: "Alloc", Mtype: gauge, Source: "web1"}, stream)
+	}()
+
+	res := stream.recv(t)
+	assert.True(t, res.Snapshot)
+	require.Len(t, res.Metrics, 1)
+	assert.Equal(t, "Alloc", res.Metrics[0].Id)
+	assert.Equal(t, 1.0, *res.Metrics[0].Value)
+
+	s.applyMetric(metric.Metric{ID: "Alloc", MType: gauge, Labels: web2, Value: getFloatPointer(20)})
+	s.applyMetric(metric.Metric{ID: "AllocCount", MType: counter, Labels: web1, Delta: getIntPointer(30)})
+	s.applyMetric(metric.Metric{ID: "Alloc", MType: gauge, Labels: web1, Value: getFloatPointer(10)})
+	res = stream.recv(t)
+	assert.False(t, res.Snapshot)
+	require.Len(t, res.Metrics, 1)
+	assert.Equal(t, 10.0, *res.Metrics[0].Value)
+
+	// ingestion goes on while the client does not read, the client catches up with a snapshot afterwards
+	final := float64(3*subscriptionBuffer - 1)
+	for i := 0; i < 3*subscriptionBuffer; i++ {
+		s.applyMetric(metric.Metric{ID: "Alloc", MType: gauge, Labels: web1, Value: getFloatPointer(float64(i))})
+	}
+	var snapshot bool
+	for i := 0; i < 4; i++ {
+		res = stream.recv(t)
+		snapshot = snapshot || res.Snapshot
+		// responses taken while updates were coming may be stale
+		if *res.Metrics[len(res.Metrics)-1].Value == final {
+			break
+		}
+	}
+	assert.True(t, snapshot)
+	assert.Equal(t, final, *res.Metrics[len(res.Metrics)-1].Value)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestStreamInterceptors(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	s := &GRPCServer{GenericService: &GenericService{trustedSubnet: subnet}}
+	handler := func(srv interface{}, ss grpc.ServerStream) error { return nil }
+	info := &grpc.StreamServerInfo{FullMethod: "/go_devops_advanced.MetricsAgent/Subscribe", IsServerStream: true}
+
+	stream := &subscribeStream{ctx: context.Background()}
+	assert.Equal(t, codes.NotFound, status.Code(s.checkReqIDStreamInterceptor(nil, stream, info, handler)))
+
+	stream.ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test", "X-Real-Ip", "10.0.1.1"))
+	assert.NoError(t, s.checkReqIDStreamInterceptor(nil, stream, info, handler))
+	assert.Equal(t, codes.PermissionDenied, status.Code(s.checkIPStreamInterceptor(nil, stream, info, handler)))
+
+	stream.ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test", "X-Real-Ip", "10.0.0.1"))
+	assert.NoError(t, s.checkIPStreamInterceptor(nil, stream, info, handler))
+}
+
+// metricsStream is a server side of StreamMetrics stream fed with requests by the test.
+type metricsStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs []*pb.StreamMetricsRequest
+	acks []*pb.StreamMetricsResponse
+}
+
+func (ms *metricsStream) Context() context.Context {
+	return ms.ctx
+}
+
+func (ms *metricsStream) Recv() (*pb.StreamMetricsRequest, error) {
+	if len(ms.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := ms.reqs[0]
+	ms.reqs = ms.reqs[1:]
+	return req, nil
+}
+
+func (ms *metricsStream) Send(res *pb.StreamMetricsResponse) error {
+	ms.acks = append(ms.acks, res)
+	return nil
+}
+
+func TestGRPCStreamMetrics(t *testing.T) {
+	service := newSourceService(t)
+	service.Cfg.Key = "secret"
+	service.agents = newAgentRegistry(defaultAgentStaleIntervals, defaultAgentEvictAfter)
+	s := &GRPCServer{GenericService: service}
+
+	signed := func(m metric.Metric) *pb.Metric {
+		return m.ConvertMetricToPB(service.Cfg.Key)
+	}
+	unsigned := metric.Metric{ID: "Unsigned", MType: gauge, Value: getFloatPointer(1)}
+	batch := []*pb.Metric{
+		signed(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(10)}),
+		signed(metric.Metric{ID: "PollCount", MType: counter, Delta: getIntPointer(5)}),
+		unsigned.ConvertMetricToPB(""),
+		signed(metric.Metric{ID: "Timer", MType: "timer", Value: getFloatPointer(1)}),
+		signed(metric.Metric{ID: "Latency", MType: histogram, Histogram: &metric.Histogram{Bounds: []float64{1}, Counts: []uint64{1}}}),
+		{Id: "NoValue", Mtype: gauge},
+	}
+	stream := &metricsStream{
+		ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+			"Request-ID", "test",
+			"Agent-ID", "web1",
+			"Agent-Signature", helpers.AgentSignature(service.Cfg.Key, "web1"),
+		)),
+		reqs: []*pb.StreamMetricsRequest{
+			{BatchId: "batch1", Metrics: batch},
+			{BatchId: "batch1", Metrics: batch},
+			{BatchId: "batch2", Metrics: batch[1:2]},
+		},
+	}
+	require.NoError(t, s.StreamMetrics(stream))
+
+	require.Len(t, stream.acks, 3)
+	ack := stream.acks[0]
+	assert.Equal(t, "batch1", ack.BatchId)
+	assert.Equal(t, uint32(2), ack.Accepted)
+	assert.Empty(t, ack.Error)
+	require.Len(t, ack.Rejected, 4)
+	assert.Equal(t, uint32(2), ack.Rejected[0].Index)
+	assert.Equal(t, "Unsigned", ack.Rejected[0].Id)
+	assert.Equal(t, "hash validation error", ack.Rejected[0].Reason)
+	assert.Equal(t, "Timer", ack.Rejected[1].Id)
+	assert.Equal(t, "Latency", ack.Rejected[2].Id)
+	assert.Equal(t, "NoValue", ack.Rejected[3].Id)
+	assert.Equal(t, "gauge has no value", ack.Rejected[3].Reason)
+
+	// replayed batch is acknowledged but not applied twice
+	assert.Equal(t, "batch1", stream.acks[1].BatchId)
+	m, ok := service.Metrics.Get(`PollCount{source="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, int64(10), *m.Delta)
+	m, ok = service.Metrics.Get(`Alloc{source="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, 10.0, *m.Value)
+
+	agents := service.agents.list(time.Now())
+	require.Len(t, agents, 1)
+	assert.Equal(t, "web1", agents[0].ID)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxPendingSamples limits samples waiting to be saved to storage.
+const maxPendingSamples = 100000
+
+// Sample is a metric value at a moment. Counters are sampled as their totals.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// MetricSample is a sample of a particular metric series. ID is the series key, see metric.SeriesKey.
+type MetricSample struct {
+	ID string `json:"id"`
+	Sample
+}
+
+// ringBuffer keeps the latest samples of a metric.
+type ringBuffer struct {
+	samples []Sample
+	start   int
+}
+
+func (rb *ringBuffer) add(s Sample, size int) {
+	if len(rb.samples) < size {
+		rb.samples = append(rb.samples, s)
+		return
+	}
+	rb.samples[rb.start] = s
+	rb.start = (rb.start + 1) % len(rb.samples)
+}
+
+// at returns i-th sample counting from the oldest.
+func (rb *ringBuffer) at(i int) Sample {
+	return rb.samples[(rb.start+i)%len(rb.samples)]
+}
+
+// ordered returns samples from the oldest to the newest.
+func (rb *ringBuffer) ordered() []Sample {
+	res := make([]Sample, 0, len(rb.samples))
+	res = append(res, rb.samples[rb.start:]...)
+	return append(res, rb.samples[:rb.start]...)
+}
+
+// History keeps the latest samples of every metric in memory and queues new samples for storage.
+// It is safe for concurrent use.
+type History struct {
+	mu       sync.RWMutex
+	size     int
+	series   map[string]*ringBuffer
+	pending  []MetricSample
+	restored bool
+}
+
+// NewHistory returns History which keeps up to size samples per metric in memory.
+// Zero size disables in-memory history, samples are only queued for storage then.
+func NewHistory(size int) *History {
+	return &History{
+		size:   size,
+		series: map[string]*ringBuffer{},
+	}
+}
+
+// Append records a new sample of metric id.
+func (h *History) Append(id string, s Sample) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(id, s)
+	if len(h.pending) >= maxPendingSamples {
+		h.pending = h.pending[1:]
+	}
+	h.pending = append(h.pending, MetricSample{ID: id, Sample: s})
+}
+
+func (h *History) add(id string, s Sample) {
+	if h.size <= 0 {
+		return
+	}
+	rb, ok := h.series[id]
+	if !ok {
+		rb = &ringBuffer{}
+		h.series[id] = rb
+	}
+	rb.add(s, h.size)
+}
+
+// Restore loads samples saved by a previous run. They are not queued for storage again.
+func (h *History) Restore(samples []MetricSample) {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range samples {
+		h.add(s.ID, s.Sample)
+	}
+	h.restored = true
+}
+
+// covers reports whether in-memory history of metric id holds all samples since from,
+// so there is no need to look into storage.
+func (h *History) covers(id string, from time.Time) bool {
+	if h == nil {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rb, ok := h.series[id]
+	if !ok || len(rb.samples) == 0 {
+		return false
+	}
+	if !rb.samples[rb.start].Timestamp.After(from) {
+		return true
+	}
+	// nothing has been evicted and older samples of previous runs are loaded
+	return len(rb.samples) < h.size && h.restored
+}
+
+// Range returns samples of metric id with timestamps in [from, to] from the oldest to the newest.
+// Zero from or to means no bound.
+func (h *History) Range(id string, from, to time.Time) []Sample {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rb, ok := h.series[id]
+	if !ok {
+		return nil
+	}
+
+	var res []Sample
+	for _, s := range rb.ordered() {
+		if (!from.IsZero() && s.Timestamp.Before(from)) || (!to.IsZero() && s.Timestamp.After(to)) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// RangeWithBase returns samples of metric id with timestamps in (from, to] from the oldest to the newest,
+// preceded by the latest sample at or before from, which is a base of increases over the range.
+func (h *History) RangeWithBase(id string, from, to time.Time) []Sample {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rb, ok := h.series[id]
+	if !ok {
+		return nil
+	}
+
+	n := len(rb.samples)
+	i := sort.Search(n, func(i int) bool { return rb.at(i).Timestamp.After(from) })
+	if i > 0 {
+		i--
+	}
+	var res []Sample
+	for ; i < n; i++ {
+		s := rb.at(i)
+		if s.Timestamp.After(to) {
+			break
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// takePending returns samples which have not been saved to storage yet.
+func (h *History) takePending() []MetricSample {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pending := h.pending
+	h.pending = nil
+	return pending
+}
+
+// returnPending queues samples which could not be saved to storage again ahead of the newer ones.
+// The oldest samples are dropped if more than maxPendingSamples are waiting.
+func (h *History) returnPending(samples []MetricSample) {
+	if h == nil || len(samples) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pending := make([]MetricSample, 0, len(samples)+len(h.pending))
+	pending = append(append(pending, samples...), h.pending...)
+	if len(pending) > maxPendingSamples {
+		pending = pending[len(pending)-maxPendingSamples:]
+	}
+	h.pending = pending
+}
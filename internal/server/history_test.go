@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryRingBuffer(t *testing.T) {
+	h := NewHistory(3)
+	start := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		h.Append("Alloc", Sample{Timestamp: start.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+
+	samples := h.Range("Alloc", time.Time{}, time.Time{})
+	require.Len(t, samples, 3)
+	assert.Equal(t, []float64{2, 3, 4}, []float64{samples[0].Value, samples[1].Value, samples[2].Value})
+
+	samples = h.Range("Alloc", start.Add(3*time.Second), start.Add(3*time.Second))
+	require.Len(t, samples, 1)
+	assert.Equal(t, float64(3), samples[0].Value)
+
+	assert.Empty(t, h.Range("Unknown", time.Time{}, time.Time{}))
+
+	// the latest sample up to from is a base of the range
+	samples = h.RangeWithBase("Alloc", start.Add(3*time.Second), start.Add(4*time.Second))
+	assert.Equal(t, []Sample{{Timestamp: start.Add(3 * time.Second), Value: 3}, {Timestamp: start.Add(4 * time.Second), Value: 4}}, samples)
+	samples = h.RangeWithBase("Alloc", start.Add(3500*time.Millisecond), start.Add(3500*time.Millisecond))
+	assert.Equal(t, []Sample{{Timestamp: start.Add(3 * time.Second), Value: 3}}, samples)
+	samples = h.RangeWithBase("Alloc", start, start.Add(2*time.Second))
+	assert.Equal(t, []Sample{{Timestamp: start.Add(2 * time.Second), Value: 2}}, samples)
+	assert.Empty(t, h.RangeWithBase("Unknown", start, start))
+
+	assert.Len(t, h.takePending(), 5)
+	assert.Empty(t, h.takePending())
+}
+
+func TestApplyMetricRecordsHistory(t *testing.T) {
+	s := GenericService{
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		history: NewHistory(10),
+	}
+	ctx := context.TODO()
+
+	mList := []metric.Metric{
+		{ID: "Alloc", MType: gauge, Value: getFloatPointer(1.5)},
+		{ID: "PollCount", MType: counter, Delta: getIntPointer(2)},
+		{ID: "PollCount", MType: counter, Delta: getIntPointer(3)},
+	}
+	require.NoError(t, s.saveListToDB(ctx, &mList))
+
+	counterSamples := s.history.Range("PollCount", time.Time{}, time.Time{})
+	require.Len(t, counterSamples, 2)
+	assert.Equal(t, float64(5), counterSamples[1].Value)
+
+	restored, err := s.backuper.RestoreHistory(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, restored, 2)
+	for _, sample := range restored {
+		if sample.ID == "PollCount" {
+			assert.Equal(t, float64(5), sample.Value)
+		}
+	}
+}
+
+func TestSaveMetricPeriodicBackup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+	s := GenericService{
+		Cfg:      &Config{StoreFile: filename, StoreInterval: time.Minute},
+		Metrics:  NewMetricStore(),
+		backuper: &FileStorageBackuper{filename: filename},
+		counters: newCounterRegistry(),
+		history:  NewHistory(10),
+	}
+	ctx := context.TODO()
+
+	// storage is left to StartRecordInterval, history samples are kept pending for it
+	require.NoError(t, s.saveMetric(ctx, &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1)}))
+	_, err := os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, s.backup(ctx, s.backuper))
+	restored, err := s.backuper.RestoreHistory(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, restored, 1)
+	assert.Equal(t, float64(1), restored[0].Value)
+
+	// without periodic saving a metric is saved right away
+	s.Cfg.StoreInterval = 0
+	require.NoError(t, s.saveMetric(ctx, &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(2)}))
+	restored, err = s.backuper.RestoreHistory(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, restored, 1)
+	assert.Equal(t, float64(2), restored[0].Value)
+}
+
+func TestSaveHistoryFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	s := GenericService{history: NewHistory(10)}
+	backuper := &FileStorageBackuper{filename: filepath.Join(dir, "metrics.json")}
+	ctx := context.TODO()
+	start := time.Unix(1000, 0)
+
+	s.history.Append("Alloc", Sample{Timestamp: start, Value: 1})
+	s.history.Append("Alloc", Sample{Timestamp: start.Add(time.Second), Value: 2})
+	assert.Error(t, s.saveHistory(ctx, backuper))
+
+	// samples which were not saved are saved next time before the new ones
+	s.history.Append("Alloc", Sample{Timestamp: start.Add(2 * time.Second), Value: 3})
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	require.NoError(t, s.saveHistory(ctx, backuper))
+	assert.Empty(t, s.history.takePending())
+
+	restored, err := backuper.RestoreHistory(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, restored, 3)
+	for i, sample := range restored {
+		assert.Equal(t, float64(i+1), sample.Value)
+	}
+}
+
+func TestReturnPendingLimit(t *testing.T) {
+	h := NewHistory(0)
+	start := time.Unix(1000, 0)
+	h.Append("Alloc", Sample{Timestamp: start, Value: -1})
+	taken := h.takePending()
+	for i := 0; i < maxPendingSamples; i++ {
+		h.Append("Alloc", Sample{Timestamp: start.Add(time.Duration(i+1) * time.Second), Value: float64(i)})
+	}
+
+	// the oldest samples are dropped
+	h.returnPending(taken)
+	pending := h.takePending()
+	require.Len(t, pending, maxPendingSamples)
+	assert.Equal(t, float64(0), pending[0].Value)
+}
+
+func TestFileRestoreHistoryCorruptedTail(t *testing.T) {
+	fs := &FileStorageBackuper{filename: filepath.Join(t.TempDir(), "metrics.json")}
+	ctx := context.TODO()
+
+	samples, err := fs.RestoreHistory(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	require.NoError(t, fs.SaveSamples(ctx, []MetricSample{{ID: "Alloc", Sample: Sample{Timestamp: time.Unix(1000, 0), Value: 1}}}))
+	f, err := os.OpenFile(fs.historyFile(), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":"Alloc","times`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	samples, err = fs.RestoreHistory(ctx, 10)
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+}
+
+func TestDBHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		err = db.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	ctx := context.TODO()
+	dbs := &DBStorageBackuper{db: db}
+	sample := MetricSample{ID: "Alloc", Sample: Sample{Timestamp: time.Now(), Value: 1.5}}
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`INSERT INTO metric_history`).ExpectExec().
+		WithArgs(sample.ID, sample.Timestamp, sample.Value).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, dbs.SaveSamples(ctx, []MetricSample{sample}))
+
+	rows := sqlmock.NewRows([]string{"id", "ts", "value"}).AddRow(sample.ID, sample.Timestamp, sample.Value)
+	mock.ExpectQuery(`SELECT id, ts, value FROM`).WithArgs(100).WillReturnRows(rows)
+	samples, err := dbs.RestoreHistory(ctx, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []MetricSample{sample}, samples)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -8,35 +8,45 @@ import (
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"path"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/Jay-T/go-devops.git/internal/utils/converter"
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/go-chi/chi/v5"
 )
 
+// streamKeepAliveInterval is how often an idle metric stream is written to.
+const streamKeepAliveInterval = 15 * time.Second
+
 //go:embed metrics.html
 var htmlPage []byte
 
 // GetAllMetricHandler returns HTML page with all metrics values.
+// Metrics of a particular agent are returned if source query parameter is set.
 // URI: "/".
 func (s HTTPServer) GetAllMetricHandler(w http.ResponseWriter, r *http.Request) {
-	var floatVal float64
-	dataMap := map[string]float64{}
+	dataMap := map[string]string{}
 
-	for key, val := range s.Metrics {
-		if val.MType == gauge {
-			floatVal = *val.Value
-		} else {
-			floatVal = float64(*val.Delta)
+	for _, val := range filterBySource(s.Metrics.List(), r.URL.Query().Get("source")) {
+		switch {
+		case val.MType == gauge && val.Value != nil:
+			dataMap[val.SeriesKey()] = fmt.Sprint(*val.Value)
+		case val.MType == counter && val.Delta != nil:
+			dataMap[val.SeriesKey()] = fmt.Sprint(*val.Delta)
+		case val.Histogram != nil:
+			dataMap[val.SeriesKey()] = fmt.Sprintf("count: %d, sum: %v", val.Histogram.Count, val.Histogram.Sum)
+		case val.Summary != nil:
+			dataMap[val.SeriesKey()] = fmt.Sprintf("count: %d, sum: %v", val.Summary.Count, val.Summary.Sum)
 		}
-		dataMap[key] = floatVal
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -71,7 +81,11 @@ func (s HTTPServer) SetMetricHandler(ctx context.Context) http.HandlerFunc {
 			http.Error(w, "Internal error during JSON parsing", http.StatusInternalServerError)
 			return
 		}
-		s.saveMetric(ctx, m)
+		setSource(m, requestSource(r))
+		if err = s.saveMetric(ctx, m); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid metric: %s", err), http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		err = r.Body.Close()
 		if err != nil {
@@ -81,6 +95,8 @@ func (s HTTPServer) SetMetricHandler(ctx context.Context) http.HandlerFunc {
 }
 
 // SetMetricListHandler saves a list of metrics from HTTP POST request.
+// Invalid metrics and metrics with a wrong hash are skipped and the rest of the batch is saved, the response is 400 then.
+// A batch which could not be saved to storage gets 500, so the agent keeps it and sends it again.
 // URI: "/updates/".
 func (s HTTPServer) SetMetricListHandler(ctx context.Context) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -92,12 +108,32 @@ func (s HTTPServer) SetMetricListHandler(ctx context.Context) http.HandlerFunc {
 		m := make([]metric.Metric, 0, 43)
 		err = json.Unmarshal(body, &m)
 		if err != nil {
-			http.Error(w, "Internal error during JSON parsing", http.StatusInternalServerError)
+			http.Error(w, "Could not parse metrics", http.StatusBadRequest)
 			return
 		}
-		err = s.saveListToDB(ctx, &m)
+		source := requestSource(r)
+		valid := make([]metric.Metric, 0, len(m))
+		var rejected []string
+		for i := range m {
+			if err = validateMetric(&m[i]); err == nil && !s.validHash(&m[i]) {
+				err = errors.New("hash validation error")
+			}
+			if err != nil {
+				rejected = append(rejected, fmt.Sprintf("metric %d: %s", i, err))
+				continue
+			}
+			setSource(&m[i], source)
+			valid = append(valid, m[i])
+		}
+		err = s.saveBatch(ctx, r.Header.Get("X-Batch-ID"), &valid)
 		if err != nil {
 			log.Print(err)
+			http.Error(w, "Could not save received data to storage", http.StatusInternalServerError)
+			return
+		}
+		if len(rejected) > 0 {
+			http.Error(w, fmt.Sprintf("Invalid metrics: %s", strings.Join(rejected, "; ")), http.StatusBadRequest)
+			return
 		}
 		err = r.Body.Close()
 		if err != nil {
@@ -107,6 +143,7 @@ func (s HTTPServer) SetMetricListHandler(ctx context.Context) http.HandlerFunc {
 }
 
 // GetMetricHandler returns a metric which was specified in HTTP POST request.
+// A metric requested without labels is found if it has a single series, see MetricStore.Find.
 // URI: "/value/".
 func (s HTTPServer) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	m, err := converter.GetBody(r)
@@ -119,12 +156,16 @@ func (s HTTPServer) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	data, found := s.Metrics[m.ID]
-	if !found {
+	data, err := s.Metrics.Find(m.ID, m.Labels)
+	if errors.Is(err, ErrAmbiguousMetric) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
+	w.Header().Add("Content-Type", "application/json")
 	res, err := data.PrepareMetricAsJSON(s.Cfg.Key)
 	if err != nil {
 		http.Error(w, "Internal error during JSON marshal", http.StatusInternalServerError)
@@ -137,6 +178,93 @@ func (s HTTPServer) GetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// rangeRequest is a body of a range query request. Step is a duration string, e.g. "1m".
+type rangeRequest struct {
+	ID          string        `json:"id"`
+	Labels      metric.Labels `json:"labels,omitempty"`
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to,omitempty"`
+	Step        string        `json:"step"`
+	Aggregation string        `json:"aggregation,omitempty"`
+}
+
+// rangeResponse is a body of a range query response.
+type rangeResponse struct {
+	ID          string        `json:"id"`
+	Labels      metric.Labels `json:"labels,omitempty"`
+	MType       string        `json:"type"`
+	Aggregation string        `json:"aggregation"`
+	Step        string        `json:"step"`
+	Points      []Sample      `json:"points"`
+}
+
+// GetMetricRangeHandler returns history of a metric which was specified in HTTP POST request aggregated by steps.
+// A metric requested without labels is found if it has a single series, see MetricStore.Find.
+// URI: "/value/range/".
+func (s HTTPServer) GetMetricRangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req rangeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Could not parse range query", http.StatusBadRequest)
+		return
+	}
+	err = r.Body.Close()
+	if err != nil {
+		log.Print(err)
+	}
+
+	step, err := time.ParseDuration(req.Step)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid step: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.queryRange(r.Context(), RangeQuery{
+		ID:          req.ID,
+		Labels:      req.Labels,
+		From:        req.From,
+		To:          req.To,
+		Step:        step,
+		Aggregation: req.Aggregation,
+	})
+	var queryErr *QueryError
+	switch {
+	case errors.Is(err, ErrMetricNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrAmbiguousMetric):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.As(err, &queryErr):
+		http.Error(w, queryErr.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Print(err)
+		http.Error(w, "Could not load metric history", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(rangeResponse{
+		ID:          res.ID,
+		Labels:      res.Labels,
+		MType:       res.MType,
+		Aggregation: res.Aggregation,
+		Step:        res.Step.String(),
+		Points:      res.Points,
+	})
+	if err != nil {
+		http.Error(w, "Internal error during JSON marshal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
 // NotImplemented handler returns HTTP StatusNotImplemented (code: 501) .
 func NotImplemented(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Uknown type", http.StatusNotImplemented)
@@ -156,6 +284,18 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends compressed data written so far to client, which is needed for streaming responses.
+func (w gzipWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		if err := gz.Flush(); err != nil {
+			log.Print(err)
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func gzipHandle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
@@ -222,6 +362,22 @@ func (s *HTTPServer) trustedNetworkCheckHandler(next http.Handler) http.Handler
 	})
 }
 
+// adminAccessHandler lets only trusted clients change server settings, e.g. silences. Clients must belong
+// to the trusted subnet or, if there is none, connect from the loopback address.
+func (s *HTTPServer) adminAccessHandler(next http.Handler) http.Handler {
+	if s.trustedSubnet != nil {
+		return s.trustedNetworkCheckHandler(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, fmt.Sprintf("Access is forbidden for %s", host), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *HTTPServer) CheckStorageStatusHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -232,3 +388,195 @@ func (s *HTTPServer) CheckStorageStatusHandler(w http.ResponseWriter, r *http.Re
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// HeartbeatHandler accepts a heartbeat of an agent which has no metrics to report.
+// The agent is registered by agentRegistryHandler.
+func (s HTTPServer) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetAgentsHandler returns JSON list of agents known to server.
+func (s HTTPServer) GetAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.agents.list(time.Now()))
+}
+
+// GetAlertsHandler returns JSON list of alerts. Alerts can be filtered by state: "/alerts/?state=firing".
+func (s HTTPServer) GetAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	if !validAlertState(state) {
+		http.Error(w, fmt.Sprintf("Unknown alert state '%s'", state), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.alerts.list(state))
+}
+
+// silenceRequest describes a silence to create. Silence ends at EndsAt or lasts for Duration since its start.
+type silenceRequest struct {
+	Matchers metric.Labels `json:"matchers"`
+	StartsAt time.Time     `json:"starts_at"`
+	EndsAt   time.Time     `json:"ends_at"`
+	Duration string        `json:"duration"`
+	Comment  string        `json:"comment"`
+}
+
+// writeJSON writes body marshalled to JSON with the status code.
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, "Internal error during JSON marshal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// GetSilencesHandler returns JSON list of silences which have not expired.
+func (s HTTPServer) GetSilencesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.notifier == nil {
+		http.Error(w, "Alert notifications are not configured", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.notifier.listSilences(time.Now()))
+}
+
+// CreateSilenceHandler creates a silence from JSON request and returns it with its ID.
+func (s HTTPServer) CreateSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	if s.notifier == nil {
+		http.Error(w, "Alert notifications are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	var req silenceRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	silence := Silence{
+		Matchers: req.Matchers,
+		StartsAt: req.StartsAt,
+		EndsAt:   req.EndsAt,
+		Comment:  req.Comment,
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid duration '%s'", req.Duration), http.StatusBadRequest)
+			return
+		}
+		if silence.StartsAt.IsZero() {
+			silence.StartsAt = now
+		}
+		silence.EndsAt = silence.StartsAt.Add(d)
+	}
+
+	silence, err = s.notifier.addSilence(silence, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, silence)
+}
+
+// DeleteSilenceHandler removes a silence.
+func (s HTTPServer) DeleteSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	if s.notifier == nil {
+		http.Error(w, "Alert notifications are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	err := s.notifier.deleteSilence(chi.URLParam(r, "silenceID"))
+	if errors.Is(err, ErrSilenceNotFound) {
+		http.Error(w, "There is no silence you requested", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StreamMetricsHandler streams updates of stored metrics as Server-Sent Events "metric" with JSON metric as data.
+// Current values of metrics are sent first. Metrics are filtered by ID globs: "/stream/?id=CPUutilization*&id=Alloc".
+// A client which does not keep up with updates gets current values of its metrics instead of the missed ones.
+// URI: "/stream/".
+func (s HTTPServer) StreamMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	patterns := r.URL.Query()["id"]
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid metric ID pattern '%s'", pattern), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var filter func(metric.Metric) bool
+	if len(patterns) > 0 {
+		filter = func(m metric.Metric) bool {
+			for _, pattern := range patterns {
+				if matchName(pattern, m.ID) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	// subscribe before taking current values, so no update is missed in between
+	sub := s.updates.subscribe(filter)
+	defer s.updates.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if !writeMetricEvents(w, sub.snapshot(s.Metrics)...) {
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-sub.ch:
+			mList := []metric.Metric{m}
+			if sub.lagged() {
+				mList = sub.snapshot(s.Metrics)
+			}
+			if !writeMetricEvents(w, mList...) {
+				return
+			}
+		case <-ticker.C:
+			// comment line keeps idle connection open through proxies
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeMetricEvents writes metrics as Server-Sent Events. It returns false if the client has gone.
+func writeMetricEvents(w io.Writer, mList ...metric.Metric) bool {
+	for _, m := range mList {
+		data, err := json.Marshal(m)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if _, err = fmt.Fprintf(w, "event: metric\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+	}
+	return true
+}
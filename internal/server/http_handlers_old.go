@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -47,11 +48,19 @@ func (s HTTPServer) SetMetricOldHandler(ctx context.Context) http.HandlerFunc {
 				MType: mType,
 				Delta: &val,
 			}
+		case histogram, summary:
+			http.Error(w, fmt.Sprintf("Metric type '%s' is supported by JSON API only", mType), http.StatusNotImplemented)
+			return
 		default:
-			log.Printf("Metric type '%s' is not expected. Skipping.", mType)
+			http.Error(w, fmt.Sprintf("Unknown metric type '%s'", mType), http.StatusNotImplemented)
+			return
+		}
+		setSource(&m, requestSource(r))
+		if err := s.saveMetric(ctx, &m); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid metric: %s", err), http.StatusBadRequest)
+			return
 		}
 		w.WriteHeader(http.StatusOK)
-		s.saveMetric(ctx, &m)
 	})
 }
 
@@ -67,18 +76,26 @@ func (s HTTPServer) GetMetricOldHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	metricName := splitURL[3]
-	val, found := s.Metrics[metricName]
-	if !found {
+	val, err := s.Metrics.Find(metricName, nil)
+	if errors.Is(err, ErrAmbiguousMetric) {
+		http.Error(w, fmt.Sprintf("Metric %s has several series, use JSON API with labels", metricName), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "There is no metric you requested", http.StatusNotFound)
 		return
 	}
-	if val.MType == counter {
+	switch {
+	case val.MType == counter && val.Delta != nil:
 		returnValue = float64(*val.Delta)
-	} else {
-		returnValue = float64(*val.Value)
+	case val.MType == gauge && val.Value != nil:
+		returnValue = *val.Value
+	default:
+		http.Error(w, fmt.Sprintf("Metric type '%s' is supported by JSON API only", val.MType), http.StatusNotImplemented)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte(fmt.Sprint(returnValue)))
+	_, err = w.Write([]byte(fmt.Sprint(returnValue)))
 	if err != nil {
 		log.Print(err)
 	}
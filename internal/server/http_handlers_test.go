@@ -1,20 +1,33 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/converter"
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestSetMetricHandler(t *testing.T) {
@@ -65,7 +78,7 @@ func TestSetMetricHandler(t *testing.T) {
 						Restore:       true,
 						Key:           "testkey",
 					},
-					Metrics: map[string]metric.Metric{},
+					Metrics: NewMetricStore(),
 					backuper: &FileStorageBackuper{
 						filename: "/tmp/test",
 					},
@@ -92,6 +105,62 @@ func TestSetMetricHandler(t *testing.T) {
 	}
 }
 
+func TestHistogramHandlers(t *testing.T) {
+	s := HTTPServer{
+		&GenericService{
+			Cfg:     &Config{Key: "testkey"},
+			Metrics: NewMetricStore(),
+			backuper: &FileStorageBackuper{
+				filename: filepath.Join(t.TempDir(), "metrics.json"),
+			},
+			history: NewHistory(10),
+		},
+	}
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		m := metric.Metric{ID: "Latency", MType: histogram, Histogram: &metric.Histogram{
+			Bounds: []float64{0.1, 0.5},
+			Counts: []uint64{1, 1, 0},
+			Sum:    0.3,
+			Count:  2,
+		}}
+		body, err := m.PrepareMetricAsJSON("testkey")
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		s.SetMetricHandler(ctx)(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	s.GetMetricHandler(w, httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"Latency","type":"histogram"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var m metric.Metric
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &m))
+	assert.Equal(t, []uint64{2, 2, 0}, m.Histogram.Counts)
+	assert.Equal(t, uint64(4), m.Histogram.Count)
+	assert.Equal(t, hex.EncodeToString(m.GenerateHash("testkey")), m.Hash)
+
+	samples := s.history.Range("Latency", time.Time{}, time.Time{})
+	require.Len(t, samples, 2)
+	assert.Equal(t, float64(4), samples[1].Value)
+
+	// protobuf keeps the distribution
+	converted, err := converter.ConvertData(m.ConvertMetricToPB(""))
+	require.NoError(t, err)
+	assert.Equal(t, m.Histogram, converted.Histogram)
+
+	w = httptest.NewRecorder()
+	s.SetMetricOldHandler(ctx)(w, httptest.NewRequest(http.MethodPost, "/update/histogram/Latency/1", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	w = httptest.NewRecorder()
+	s.GetMetricOldHandler(w, httptest.NewRequest(http.MethodGet, "/value/histogram/Latency", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	w = httptest.NewRecorder()
+	s.GetAllMetricHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, w.Body.String(), "count: 4, sum: 0.6")
+}
+
 func TestGetMetricHandler(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -130,11 +199,13 @@ func TestGetMetricHandler(t *testing.T) {
 						Restore:       true,
 						Key:           "testkey",
 					},
-					Metrics: map[string]metric.Metric{},
+					Metrics: NewMetricStore(),
 				},
 			}
 
-			s.Metrics["Alloc"] = tt.metric
+			stored := tt.metric
+			stored.ID = "Alloc"
+			s.Metrics.Upsert(stored)
 			mSer, _ := json.Marshal(tt.metric)
 			request := httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBuffer(mSer))
 			w := httptest.NewRecorder()
@@ -169,6 +240,16 @@ func TestGenerateHash(t *testing.T) {
 			},
 			want: []byte{0xa2, 0xbc, 0x39, 0x8d, 0x45, 0x7f, 0x8e, 0x41, 0x7d, 0xce, 0x87, 0x76, 0x44, 0xf, 0x23, 0x5, 0x19, 0xf0, 0xee, 0x5e, 0x2a, 0xc, 0xf9, 0x61, 0x30, 0xcc, 0x63, 0x12, 0x72, 0xa9, 0x98, 0x7b},
 		},
+		{
+			name: "Labels",
+			metric: metric.Metric{
+				ID:     "Alloc",
+				MType:  gauge,
+				Value:  getFloatPointer(354872),
+				Labels: metric.Labels{"service": "api", "host": "web1"},
+			},
+			want: []byte{0xc4, 0xf, 0x74, 0xbc, 0xf7, 0xc1, 0x31, 0x9d, 0xe3, 0xbd, 0x37, 0xe5, 0x68, 0x4d, 0x67, 0xaa, 0x87, 0x1c, 0x1b, 0x98, 0x55, 0x44, 0xc8, 0xf1, 0xf9, 0xb0, 0xeb, 0xd5, 0x15, 0x63, 0x95, 0x4a},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -181,7 +262,7 @@ func TestGenerateHash(t *testing.T) {
 						Restore:       true,
 						Key:           "testkey",
 					},
-					Metrics: map[string]metric.Metric{},
+					Metrics: NewMetricStore(),
 				},
 			}
 			res := tt.metric.GenerateHash(s.Cfg.Key)
@@ -206,7 +287,8 @@ func TestSetMetricListHandler(t *testing.T) {
 
 	s := HTTPServer{
 		&GenericService{
-			Metrics: map[string]metric.Metric{},
+			Cfg:     &Config{},
+			Metrics: NewMetricStore(),
 			backuper: &DBStorageBackuper{
 				db: db,
 			},
@@ -241,7 +323,7 @@ func TestSetMetricListHandler(t *testing.T) {
 				Value: getFloatPointer(354872),
 				Hash:  "a2bc398d457f8e417dce8776440f230519f0ee5e2a0cf96130cc631272a9987b",
 			},
-			want: 500,
+			want: 400,
 		},
 	}
 
@@ -274,6 +356,115 @@ func TestSetMetricListHandler(t *testing.T) {
 	}
 }
 
+func TestIngestRejectsInvalidMetrics(t *testing.T) {
+	service := newSourceService(t)
+	s := HTTPServer{service}
+	ctx := context.TODO()
+	require.NoError(t, service.saveMetric(ctx, &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1)}))
+
+	w := httptest.NewRecorder()
+	s.SetMetricHandler(ctx)(w, httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(`{"id": "Alloc", "type": "gauge"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	body := `[{"id": "Alloc", "type": "gauge"}, {"id": "Frees", "type": "gauge", "value": 2}]`
+	s.SetMetricListHandler(ctx)(w, httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "metric 0: gauge has no value")
+
+	g := &GRPCServer{GenericService: service}
+	grpcCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("Request-ID", "test"))
+	res, err := g.UpdateMetric(grpcCtx, &pb.UpdateMetricRequest{Metric: &pb.Metric{Id: "Alloc", Mtype: gauge}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, res.Error)
+	res, err = g.UpdateMetric(grpcCtx, &pb.UpdateMetricRequest{Metric: &pb.Metric{Id: "Alloc", Mtype: gauge, Value: getFloatPointer(math.NaN())}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, res.Error)
+
+	// series keys of these would be confused with labeled series of Alloc
+	for _, m := range []metric.Metric{
+		{ID: `Alloc{host="web1"}`, MType: gauge, Value: getFloatPointer(3)},
+		{ID: "Alloc", MType: gauge, Value: getFloatPointer(3), Labels: metric.Labels{`host="web1",x`: "y"}},
+		{ID: "Alloc", MType: gauge, Value: getFloatPointer(3), Labels: metric.Labels{"1host": "web1"}},
+		// values which can not be saved to storage
+		{ID: "Alloc", MType: gauge, Value: getFloatPointer(math.NaN())},
+		{ID: "Alloc", MType: gauge, Value: getFloatPointer(math.Inf(1))},
+		{ID: "Latency", MType: histogram, Histogram: &metric.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: math.Inf(-1), Count: 1}},
+		{ID: "Latency", MType: summary, Summary: &metric.Summary{Quantiles: []metric.Quantile{{Quantile: 0.5, Value: math.NaN()}}, Count: 1}},
+	} {
+		m := m
+		assert.Error(t, service.saveMetric(ctx, &m))
+	}
+	assert.Equal(t, 2, service.Metrics.Len())
+
+	m, ok := service.Metrics.Get("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 1.0, *m.Value)
+	m, ok = service.Metrics.Get("Frees")
+	require.True(t, ok)
+	assert.Equal(t, 2.0, *m.Value)
+}
+
+func TestSetMetricListHandlerSaveFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	service := newSourceService(t)
+	service.backuper = &FileStorageBackuper{filename: filepath.Join(dir, "metrics.json")}
+	s := HTTPServer{service}
+	ctx := context.TODO()
+	send := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id": "Alloc", "type": "gauge", "value": 1}]`))
+		r.Header.Set("X-Batch-ID", "batch1")
+		w := httptest.NewRecorder()
+		s.SetMetricListHandler(ctx)(w, r)
+		return w.Code
+	}
+
+	// the agent keeps a batch which is not saved and sends it again
+	assert.Equal(t, http.StatusInternalServerError, send())
+	assert.Equal(t, http.StatusInternalServerError, send())
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	assert.Equal(t, http.StatusOK, send())
+
+	restored := NewMetricStore()
+	require.NoError(t, service.backuper.RestoreMetrics(ctx, restored))
+	assert.Equal(t, 1, restored.Len())
+}
+
+func TestBatchHashValidation(t *testing.T) {
+	service := newSourceService(t)
+	service.Cfg.Key = "secret"
+	ctx := context.TODO()
+
+	signed := metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1)}
+	signed.Hash = hex.EncodeToString(signed.GenerateHash("secret"))
+	forged := metric.Metric{ID: "Frees", MType: gauge, Value: getFloatPointer(2)}
+	forged.Hash = hex.EncodeToString(forged.GenerateHash("other"))
+	unsigned := metric.Metric{ID: "Mallocs", MType: gauge, Value: getFloatPointer(3)}
+
+	body, err := json.Marshal([]metric.Metric{signed, forged, unsigned})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	HTTPServer{service}.SetMetricListHandler(ctx)(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "metric 1: hash validation error")
+	assert.Contains(t, w.Body.String(), "metric 2: hash validation error")
+
+	g := &GRPCServer{GenericService: service}
+	grpcCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("Request-ID", "test"))
+	res, err := g.UpdateMetrics(grpcCtx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		forged.ConvertMetricToPB(""),
+		unsigned.ConvertMetricToPB(""),
+	}})
+	require.NoError(t, err)
+	assert.Contains(t, res.Error, "metric 0: hash validation error")
+	assert.Contains(t, res.Error, "metric 1: hash validation error")
+
+	// only the signed metric is saved
+	assert.Equal(t, 1, service.Metrics.Len())
+	_, ok := service.Metrics.Get("Alloc")
+	assert.True(t, ok)
+}
+
 func TestCheckStorageStatusHandler(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
 	if err != nil {
@@ -288,7 +479,7 @@ func TestCheckStorageStatusHandler(t *testing.T) {
 
 	s := HTTPServer{
 		&GenericService{
-			Metrics: map[string]metric.Metric{},
+			Metrics: NewMetricStore(),
 			backuper: &DBStorageBackuper{
 				db: db,
 			},
@@ -329,15 +520,14 @@ func NewDelta(n int64) *int64 {
 func TestGetMetricOldHandler(t *testing.T) {
 	s := HTTPServer{
 		&GenericService{
-			Metrics: map[string]metric.Metric{
-				"PollCount": {
-					ID:    "PollCount",
-					MType: counter,
-					Delta: NewDelta(2),
-				},
-			},
+			Metrics: NewMetricStore(),
 		},
 	}
+	s.Metrics.Upsert(metric.Metric{
+		ID:    "PollCount",
+		MType: counter,
+		Delta: NewDelta(2),
+	})
 
 	tests := []struct {
 		name      string
@@ -537,3 +727,125 @@ func TestTrustedNetworkCheckHandler(t *testing.T) {
 		})
 	}
 }
+
+// readEvent reads a Server-Sent Event skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestStreamMetricsHandler(t *testing.T) {
+	service := newSourceService(t)
+	service.updates = newBroker()
+	ctx := context.Background()
+	service.saveMetric(ctx, &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(10)})
+	service.saveMetric(ctx, &metric.Metric{ID: "PollCount", MType: counter, Delta: getIntPointer(5)})
+
+	s := HTTPServer{service}
+	srv := httptest.NewServer(gzipHandle(http.HandlerFunc(s.StreamMetricsHandler)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream/?id=[")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, srv.URL+"/stream/?id=Alloc&id=CPUutilization*", nil)
+	require.NoError(t, err)
+	// the client requests gzip, so events have to be flushed through gzipHandle
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	body := bufio.NewReader(resp.Body)
+
+	// current values come first
+	event, data := readEvent(t, body)
+	assert.Equal(t, "metric", event)
+	var m metric.Metric
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	assert.Equal(t, "Alloc", m.ID)
+	assert.Equal(t, 10.0, *m.Value)
+
+	service.saveMetric(ctx, &metric.Metric{ID: "PollCount", MType: counter, Delta: getIntPointer(5)})
+	service.saveMetric(ctx, &metric.Metric{ID: "CPUutilization1", MType: gauge, Value: getFloatPointer(42)})
+	service.saveMetric(ctx, &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(20)})
+
+	_, data = readEvent(t, body)
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	assert.Equal(t, "CPUutilization1", m.ID)
+	assert.Equal(t, 42.0, *m.Value)
+	_, data = readEvent(t, body)
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	assert.Equal(t, "Alloc", m.ID)
+	assert.Equal(t, 20.0, *m.Value)
+}
+
+func TestGetMetricByNameWithAgentLabels(t *testing.T) {
+	service := newSourceService(t)
+	service.agents = newAgentRegistry(defaultAgentStaleIntervals, defaultAgentEvictAfter)
+	s := HTTPServer{service}
+	ctx := context.Background()
+	r := chi.NewRouter()
+	r.With(s.agentRegistryHandler).Post("/update/", s.SetMetricHandler(ctx))
+	r.Get("/value/*", s.GetMetricOldHandler)
+	r.Post("/value/", s.GetMetricHandler)
+
+	post := func(agentID string, value float64) {
+		body, err := json.Marshal(metric.Metric{ID: "Alloc", MType: gauge, Value: &value, Labels: metric.Labels{"host": agentID}})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body))
+		req.Header.Set("X-Agent-ID", agentID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	post("web1", 10)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/value/gauge/Alloc", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBufferString(`{"id": "Alloc", "type": "gauge"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var m metric.Metric
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &m))
+	assert.Equal(t, metric.Labels{"host": "web1", sourceLabel: "web1"}, m.Labels)
+
+	g := &GRPCServer{GenericService: service}
+	grpcCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("Request-ID", "test"))
+	res, err := g.GetMetric(grpcCtx, &pb.GetMetricRequest{Id: "Alloc"})
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, *res.Metric.Value)
+
+	// the name is ambiguous when another agent reports the metric
+	post("web2", 20)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/value/gauge/Alloc", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBufferString(`{"id": "Alloc", "type": "gauge"}`)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBufferString(`{"id": "Alloc", "type": "gauge", "labels": {"host": "web2", "source": "web2"}}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = g.GetMetric(grpcCtx, &pb.GetMetricRequest{Id: "Alloc"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
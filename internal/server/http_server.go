@@ -45,16 +45,24 @@ func (s HTTPServer) StartServer(ctx context.Context, backuper StorageBackuper) {
 
 	r.Mount("/debug", middleware.Profiler())
 	// old methods
-	r.Post("/update/gauge/{metricName}/{metricValue}", s.SetMetricOldHandler(ctx))
-	r.Post("/update/counter/{metricName}/{metricValue}", s.SetMetricOldHandler(ctx))
+	r.With(s.agentRegistryHandler).Post("/update/gauge/{metricName}/{metricValue}", s.SetMetricOldHandler(ctx))
+	r.With(s.agentRegistryHandler).Post("/update/counter/{metricName}/{metricValue}", s.SetMetricOldHandler(ctx))
 	r.Post("/update/*", NotImplemented)
 	r.Post("/update/{metricName}/", NotFound)
 	r.Get("/value/*", s.GetMetricOldHandler)
 	r.Get("/", s.GetAllMetricHandler)
 	// new methods
-	r.Post("/update/", s.SetMetricHandler(ctx))
-	r.Post("/updates/", s.SetMetricListHandler(ctx))
+	r.With(s.agentRegistryHandler).Post("/update/", s.SetMetricHandler(ctx))
+	r.With(s.agentRegistryHandler).Post("/updates/", s.SetMetricListHandler(ctx))
+	r.With(s.agentRegistryHandler).Post("/heartbeat/", s.HeartbeatHandler)
+	r.Get("/agents/", s.GetAgentsHandler)
+	r.Get("/alerts/", s.GetAlertsHandler)
+	r.Get("/silences/", s.GetSilencesHandler)
+	r.With(s.adminAccessHandler).Post("/silences/", s.CreateSilenceHandler)
+	r.With(s.adminAccessHandler).Delete("/silences/{silenceID}", s.DeleteSilenceHandler)
 	r.Post("/value/", s.GetMetricHandler)
+	r.Post("/value/range/", s.GetMetricRangeHandler)
+	r.Get("/stream/", s.StreamMetricsHandler)
 	r.Get("/ping", s.CheckStorageStatusHandler)
 
 	srv := &http.Server{
@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/rs/xid"
+)
+
+// ruleLabel refers to alert rule name in grouping and silence matchers.
+const ruleLabel = "rule"
+
+// notifierTick is how often notifier checks groups for due notifications.
+const notifierTick = time.Second
+
+const (
+	defaultGroupInterval  = 30 * time.Second
+	defaultRepeatInterval = 4 * time.Hour
+	defaultNotifyRetries  = 3
+	defaultRetryBackoff   = time.Second
+	defaultNotifyTimeout  = 5 * time.Second
+)
+
+// ErrSilenceNotFound is returned when a requested silence is unknown.
+var ErrSilenceNotFound = errors.New("silence not found")
+
+// errNotificationRejected marks a delivery failure which is not going to succeed when repeated, e.g. a client error.
+var errNotificationRejected = errors.New("notification rejected")
+
+// NotificationConfig describes delivery of alert notifications to webhooks.
+// Alerts are grouped by GroupBy labels, "rule" stands for the rule name. A group is notified at most once per
+// GroupInterval when its alerts change and every RepeatInterval while it has firing alerts.
+// A failed delivery is retried MaxRetries times with exponential backoff, negative MaxRetries disables retries.
+type NotificationConfig struct {
+	Webhooks       []string      `json:"webhooks"`
+	GroupBy        []string      `json:"group_by"`
+	GroupInterval  time.Duration `json:"group_interval"`
+	RepeatInterval time.Duration `json:"repeat_interval"`
+	MaxRetries     int           `json:"max_retries"`
+	RetryBackoff   time.Duration `json:"retry_backoff"`
+	Timeout        time.Duration `json:"timeout"`
+}
+
+func (config *NotificationConfig) UnmarshalJSON(b []byte) error {
+	type MyTypeAlias NotificationConfig
+
+	unmarshalledJSON := &struct {
+		*MyTypeAlias
+		GroupInterval  string `json:"group_interval"`
+		RepeatInterval string `json:"repeat_interval"`
+		RetryBackoff   string `json:"retry_backoff"`
+		Timeout        string `json:"timeout"`
+	}{
+		MyTypeAlias: (*MyTypeAlias)(config),
+	}
+	err := json.Unmarshal(b, &unmarshalledJSON)
+	if err != nil {
+		return err
+	}
+
+	optionalDurations := []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{unmarshalledJSON.GroupInterval, &config.GroupInterval},
+		{unmarshalledJSON.RepeatInterval, &config.RepeatInterval},
+		{unmarshalledJSON.RetryBackoff, &config.RetryBackoff},
+		{unmarshalledJSON.Timeout, &config.Timeout},
+	}
+	for _, d := range optionalDurations {
+		if d.value == "" {
+			continue
+		}
+		*d.dst, err = time.ParseDuration(d.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setDefaults fills options which are not set.
+func (config *NotificationConfig) setDefaults() {
+	if len(config.GroupBy) == 0 {
+		config.GroupBy = []string{ruleLabel}
+	}
+	if config.GroupInterval <= 0 {
+		config.GroupInterval = defaultGroupInterval
+	}
+	if config.RepeatInterval <= 0 {
+		config.RepeatInterval = defaultRepeatInterval
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = defaultNotifyRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultNotifyTimeout
+	}
+}
+
+// Notification is a payload POSTed to webhooks. Status is firing if any alert of the group is firing.
+type Notification struct {
+	GroupKey    string        `json:"group_key"`
+	GroupLabels metric.Labels `json:"group_labels"`
+	Status      string        `json:"status"`
+	Alerts      []Alert       `json:"alerts"`
+	SentAt      time.Time     `json:"sent_at"`
+}
+
+// Silence suppresses notifications of alerts matching all its matchers within [StartsAt, EndsAt).
+type Silence struct {
+	ID       string        `json:"id"`
+	Matchers metric.Labels `json:"matchers"`
+	StartsAt time.Time     `json:"starts_at"`
+	EndsAt   time.Time     `json:"ends_at"`
+	Comment  string        `json:"comment,omitempty"`
+}
+
+func (s Silence) active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+func (s Silence) matches(labels metric.Labels) bool {
+	for k, v := range s.Matchers {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// alertGroup holds alerts notified together. Version changes with every alert update.
+type alertGroup struct {
+	labels   metric.Labels
+	alerts   map[string]Alert
+	version  int
+	webhooks map[string]webhookState
+}
+
+// webhookState tracks notifications of a group to a webhook: the last attempt and the last delivered version.
+type webhookState struct {
+	version  int
+	lastSent time.Time
+}
+
+// pendingNotification is a notification of a group version due to be sent to webhooks.
+type pendingNotification struct {
+	Notification
+	version  int
+	webhooks []string
+}
+
+// notifier delivers alert notifications to webhooks. It is safe for concurrent use.
+type notifier struct {
+	cfg    NotificationConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	groups   map[string]*alertGroup
+	silences map[string]Silence
+}
+
+func newNotifier(cfg NotificationConfig) *notifier {
+	cfg.setDefaults()
+	return &notifier{
+		cfg:      cfg,
+		client:   &http.Client{},
+		groups:   map[string]*alertGroup{},
+		silences: map[string]Silence{},
+	}
+}
+
+// alertLabels returns labels of alert with its rule name.
+func alertLabels(a Alert) metric.Labels {
+	labels := a.Labels.Copy()
+	if labels == nil {
+		labels = metric.Labels{}
+	}
+	labels[ruleLabel] = a.Rule
+	return labels
+}
+
+// notify adds alerts which have started firing or have been resolved to their groups.
+func (n *notifier) notify(alerts []Alert) {
+	if n == nil || len(alerts) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, a := range alerts {
+		labels := alertLabels(a)
+		groupLabels := metric.Labels{}
+		for _, name := range n.cfg.GroupBy {
+			if v, ok := labels[name]; ok {
+				groupLabels[name] = v
+			}
+		}
+
+		key := groupLabels.String()
+		g, ok := n.groups[key]
+		if !ok {
+			g = &alertGroup{labels: groupLabels, alerts: map[string]Alert{}, webhooks: map[string]webhookState{}}
+			n.groups[key] = g
+		}
+		g.alerts[a.Rule+a.Labels.String()] = a
+		g.version++
+	}
+}
+
+// silenced reports whether an active silence matches the alert.
+func (n *notifier) silenced(a Alert, now time.Time) bool {
+	labels := alertLabels(a)
+	for _, s := range n.silences {
+		if s.active(now) && s.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// due returns notifications of groups which have changed or must be repeated at the moment.
+// A notification is addressed to webhooks which have not received the group version or must get it repeated.
+// Silenced alerts are not notified, silenced resolved alerts are dropped.
+func (n *notifier) due(now time.Time) []pendingNotification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var res []pendingNotification
+	for key, g := range n.groups {
+		var alerts []Alert
+		firing := false
+		for id, a := range g.alerts {
+			if n.silenced(a, now) {
+				if a.State == AlertResolved {
+					delete(g.alerts, id)
+				}
+				continue
+			}
+			alerts = append(alerts, a)
+			firing = firing || a.State == AlertFiring
+		}
+		if len(g.alerts) == 0 {
+			delete(n.groups, key)
+			continue
+		}
+		if len(alerts) == 0 {
+			continue
+		}
+
+		var webhooks []string
+		for _, url := range n.cfg.Webhooks {
+			st := g.webhooks[url]
+			since := now.Sub(st.lastSent)
+			if (st.version != g.version && since >= n.cfg.GroupInterval) || (firing && since >= n.cfg.RepeatInterval) {
+				webhooks = append(webhooks, url)
+			}
+		}
+		if len(webhooks) == 0 {
+			continue
+		}
+
+		sort.Slice(alerts, func(i, j int) bool {
+			return alerts[i].Rule+alerts[i].Labels.String() < alerts[j].Rule+alerts[j].Labels.String()
+		})
+		status := AlertResolved
+		if firing {
+			status = AlertFiring
+		}
+		res = append(res, pendingNotification{
+			Notification: Notification{
+				GroupKey:    key,
+				GroupLabels: g.labels,
+				Status:      status,
+				Alerts:      alerts,
+				SentAt:      now,
+			},
+			version:  g.version,
+			webhooks: webhooks,
+		})
+	}
+	return res
+}
+
+// flush sends due notifications to their webhooks. A webhook which has not got a notification
+// is sent it again after group interval, webhooks which have got or rejected it are not sent it again.
+func (n *notifier) flush(ctx context.Context, now time.Time) {
+	if n == nil {
+		return
+	}
+
+	for _, p := range n.due(now) {
+		for _, url := range p.webhooks {
+			err := n.deliver(ctx, url, p.Notification)
+			switch {
+			case errors.Is(err, errNotificationRejected):
+				// the same notification would be rejected again, so it is not retried
+				log.Printf("Giving up notification of group %s to %s: %s", p.GroupKey, url, err)
+			case err != nil:
+				log.Printf("Could not deliver notification of group %s to %s: %s", p.GroupKey, url, err)
+			}
+			n.sent(p, url, err == nil || errors.Is(err, errNotificationRejected))
+		}
+	}
+}
+
+// sent records delivery attempt of notification to a webhook. A notification which has been given up
+// counts as delivered. Resolved alerts delivered to all webhooks are dropped unless they have changed since.
+func (n *notifier) sent(p pendingNotification, url string, delivered bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	g, ok := n.groups[p.GroupKey]
+	if !ok {
+		return
+	}
+	st := g.webhooks[url]
+	st.lastSent = p.SentAt
+	if delivered {
+		st.version = p.version
+	}
+	g.webhooks[url] = st
+	if !delivered {
+		return
+	}
+
+	for _, webhook := range n.cfg.Webhooks {
+		if g.webhooks[webhook].version < p.version {
+			return
+		}
+	}
+	for _, a := range p.Alerts {
+		id := a.Rule + a.Labels.String()
+		if cur, ok := g.alerts[id]; ok && cur.State == AlertResolved && cur.ResolvedAt.Equal(a.ResolvedAt) {
+			delete(g.alerts, id)
+		}
+	}
+	if len(g.alerts) == 0 {
+		delete(n.groups, p.GroupKey)
+	}
+}
+
+// deliver POSTs notification to url. Network errors and server errors are retried with exponential backoff.
+// Other failures are errNotificationRejected.
+func (n *notifier) deliver(ctx context.Context, url string, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errNotificationRejected, err)
+	}
+
+	backoff := n.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		retryable, err = n.post(ctx, url, body)
+		if err != nil && !retryable {
+			return fmt.Errorf("%w: %s", errNotificationRejected, err)
+		}
+		if err == nil || attempt >= n.cfg.MaxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt and reports whether a failed attempt can be retried.
+func (n *notifier) post(ctx context.Context, url string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		log.Print(err)
+	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+}
+
+// run periodically sends due notifications.
+func (n *notifier) run(ctx context.Context) {
+	ticker := time.NewTicker(notifierTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.flush(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addSilence validates silence and adds it with a new ID. Silence starts now unless its start is set.
+func (n *notifier) addSilence(s Silence, now time.Time) (Silence, error) {
+	if len(s.Matchers) == 0 {
+		return Silence{}, errors.New("silence must have matchers")
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(s.StartsAt) || !s.EndsAt.After(now) {
+		return Silence{}, errors.New("silence must end in the future after its start")
+	}
+	s.ID = xid.New().String()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.silences[s.ID] = s
+	return s, nil
+}
+
+// listSilences returns silences which have not expired sorted by start. Expired silences are dropped.
+func (n *notifier) listSilences(now time.Time) []Silence {
+	n.mu.Lock()
+	res := make([]Silence, 0, len(n.silences))
+	for id, s := range n.silences {
+		if !now.Before(s.EndsAt) {
+			delete(n.silences, id)
+			continue
+		}
+		res = append(res, s)
+	}
+	n.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].StartsAt.Equal(res[j].StartsAt) {
+			return res[i].StartsAt.Before(res[j].StartsAt)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// deleteSilence removes silence with the id.
+func (n *notifier) deleteSilence(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.silences[id]; !ok {
+		return ErrSilenceNotFound
+	}
+	delete(n.silences, id)
+	return nil
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver collects notifications POSTed to a test server.
+type webhookReceiver struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func (rcv *webhookReceiver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		rcv.mu.Lock()
+		rcv.notifications = append(rcv.notifications, n)
+		rcv.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (rcv *webhookReceiver) take() []Notification {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	res := rcv.notifications
+	rcv.notifications = nil
+	return res
+}
+
+func testAlert(rule, host, state string, at time.Time) Alert {
+	a := Alert{Rule: rule, Labels: metric.Labels{"host": host}, State: state, ActiveAt: at}
+	switch state {
+	case AlertFiring:
+		a.FiredAt = at
+	case AlertResolved:
+		a.FiredAt = at.Add(-time.Minute)
+		a.ResolvedAt = at
+	}
+	return a
+}
+
+func TestNotifierGrouping(t *testing.T) {
+	rcv := &webhookReceiver{}
+	srv := httptest.NewServer(rcv.handler(t))
+	defer srv.Close()
+
+	n := newNotifier(NotificationConfig{
+		Webhooks:       []string{srv.URL},
+		GroupInterval:  time.Minute,
+		RepeatInterval: time.Hour,
+	})
+	ctx := context.Background()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// alerts of a rule are grouped into one notification
+	n.notify([]Alert{
+		testAlert("LowMemory", "web1", AlertFiring, start),
+		testAlert("LowMemory", "web2", AlertFiring, start),
+		testAlert("HighCPU", "web1", AlertFiring, start),
+	})
+	n.flush(ctx, start)
+	got := rcv.take()
+	require.Len(t, got, 2)
+	for _, notification := range got {
+		assert.Equal(t, AlertFiring, notification.Status)
+		if notification.GroupLabels[ruleLabel] == "LowMemory" {
+			assert.Len(t, notification.Alerts, 2)
+		}
+	}
+
+	// changes within group interval are sent together when it passes
+	n.notify([]Alert{testAlert("LowMemory", "web3", AlertFiring, start.Add(10*time.Second))})
+	n.notify([]Alert{testAlert("LowMemory", "web1", AlertResolved, start.Add(20*time.Second))})
+	n.flush(ctx, start.Add(30*time.Second))
+	assert.Empty(t, rcv.take())
+	n.flush(ctx, start.Add(time.Minute))
+	got = rcv.take()
+	require.Len(t, got, 1)
+	require.Len(t, got[0].Alerts, 3)
+	assert.Equal(t, AlertResolved, got[0].Alerts[0].State)
+
+	// delivered resolved alerts are not repeated, firing alerts are repeated every repeat interval
+	n.flush(ctx, start.Add(30*time.Minute))
+	assert.Empty(t, rcv.take())
+	n.flush(ctx, start.Add(time.Hour+time.Minute))
+	got = rcv.take()
+	require.Len(t, got, 2)
+	for _, notification := range got {
+		if notification.GroupLabels[ruleLabel] == "LowMemory" {
+			assert.Len(t, notification.Alerts, 2)
+		}
+	}
+
+	// group is dropped when all its alerts are resolved and notified
+	n.notify([]Alert{testAlert("HighCPU", "web1", AlertResolved, start.Add(2*time.Hour))})
+	n.flush(ctx, start.Add(2*time.Hour))
+	got = rcv.take()
+	require.Len(t, got, 1)
+	assert.Equal(t, AlertResolved, got[0].Status)
+	n.mu.Lock()
+	assert.Len(t, n.groups, 1)
+	n.mu.Unlock()
+}
+
+func TestNotifierSilences(t *testing.T) {
+	rcv := &webhookReceiver{}
+	srv := httptest.NewServer(rcv.handler(t))
+	defer srv.Close()
+
+	n := newNotifier(NotificationConfig{Webhooks: []string{srv.URL}, GroupBy: []string{"host"}})
+	ctx := context.Background()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := n.addSilence(Silence{EndsAt: start.Add(time.Hour)}, start)
+	assert.Error(t, err)
+	_, err = n.addSilence(Silence{Matchers: metric.Labels{"host": "web1"}, EndsAt: start}, start)
+	assert.Error(t, err)
+
+	silence, err := n.addSilence(Silence{Matchers: metric.Labels{"host": "web1"}, EndsAt: start.Add(time.Hour)}, start)
+	require.NoError(t, err)
+	require.NotEmpty(t, silence.ID)
+	assert.Equal(t, start, silence.StartsAt)
+
+	n.notify([]Alert{
+		testAlert("LowMemory", "web1", AlertFiring, start),
+		testAlert("LowMemory", "web2", AlertFiring, start),
+	})
+	n.flush(ctx, start)
+	got := rcv.take()
+	require.Len(t, got, 1)
+	assert.Equal(t, metric.Labels{"host": "web2"}, got[0].GroupLabels)
+
+	// silenced alert is notified after silence ends
+	n.flush(ctx, start.Add(time.Hour))
+	got = rcv.take()
+	require.Len(t, got, 1)
+	assert.Equal(t, metric.Labels{"host": "web1"}, got[0].GroupLabels)
+	assert.Empty(t, n.listSilences(start.Add(time.Hour)))
+
+	// silences can match rule name
+	_, err = n.addSilence(Silence{Matchers: metric.Labels{ruleLabel: "LowMemory"}, EndsAt: start.Add(3 * time.Hour)}, start.Add(2*time.Hour))
+	require.NoError(t, err)
+	n.notify([]Alert{testAlert("LowMemory", "web2", AlertResolved, start.Add(2*time.Hour))})
+	n.flush(ctx, start.Add(2*time.Hour))
+	assert.Empty(t, rcv.take())
+
+	silences := n.listSilences(start.Add(2 * time.Hour))
+	require.Len(t, silences, 1)
+	require.NoError(t, n.deleteSilence(silences[0].ID))
+	assert.ErrorIs(t, n.deleteSilence(silences[0].ID), ErrSilenceNotFound)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1, 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	n := newNotifier(NotificationConfig{
+		Webhooks:      []string{srv.URL},
+		GroupInterval: time.Minute,
+		MaxRetries:    1,
+		RetryBackoff:  time.Millisecond,
+	})
+	ctx := context.Background()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// both attempts fail, the group is sent again after group interval
+	n.notify([]Alert{testAlert("LowMemory", "web1", AlertFiring, start)})
+	n.flush(ctx, start)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	n.flush(ctx, start.Add(30*time.Second))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	n.flush(ctx, start.Add(time.Minute))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	n.flush(ctx, start.Add(2*time.Minute))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// client errors are not retried
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	assert.ErrorIs(t, n.deliver(ctx, bad.URL, Notification{}), errNotificationRejected)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestNotifierGivesUpRejectedNotifications(t *testing.T) {
+	var calls int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer bad.Close()
+
+	n := newNotifier(NotificationConfig{Webhooks: []string{bad.URL}, GroupInterval: time.Minute})
+	ctx := context.Background()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	n.notify([]Alert{testAlert("LowMemory", "web1", AlertResolved, start)})
+	n.flush(ctx, start)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	// the rejected group is not kept for retries
+	assert.Empty(t, n.groups)
+
+	n.flush(ctx, start.Add(time.Minute))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestNotifierRetriesFailedWebhooksOnly(t *testing.T) {
+	rcv := &webhookReceiver{}
+	good := httptest.NewServer(rcv.handler(t))
+	defer good.Close()
+
+	var calls int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer flaky.Close()
+
+	n := newNotifier(NotificationConfig{
+		Webhooks:      []string{good.URL, flaky.URL},
+		GroupInterval: time.Minute,
+		MaxRetries:    -1,
+	})
+	ctx := context.Background()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	n.notify([]Alert{testAlert("LowMemory", "web1", AlertResolved, start)})
+	n.flush(ctx, start)
+	assert.Len(t, rcv.take(), 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	// the resolved alert is kept until every webhook has got it
+	assert.Len(t, n.groups, 1)
+
+	n.flush(ctx, start.Add(time.Minute))
+	assert.Empty(t, rcv.take())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Empty(t, n.groups)
+}
+
+func TestAlertNotificationsEndToEnd(t *testing.T) {
+	rcv := &webhookReceiver{}
+	srv := httptest.NewServer(rcv.handler(t))
+	defer srv.Close()
+
+	service := newSourceService(t)
+	service.notifier = newNotifier(NotificationConfig{Webhooks: []string{srv.URL}})
+	cfg, err := LoadAlertConfig(writeAlertRules(t, `{"rules": [{"name": "HighAlloc", "expr": "Alloc > 10"}]}`))
+	require.NoError(t, err)
+	service.alerts = newAlertEngine(cfg.Rules, service.Metrics, service.history, service.notifier)
+
+	service.saveMetric(context.Background(), &metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(20)})
+	service.alerts.evaluateChanged(time.Now())
+	service.notifier.flush(context.Background(), time.Now())
+	got := rcv.take()
+	require.Len(t, got, 1)
+	assert.Equal(t, "HighAlloc", got[0].Alerts[0].Rule)
+	assert.Equal(t, 20.0, got[0].Alerts[0].Value)
+}
+
+func TestSilenceHandlers(t *testing.T) {
+	s := HTTPServer{newSourceService(t)}
+	w := httptest.NewRecorder()
+	s.GetSilencesHandler(w, httptest.NewRequest(http.MethodGet, "/silences/", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	s.notifier = newNotifier(NotificationConfig{Webhooks: []string{"http://localhost"}})
+	r := chi.NewRouter()
+	r.Get("/silences/", s.GetSilencesHandler)
+	r.Post("/silences/", s.CreateSilenceHandler)
+	r.Delete("/silences/{silenceID}", s.DeleteSilenceHandler)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/silences/", bytes.NewBufferString(`{"matchers": {"host": "web1"}, "duration": "bad"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/silences/", bytes.NewBufferString(`{"duration": "1h"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/silences/", bytes.NewBufferString(`{"matchers": {"host": "web1"}, "duration": "1h", "comment": "maintenance"}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created Silence
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, time.Hour, created.EndsAt.Sub(created.StartsAt))
+	assert.Equal(t, "maintenance", created.Comment)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/silences/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var silences []Silence
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &silences))
+	require.Len(t, silences, 1)
+	assert.Equal(t, created.ID, silences[0].ID)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/silences/"+created.ID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/silences/"+created.ID, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSilenceHandlersAccess(t *testing.T) {
+	s := HTTPServer{newSourceService(t)}
+	s.notifier = newNotifier(NotificationConfig{Webhooks: []string{"http://localhost"}})
+	r := chi.NewRouter()
+	r.With(s.adminAccessHandler).Post("/silences/", s.CreateSilenceHandler)
+	r.With(s.adminAccessHandler).Delete("/silences/{silenceID}", s.DeleteSilenceHandler)
+	body := `{"matchers": {"host": "web1"}, "duration": "1h"}`
+
+	// without trusted subnet only local clients may change silences
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/silences/", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/silences/1", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/silences/", bytes.NewBufferString(body))
+	req.RemoteAddr = "127.0.0.1:1234"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	_, s.trustedSubnet, _ = net.ParseCIDR("10.0.0.0/8")
+	r = chi.NewRouter()
+	r.With(s.adminAccessHandler).Post("/silences/", s.CreateSilenceHandler)
+	for ip, want := range map[string]int{"192.168.0.1": http.StatusForbidden, "10.0.0.1": http.StatusCreated} {
+		req = httptest.NewRequest(http.MethodPost, "/silences/", bytes.NewBufferString(body))
+		req.Header.Set("X-Real-Ip", ip)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, ip)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// maxRangePoints limits number of points in a range query result.
+const maxRangePoints = 11000
+
+// Aggregations of samples within a range query step.
+const (
+	AggregationAvg  = "avg"
+	AggregationMin  = "min"
+	AggregationMax  = "max"
+	AggregationSum  = "sum"
+	AggregationLast = "last"
+	// AggregationRate is a per-second increase of a counter.
+	AggregationRate = "rate"
+)
+
+// ErrMetricNotFound is returned when a requested metric is unknown.
+var ErrMetricNotFound = errors.New("metric not found")
+
+// QueryError describes an invalid query.
+type QueryError struct {
+	msg string
+}
+
+func (e *QueryError) Error() string {
+	return e.msg
+}
+
+// NewQueryError returns QueryError with formatted message.
+func NewQueryError(format string, a ...interface{}) error {
+	return &QueryError{msg: fmt.Sprintf(format, a...)}
+}
+
+// RangeQuery describes a query of metric series history over a time range.
+// Samples are grouped into steps starting at From, every step gives a point with aggregated value.
+type RangeQuery struct {
+	ID          string
+	Labels      metric.Labels
+	From        time.Time
+	To          time.Time
+	Step        time.Duration
+	Aggregation string
+}
+
+// RangeResult is a result of RangeQuery. Steps without samples have no points.
+type RangeResult struct {
+	ID          string
+	Labels      metric.Labels
+	MType       string
+	Aggregation string
+	Step        time.Duration
+	Points      []Sample
+}
+
+// validate checks the query and fills defaults: aggregation is avg, range ends now.
+func (q *RangeQuery) validate(mType string) error {
+	if q.ID == "" {
+		return NewQueryError("metric id is required")
+	}
+	if q.From.IsZero() {
+		return NewQueryError("range start is required")
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if !q.To.After(q.From) {
+		return NewQueryError("range end must be after its start")
+	}
+	if q.Step <= 0 {
+		return NewQueryError("step must be positive")
+	}
+	if q.To.Sub(q.From)/q.Step >= maxRangePoints {
+		return NewQueryError("range is too long for step %s: more than %d points", q.Step, maxRangePoints)
+	}
+
+	switch q.Aggregation {
+	case "":
+		q.Aggregation = AggregationAvg
+	case AggregationAvg, AggregationMin, AggregationMax, AggregationSum, AggregationLast:
+	case AggregationRate:
+		if mType != counter && mType != histogram && mType != summary {
+			return NewQueryError("rate is supported for counters, histograms and summaries only")
+		}
+	default:
+		return NewQueryError("unknown aggregation '%s'", q.Aggregation)
+	}
+	return nil
+}
+
+// bucket accumulates samples of a step.
+type bucket struct {
+	count    int
+	sum      float64
+	min      float64
+	max      float64
+	last     float64
+	increase float64
+	rated    bool
+}
+
+func (b *bucket) add(value float64) {
+	if b.count == 0 {
+		b.min, b.max = value, value
+	}
+	b.count++
+	b.sum += value
+	b.min = math.Min(b.min, value)
+	b.max = math.Max(b.max, value)
+	b.last = value
+}
+
+// addRollup adds samples aggregated by rollup.
+func (b *bucket) addRollup(r Rollup) {
+	if b.count == 0 {
+		b.min, b.max = r.Min, r.Max
+	}
+	b.count += int(r.Count)
+	b.sum += r.Sum
+	b.min = math.Min(b.min, r.Min)
+	b.max = math.Max(b.max, r.Max)
+	b.last = r.Last
+}
+
+func (b *bucket) value(aggregation string, step time.Duration) float64 {
+	switch aggregation {
+	case AggregationMin:
+		return b.min
+	case AggregationMax:
+		return b.max
+	case AggregationSum:
+		return b.sum
+	case AggregationLast:
+		return b.last
+	case AggregationRate:
+		return b.increase / step.Seconds()
+	default:
+		return b.sum / float64(b.count)
+	}
+}
+
+// counterIncrease returns how much a counter total has grown from prev to cur.
+// Counter totals decrease only after reset, then all the value is an increase.
+func counterIncrease(prev, cur float64) float64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	return cur
+}
+
+// aggregate groups rollups and samples sorted by time into steps of the query. Rollups are older than samples
+// and are placed into steps by their start. Data before the range only serves as a base for counter increase.
+func aggregate(rollups []Rollup, samples []Sample, q RangeQuery) []Sample {
+	n := int((q.To.Sub(q.From) + q.Step - 1) / q.Step)
+	buckets := make([]bucket, n)
+
+	var prev *float64
+	place := func(ts time.Time, last float64) *bucket {
+		defer func() { prev = &last }()
+		if ts.Before(q.From) || ts.After(q.To) {
+			return nil
+		}
+		idx := int(ts.Sub(q.From) / q.Step)
+		if idx >= n {
+			idx = n - 1
+		}
+		b := &buckets[idx]
+		if prev != nil {
+			b.increase += counterIncrease(*prev, last)
+			b.rated = true
+		}
+		return b
+	}
+
+	for _, r := range rollups {
+		if b := place(r.Start, r.Last); b != nil {
+			b.addRollup(r)
+		}
+	}
+	for _, s := range samples {
+		if b := place(s.Timestamp, s.Value); b != nil {
+			b.add(s.Value)
+		}
+	}
+
+	points := make([]Sample, 0, n)
+	for i, b := range buckets {
+		if b.count == 0 || (q.Aggregation == AggregationRate && !b.rated) {
+			continue
+		}
+		points = append(points, Sample{
+			Timestamp: q.From.Add(time.Duration(i) * q.Step),
+			Value:     b.value(q.Aggregation, q.Step),
+		})
+	}
+	return points
+}
+
+// queryRange answers a range query from in-memory history or from storage
+// if memory does not hold the whole range. A metric requested without labels is resolved
+// to its only series, see MetricStore.Find.
+func (s GenericService) queryRange(ctx context.Context, q RangeQuery) (*RangeResult, error) {
+	m, err := s.Metrics.Find(q.ID, q.Labels)
+	if err != nil {
+		return nil, err
+	}
+	key := m.SeriesKey()
+	if err = q.validate(m.MType); err != nil {
+		return nil, err
+	}
+
+	// rate needs a sample before the range as a base for the first step
+	from := q.From
+	if q.Aggregation == AggregationRate {
+		from = from.Add(-q.Step)
+	}
+
+	var samples []Sample
+	var rollups []Rollup
+	if s.history.covers(key, from) || s.backuper == nil {
+		samples = s.history.Range(key, from, q.To)
+	} else {
+		// older history may be already rolled up by compaction
+		rollups, err = s.backuper.LoadRollups(ctx, key, from, q.To)
+		if err != nil {
+			return nil, err
+		}
+		samples, err = s.backuper.LoadHistory(ctx, key, from, q.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &RangeResult{
+		ID:          q.ID,
+		Labels:      m.Labels,
+		MType:       m.MType,
+		Aggregation: q.Aggregation,
+		Step:        q.Step,
+		Points:      aggregate(rollups, samples, q),
+	}, nil
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var queryStart = time.Date(2023, 1, 1, 3, 0, 0, 0, time.UTC)
+
+func querySamples(values ...float64) []Sample {
+	samples := make([]Sample, 0, len(values))
+	for i, v := range values {
+		samples = append(samples, Sample{Timestamp: queryStart.Add(time.Duration(i*30) * time.Second), Value: v})
+	}
+	return samples
+}
+
+func TestAggregate(t *testing.T) {
+	// two samples per minute
+	samples := querySamples(1, 3, 10, 2)
+	q := RangeQuery{From: queryStart, To: queryStart.Add(2 * time.Minute), Step: time.Minute}
+
+	tests := []struct {
+		aggregation string
+		want        []float64
+	}{
+		{aggregation: AggregationAvg, want: []float64{2, 6}},
+		{aggregation: AggregationMin, want: []float64{1, 2}},
+		{aggregation: AggregationMax, want: []float64{3, 10}},
+		{aggregation: AggregationSum, want: []float64{4, 12}},
+		{aggregation: AggregationLast, want: []float64{3, 2}},
+		// increase of 2 in the first minute, 7 and 2 after reset in the second one
+		{aggregation: AggregationRate, want: []float64{2.0 / 60, 9.0 / 60}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.aggregation, func(t *testing.T) {
+			q.Aggregation = tt.aggregation
+			points := aggregate(nil, samples, q)
+			require.Len(t, points, len(tt.want))
+			for i, p := range points {
+				assert.Equal(t, queryStart.Add(time.Duration(i)*time.Minute), p.Timestamp)
+				assert.InDelta(t, tt.want[i], p.Value, 1e-9)
+			}
+		})
+	}
+}
+
+func TestRangeQueryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		q     RangeQuery
+		mType string
+	}{
+		{name: "no id", q: RangeQuery{From: queryStart, Step: time.Minute}, mType: gauge},
+		{name: "no start", q: RangeQuery{ID: "Alloc", Step: time.Minute}, mType: gauge},
+		{name: "end before start", q: RangeQuery{ID: "Alloc", From: queryStart, To: queryStart.Add(-time.Hour), Step: time.Minute}, mType: gauge},
+		{name: "no step", q: RangeQuery{ID: "Alloc", From: queryStart}, mType: gauge},
+		{name: "too many points", q: RangeQuery{ID: "Alloc", From: queryStart, To: queryStart.Add(24 * time.Hour), Step: time.Second}, mType: gauge},
+		{name: "unknown aggregation", q: RangeQuery{ID: "Alloc", From: queryStart, Step: time.Minute, Aggregation: "median"}, mType: gauge},
+		{name: "rate of gauge", q: RangeQuery{ID: "Alloc", From: queryStart, Step: time.Minute, Aggregation: AggregationRate}, mType: gauge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queryErr *QueryError
+			assert.ErrorAs(t, tt.q.validate(tt.mType), &queryErr)
+		})
+	}
+
+	q := RangeQuery{ID: "Alloc", From: time.Now().Add(-time.Hour), Step: time.Minute}
+	require.NoError(t, q.validate(gauge))
+	assert.Equal(t, AggregationAvg, q.Aggregation)
+	assert.False(t, q.To.IsZero())
+}
+
+func newQueryService(t *testing.T, historySize int) GenericService {
+	s := GenericService{
+		Cfg:     &Config{},
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		history: NewHistory(historySize),
+	}
+	s.Metrics.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(2)})
+
+	var samples []MetricSample
+	for _, sample := range querySamples(1, 3, 10, 2) {
+		s.history.Append("Alloc", sample)
+		samples = append(samples, MetricSample{ID: "Alloc", Sample: sample})
+	}
+	require.NoError(t, s.backuper.SaveSamples(context.TODO(), samples))
+	s.history.takePending()
+	return s
+}
+
+func TestQueryRangeFallsBackToStorage(t *testing.T) {
+	q := RangeQuery{ID: "Alloc", From: queryStart, To: queryStart.Add(2 * time.Minute), Step: time.Minute, Aggregation: AggregationMax}
+
+	// memory keeps only the latest two samples, the rest are loaded from storage
+	s := newQueryService(t, 2)
+	res, err := s.queryRange(context.TODO(), q)
+	require.NoError(t, err)
+	require.Len(t, res.Points, 2)
+	assert.Equal(t, float64(3), res.Points[0].Value)
+	assert.Equal(t, gauge, res.MType)
+
+	_, err = s.queryRange(context.TODO(), RangeQuery{ID: "Unknown", From: queryStart, Step: time.Minute})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+}
+
+func TestGetMetricRangeHandler(t *testing.T) {
+	s := HTTPServer{}
+	gs := newQueryService(t, 10)
+	s.GenericService = &gs
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "ok", body: `{"id":"Alloc","from":"2023-01-01T03:00:00Z","to":"2023-01-01T03:02:00Z","step":"1m","aggregation":"max"}`, wantCode: http.StatusOK},
+		{name: "unknown metric", body: `{"id":"Unknown","from":"2023-01-01T03:00:00Z","step":"1m"}`, wantCode: http.StatusNotFound},
+		{name: "bad step", body: `{"id":"Alloc","from":"2023-01-01T03:00:00Z","step":"minute"}`, wantCode: http.StatusBadRequest},
+		{name: "rate of gauge", body: `{"id":"Alloc","from":"2023-01-01T03:00:00Z","step":"1m","aggregation":"rate"}`, wantCode: http.StatusBadRequest},
+		{name: "bad json", body: `{`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.GetMetricRangeHandler(w, httptest.NewRequest(http.MethodPost, "/value/range/", bytes.NewBufferString(tt.body)))
+			res := w.Result()
+			defer func() {
+				assert.NoError(t, res.Body.Close())
+			}()
+			require.Equal(t, tt.wantCode, res.StatusCode)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var body rangeResponse
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			assert.Equal(t, "1m0s", body.Step)
+			require.Len(t, body.Points, 2)
+			assert.Equal(t, float64(10), body.Points[1].Value)
+		})
+	}
+}
+
+func TestGRPCQueryRange(t *testing.T) {
+	gs := newQueryService(t, 10)
+	s := &GRPCServer{GenericService: &gs}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test"))
+
+	res, err := s.QueryRange(ctx, &pb.QueryRangeRequest{
+		Id:          "Alloc",
+		From:        timestamppb.New(queryStart),
+		To:          timestamppb.New(queryStart.Add(2 * time.Minute)),
+		Step:        durationpb.New(time.Minute),
+		Aggregation: AggregationLast,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Points, 2)
+	assert.Equal(t, float64(2), res.Points[1].Value)
+
+	_, err = s.QueryRange(ctx, &pb.QueryRangeRequest{Id: "Alloc", From: timestamppb.New(queryStart)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestQueryRangeByBareID(t *testing.T) {
+	gs := newSourceService(t)
+	gs.history = NewHistory(10)
+	s := HTTPServer{gs}
+
+	// agent labels its metrics with host, the server adds source
+	r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(`[{"id":"Alloc","type":"gauge","value":5,"labels":{"host":"web1"}}]`))
+	r.Header.Set("X-Agent-ID", "web1")
+	w := httptest.NewRecorder()
+	s.SetMetricListHandler(context.TODO())(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body := fmt.Sprintf(`{"id":"Alloc","from":"%s","step":"1m","aggregation":"last"}`, time.Now().Add(-time.Minute).Format(time.RFC3339))
+	w = httptest.NewRecorder()
+	s.GetMetricRangeHandler(w, httptest.NewRequest(http.MethodPost, "/value/range/", bytes.NewBufferString(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var res rangeResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, metric.Labels{"host": "web1", sourceLabel: "web1"}, res.Labels)
+	require.NotEmpty(t, res.Points)
+	assert.Equal(t, float64(5), res.Points[len(res.Points)-1].Value)
+
+	gRPC := &GRPCServer{GenericService: gs}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test"))
+	q := &pb.QueryRangeRequest{Id: "Alloc", From: timestamppb.New(time.Now().Add(-time.Minute)), Step: durationpb.New(time.Minute)}
+	_, err := gRPC.QueryRange(ctx, q)
+	require.NoError(t, err)
+
+	// another agent makes the bare ID ambiguous
+	gs.Metrics.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1), Labels: metric.Labels{sourceLabel: "web2"}})
+	w = httptest.NewRecorder()
+	s.GetMetricRangeHandler(w, httptest.NewRequest(http.MethodPost, "/value/range/", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	_, err = gRPC.QueryRange(ctx, q)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// RecordingRule describes a derived metric, e.g. "MemoryUsedPercent = (TotalMemory-FreeMemory)/TotalMemory*100".
+// Every sample of the expression is stored as a gauge named after the rule with labels of the sample
+// and the rule labels.
+type RecordingRule struct {
+	Name   string        `json:"name"`
+	Expr   string        `json:"expr"`
+	Labels metric.Labels `json:"labels,omitempty"`
+
+	expr exprNode
+}
+
+// compile checks rule name and parses rule expression.
+func (r *RecordingRule) compile() error {
+	if r.Name == "" || !isIdentRune(r.Name[0], true) {
+		return fmt.Errorf("recording rule '%s' has invalid name '%s'", r.Expr, r.Name)
+	}
+	for i := 1; i < len(r.Name); i++ {
+		if !isIdentRune(r.Name[i], false) {
+			return fmt.Errorf("recording rule '%s' has invalid name '%s'", r.Expr, r.Name)
+		}
+	}
+
+	p, err := newParser(r.Expr)
+	if err != nil {
+		return err
+	}
+	r.expr, err = p.parseExpr()
+	if err != nil {
+		return err
+	}
+	if p.tok.kind != tokEOF {
+		return p.errorf("unexpected '%s'", p.tok.text)
+	}
+	return nil
+}
+
+// LoadRecordingRules reads recording rules from JSON file: {"rules": [{"name": ..., "expr": ..., "labels": {...}}]}.
+// Rules are evaluated in the file order, so a rule may use metrics recorded by rules above it.
+func LoadRecordingRules(path string) ([]RecordingRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Rules []RecordingRule `json:"rules"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range file.Rules {
+		if err := file.Rules[i].compile(); err != nil {
+			return nil, err
+		}
+		if names[file.Rules[i].Name] {
+			return nil, fmt.Errorf("recording rule '%s' is duplicated", file.Rules[i].Name)
+		}
+		names[file.Rules[i].Name] = true
+	}
+	return file.Rules, nil
+}
+
+// record evaluates recording rules and stores their results as gauges. Samples which are not finite numbers,
+// e.g. after division by zero, are skipped.
+func (s GenericService) record(now time.Time) []metric.Metric {
+	var recorded []metric.Metric
+	for _, rule := range s.recordingRules {
+		ec := &evalContext{metrics: s.Metrics.List(), history: s.history, now: now}
+		for _, sample := range rule.expr.eval(ec).samples {
+			value := sample.Value
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			labels := sample.Labels.Copy()
+			for k, v := range rule.Labels {
+				if labels == nil {
+					labels = metric.Labels{}
+				}
+				labels[k] = v
+			}
+			m := metric.Metric{ID: rule.Name, MType: gauge, Labels: labels, Value: &value}
+			if err := s.applyMetric(m); err != nil {
+				log.Printf("Recording rule %s: %s", rule.Name, err)
+				continue
+			}
+			recorded = append(recorded, m)
+		}
+	}
+	s.evaluateAlerts(recorded)
+	return recorded
+}
+
+// StartRecordingRules periodically evaluates recording rules.
+func (s GenericService) StartRecordingRules(ctx context.Context) {
+	ticker := time.NewTicker(s.Cfg.RecordingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.record(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestLoadRecordingRules(t *testing.T) {
+	rules, err := LoadRecordingRules(writeAlertRules(t, `{"rules": [
+		{"name": "MemoryUsedPercent", "expr": "(TotalMemory-FreeMemory)/TotalMemory*100"},
+		{"name": "CPUutilizationAvg", "expr": "avg(CPUutilization*) by (host)", "labels": {"derived": "true"}}
+	]}`))
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	for _, rules := range []string{
+		`{"rules": [{"name": "", "expr": "FreeMemory"}]}`,
+		`{"rules": [{"name": "Bad name", "expr": "FreeMemory"}]}`,
+		`{"rules": [{"name": "Free", "expr": "FreeMemory +"}]}`,
+		`{"rules": [{"name": "Free", "expr": "FreeMemory for 5m"}]}`,
+		`{"rules": [{"name": "A", "expr": "FreeMemory"}, {"name": "A", "expr": "TotalMemory"}]}`,
+	} {
+		_, err := LoadRecordingRules(writeAlertRules(t, rules))
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestRecordingRules(t *testing.T) {
+	rules, err := LoadRecordingRules(writeAlertRules(t, `{"rules": [
+		{"name": "MemoryUsedPercent", "expr": "(TotalMemory-FreeMemory)/TotalMemory*100"},
+		{"name": "CPUutilizationAvg", "expr": "avg(CPUutilization*)", "labels": {"derived": "true"}},
+		{"name": "PollRate", "expr": "rate(PollCount[1m])"},
+		{"name": "MemoryUsedHalf", "expr": "MemoryUsedPercent / 2"}
+	]}`))
+	require.NoError(t, err)
+
+	service := newSourceService(t)
+	service.history = NewHistory(100)
+	service.recordingRules = rules
+	ctx := context.Background()
+
+	mList := []metric.Metric{
+		{ID: "TotalMemory", MType: gauge, Value: getFloatPointer(400)},
+		{ID: "FreeMemory", MType: gauge, Value: getFloatPointer(100)},
+		{ID: "CPUutilization1", MType: gauge, Value: getFloatPointer(10)},
+		{ID: "CPUutilization2", MType: gauge, Value: getFloatPointer(20)},
+		{ID: "PollCount", MType: counter, Delta: getIntPointer(30)},
+	}
+	require.NoError(t, service.saveBatch(ctx, "batch", &mList))
+
+	// counter has a single sample, so it has not increased yet
+	recorded := service.record(time.Now())
+	require.Len(t, recorded, 4)
+
+	m, ok := service.Metrics.Get("MemoryUsedPercent")
+	require.True(t, ok)
+	assert.Equal(t, gauge, m.MType)
+	assert.Equal(t, 75.0, *m.Value)
+	m, ok = service.Metrics.Get("MemoryUsedHalf")
+	require.True(t, ok)
+	assert.Equal(t, 37.5, *m.Value)
+	m, ok = service.Metrics.Get(`CPUutilizationAvg{derived="true"}`)
+	require.True(t, ok)
+	assert.Equal(t, 15.0, *m.Value)
+	m, ok = service.Metrics.Get("PollRate")
+	require.True(t, ok)
+	assert.Equal(t, 0.0, *m.Value)
+
+	// division by zero is not recorded, the previous value is kept
+	mList = []metric.Metric{{ID: "TotalMemory", MType: gauge, Value: getFloatPointer(0)}}
+	require.NoError(t, service.saveBatch(ctx, "batch2", &mList))
+	recorded = service.record(time.Now())
+	assert.Len(t, recorded, 3)
+
+	// recorded metrics are ordinary metrics
+	s := HTTPServer{service}
+	w := httptest.NewRecorder()
+	s.GetMetricOldHandler(w, httptest.NewRequest(http.MethodGet, "/value/gauge/MemoryUsedPercent", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "75", w.Body.String())
+
+	g := &GRPCServer{GenericService: service}
+	grpcCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("Request-ID", "test"))
+	res, err := g.GetMetric(grpcCtx, &pb.GetMetricRequest{Id: "CPUutilizationAvg", Labels: map[string]string{"derived": "true"}})
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, *res.Metric.Value)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/helpers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// defaultAgentReportInterval is assumed for agents which do not report their interval.
+const defaultAgentReportInterval = 10 * time.Second
+
+// Transports agents use to report metrics.
+const (
+	transportHTTP = "http"
+	transportGRPC = "grpc"
+)
+
+// AgentInfo describes an agent known to server.
+// An agent is stale when it has missed several report intervals.
+type AgentInfo struct {
+	ID             string        `json:"id"`
+	Version        string        `json:"version,omitempty"`
+	Transport      string        `json:"transport"`
+	Address        string        `json:"address,omitempty"`
+	ReportInterval time.Duration `json:"report_interval"`
+	FirstSeen      time.Time     `json:"first_seen"`
+	LastSeen       time.Time     `json:"last_seen"`
+	Stale          bool          `json:"stale"`
+}
+
+// agentRegistry keeps agents which have reported to server. It is safe for concurrent use.
+type agentRegistry struct {
+	mu             sync.Mutex
+	agents         map[string]AgentInfo
+	staleIntervals int
+	evictAfter     time.Duration
+}
+
+// newAgentRegistry returns agentRegistry which marks agents stale after staleIntervals missed reports
+// and forgets agents which have not reported for evictAfter. Zero evictAfter keeps agents forever.
+func newAgentRegistry(staleIntervals int, evictAfter time.Duration) *agentRegistry {
+	return &agentRegistry{
+		agents:         map[string]AgentInfo{},
+		staleIntervals: staleIntervals,
+		evictAfter:     evictAfter,
+	}
+}
+
+// seen records a request of agent at the moment. Agents without ID are not registered.
+func (r *agentRegistry) seen(info AgentInfo, now time.Time) {
+	if r == nil || info.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev, ok := r.agents[info.ID]; ok {
+		info.FirstSeen = prev.FirstSeen
+	} else {
+		// registry grows only with new agents, so it is the moment to forget gone ones
+		r.evict(now)
+		info.FirstSeen = now
+	}
+	info.LastSeen = now
+	r.agents[info.ID] = info
+}
+
+// evict removes agents which have not reported for evictAfter. Caller must hold r.mu.
+func (r *agentRegistry) evict(now time.Time) {
+	if r.evictAfter <= 0 {
+		return
+	}
+	for id, info := range r.agents {
+		if now.Sub(info.LastSeen) > r.evictAfter {
+			delete(r.agents, id)
+		}
+	}
+}
+
+// list returns all known agents sorted by ID with their state at the moment.
+func (r *agentRegistry) list(now time.Time) []AgentInfo {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	r.evict(now)
+	agents := make([]AgentInfo, 0, len(r.agents))
+	for _, info := range r.agents {
+		interval := info.ReportInterval
+		if interval <= 0 {
+			interval = defaultAgentReportInterval
+		}
+		info.Stale = r.staleIntervals > 0 && now.Sub(info.LastSeen) > time.Duration(r.staleIntervals)*interval
+		agents = append(agents, info)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+// parseReportInterval parses reported interval. Invalid values are treated as unknown.
+func parseReportInterval(value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// agentRegistryHandler registers the agent which has sent HTTP request.
+func (s HTTPServer) agentRegistryHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.validAgentID(r.Header.Get("X-Agent-ID"), r.Header.Get("X-Agent-Signature")) {
+			http.Error(w, "Agent ID signature is invalid", http.StatusForbidden)
+			return
+		}
+		address := r.Header.Get("X-Real-Ip")
+		if address == "" {
+			address, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		s.agents.seen(AgentInfo{
+			ID:             requestSource(r),
+			Version:        r.Header.Get("X-Agent-Version"),
+			Transport:      transportHTTP,
+			Address:        address,
+			ReportInterval: parseReportInterval(r.Header.Get("X-Report-Interval")),
+		}, time.Now())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// agentRegistryInterceptor registers the agent which has sent gRPC request with metrics or a heartbeat.
+func (s *GRPCServer) agentRegistryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	switch method {
+	case "UpdateMetric", "UpdateMetrics", "Heartbeat":
+	default:
+		return handler(ctx, req)
+	}
+
+	if err := s.checkAgentID(ctx); err != nil {
+		return nil, err
+	}
+	s.agents.seen(grpcAgentInfo(ctx), time.Now())
+	return handler(ctx, req)
+}
+
+// checkAgentID checks signature of agent ID from gRPC metadata, see validAgentID.
+func (s *GRPCServer) checkAgentID(ctx context.Context) error {
+	if !s.validAgentID(helpers.GetMetadataValue(ctx, "Agent-ID"), helpers.GetMetadataValue(ctx, "Agent-Signature")) {
+		return status.Error(codes.PermissionDenied, "agent ID signature is invalid")
+	}
+	return nil
+}
+
+// grpcAgentInfo returns information about the agent which has sent gRPC request.
+func grpcAgentInfo(ctx context.Context) AgentInfo {
+	address := helpers.GetMetadataValue(ctx, "X-Real-Ip")
+	if p, ok := peer.FromContext(ctx); ok && address == "" {
+		address, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	return AgentInfo{
+		ID:             helpers.GetSource(ctx),
+		Version:        helpers.GetMetadataValue(ctx, "Agent-Version"),
+		Transport:      transportGRPC,
+		Address:        address,
+		ReportInterval: parseReportInterval(helpers.GetMetadataValue(ctx, "Report-Interval")),
+	}
+}
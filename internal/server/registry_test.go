@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestAgentRegistry(t *testing.T) {
+	r := newAgentRegistry(3, 0)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r.seen(AgentInfo{ID: ""}, start)
+	r.seen(AgentInfo{ID: "web2", Version: "v1", Transport: transportGRPC, ReportInterval: time.Minute}, start)
+	r.seen(AgentInfo{ID: "web1", Version: "v1", Transport: transportHTTP, ReportInterval: 10 * time.Second}, start)
+	r.seen(AgentInfo{ID: "web1", Version: "v2", Transport: transportHTTP, ReportInterval: 10 * time.Second}, start.Add(20*time.Second))
+
+	agents := r.list(start.Add(40 * time.Second))
+	require.Len(t, agents, 2)
+	assert.Equal(t, "web1", agents[0].ID)
+	assert.Equal(t, "v2", agents[0].Version)
+	assert.Equal(t, start, agents[0].FirstSeen)
+	assert.Equal(t, start.Add(20*time.Second), agents[0].LastSeen)
+	assert.False(t, agents[0].Stale)
+	assert.False(t, agents[1].Stale)
+
+	// web1 missed more than 3 intervals of 10s, web2 reports every minute
+	agents = r.list(start.Add(51 * time.Second))
+	assert.True(t, agents[0].Stale)
+	assert.False(t, agents[1].Stale)
+
+	// unknown interval falls back to default
+	r.seen(AgentInfo{ID: "web3"}, start)
+	agents = r.list(start.Add(3*defaultAgentReportInterval + time.Second))
+	assert.True(t, agents[2].Stale)
+}
+
+func TestAgentRegistryEviction(t *testing.T) {
+	r := newAgentRegistry(3, time.Hour)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r.seen(AgentInfo{ID: "web1"}, start)
+	r.seen(AgentInfo{ID: "web2"}, start)
+	r.seen(AgentInfo{ID: "web2"}, start.Add(30*time.Minute))
+
+	// a new agent makes registry forget agents gone for longer than an hour
+	r.seen(AgentInfo{ID: "web3"}, start.Add(61*time.Minute))
+	r.mu.Lock()
+	assert.Len(t, r.agents, 2)
+	assert.NotContains(t, r.agents, "web1")
+	r.mu.Unlock()
+
+	agents := r.list(start.Add(91 * time.Minute))
+	require.Len(t, agents, 1)
+	assert.Equal(t, "web3", agents[0].ID)
+	assert.True(t, agents[0].Stale)
+}
+
+func TestAgentsHandlers(t *testing.T) {
+	s := HTTPServer{newSourceService(t)}
+	s.agents = newAgentRegistry(defaultAgentStaleIntervals, defaultAgentEvictAfter)
+
+	r := httptest.NewRequest(http.MethodPost, "/heartbeat/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Agent-ID", "web1")
+	r.Header.Set("X-Agent-Version", "v1.2.0")
+	r.Header.Set("X-Report-Interval", "10s")
+	w := httptest.NewRecorder()
+	s.agentRegistryHandler(http.HandlerFunc(s.HeartbeatHandler)).ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	s.GetAgentsHandler(w, httptest.NewRequest(http.MethodGet, "/agents/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var agents []AgentInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &agents))
+	require.Len(t, agents, 1)
+	assert.Equal(t, "web1", agents[0].ID)
+	assert.Equal(t, "v1.2.0", agents[0].Version)
+	assert.Equal(t, transportHTTP, agents[0].Transport)
+	assert.Equal(t, "10.0.0.1", agents[0].Address)
+	assert.Equal(t, 10*time.Second, agents[0].ReportInterval)
+	assert.False(t, agents[0].Stale)
+}
+
+func TestGRPCAgents(t *testing.T) {
+	s := &GRPCServer{GenericService: newSourceService(t)}
+	s.agents = newAgentRegistry(defaultAgentStaleIntervals, defaultAgentEvictAfter)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"Request-ID", "test",
+		"Agent-ID", "web1",
+		"Agent-Version", "v1.2.0",
+		"Report-Interval", "1m0s",
+		"X-Real-Ip", "10.0.0.1",
+	))
+	heartbeat := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.Heartbeat(ctx, req.(*emptypb.Empty))
+	}
+	_, err := s.agentRegistryInterceptor(ctx, &emptypb.Empty{}, &grpc.UnaryServerInfo{FullMethod: "/go_devops_advanced.MetricsAgent/Heartbeat"}, heartbeat)
+	require.NoError(t, err)
+
+	// requests which do not report metrics do not register agents
+	other := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test", "Agent-ID", "reader"))
+	_, err = s.agentRegistryInterceptor(other, &emptypb.Empty{}, &grpc.UnaryServerInfo{FullMethod: "/go_devops_advanced.MetricsAgent/ListAgents"}, heartbeat)
+	require.NoError(t, err)
+
+	res, err := s.ListAgents(ctx, &emptypb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, res.Agents, 1)
+	assert.Equal(t, "web1", res.Agents[0].Id)
+	assert.Equal(t, "v1.2.0", res.Agents[0].Version)
+	assert.Equal(t, transportGRPC, res.Agents[0].Transport)
+	assert.Equal(t, "10.0.0.1", res.Agents[0].Address)
+	assert.Equal(t, time.Minute, res.Agents[0].ReportInterval.AsDuration())
+	assert.False(t, res.Agents[0].Stale)
+}
+
+func TestAgentIDSignature(t *testing.T) {
+	s := HTTPServer{newSourceService(t)}
+	s.Cfg.Key = "secret"
+	s.agents = newAgentRegistry(defaultAgentStaleIntervals, defaultAgentEvictAfter)
+
+	tests := []struct {
+		name      string
+		agentID   string
+		signature string
+		want      int
+	}{
+		{name: "signed", agentID: "web1", signature: helpers.AgentSignature("secret", "web1"), want: http.StatusOK},
+		{name: "unsigned", agentID: "web2", want: http.StatusForbidden},
+		{name: "signed for another agent", agentID: "web2", signature: helpers.AgentSignature("secret", "web1"), want: http.StatusForbidden},
+		{name: "signed with another key", agentID: "web2", signature: helpers.AgentSignature("other", "web2"), want: http.StatusForbidden},
+		{name: "without agent ID", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/heartbeat/", nil)
+			r.Header.Set("X-Agent-ID", tt.agentID)
+			r.Header.Set("X-Agent-Signature", tt.signature)
+			w := httptest.NewRecorder()
+			s.agentRegistryHandler(http.HandlerFunc(s.HeartbeatHandler)).ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+
+	agents := s.agents.list(time.Now())
+	require.Len(t, agents, 1)
+	assert.Equal(t, "web1", agents[0].ID)
+}
+
+func TestGRPCAgentIDSignature(t *testing.T) {
+	s := &GRPCServer{GenericService: newSourceService(t)}
+	s.Cfg.Key = "secret"
+	s.agents = newAgentRegistry(defaultAgentStaleIntervals, defaultAgentEvictAfter)
+	heartbeat := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.Heartbeat(ctx, req.(*emptypb.Empty))
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/go_devops_advanced.MetricsAgent/Heartbeat"}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"Request-ID", "test",
+		"Agent-ID", "web1",
+		"Agent-Signature", helpers.AgentSignature("secret", "web1"),
+	))
+	_, err := s.agentRegistryInterceptor(ctx, &emptypb.Empty{}, info, heartbeat)
+	require.NoError(t, err)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"Request-ID", "test",
+		"Agent-ID", "web2",
+		"Agent-Signature", helpers.AgentSignature("secret", "web1"),
+	))
+	_, err = s.agentRegistryInterceptor(ctx, &emptypb.Empty{}, info, heartbeat)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	agents := s.agents.list(time.Now())
+	require.Len(t, agents, 1)
+	assert.Equal(t, "web1", agents[0].ID)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Resolutions of rolled up history.
+const (
+	minuteResolution = time.Minute
+	hourResolution   = time.Hour
+)
+
+// RetentionPolicy describes how long history is kept.
+// Raw samples older than Raw are rolled up into 1-minute aggregates, 1-minute aggregates older than Minute
+// are rolled up into 1-hour aggregates, which are deleted after Hour. Zero duration keeps data forever.
+type RetentionPolicy struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+}
+
+// cutoffs returns moments before which data of every tier is compacted. Zero moment means no compaction.
+// Cutoffs are aligned to the resolution of the next tier, so periods are not split between tiers.
+func (p RetentionPolicy) cutoffs(now time.Time) (raw, minute, hour time.Time) {
+	if p.Raw > 0 {
+		raw = now.Add(-p.Raw).Truncate(minuteResolution)
+	}
+	if p.Minute > 0 {
+		minute = now.Add(-p.Minute).Truncate(hourResolution)
+	}
+	if p.Hour > 0 {
+		hour = now.Add(-p.Hour).Truncate(hourResolution)
+	}
+	return raw, minute, hour
+}
+
+// Rollup aggregates samples of a metric over a period of Resolution starting at Start.
+type Rollup struct {
+	ID         string        `json:"id"`
+	Resolution time.Duration `json:"resolution"`
+	Start      time.Time     `json:"start"`
+	Min        float64       `json:"min"`
+	Max        float64       `json:"max"`
+	Sum        float64       `json:"sum"`
+	Count      int64         `json:"count"`
+	Last       float64       `json:"last"`
+}
+
+type rollupKey struct {
+	id         string
+	resolution time.Duration
+	start      int64
+}
+
+func (r Rollup) key() rollupKey {
+	return rollupKey{id: r.ID, resolution: r.Resolution, start: r.Start.UnixNano()}
+}
+
+// merge adds aggregates of a later period part to r.
+func (r *Rollup) merge(later Rollup) {
+	r.Min = math.Min(r.Min, later.Min)
+	r.Max = math.Max(r.Max, later.Max)
+	r.Sum += later.Sum
+	r.Count += later.Count
+	r.Last = later.Last
+}
+
+// rollupSamples aggregates samples into rollups of the resolution.
+func rollupSamples(samples []MetricSample, resolution time.Duration) []Rollup {
+	sorted := make([]MetricSample, len(samples))
+	copy(sorted, samples)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	rollups := make([]Rollup, 0, len(sorted))
+	for _, s := range sorted {
+		rollups = append(rollups, Rollup{
+			ID:         s.ID,
+			Resolution: resolution,
+			Start:      s.Timestamp.Truncate(resolution),
+			Min:        s.Value,
+			Max:        s.Value,
+			Sum:        s.Value,
+			Count:      1,
+			Last:       s.Value,
+		})
+	}
+	return mergeRollups(nil, rollups)
+}
+
+// downsampleRollups aggregates rollups into rollups of a lower resolution.
+func downsampleRollups(rollups []Rollup, resolution time.Duration) []Rollup {
+	res := make([]Rollup, 0, len(rollups))
+	for _, r := range rollups {
+		r.Resolution = resolution
+		r.Start = r.Start.Truncate(resolution)
+		res = append(res, r)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return mergeRollups(nil, res)
+}
+
+// mergeRollups merges added rollups into existing ones. Rollups of the same period are combined.
+// The result is sorted by metric, resolution and start.
+func mergeRollups(existing, added []Rollup) []Rollup {
+	byKey := make(map[rollupKey]*Rollup, len(existing)+len(added))
+	res := make([]*Rollup, 0, len(existing)+len(added))
+	for _, list := range [][]Rollup{existing, added} {
+		for i := range list {
+			r := list[i]
+			if stored, ok := byKey[r.key()]; ok {
+				stored.merge(r)
+				continue
+			}
+			byKey[r.key()] = &r
+			res = append(res, &r)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ID != res[j].ID {
+			return res[i].ID < res[j].ID
+		}
+		if res[i].Resolution != res[j].Resolution {
+			return res[i].Resolution < res[j].Resolution
+		}
+		return res[i].Start.Before(res[j].Start)
+	})
+	merged := make([]Rollup, 0, len(res))
+	for _, r := range res {
+		merged = append(merged, *r)
+	}
+	return merged
+}
+
+// StartCompaction periodically rolls up and deletes old history according to retention policy.
+func (s GenericService) StartCompaction(ctx context.Context, backuper StorageBackuper) {
+	policy := RetentionPolicy{
+		Raw:    s.Cfg.RawRetention,
+		Minute: s.Cfg.MinuteRetention,
+		Hour:   s.Cfg.HourRetention,
+	}
+
+	ticker := time.NewTicker(s.Cfg.CompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := backuper.Compact(ctx, policy, time.Now())
+			if err != nil {
+				log.Printf("History compaction failed: %s", err)
+			}
+		case <-ctx.Done():
+			log.Println("Compaction has been canceled successfully.")
+			return
+		}
+	}
+}
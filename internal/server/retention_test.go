@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicyCutoffs(t *testing.T) {
+	now := time.Date(2023, 1, 10, 12, 34, 56, 0, time.UTC)
+	policy := RetentionPolicy{Raw: time.Hour, Minute: 24 * time.Hour}
+
+	raw, minute, hour := policy.cutoffs(now)
+	assert.Equal(t, time.Date(2023, 1, 10, 11, 34, 0, 0, time.UTC), raw)
+	assert.Equal(t, time.Date(2023, 1, 9, 12, 0, 0, 0, time.UTC), minute)
+	assert.True(t, hour.IsZero())
+}
+
+func TestRollupSamples(t *testing.T) {
+	// 1, 3 in the first minute, 10, 2 in the second one
+	samples := []MetricSample{}
+	for _, s := range querySamples(1, 3, 10, 2) {
+		samples = append(samples, MetricSample{ID: "Alloc", Sample: s})
+	}
+
+	rollups := rollupSamples(samples, minuteResolution)
+	require.Len(t, rollups, 2)
+	assert.Equal(t, Rollup{ID: "Alloc", Resolution: minuteResolution, Start: queryStart, Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3}, rollups[0])
+	assert.Equal(t, Rollup{ID: "Alloc", Resolution: minuteResolution, Start: queryStart.Add(time.Minute), Min: 2, Max: 10, Sum: 12, Count: 2, Last: 2}, rollups[1])
+
+	hours := downsampleRollups(rollups, hourResolution)
+	require.Len(t, hours, 1)
+	assert.Equal(t, Rollup{ID: "Alloc", Resolution: hourResolution, Start: queryStart, Min: 1, Max: 10, Sum: 16, Count: 4, Last: 2}, hours[0])
+
+	merged := mergeRollups(hours, []Rollup{{ID: "Alloc", Resolution: hourResolution, Start: queryStart, Min: 0, Max: 5, Sum: 5, Count: 2, Last: 5}})
+	require.Len(t, merged, 1)
+	assert.Equal(t, Rollup{ID: "Alloc", Resolution: hourResolution, Start: queryStart, Min: 0, Max: 10, Sum: 21, Count: 6, Last: 5}, merged[0])
+}
+
+func TestFileCompact(t *testing.T) {
+	ctx := context.TODO()
+	fb := &FileStorageBackuper{filename: filepath.Join(t.TempDir(), "metrics.json")}
+
+	var samples []MetricSample
+	for _, s := range querySamples(1, 3, 10, 2) {
+		samples = append(samples, MetricSample{ID: "Alloc", Sample: s})
+	}
+	require.NoError(t, fb.SaveSamples(ctx, samples))
+
+	// samples of the first minute are rolled up, the rest are kept raw
+	policy := RetentionPolicy{Raw: time.Hour, Minute: 24 * time.Hour, Hour: 48 * time.Hour}
+	require.NoError(t, fb.Compact(ctx, policy, queryStart.Add(time.Hour+time.Minute)))
+
+	raw, err := fb.LoadHistory(ctx, "Alloc", time.Time{}, queryStart.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, querySamples(1, 3, 10, 2)[2:], raw)
+	rollups, err := fb.LoadRollups(ctx, "Alloc", time.Time{}, queryStart.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, Rollup{ID: "Alloc", Resolution: minuteResolution, Start: queryStart, Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3}, rollups[0])
+
+	// a day later all samples are in a 1-hour rollup
+	require.NoError(t, fb.Compact(ctx, policy, queryStart.Add(26*time.Hour)))
+	raw, err = fb.LoadHistory(ctx, "Alloc", time.Time{}, queryStart.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, raw)
+	rollups, err = fb.LoadRollups(ctx, "Alloc", time.Time{}, queryStart.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, Rollup{ID: "Alloc", Resolution: hourResolution, Start: queryStart, Min: 1, Max: 10, Sum: 16, Count: 4, Last: 2}, rollups[0])
+
+	// past the final retention nothing is left
+	require.NoError(t, fb.Compact(ctx, policy, queryStart.Add(50*time.Hour)))
+	rollups, err = fb.LoadRollups(ctx, "Alloc", time.Time{}, queryStart.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, rollups)
+}
+
+func TestDBCompact(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		err = db.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	ctx := context.TODO()
+	dbs := &DBStorageBackuper{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO metric_rollups .* FROM metric_history`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM metric_history`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO metric_rollups .* FROM metric_rollups`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM metric_rollups WHERE resolution = 60`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`DELETE FROM metric_rollups WHERE resolution = 3600`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	err = dbs.Compact(ctx, RetentionPolicy{Raw: time.Hour, Minute: time.Hour, Hour: time.Hour}, time.Now())
+	assert.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO metric_rollups`).WillReturnError(New("TestError"))
+	mock.ExpectRollback()
+	err = dbs.Compact(ctx, RetentionPolicy{Raw: time.Hour}, time.Now())
+	assert.Error(t, err)
+
+	// nothing to do when data is kept forever
+	assert.NoError(t, dbs.Compact(ctx, RetentionPolicy{}, time.Now()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestQueryRangeOverRollups(t *testing.T) {
+	s := newQueryService(t, 2)
+	fb := s.backuper.(*FileStorageBackuper)
+	policy := RetentionPolicy{Raw: time.Hour}
+	require.NoError(t, fb.Compact(context.TODO(), policy, queryStart.Add(time.Hour+time.Minute)))
+
+	q := RangeQuery{ID: "Alloc", From: queryStart, To: queryStart.Add(2 * time.Minute), Step: time.Minute, Aggregation: AggregationAvg}
+	res, err := s.queryRange(context.TODO(), q)
+	require.NoError(t, err)
+	require.Len(t, res.Points, 2)
+	assert.Equal(t, float64(2), res.Points[0].Value)
+	assert.Equal(t, float64(6), res.Points[1].Value)
+}
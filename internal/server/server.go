@@ -3,7 +3,12 @@ package server
 
 import (
 	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"time"
@@ -13,8 +18,10 @@ import (
 )
 
 const (
-	gauge   = "gauge"
-	counter = "counter"
+	gauge     = "gauge"
+	counter   = "counter"
+	histogram = "histogram"
+	summary   = "summary"
 )
 
 // Server common interface for gRPC and HTTP server implementations.
@@ -46,11 +53,19 @@ func NewServer(ctx context.Context, cfg *Config, backuper StorageBackuper) (Serv
 
 // GenericService structure. Holds application config and db connector.
 type GenericService struct {
-	Cfg           *Config
-	Metrics       map[string]metric.Metric
-	Decryptor     *Decryptor
-	backuper      StorageBackuper
-	trustedSubnet *net.IPNet
+	Cfg            *Config
+	Metrics        *MetricStore
+	Decryptor      *Decryptor
+	backuper       StorageBackuper
+	trustedSubnet  *net.IPNet
+	batches        *batchRegistry
+	counters       *counterRegistry
+	history        *History
+	agents         *agentRegistry
+	alerts         *alertEngine
+	notifier       *notifier
+	recordingRules []RecordingRule
+	updates        *broker
 }
 
 // NewService returns GenericService with config parsed from flags or ENV vars.
@@ -58,8 +73,13 @@ func NewService(ctx context.Context, cfg *Config, backuper StorageBackuper) (*Ge
 	var s GenericService
 	var err error
 
-	s.Metrics = map[string]metric.Metric{}
+	s.Metrics = NewMetricStore()
 	s.Cfg = cfg
+	s.batches = newBatchRegistry(defaultBatchRegistrySize)
+	s.counters = newCounterRegistry()
+	s.history = NewHistory(s.Cfg.HistorySize)
+	s.agents = newAgentRegistry(s.Cfg.AgentStaleIntervals, s.Cfg.AgentEvictAfter)
+	s.updates = newBroker()
 
 	if s.Cfg.Restore {
 		err = backuper.RestoreMetrics(ctx, s.Metrics)
@@ -67,11 +87,43 @@ func NewService(ctx context.Context, cfg *Config, backuper StorageBackuper) (*Ge
 			log.Print("Error during data restoration.")
 			return nil, err
 		}
+
+		states, err := backuper.RestoreCounterStates(ctx)
+		if err != nil {
+			log.Print("Error during counter states restoration.")
+			return nil, err
+		}
+		s.counters.restore(states)
+
+		if s.Cfg.HistorySize > 0 {
+			samples, err := backuper.RestoreHistory(ctx, s.Cfg.HistorySize)
+			if err != nil {
+				log.Print("Error during history restoration.")
+				return nil, err
+			}
+			s.history.Restore(samples)
+		}
 	}
 
-	if s.Cfg.StoreFile != "" && s.Cfg.StoreInterval > time.Duration(0) {
-		log.Printf("Saving results to storage with interval %s", s.Cfg.StoreInterval)
-		go s.StartRecordInterval(ctx, backuper)
+	if s.Cfg.AlertRulesFile != "" {
+		alertCfg, err := LoadAlertConfig(s.Cfg.AlertRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		if alertCfg.Notifications != nil && len(alertCfg.Notifications.Webhooks) > 0 {
+			s.notifier = newNotifier(*alertCfg.Notifications)
+			log.Printf("Sending alert notifications to %d webhooks", len(alertCfg.Notifications.Webhooks))
+		}
+		s.alerts = newAlertEngine(alertCfg.Rules, s.Metrics, s.history, s.notifier)
+		log.Printf("Loaded %d alert rules from %s", len(alertCfg.Rules), s.Cfg.AlertRulesFile)
+	}
+
+	if s.Cfg.RecordingRulesFile != "" {
+		s.recordingRules, err = LoadRecordingRules(s.Cfg.RecordingRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d recording rules from %s", len(s.recordingRules), s.Cfg.RecordingRulesFile)
 	}
 
 	if s.Cfg.CryptoKey != "" {
@@ -92,26 +144,186 @@ func NewService(ctx context.Context, cfg *Config, backuper StorageBackuper) (*Ge
 	}
 
 	s.backuper = backuper
+
+	// background workers get a copy of the service, so they are started once it is fully built
+	if s.savesPeriodically() {
+		log.Printf("Saving results to storage with interval %s", s.Cfg.StoreInterval)
+		go s.StartRecordInterval(ctx, backuper)
+	}
+
+	if s.Cfg.CompactionInterval > time.Duration(0) {
+		log.Printf("Compacting history with interval %s", s.Cfg.CompactionInterval)
+		go s.StartCompaction(ctx, backuper)
+	}
+
+	if s.notifier != nil {
+		go s.notifier.run(ctx)
+	}
+
+	if s.alerts != nil {
+		go s.StartAlertEvaluation(ctx)
+	}
+
+	if len(s.recordingRules) > 0 && s.Cfg.RecordingInterval > time.Duration(0) {
+		go s.StartRecordingRules(ctx)
+	}
+
 	return &s, nil
 }
 
-func (s GenericService) saveMetric(ctx context.Context, m *metric.Metric) {
+// applyMetric updates stored metrics with a received one, records a history sample and publishes the stored metric
+// to subscribers. Gauges are replaced, counters are increased by increment computed by counter registry.
+// Histograms and summaries are merged with stored ones, their history is the number of observations.
+// Repeated reports of histograms and summaries are not merged again.
+// Invalid metrics are not applied, see validateMetric.
+func (s GenericService) applyMetric(m metric.Metric) error {
+	if err := validateMetric(&m); err != nil {
+		return err
+	}
+
+	var stored metric.Metric
 	switch m.MType {
 	case counter:
-		if s.Metrics[m.ID].Delta == nil {
-			s.Metrics[m.ID] = *m
-		} else {
-			*s.Metrics[m.ID].Delta += *m.Delta
+		stored = s.Metrics.Add(m.ID, m.Labels, s.counters.increment(&m))
+		s.history.Append(m.SeriesKey(), Sample{Timestamp: time.Now(), Value: float64(*stored.Delta)})
+	case gauge:
+		s.Metrics.Upsert(m)
+		s.history.Append(m.SeriesKey(), Sample{Timestamp: time.Now(), Value: *m.Value})
+		stored = copyMetric(m)
+		stored.Hash = ""
+	case histogram, summary:
+		// a report carrying number of observations since the agent start is merged once,
+		// the same report sent again does not increase it, see counterRegistry.increment
+		if m.Cumulative != nil && s.counters.increment(&m) == 0 {
+			return nil
+		}
+		var err error
+		stored, err = s.Metrics.Merge(m)
+		if errors.Is(err, metric.ErrBoundsMismatch) {
+			log.Printf("Histogram %s has changed its buckets, its observations start over.", m.SeriesKey())
+		} else if err != nil {
+			return err
 		}
+		s.history.Append(m.SeriesKey(), Sample{Timestamp: time.Now(), Value: float64(observations(stored))})
+	}
+	s.updates.publish(stored)
+	return nil
+}
+
+// validateMetric checks that received metric has a valid ID and label names, a known type and a value of the type.
+// Values must be finite numbers, NaN and infinities can not be saved to storage.
+func validateMetric(m *metric.Metric) error {
+	if err := metric.ValidateID(m.ID); err != nil {
+		return err
+	}
+	if err := m.Labels.Validate(); err != nil {
+		return err
+	}
+	switch m.MType {
 	case gauge:
-		s.Metrics[m.ID] = *m
+		if m.Value == nil {
+			return errors.New("gauge has no value")
+		}
+		if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return errors.New("gauge value is not a finite number")
+		}
+	case counter:
+		if m.Delta == nil {
+			return errors.New("counter has no delta")
+		}
+	case histogram:
+		return m.Histogram.Validate()
+	case summary:
+		return m.Summary.Validate()
 	default:
-		log.Printf("Metric type '%s' is not expected. Skipping.", m.MType)
+		return fmt.Errorf("metric type '%s' is not expected", m.MType)
+	}
+	return nil
+}
+
+// validHash checks hash of metric if server has a key.
+func (s GenericService) validHash(m *metric.Metric) bool {
+	if s.Cfg.Key == "" {
+		return true
+	}
+	remoteHash, err := hex.DecodeString(m.Hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(m.GenerateHash(s.Cfg.Key), remoteHash)
+}
+
+// observations returns number of observations of a histogram or a summary.
+func observations(m metric.Metric) uint64 {
+	switch {
+	case m.Histogram != nil:
+		return m.Histogram.Count
+	case m.Summary != nil:
+		return m.Summary.Count
+	}
+	return 0
+}
+
+// saveCounterStates saves counter states which have changed to storage and removes expired ones from it.
+// Failed save is repeated next time.
+func (s GenericService) saveCounterStates(ctx context.Context, backuper StorageBackuper) error {
+	snap, changed := s.counters.snapshot()
+	if !changed {
+		return nil
+	}
+	if err := backuper.SaveCounterStates(ctx, snap.states, time.Now().Add(-counterStateTTL)); err != nil {
+		return err
+	}
+	s.counters.markSaved(snap)
+	return nil
+}
+
+// saveHistory saves samples recorded since the previous call to storage.
+// Samples which could not be saved are kept for the next call.
+func (s GenericService) saveHistory(ctx context.Context, backuper StorageBackuper) error {
+	samples := s.history.takePending()
+	if len(samples) == 0 {
+		return nil
+	}
+	if err := backuper.SaveSamples(ctx, samples); err != nil {
+		s.history.returnPending(samples)
+		return err
+	}
+	return nil
+}
+
+// backup saves metrics, counter states and new history samples to storage.
+func (s GenericService) backup(ctx context.Context, backuper StorageBackuper) error {
+	if err := backuper.SaveMetric(ctx, s.Metrics); err != nil {
+		return err
+	}
+	if err := s.saveCounterStates(ctx, backuper); err != nil {
+		return err
+	}
+	return s.saveHistory(ctx, backuper)
+}
+
+// savesPeriodically reports whether metrics are saved to storage by StartRecordInterval.
+func (s GenericService) savesPeriodically() bool {
+	return s.Cfg != nil && s.Cfg.StoreFile != "" && s.Cfg.StoreInterval > time.Duration(0)
+}
+
+// saveMetric applies a received metric. An invalid metric is rejected with an error.
+// Metrics are saved to storage right away only if they are not saved periodically,
+// otherwise agents sending metrics one by one would write storage for every metric.
+func (s GenericService) saveMetric(ctx context.Context, m *metric.Metric) error {
+	if err := s.applyMetric(*m); err != nil {
+		return err
+	}
+	s.evaluateAlerts([]metric.Metric{*m})
+	if s.savesPeriodically() {
+		return nil
 	}
-	err := s.backuper.SaveMetric(ctx, s.Metrics)
+	err := s.backup(ctx, s.backuper)
 	if err != nil {
 		log.Print(err)
 	}
+	return nil
 }
 
 // StartRecordInterval preiodically saves metrics.
@@ -120,7 +332,7 @@ func (s GenericService) StartRecordInterval(ctx context.Context, backuper Storag
 	for {
 		select {
 		case <-ticker.C:
-			err := backuper.SaveMetric(ctx, s.Metrics)
+			err := s.backup(ctx, backuper)
 			if err != nil {
 				log.Print(err.Error())
 			}
@@ -134,7 +346,7 @@ func (s GenericService) StartRecordInterval(ctx context.Context, backuper Storag
 // CloseApp closes http application.
 func (s GenericService) StopServer(ctx context.Context, cancel context.CancelFunc, backuper StorageBackuper) {
 	log.Println("Received a SIGINT! Stopping application")
-	err := backuper.SaveMetric(ctx, s.Metrics)
+	err := s.backup(ctx, backuper)
 	if err != nil {
 		log.Print(err)
 	}
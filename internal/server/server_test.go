@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/Jay-T/go-devops.git/internal/utils/converter"
 	"github.com/Jay-T/go-devops.git/internal/utils/metric"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type MetricNew struct {
@@ -72,7 +74,7 @@ func TestSetMetricOldHandler(t *testing.T) {
 						StoreFile:     "file.json",
 						Restore:       true,
 					},
-					Metrics: map[string]metric.Metric{},
+					Metrics: NewMetricStore(),
 					backuper: &FileStorageBackuper{
 						filename: "/tmp/test",
 					},
@@ -149,7 +151,7 @@ func TestStartServer(t *testing.T) {
 	}
 	s := HTTPServer{
 		&GenericService{
-			Metrics: map[string]metric.Metric{},
+			Metrics: NewMetricStore(),
 			Cfg: &Config{
 				Address: "localhost:8080",
 			},
@@ -180,6 +182,8 @@ func TestNewService(t *testing.T) {
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
+	storeFile := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, (&FileStorageBackuper{filename: storeFile}).SaveMetric(context.TODO(), NewMetricStore()))
 	tests := []struct {
 		name     string
 		backuper StorageBackuper
@@ -189,7 +193,7 @@ func TestNewService(t *testing.T) {
 		{
 			name: "TestOne",
 			backuper: &FileStorageBackuper{
-				filename: "/tmp/test",
+				filename: storeFile,
 			},
 			cfg: &Config{
 				Restore: true,
@@ -231,7 +235,7 @@ func BenchmarkSetMetricHandler(b *testing.B) {
 				StoreFile:     "file.json",
 				Restore:       true,
 			},
-			Metrics: map[string]metric.Metric{},
+			Metrics: NewMetricStore(),
 			backuper: &FileStorageBackuper{
 				filename: "/tmp/test",
 			},
@@ -298,7 +302,7 @@ func BenchmarkGetAllMetricHandler(b *testing.B) {
 				StoreFile:     "file.json",
 				Restore:       true,
 			},
-			Metrics: map[string]metric.Metric{},
+			Metrics: NewMetricStore(),
 		},
 	}
 
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/helpers"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// sourceLabel is a label with identity of the agent which sent a metric.
+// Series of different agents are kept apart, since the label is a part of series key.
+const sourceLabel = "source"
+
+// requestSource returns identity of the agent which sent HTTP request: X-Agent-ID header
+// or X-Real-Ip if agent ID is not set. It returns an empty string if neither is set.
+// Agent ID is trusted only after validAgentID check, which agentRegistryHandler does.
+func requestSource(r *http.Request) string {
+	if id := r.Header.Get("X-Agent-ID"); id != "" {
+		return id
+	}
+	return r.Header.Get("X-Real-Ip")
+}
+
+// validAgentID reports whether agent ID sent with a request may be trusted. With a key set agents sign
+// their IDs, see helpers.AgentSignature, so a client without the key can not write series or registry entries
+// of another agent. Without a key agent IDs are trusted as sent, the same way as X-Real-Ip,
+// and the server must be reachable from trusted networks only.
+func (s GenericService) validAgentID(id, signature string) bool {
+	return s.Cfg.Key == "" || id == "" || helpers.ValidAgentSignature(s.Cfg.Key, id, signature)
+}
+
+// setSource labels metric with its source. A source label set by the agent itself is replaced.
+// Metrics of unknown source are left as is.
+func setSource(m *metric.Metric, source string) {
+	if source == "" {
+		return
+	}
+	labels := m.Labels.Copy()
+	if labels == nil {
+		labels = metric.Labels{}
+	}
+	labels[sourceLabel] = source
+	m.Labels = labels
+}
+
+// filterBySource returns metrics reported by source. Empty source matches all metrics.
+func filterBySource(mList []metric.Metric, source string) []metric.Metric {
+	if source == "" {
+		return mList
+	}
+	res := make([]metric.Metric, 0, len(mList))
+	for _, m := range mList {
+		if m.Labels[sourceLabel] == source {
+			res = append(res, m)
+		}
+	}
+	return res
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/Jay-T/go-devops.git/internal/pb"
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func newSourceService(t *testing.T) *GenericService {
+	return &GenericService{
+		Cfg:     &Config{},
+		Metrics: NewMetricStore(),
+		backuper: &FileStorageBackuper{
+			filename: filepath.Join(t.TempDir(), "metrics.json"),
+		},
+		batches:  newBatchRegistry(defaultBatchRegistrySize),
+		counters: newCounterRegistry(),
+	}
+}
+
+func TestRequestSource(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	assert.Equal(t, "", requestSource(r))
+	r.Header.Set("X-Real-Ip", "10.0.0.1")
+	assert.Equal(t, "10.0.0.1", requestSource(r))
+	r.Header.Set("X-Agent-ID", "web1")
+	assert.Equal(t, "web1", requestSource(r))
+
+	m := metric.Metric{ID: "Alloc", Labels: metric.Labels{sourceLabel: "spoofed", "host": "web1"}}
+	labels := m.Labels
+	setSource(&m, "web2")
+	assert.Equal(t, metric.Labels{sourceLabel: "web2", "host": "web1"}, m.Labels)
+	assert.Equal(t, "spoofed", labels[sourceLabel], "labels of the received metric must not be shared")
+}
+
+func TestSetMetricListHandlerSources(t *testing.T) {
+	s := HTTPServer{newSourceService(t)}
+	ctx := context.TODO()
+
+	// two agents report the same metric
+	for _, agent := range []string{"web1", "web2"} {
+		r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(`[{"id":"Alloc","type":"gauge","value":1}]`))
+		r.Header.Set("X-Agent-ID", agent)
+		r.Header.Set("X-Batch-ID", agent)
+		w := httptest.NewRecorder()
+		s.SetMetricListHandler(ctx)(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, 2, s.Metrics.Len())
+	_, ok := s.Metrics.Get(`Alloc{source="web1"}`)
+	assert.True(t, ok)
+
+	w := httptest.NewRecorder()
+	s.GetAllMetricHandler(w, httptest.NewRequest(http.MethodGet, "/?source=web2", nil))
+	assert.Contains(t, w.Body.String(), `Alloc{source="web2"}`)
+	assert.NotContains(t, w.Body.String(), "web1")
+}
+
+func TestGRPCSources(t *testing.T) {
+	s := &GRPCServer{GenericService: newSourceService(t)}
+
+	for _, agent := range []string{"web1", "web2"} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test", "Agent-ID", agent))
+		res, err := s.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{
+			Metrics: []*pb.Metric{{Id: "PollCount", Mtype: counter, Delta: getIntPointer(2)}},
+		})
+		require.NoError(t, err)
+		require.Empty(t, res.Error)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Request-ID", "test", "X-Real-Ip", "10.0.0.1"))
+	_, err := s.UpdateMetric(ctx, &pb.UpdateMetricRequest{Metric: &pb.Metric{Id: "PollCount", Mtype: counter, Delta: getIntPointer(1)}})
+	require.NoError(t, err)
+
+	all, err := s.GetAllMetrics(ctx, &pb.GetAllMetricsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, all.Metrics, 3)
+
+	res, err := s.GetAllMetrics(ctx, &pb.GetAllMetricsRequest{Source: "10.0.0.1"})
+	require.NoError(t, err)
+	require.Len(t, res.Metrics, 1)
+	assert.Equal(t, int64(1), *res.Metrics[0].Delta)
+
+	m, err := s.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount", Labels: map[string]string{sourceLabel: "web2"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *m.Metric.Delta)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+)
+
+// ErrAmbiguousMetric is returned when a metric requested by ID without labels has several series.
+var ErrAmbiguousMetric = errors.New("metric has several series, labels are required")
+
+// MetricStore keeps current metric values in memory. It is safe for concurrent use.
+// Metrics are keyed by series key, which is the name with labels. They are copied on the way in and out,
+// so callers never share values with the store.
+type MetricStore struct {
+	mu      sync.RWMutex
+	metrics map[string]metric.Metric
+}
+
+// NewMetricStore returns an empty MetricStore.
+func NewMetricStore() *MetricStore {
+	return &MetricStore{
+		metrics: map[string]metric.Metric{},
+	}
+}
+
+// copyMetric returns a deep copy of metric m.
+func copyMetric(m metric.Metric) metric.Metric {
+	if m.Delta != nil {
+		delta := *m.Delta
+		m.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		m.Value = &value
+	}
+	if m.Cumulative != nil {
+		cumulative := *m.Cumulative
+		m.Cumulative = &cumulative
+	}
+	m.Labels = m.Labels.Copy()
+	m.Histogram = m.Histogram.Copy()
+	m.Summary = m.Summary.Copy()
+	return m
+}
+
+// Get returns metric by series key, see metric.SeriesKey.
+func (st *MetricStore) Get(key string) (metric.Metric, bool) {
+	if st == nil {
+		return metric.Metric{}, false
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	m, ok := st.metrics[key]
+	if !ok {
+		return metric.Metric{}, false
+	}
+	return copyMetric(m), true
+}
+
+// Find returns metric by ID and labels. Metric requested without labels is resolved to its only series,
+// so readers which do not know labels attached by agents still get their metrics.
+// ErrMetricNotFound or ErrAmbiguousMetric is returned if there is no such series or there are several of them.
+func (st *MetricStore) Find(id string, labels metric.Labels) (metric.Metric, error) {
+	if m, ok := st.Get(metric.SeriesKey(id, labels)); ok {
+		return m, nil
+	}
+	if len(labels) > 0 || st == nil {
+		return metric.Metric{}, ErrMetricNotFound
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	var found *metric.Metric
+	for _, m := range st.metrics {
+		if m.ID != id {
+			continue
+		}
+		if found != nil {
+			return metric.Metric{}, ErrAmbiguousMetric
+		}
+		m := m
+		found = &m
+	}
+	if found == nil {
+		return metric.Metric{}, ErrMetricNotFound
+	}
+	return copyMetric(*found), nil
+}
+
+// Upsert saves metric replacing the stored one of the same series.
+func (st *MetricStore) Upsert(m metric.Metric) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.metrics[m.SeriesKey()] = copyMetric(m)
+}
+
+// Add increases counter series by delta and returns its new value.
+// Missing counter is created, a metric of another type of the same series is replaced.
+func (st *MetricStore) Add(id string, labels metric.Labels, delta int64) metric.Metric {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := metric.SeriesKey(id, labels)
+	total := delta
+	if m, ok := st.metrics[key]; ok && m.MType == counter && m.Delta != nil {
+		total += *m.Delta
+	}
+	m := metric.Metric{ID: id, MType: counter, Delta: &total, Labels: labels.Copy()}
+	st.metrics[key] = m
+	return copyMetric(m)
+}
+
+// Merge adds observations of a histogram or a summary to the stored one of the same series and returns the result.
+// Missing metric is created, a metric of another type is replaced. Invalid metric is not stored.
+// A histogram with other buckets replaces the stored one, metric.ErrBoundsMismatch is returned then.
+func (st *MetricStore) Merge(m metric.Metric) (metric.Metric, error) {
+	var err error
+	switch m.MType {
+	case histogram:
+		err = m.Histogram.Validate()
+	case summary:
+		err = m.Summary.Validate()
+	default:
+		err = fmt.Errorf("metric type '%s' can not be merged", m.MType)
+	}
+	if err != nil {
+		return metric.Metric{}, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := m.SeriesKey()
+	res := copyMetric(m)
+	res.Hash = ""
+	if stored, ok := st.metrics[key]; ok && stored.MType == m.MType {
+		switch {
+		case stored.Histogram != nil && m.Histogram != nil:
+			merged := stored.Histogram.Copy()
+			if err = merged.Merge(m.Histogram); err == nil {
+				res.Histogram = merged
+			}
+		case stored.Summary != nil && m.Summary != nil:
+			merged := stored.Summary.Copy()
+			merged.Merge(m.Summary)
+			res.Summary = merged
+		}
+	}
+	st.metrics[key] = res
+	return copyMetric(res), err
+}
+
+// List returns all metrics sorted by series key.
+func (st *MetricStore) List() []metric.Metric {
+	if st == nil {
+		return nil
+	}
+
+	st.mu.RLock()
+	mList := make([]metric.Metric, 0, len(st.metrics))
+	for _, m := range st.metrics {
+		mList = append(mList, copyMetric(m))
+	}
+	st.mu.RUnlock()
+
+	sort.Slice(mList, func(i, j int) bool { return mList[i].SeriesKey() < mList[j].SeriesKey() })
+	return mList
+}
+
+// Delete removes metric by series key. It returns false if there was no such metric.
+func (st *MetricStore) Delete(key string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.metrics[key]; !ok {
+		return false
+	}
+	delete(st.metrics, key)
+	return true
+}
+
+// Len returns number of stored metrics.
+func (st *MetricStore) Len() int {
+	if st == nil {
+		return 0
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return len(st.metrics)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Jay-T/go-devops.git/internal/utils/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricStore(t *testing.T) {
+	st := NewMetricStore()
+
+	_, ok := st.Get("Alloc")
+	assert.False(t, ok)
+
+	value := 1.5
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: &value})
+	value = 2
+	m, ok := st.Get("Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 1.5, *m.Value, "store must not share values with callers")
+
+	*m.Value = 3
+	m, _ = st.Get("Alloc")
+	assert.Equal(t, 1.5, *m.Value)
+
+	assert.Equal(t, int64(2), *st.Add("PollCount", nil, 2).Delta)
+	assert.Equal(t, int64(5), *st.Add("PollCount", nil, 3).Delta)
+
+	mList := st.List()
+	require.Len(t, mList, 2)
+	assert.Equal(t, "Alloc", mList[0].ID)
+	assert.Equal(t, "PollCount", mList[1].ID)
+
+	assert.True(t, st.Delete("Alloc"))
+	assert.False(t, st.Delete("Alloc"))
+	assert.Equal(t, 1, st.Len())
+}
+
+func TestMetricStoreLabels(t *testing.T) {
+	st := NewMetricStore()
+
+	labels := metric.Labels{"host": "web1"}
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1), Labels: labels})
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(2), Labels: metric.Labels{"host": "web2"}})
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(3)})
+	labels["host"] = "changed"
+	assert.Equal(t, 3, st.Len())
+
+	m, ok := st.Get(`Alloc{host="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, float64(1), *m.Value)
+	assert.Equal(t, metric.Labels{"host": "web1"}, m.Labels)
+	m, _ = st.Get("Alloc")
+	assert.Equal(t, float64(3), *m.Value)
+
+	st.Add("PollCount", metric.Labels{"host": "web1"}, 2)
+	assert.Equal(t, int64(3), *st.Add("PollCount", metric.Labels{"host": "web1"}, 1).Delta)
+	assert.Equal(t, int64(1), *st.Add("PollCount", metric.Labels{"host": "web2"}, 1).Delta)
+
+	var keys []string
+	for _, m := range st.List() {
+		keys = append(keys, m.SeriesKey())
+	}
+	assert.Equal(t, []string{"Alloc", `Alloc{host="web1"}`, `Alloc{host="web2"}`, `PollCount{host="web1"}`, `PollCount{host="web2"}`}, keys)
+}
+
+func TestMetricStoreMergeDistributions(t *testing.T) {
+	st := NewMetricStore()
+	latency := func(counts []uint64, sum float64, count uint64) metric.Metric {
+		return metric.Metric{ID: "Latency", MType: histogram, Histogram: &metric.Histogram{
+			Bounds: []float64{0.1, 0.5},
+			Counts: counts,
+			Sum:    sum,
+			Count:  count,
+		}}
+	}
+
+	// two agents report observations of the same series
+	_, err := st.Merge(latency([]uint64{1, 2, 0}, 0.7, 3))
+	require.NoError(t, err)
+	m, err := st.Merge(latency([]uint64{0, 1, 1}, 1.3, 2))
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 3, 1}, m.Histogram.Counts)
+	assert.Equal(t, uint64(5), m.Histogram.Count)
+	assert.InDelta(t, 2.0, m.Histogram.Sum, 1e-9)
+
+	_, err = st.Merge(latency([]uint64{1, 1}, 0.7, 2))
+	assert.Error(t, err, "counts do not match bounds")
+	_, err = st.Merge(latency([]uint64{1, 1, 1}, 0.7, 5))
+	assert.Error(t, err, "count does not match bucket counts")
+	m, _ = st.Get("Latency")
+	assert.Equal(t, uint64(5), m.Histogram.Count)
+
+	rebucketed := metric.Metric{ID: "Latency", MType: histogram, Histogram: &metric.Histogram{
+		Bounds: []float64{1},
+		Counts: []uint64{1, 0},
+		Sum:    0.2,
+		Count:  1,
+	}}
+	m, err = st.Merge(rebucketed)
+	assert.ErrorIs(t, err, metric.ErrBoundsMismatch)
+	assert.Equal(t, rebucketed.Histogram, m.Histogram)
+
+	rpc := func(p50 float64, sum float64, count uint64) metric.Metric {
+		return metric.Metric{ID: "RPC", MType: summary, Summary: &metric.Summary{
+			Quantiles: []metric.Quantile{{Quantile: 0.5, Value: p50}, {Quantile: 0.99, Value: p50 * 2}},
+			Sum:       sum,
+			Count:     count,
+		}}
+	}
+	_, err = st.Merge(rpc(0.1, 1, 10))
+	require.NoError(t, err)
+	m, err = st.Merge(rpc(0.3, 2, 5))
+	require.NoError(t, err)
+	assert.Equal(t, rpc(0.3, 3, 15).Summary, m.Summary)
+
+	_, err = st.Merge(metric.Metric{ID: "RPC", MType: summary, Summary: &metric.Summary{Quantiles: []metric.Quantile{{Quantile: 1.5}}}})
+	assert.Error(t, err)
+	_, err = st.Merge(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1)})
+	assert.Error(t, err)
+}
+
+func TestMetricStoreConcurrentAccess(t *testing.T) {
+	st := NewMetricStore()
+	const workers, iterations = 8, 500
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				value := float64(i)
+				st.Upsert(metric.Metric{ID: fmt.Sprintf("Gauge%d", i%10), MType: gauge, Value: &value})
+				st.Add("PollCount", nil, 1)
+				st.Get("Gauge1")
+				st.List()
+				if i%50 == 0 {
+					st.Delete(fmt.Sprintf("Gauge%d", w))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	m, ok := st.Get("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(workers*iterations), *m.Delta)
+}
+
+func TestConcurrentHandlersAndBackup(t *testing.T) {
+	fs := &FileStorageBackuper{
+		filename: filepath.Join(t.TempDir(), "metrics.json"),
+	}
+	s := HTTPServer{
+		&GenericService{
+			Cfg:      &Config{},
+			Metrics:  NewMetricStore(),
+			backuper: fs,
+			batches:  newBatchRegistry(defaultBatchRegistrySize),
+			counters: newCounterRegistry(),
+		},
+	}
+	ctx := context.TODO()
+	update := s.SetMetricHandler(ctx)
+	updates := s.SetMetricListHandler(ctx)
+	const workers, iterations = 4, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				body, err := json.Marshal(metric.Metric{ID: "PollCount", MType: counter, Delta: getIntPointer(1)})
+				require.NoError(t, err)
+				update(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				body, err := json.Marshal([]metric.Metric{{ID: "Alloc", MType: gauge, Value: getFloatPointer(float64(i))}})
+				require.NoError(t, err)
+				updates(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				s.GetAllMetricHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+				assert.NoError(t, fs.SaveMetric(ctx, s.Metrics))
+			}
+		}()
+	}
+	wg.Wait()
+
+	m, ok := s.Metrics.Get("PollCount")
+	require.True(t, ok)
+	assert.Equal(t, int64(workers*iterations), *m.Delta)
+}
+
+func TestMetricStoreFind(t *testing.T) {
+	st := NewMetricStore()
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(1), Labels: metric.Labels{"host": "web1"}})
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(2), Labels: metric.Labels{"host": "web2"}})
+	st.Upsert(metric.Metric{ID: "FreeMemory", MType: gauge, Value: getFloatPointer(3), Labels: metric.Labels{"host": "web1"}})
+
+	m, err := st.Find("FreeMemory", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *m.Value)
+	m, err = st.Find("Alloc", metric.Labels{"host": "web2"})
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *m.Value)
+	_, err = st.Find("Alloc", nil)
+	assert.ErrorIs(t, err, ErrAmbiguousMetric)
+	_, err = st.Find("FreeMemory", metric.Labels{"host": "web2"})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+	_, err = st.Find("Unknown", nil)
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+
+	// unlabeled series is returned as is
+	st.Upsert(metric.Metric{ID: "Alloc", MType: gauge, Value: getFloatPointer(4)})
+	m, err = st.Find("Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, *m.Value)
+}
@@ -10,26 +10,37 @@ import (
 )
 
 const (
-	gauge   = "gauge"
-	counter = "counter"
+	gauge     = "gauge"
+	counter   = "counter"
+	histogram = "histogram"
+	summary   = "summary"
 )
 
 // ConvertData converts pb.Metric struct into metric.Metric struct.
 func ConvertData(pbm *pb.Metric) (*metric.Metric, error) {
-	if pbm.Mtype == counter {
-		return &metric.Metric{
-			ID:    pbm.Id,
-			MType: pbm.Mtype,
-			Delta: pbm.Delta,
-			Hash:  pbm.Hash,
-		}, nil
+	m := &metric.Metric{
+		ID:     pbm.Id,
+		MType:  pbm.Mtype,
+		Hash:   pbm.Hash,
+		Labels: pbm.Labels,
 	}
-	return &metric.Metric{
-		ID:    pbm.Id,
-		MType: pbm.Mtype,
-		Value: pbm.Value,
-		Hash:  pbm.Hash,
-	}, nil
+	switch pbm.Mtype {
+	case counter:
+		m.Delta = pbm.Delta
+		m.Cumulative = pbm.Cumulative
+		m.StartTime = pbm.StartTime
+	case histogram:
+		m.Histogram = metric.HistogramFromPB(pbm.Histogram)
+		m.Cumulative = pbm.Cumulative
+		m.StartTime = pbm.StartTime
+	case summary:
+		m.Summary = metric.SummaryFromPB(pbm.Summary)
+		m.Cumulative = pbm.Cumulative
+		m.StartTime = pbm.StartTime
+	default:
+		m.Value = pbm.Value
+	}
+	return m, nil
 }
 
 // GetBody parses HTTP request's body and returns Metric.
@@ -2,6 +2,9 @@ package helpers
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"log"
 	"net"
 	"strings"
@@ -15,6 +18,48 @@ func GetReqID(ctx context.Context) string {
 	return md.Get("Request-ID")[0]
 }
 
+// GetBatchID helper returns Batch-ID from metadata if it is set.
+func GetBatchID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ids := md.Get("Batch-ID")
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// GetMetadataValue helper returns the first value of key from metadata or an empty string if it is not set.
+func GetMetadataValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// GetSource helper returns identity of the agent which sent the request: Agent-ID from metadata
+// or X-Real-Ip if agent ID is not set. It returns an empty string if neither is set.
+func GetSource(ctx context.Context) string {
+	if id := GetMetadataValue(ctx, "Agent-ID"); id != "" {
+		return id
+	}
+	return GetMetadataValue(ctx, "X-Real-Ip")
+}
+
+// AgentSignature returns signature of agent ID made with key. Agents send it along with their ID,
+// so server with the same key can tell the agent from a client which uses its ID.
+func AgentSignature(key, agentID string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte("agent:" + agentID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidAgentSignature reports whether signature of agent ID has been made with key.
+func ValidAgentSignature(key, agentID, signature string) bool {
+	return hmac.Equal([]byte(AgentSignature(key, agentID)), []byte(signature))
+}
+
 // GetLocalInterfaceAddress returns IP address of interface <ifname>.
 func GetLocalInterfaceAddress(remoteAddress string) (string, error) {
 	var localAddress string
@@ -0,0 +1,198 @@
+package metric
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Jay-T/go-devops.git/internal/pb"
+)
+
+// ErrBoundsMismatch is returned when histograms with different buckets are merged.
+var ErrBoundsMismatch = errors.New("histogram bucket bounds do not match")
+
+// Histogram counts observations in buckets with explicit upper bounds.
+// Counts has a bucket per bound, an observation goes to the first bucket whose bound is not less than it.
+// The last extra bucket counts observations above all bounds.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// Validate checks that bounds are increasing finite numbers, counts match them and sum is finite.
+func (h *Histogram) Validate() error {
+	if h == nil {
+		return errors.New("histogram is empty")
+	}
+	if !isFinite(h.Sum) {
+		return errors.New("histogram sum is not a finite number")
+	}
+	for _, b := range h.Bounds {
+		if !isFinite(b) {
+			return errors.New("histogram bounds must be finite numbers")
+		}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram has %d bounds and %d counts, expected %d counts", len(h.Bounds), len(h.Counts), len(h.Bounds)+1)
+	}
+	for i := 1; i < len(h.Bounds); i++ {
+		if !(h.Bounds[i] > h.Bounds[i-1]) {
+			return errors.New("histogram bounds must increase")
+		}
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("histogram count %d does not match sum of bucket counts %d", h.Count, total)
+	}
+	return nil
+}
+
+// Merge adds observations of other histogram. Histograms must have the same bounds.
+func (h *Histogram) Merge(other *Histogram) error {
+	if len(h.Bounds) != len(other.Bounds) {
+		return ErrBoundsMismatch
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return ErrBoundsMismatch
+		}
+	}
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+	return nil
+}
+
+// Copy returns a deep copy of the histogram.
+func (h *Histogram) Copy() *Histogram {
+	if h == nil {
+		return nil
+	}
+	res := *h
+	res.Bounds = append([]float64(nil), h.Bounds...)
+	res.Counts = append([]uint64(nil), h.Counts...)
+	return &res
+}
+
+// isFinite reports whether v is neither NaN nor infinity, which JSON can not encode.
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// Quantile is a value below which the Quantile fraction of observations falls.
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Summary describes observations with quantiles computed by the reporter, their sum and count.
+type Summary struct {
+	Quantiles []Quantile `json:"quantiles"`
+	Sum       float64    `json:"sum"`
+	Count     uint64     `json:"count"`
+}
+
+// Validate checks that quantiles are within [0, 1] and sorted, their values and sum are finite.
+func (s *Summary) Validate() error {
+	if s == nil {
+		return errors.New("summary is empty")
+	}
+	if !isFinite(s.Sum) {
+		return errors.New("summary sum is not a finite number")
+	}
+	for i, q := range s.Quantiles {
+		if !isFinite(q.Value) {
+			return fmt.Errorf("value of quantile %g is not a finite number", q.Quantile)
+		}
+		if q.Quantile < 0 || q.Quantile > 1 {
+			return fmt.Errorf("quantile %g is out of [0, 1]", q.Quantile)
+		}
+		if i > 0 && !(q.Quantile > s.Quantiles[i-1].Quantile) {
+			return errors.New("summary quantiles must increase")
+		}
+	}
+	return nil
+}
+
+// Merge adds sum and count of other summary.
+// Quantiles of different reports cannot be combined exactly, so the quantiles of other summary are kept.
+func (s *Summary) Merge(other *Summary) {
+	s.Quantiles = append([]Quantile(nil), other.Quantiles...)
+	s.Sum += other.Sum
+	s.Count += other.Count
+}
+
+// Copy returns a deep copy of the summary.
+func (s *Summary) Copy() *Summary {
+	if s == nil {
+		return nil
+	}
+	res := *s
+	res.Quantiles = append([]Quantile(nil), s.Quantiles...)
+	return &res
+}
+
+// histogramToPB converts Histogram to pb.Histogram.
+func histogramToPB(h *Histogram) *pb.Histogram {
+	if h == nil {
+		return nil
+	}
+	return &pb.Histogram{
+		Bounds: h.Bounds,
+		Counts: h.Counts,
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// HistogramFromPB converts pb.Histogram to Histogram.
+func HistogramFromPB(h *pb.Histogram) *Histogram {
+	if h == nil {
+		return nil
+	}
+	return &Histogram{
+		Bounds: h.Bounds,
+		Counts: h.Counts,
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// summaryToPB converts Summary to pb.Summary.
+func summaryToPB(s *Summary) *pb.Summary {
+	if s == nil {
+		return nil
+	}
+	quantiles := make([]*pb.Quantile, 0, len(s.Quantiles))
+	for _, q := range s.Quantiles {
+		quantiles = append(quantiles, &pb.Quantile{Quantile: q.Quantile, Value: q.Value})
+	}
+	return &pb.Summary{
+		Quantiles: quantiles,
+		Sum:       s.Sum,
+		Count:     s.Count,
+	}
+}
+
+// SummaryFromPB converts pb.Summary to Summary.
+func SummaryFromPB(s *pb.Summary) *Summary {
+	if s == nil {
+		return nil
+	}
+	quantiles := make([]Quantile, 0, len(s.Quantiles))
+	for _, q := range s.Quantiles {
+		quantiles = append(quantiles, Quantile{Quantile: q.Quantile, Value: q.Value})
+	}
+	return &Summary{
+		Quantiles: quantiles,
+		Sum:       s.Sum,
+		Count:     s.Count,
+	}
+}
@@ -5,23 +5,115 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/Jay-T/go-devops.git/internal/pb"
 )
 
 const (
-	gauge   = "gauge"
-	counter = "counter"
+	gauge     = "gauge"
+	counter   = "counter"
+	histogram = "histogram"
+	summary   = "summary"
 )
 
 // Metric struct. Describes metric message format.
 type Metric struct {
-	ID    string   `json:"id"`              // metric's name
-	MType string   `json:"type"`            // parameter taking value of gauge or counter
-	Delta *int64   `json:"delta,omitempty"` // metric value in case of MType == counter
-	Value *float64 `json:"value,omitempty"` // metric value in case of MType == gauge
-	Hash  string   `json:"hash,omitempty"`  // hash value
+	ID         string     `json:"id"`                   // metric's name
+	MType      string     `json:"type"`                 // parameter taking value of gauge, counter, histogram or summary
+	Delta      *int64     `json:"delta,omitempty"`      // metric value in case of MType == counter
+	Value      *float64   `json:"value,omitempty"`      // metric value in case of MType == gauge
+	Hash       string     `json:"hash,omitempty"`       // hash value
+	Cumulative *int64     `json:"cumulative,omitempty"` // counter total or number of observations since StartTime, never decreases
+	StartTime  int64      `json:"start_time,omitempty"` // time the counter started counting, unix nanoseconds
+	Labels     Labels     `json:"labels,omitempty"`     // series labels, e.g. host or service
+	Histogram  *Histogram `json:"histogram,omitempty"`  // observations since the previous report in case of MType == histogram
+	Summary    *Summary   `json:"summary,omitempty"`    // metric value in case of MType == summary
+}
+
+// Labels is a set of label names and values which identifies a series of a metric together with its name.
+type Labels map[string]string
+
+// labelNameRegex describes valid label names.
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidLabelName reports whether name may be used as a label name.
+func ValidLabelName(name string) bool {
+	return labelNameRegex.MatchString(name)
+}
+
+// Validate checks that label names are valid, so labels rendered by String can't be confused.
+func (l Labels) Validate() error {
+	for k := range l {
+		if !ValidLabelName(k) {
+			return fmt.Errorf("invalid label name '%s'", k)
+		}
+	}
+	return nil
+}
+
+// ValidateID checks that metric ID can't be confused with labels in a series key, see SeriesKey.
+func ValidateID(id string) error {
+	if id == "" {
+		return errors.New("metric has no ID")
+	}
+	if strings.Contains(id, "{") {
+		return fmt.Errorf("metric ID '%s' contains '{'", id)
+	}
+	return nil
+}
+
+// Copy returns a copy of label set.
+func (l Labels) Copy() Labels {
+	if l == nil {
+		return nil
+	}
+	res := make(Labels, len(l))
+	for k, v := range l {
+		res[k] = v
+	}
+	return res
+}
+
+// String returns labels sorted by name in {name="value",...} format. Empty set gives an empty string.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// SeriesKey returns identity of a series, which is the metric name followed by its labels.
+// The key of a metric without labels is its name.
+func SeriesKey(id string, labels Labels) string {
+	return id + labels.String()
+}
+
+// SeriesKey returns identity of the metric series.
+func (m Metric) SeriesKey() string {
+	return SeriesKey(m.ID, m.Labels)
 }
 
 // GetValueInt returns pointer to int64 value.
@@ -38,12 +130,39 @@ func (m Metric) GetValueFloat() float64 {
 func (m *Metric) GenerateHash(key string) []byte {
 	var data string
 
+	// labels are a part of series identity, so they are signed as well; unlabeled metrics keep legacy hash
+	id := m.SeriesKey()
 	h := hmac.New(sha256.New, []byte(key))
 	switch m.MType {
 	case gauge:
-		data = fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value)
+		var value float64
+		if m.Value != nil {
+			value = *m.Value
+		}
+		data = fmt.Sprintf("%s:gauge:%f", id, value)
 	case counter:
-		data = fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta)
+		var delta int64
+		if m.Delta != nil {
+			delta = *m.Delta
+		}
+		if m.Cumulative != nil {
+			data = fmt.Sprintf("%s:counter:%d:%d:%d", id, delta, *m.Cumulative, m.StartTime)
+		} else {
+			data = fmt.Sprintf("%s:counter:%d", id, delta)
+		}
+	case histogram:
+		data = fmt.Sprintf("%s:histogram", id)
+		if h := m.Histogram; h != nil {
+			data = fmt.Sprintf("%s:%v:%v:%f:%d", data, h.Bounds, h.Counts, h.Sum, h.Count)
+		}
+	case summary:
+		data = fmt.Sprintf("%s:summary", id)
+		if s := m.Summary; s != nil {
+			data = fmt.Sprintf("%s:%v:%f:%d", data, s.Quantiles, s.Sum, s.Count)
+		}
+	}
+	if (m.MType == histogram || m.MType == summary) && m.Cumulative != nil {
+		data = fmt.Sprintf("%s:%d:%d", data, *m.Cumulative, m.StartTime)
 	}
 	h.Write([]byte(data))
 	return h.Sum(nil)
@@ -70,18 +189,27 @@ func (m *Metric) ConvertMetricToPB(key string) *pb.Metric {
 		hash := m.GenerateHash(key)
 		m.Hash = hex.EncodeToString(hash)
 	}
-	if m.MType == counter {
-		return &pb.Metric{
-			Id:    m.ID,
-			Mtype: m.MType,
-			Delta: m.Delta,
-			Hash:  m.Hash,
-		}
+	pbm := &pb.Metric{
+		Id:     m.ID,
+		Mtype:  m.MType,
+		Hash:   m.Hash,
+		Labels: m.Labels,
 	}
-	return &pb.Metric{
-		Id:    m.ID,
-		Mtype: m.MType,
-		Value: m.Value,
-		Hash:  m.Hash,
+	switch m.MType {
+	case counter:
+		pbm.Delta = m.Delta
+		pbm.Cumulative = m.Cumulative
+		pbm.StartTime = m.StartTime
+	case histogram:
+		pbm.Histogram = histogramToPB(m.Histogram)
+		pbm.Cumulative = m.Cumulative
+		pbm.StartTime = m.StartTime
+	case summary:
+		pbm.Summary = summaryToPB(m.Summary)
+		pbm.Cumulative = m.Cumulative
+		pbm.StartTime = m.StartTime
+	default:
+		pbm.Value = m.Value
 	}
+	return pbm
 }